@@ -21,12 +21,24 @@ func (p *Plugin) OnActivate() error {
 		return err
 	}
 
+	// records stay readable without migrations, so a failed one doesn't stop the plugin,
+	// it's run again by the next activation or by the command.
+	if _, err := p._runMigrations(false); err != nil {
+		if errors.Is(err, ErrLocked) {
+			p.API.LogInfo("Migrations are running on another server.")
+		} else {
+			p.API.LogError("Failed to migrate records.", "err", fmt.Sprintf("%+v", err))
+		}
+	}
+
 	// conf := p.getConfiguration()
         
 	if err := p.registerCommands(); err != nil {
 		return errors.Wrap(err, "failed to register commands")
 	}
 
+	p._startBackgroundJob()
+
 	return nil
 }
 
@@ -52,5 +64,6 @@ func (p *Plugin) OnDeactivate() error {
   // 1. Delete Channel
   // 2. Delete team
   // 3. Delete bot
+  p._stopBackgroundJob()
   return nil
 }
@@ -0,0 +1,988 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/mattermost/mattermost-server/v5/plugin"
+	"github.com/pkg/errors"
+)
+
+// Versioned REST API. The flat endpoints(/books, /borrow, /workflow...) are kept for the webapp.
+//
+//	GET    /api/v1/books/{post_id}
+//	POST   /api/v1/books
+//	PUT    /api/v1/books/{post_id}
+//	PATCH  /api/v1/books/{post_id}
+//	DELETE /api/v1/books/{post_id}
+//	POST   /api/v1/books/{post_id}/copies           add copies
+//	POST   /api/v1/books/{post_id}/copies/retire
+//	POST   /api/v1/books/{post_id}/copies/reassign
+//	GET    /api/v1/books/{post_id}/reviews
+//	POST   /api/v1/books/{post_id}/reviews          rate a returned book
+//	GET    /api/v1/books/{post_id}/also_borrowed?limit=
+//	POST   /api/v1/borrows
+//	POST   /api/v1/borrows/{master_key}/transitions
+//	DELETE /api/v1/borrows/{master_key}
+//	GET    /api/v1/backup                           a zip archive of the library
+//	POST   /api/v1/restore                          the archive as the body
+//	GET    /api/v1/stats?from=YYYY-MM-DD&to=YYYY-MM-DD
+//	GET    /api/v1/recommendations?limit=           suggestions for the current user
+//	GET    /api/v1/purchases?status=                the open ones by default
+//	POST   /api/v1/purchases                        propose a book to buy
+//	POST   /api/v1/purchases/{master_key}/votes
+//	POST   /api/v1/purchases/{master_key}/transitions
+//	DELETE /api/v1/purchases/{master_key}
+//	GET    /api/v1/donations?status=                the offered ones by default
+//	POST   /api/v1/donations                        offer copies of a book
+//	POST   /api/v1/donations/{master_key}/transitions
+//	DELETE /api/v1/donations/{master_key}
+//
+// An etag missing in the body is taken from the If-Match header.
+// Like the flat endpoints, ?library={id} picks a library other than the default one.
+const apiV1Prefix = "/api/v1/"
+
+func (p *Plugin) handleAPIv1(c *plugin.Context, w http.ResponseWriter, r *http.Request) {
+	userId := r.Header.Get("Mattermost-User-ID")
+	path := strings.Trim(strings.TrimPrefix(r.URL.Path, apiV1Prefix), "/")
+	segs := strings.Split(path, "/")
+
+	switch segs[0] {
+	case "books":
+		p._serveBooksV1(userId, segs[1:], w, r)
+	case "borrows":
+		p._serveBorrowsV1(userId, segs[1:], w, r)
+	case "purchases":
+		p._servePurchasesV1(userId, segs[1:], w, r)
+	case "donations":
+		p._serveDonationsV1(userId, segs[1:], w, r)
+	case "backup":
+		if r.Method != http.MethodGet {
+			p._writeMethodNotAllowed(w, http.MethodGet)
+			return
+		}
+		p._backupV1(userId, w)
+	case "restore":
+		if r.Method != http.MethodPost {
+			p._writeMethodNotAllowed(w, http.MethodPost)
+			return
+		}
+		p._restoreV1(userId, w, r)
+	case "stats":
+		if r.Method != http.MethodGet {
+			p._writeMethodNotAllowed(w, http.MethodGet)
+			return
+		}
+		p._statsV1(userId, w, r)
+	case "recommendations":
+		if r.Method != http.MethodGet {
+			p._writeMethodNotAllowed(w, http.MethodGet)
+			return
+		}
+		p._recommendationsV1(userId, w, r)
+	case "ical":
+		p._serveICalV1(userId, segs[1:], w, r)
+	case "webhooks":
+		p._serveWebhooksV1(userId, segs[1:], w, r)
+	case "tokens":
+		p._serveTokensV1(userId, segs[1:], w, r)
+	case "penalties":
+		p._servePenaltiesV1(userId, segs[1:], w, r)
+	case "labels":
+		if r.Method != http.MethodGet {
+			p._writeMethodNotAllowed(w, http.MethodGet)
+			return
+		}
+		p._labelsV1(userId, w, r)
+	default:
+		p._writeAPIError(w, errors.Wrapf(ErrNotFound, "unknown resource %v", path))
+	}
+}
+
+func (p *Plugin) _serveBooksV1(userId string, segs []string, w http.ResponseWriter, r *http.Request) {
+	switch {
+	case len(segs) == 0 || segs[0] == "":
+		if r.Method != http.MethodPost {
+			p._writeMethodNotAllowed(w, http.MethodPost)
+			return
+		}
+		p._createBookV1(userId, w, r)
+
+	case len(segs) == 1:
+		switch r.Method {
+		case http.MethodGet:
+			p._getBookV1(userId, segs[0], w)
+		case http.MethodPut:
+			p._updateBookV1(userId, segs[0], w, r)
+		case http.MethodPatch:
+			p._patchBookV1(userId, segs[0], w, r)
+		case http.MethodDelete:
+			p._deleteBookV1(userId, segs[0], w, r)
+		default:
+			p._writeMethodNotAllowed(w, http.MethodGet, http.MethodPut, http.MethodPatch, http.MethodDelete)
+		}
+
+	case segs[1] == "copies" && len(segs) <= 3:
+		action := BOOKS_ACTION_ADD_COPIES
+		if len(segs) == 3 {
+			switch segs[2] {
+			case "retire":
+				action = BOOKS_ACTION_RETIRE_COPIES
+			case "reassign":
+				action = BOOKS_ACTION_REASSIGN_COPIES
+			default:
+				p._writeAPIError(w, errors.Wrapf(ErrNotFound, "unknown copies action %v", segs[2]))
+				return
+			}
+		}
+		if r.Method != http.MethodPost {
+			p._writeMethodNotAllowed(w, http.MethodPost)
+			return
+		}
+		p._operateCopiesV1(userId, segs[0], action, w, r)
+
+	case segs[1] == "copies" && len(segs) == 4 && segs[3] == "qr":
+		if r.Method != http.MethodGet {
+			p._writeMethodNotAllowed(w, http.MethodGet)
+			return
+		}
+		p._copyQRCodeV1(userId, segs[0], segs[2], w)
+
+	case segs[1] == "reviews" && len(segs) == 2:
+		switch r.Method {
+		case http.MethodGet:
+			p._getReviewsV1(segs[0], w)
+		case http.MethodPost:
+			p._reviewBookV1(userId, segs[0], w, r)
+		default:
+			p._writeMethodNotAllowed(w, http.MethodGet, http.MethodPost)
+		}
+
+	case segs[1] == "eligibility" && len(segs) == 2:
+		if r.Method != http.MethodGet {
+			p._writeMethodNotAllowed(w, http.MethodGet)
+			return
+		}
+		p._eligibilityV1(userId, segs[0], w, r)
+
+	case segs[1] == "also_borrowed" && len(segs) == 2:
+		if r.Method != http.MethodGet {
+			p._writeMethodNotAllowed(w, http.MethodGet)
+			return
+		}
+		p._alsoBorrowedV1(segs[0], w, r)
+
+	default:
+		p._writeAPIError(w, errors.Wrapf(ErrNotFound, "unknown resource %v", strings.Join(segs, "/")))
+	}
+}
+
+func (p *Plugin) _serveBorrowsV1(userId string, segs []string, w http.ResponseWriter, r *http.Request) {
+	switch {
+	case len(segs) == 0 || segs[0] == "":
+		if r.Method != http.MethodPost {
+			p._writeMethodNotAllowed(w, http.MethodPost)
+			return
+		}
+		p._createBorrowV1(userId, w, r)
+
+	case len(segs) == 1:
+		if r.Method != http.MethodDelete {
+			p._writeMethodNotAllowed(w, http.MethodDelete)
+			return
+		}
+		p._transitBorrowV1(userId, segs[0], true, w, r)
+
+	case len(segs) == 2 && segs[1] == "transitions":
+		if r.Method != http.MethodPost {
+			p._writeMethodNotAllowed(w, http.MethodPost)
+			return
+		}
+		p._transitBorrowV1(userId, segs[0], false, w, r)
+
+	default:
+		p._writeAPIError(w, errors.Wrapf(ErrNotFound, "unknown resource %v", strings.Join(segs, "/")))
+	}
+}
+
+func (p *Plugin) _servePurchasesV1(userId string, segs []string, w http.ResponseWriter, r *http.Request) {
+	switch {
+	case len(segs) == 0 || segs[0] == "":
+		switch r.Method {
+		case http.MethodGet:
+			p._listPurchasesV1(w, r)
+		case http.MethodPost:
+			p._proposePurchaseV1(userId, w, r)
+		default:
+			p._writeMethodNotAllowed(w, http.MethodGet, http.MethodPost)
+		}
+
+	case len(segs) == 1:
+		if r.Method != http.MethodDelete {
+			p._writeMethodNotAllowed(w, http.MethodDelete)
+			return
+		}
+		p._transitPurchaseV1(userId, segs[0], true, w, r)
+
+	case len(segs) == 2 && segs[1] == "votes":
+		if r.Method != http.MethodPost {
+			p._writeMethodNotAllowed(w, http.MethodPost)
+			return
+		}
+		p._votePurchaseV1(userId, segs[0], w)
+
+	case len(segs) == 2 && segs[1] == "transitions":
+		if r.Method != http.MethodPost {
+			p._writeMethodNotAllowed(w, http.MethodPost)
+			return
+		}
+		p._transitPurchaseV1(userId, segs[0], false, w, r)
+
+	default:
+		p._writeAPIError(w, errors.Wrapf(ErrNotFound, "unknown resource %v", strings.Join(segs, "/")))
+	}
+}
+
+func (p *Plugin) _serveDonationsV1(userId string, segs []string, w http.ResponseWriter, r *http.Request) {
+	switch {
+	case len(segs) == 0 || segs[0] == "":
+		switch r.Method {
+		case http.MethodGet:
+			p._listDonationsV1(w, r)
+		case http.MethodPost:
+			p._offerDonationV1(userId, w, r)
+		default:
+			p._writeMethodNotAllowed(w, http.MethodGet, http.MethodPost)
+		}
+
+	case len(segs) == 1:
+		if r.Method != http.MethodDelete {
+			p._writeMethodNotAllowed(w, http.MethodDelete)
+			return
+		}
+		p._transitDonationV1(userId, segs[0], true, w, r)
+
+	case len(segs) == 2 && segs[1] == "transitions":
+		if r.Method != http.MethodPost {
+			p._writeMethodNotAllowed(w, http.MethodPost)
+			return
+		}
+		p._transitDonationV1(userId, segs[0], false, w, r)
+
+	default:
+		p._writeAPIError(w, errors.Wrapf(ErrNotFound, "unknown resource %v", strings.Join(segs, "/")))
+	}
+}
+
+// Private and inventory parts are returned to the users who can read their channels.
+func (p *Plugin) _getBookV1(userId string, pubId string, w http.ResponseWriter) {
+	opts, err := p._getExportOptions(userId)
+	if err != nil {
+		p._writeAPIError(w, err)
+		return
+	}
+
+	info, err := p.GetABook(pubId)
+	if err != nil {
+		p._writeAPIError(w, err)
+		return
+	}
+
+	book := info.book
+	if !opts.withPri {
+		book.BookPrivate = nil
+	}
+	if !opts.withInv {
+		book.BookInventory = nil
+	}
+	book.Upload = &Upload{
+		Post_id: info.pubPost.Id,
+		Etag:    book.BookPublic.MatchId,
+	}
+
+	w.Header().Set("ETag", book.BookPublic.MatchId)
+	p._writeAPIResult(w, http.StatusOK, book)
+}
+
+func (p *Plugin) _createBookV1(userId string, w http.ResponseWriter, r *http.Request) {
+	if err := p._checkRole(userId, ROLE_CATALOG_EDITOR); err != nil {
+		p._writeAPIError(w, err)
+		return
+	}
+
+	var book Book
+	if err := _decodeAPIBody(r, &book); err != nil {
+		p._writeAPIError(w, err)
+		return
+	}
+	if book.Upload != nil && (book.Upload.Post_id != "" || book.Upload.Delete) {
+		p._writeAPIError(w, KindError(ErrInvalidRequest, "post id or delete is not allowed in creating a book."))
+		return
+	}
+
+	bookmsg, err := p._uploadABook(&book, uploadOptions{})
+	if err != nil {
+		p._writeAPIError(w, err)
+		return
+	}
+
+	p._writeAPIResult(w, http.StatusCreated, bookmsg)
+}
+
+func (p *Plugin) _updateBookV1(userId string, pubId string, w http.ResponseWriter, r *http.Request) {
+	if err := p._checkRole(userId, ROLE_CATALOG_EDITOR); err != nil {
+		p._writeAPIError(w, err)
+		return
+	}
+
+	var book Book
+	if err := _decodeAPIBody(r, &book); err != nil {
+		p._writeAPIError(w, err)
+		return
+	}
+	if book.Upload == nil {
+		book.Upload = &Upload{}
+	}
+	if book.Upload.Delete || book.Upload.MatchIsbn {
+		p._writeAPIError(w, KindError(ErrInvalidRequest, "delete or match_isbn is not allowed in updating a book."))
+		return
+	}
+	book.Upload.Post_id = pubId
+	book.Upload.Etag = _etagOf(book.Upload.Etag, r)
+
+	bookmsg, err := p._uploadABook(&book, uploadOptions{})
+	if err != nil {
+		p._writeAPIError(w, err)
+		return
+	}
+
+	p._writeAPIResult(w, http.StatusOK, bookmsg)
+}
+
+func (p *Plugin) _patchBookV1(userId string, pubId string, w http.ResponseWriter, r *http.Request) {
+	if err := p._checkRole(userId, ROLE_CATALOG_EDITOR); err != nil {
+		p._writeAPIError(w, err)
+		return
+	}
+
+	var patch BookPatch
+	if err := _decodeAPIBody(r, &patch); err != nil {
+		p._writeAPIError(w, err)
+		return
+	}
+	patch.Post_id = pubId
+	patch.Etag = _etagOf(patch.Etag, r)
+
+	bookmsg, err := p._patchABook(&patch)
+	if err != nil {
+		p._writeAPIError(w, err)
+		return
+	}
+
+	p._writeAPIResult(w, http.StatusOK, bookmsg)
+}
+
+func (p *Plugin) _deleteBookV1(userId string, pubId string, w http.ResponseWriter, r *http.Request) {
+	if err := p._checkRole(userId, ROLE_CATALOG_EDITOR); err != nil {
+		p._writeAPIError(w, err)
+		return
+	}
+
+	bookmsg, err := p._uploadABook(&Book{
+		Upload: &Upload{
+			Post_id: pubId,
+			Delete:  true,
+			Etag:    _etagOf("", r),
+		},
+	}, uploadOptions{})
+	if err != nil {
+		p._writeAPIError(w, err)
+		return
+	}
+
+	p._writeAPIResult(w, http.StatusOK, bookmsg)
+}
+
+func (p *Plugin) _operateCopiesV1(userId string, pubId string, action string, w http.ResponseWriter, r *http.Request) {
+	if err := p._checkRole(userId, ROLE_CATALOG_EDITOR); err != nil {
+		p._writeAPIError(w, err)
+		return
+	}
+
+	var op CopyOperation
+	if err := _decodeAPIBody(r, &op); err != nil {
+		p._writeAPIError(w, err)
+		return
+	}
+	op.Post_id = pubId
+	op.Etag = _etagOf(op.Etag, r)
+
+	bookmsg, err := p._operateCopies(action, &op)
+	if err != nil {
+		p._writeAPIError(w, err)
+		return
+	}
+
+	p._writeAPIResult(w, http.StatusOK, bookmsg)
+}
+
+func (p *Plugin) _createBorrowV1(userId string, w http.ResponseWriter, r *http.Request) {
+	var otherData otherRequestData
+	otherData.processTime = GetNowTime()
+
+	var key BorrowRequestKey
+	if err := _decodeAPIBody(r, &key); err != nil {
+		p._writeAPIError(w, err)
+		return
+	}
+
+	masterKey, warnings, err := p._borrowABook(userId, &key, otherData)
+	if err != nil {
+		p._writeAPIError(w, err)
+		return
+	}
+
+	p._writeAPIResult(w, http.StatusCreated, Result{
+		Messages: Messages{"master_key": masterKey},
+		Warnings: warnings,
+	})
+}
+
+func (p *Plugin) _transitBorrowV1(userId string, masterKey string, delete bool, w http.ResponseWriter, r *http.Request) {
+	req := new(WorkflowRequest)
+	if !delete {
+		if err := _decodeAPIBody(r, req); err != nil {
+			p._writeAPIError(w, err)
+			return
+		}
+	}
+	req.MasterPostKey = masterKey
+	req.Delete = delete
+	req.Etag = _etagOf(req.Etag, r)
+
+	if err := p._processWorkflowRequest(userId, req); err != nil {
+		p._writeAPIError(w, err)
+		return
+	}
+
+	p._writeAPIResult(w, http.StatusOK, Result{})
+}
+
+func (p *Plugin) _listPurchasesV1(w http.ResponseWriter, r *http.Request) {
+	entries, err := p._listPurchases(r.URL.Query().Get("status"))
+	if err != nil {
+		p._writeAPIError(w, err)
+		return
+	}
+
+	p._writeAPIResult(w, http.StatusOK, entries)
+}
+
+func (p *Plugin) _proposePurchaseV1(userId string, w http.ResponseWriter, r *http.Request) {
+	var proposal PurchaseProposal
+	if err := _decodeAPIBody(r, &proposal); err != nil {
+		p._writeAPIError(w, err)
+		return
+	}
+
+	masterKey, err := p._proposePurchase(userId, &proposal)
+	if err != nil {
+		p._writeAPIError(w, err)
+		return
+	}
+
+	p._writeAPIResult(w, http.StatusCreated, Result{
+		Messages: Messages{"master_key": masterKey},
+	})
+}
+
+func (p *Plugin) _votePurchaseV1(userId string, masterKey string, w http.ResponseWriter) {
+	master, err := p._votePurchase(userId, masterKey)
+	if err != nil {
+		p._writeAPIError(w, err)
+		return
+	}
+
+	p._writeAPIResult(w, http.StatusOK, PurchaseEntry{MasterKey: masterKey, PurchaseRequest: master})
+}
+
+func (p *Plugin) _transitPurchaseV1(userId string, masterKey string, delete bool, w http.ResponseWriter, r *http.Request) {
+	req := new(PurchaseWorkflowRequest)
+	if !delete {
+		if err := _decodeAPIBody(r, req); err != nil {
+			p._writeAPIError(w, err)
+			return
+		}
+	}
+	req.MasterPostKey = masterKey
+	req.Delete = delete
+	req.Etag = _etagOf(req.Etag, r)
+
+	if err := p._processPurchaseRequest(userId, req); err != nil {
+		p._writeAPIError(w, err)
+		return
+	}
+
+	p._writeAPIResult(w, http.StatusOK, Result{})
+}
+
+func (p *Plugin) _listDonationsV1(w http.ResponseWriter, r *http.Request) {
+	entries, err := p._listDonations(r.URL.Query().Get("status"))
+	if err != nil {
+		p._writeAPIError(w, err)
+		return
+	}
+
+	p._writeAPIResult(w, http.StatusOK, entries)
+}
+
+func (p *Plugin) _offerDonationV1(userId string, w http.ResponseWriter, r *http.Request) {
+	var offer DonationOffer
+	if err := _decodeAPIBody(r, &offer); err != nil {
+		p._writeAPIError(w, err)
+		return
+	}
+
+	masterKey, err := p._offerDonation(userId, &offer)
+	if err != nil {
+		p._writeAPIError(w, err)
+		return
+	}
+
+	p._writeAPIResult(w, http.StatusCreated, Result{
+		Messages: Messages{"master_key": masterKey},
+	})
+}
+
+func (p *Plugin) _transitDonationV1(userId string, masterKey string, delete bool, w http.ResponseWriter, r *http.Request) {
+	req := new(DonationWorkflowRequest)
+	if !delete {
+		if err := _decodeAPIBody(r, req); err != nil {
+			p._writeAPIError(w, err)
+			return
+		}
+	}
+	req.MasterPostKey = masterKey
+	req.Delete = delete
+	req.Etag = _etagOf(req.Etag, r)
+
+	if err := p._processDonationRequest(userId, req); err != nil {
+		p._writeAPIError(w, err)
+		return
+	}
+
+	p._writeAPIResult(w, http.StatusOK, Result{})
+}
+
+func (p *Plugin) _getReviewsV1(pubId string, w http.ResponseWriter) {
+	reviews, err := p._getBookReviews(pubId)
+	if err != nil {
+		p._writeAPIError(w, err)
+		return
+	}
+
+	p._writeAPIResult(w, http.StatusOK, reviews)
+}
+
+func (p *Plugin) _reviewBookV1(userId string, pubId string, w http.ResponseWriter, r *http.Request) {
+	var req ReviewRequest
+	if err := _decodeAPIBody(r, &req); err != nil {
+		p._writeAPIError(w, err)
+		return
+	}
+	req.BookPostId = pubId
+
+	review, err := p._reviewABook(userId, &req)
+	if err != nil {
+		p._writeAPIError(w, err)
+		return
+	}
+
+	p._writeAPIResult(w, http.StatusCreated, review)
+}
+
+func (p *Plugin) _backupV1(userId string, w http.ResponseWriter) {
+	if err := p._checkRole(userId, ROLE_LIBRARY_ADMIN); err != nil {
+		p._writeAPIError(w, err)
+		return
+	}
+
+	file, err := p._backup()
+	if err != nil {
+		p._writeAPIError(w, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", file.contentType)
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", file.name))
+	w.Write(file.data)
+}
+
+func (p *Plugin) _restoreV1(userId string, w http.ResponseWriter, r *http.Request) {
+	if err := p._checkRole(userId, ROLE_LIBRARY_ADMIN); err != nil {
+		p._writeAPIError(w, err)
+		return
+	}
+
+	data, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		p._writeAPIError(w, KindError(ErrInvalidRequest, "read request body error: %v", err))
+		return
+	}
+
+	messages, err := p._restore(data)
+	if err != nil {
+		p._writeAPIError(w, err)
+		return
+	}
+
+	p._writeAPIResult(w, http.StatusOK, Result{Messages: messages})
+}
+
+func (p *Plugin) _statsV1(userId string, w http.ResponseWriter, r *http.Request) {
+	if err := p._checkRole(userId, ROLE_LIBRARY_ADMIN, ROLE_LIBWORKER); err != nil {
+		p._writeAPIError(w, err)
+		return
+	}
+
+	query := r.URL.Query()
+	from, to, err := _parseStatsRange(query.Get("from"), query.Get("to"), time.Now())
+	if err != nil {
+		p._writeAPIError(w, err)
+		return
+	}
+
+	stats, err := p._computeStats(from, to)
+	if err != nil {
+		p._writeAPIError(w, err)
+		return
+	}
+
+	p._writeAPIResult(w, http.StatusOK, stats)
+}
+
+func (p *Plugin) _alsoBorrowedV1(pubId string, w http.ResponseWriter, r *http.Request) {
+	limit, err := _parseRecommendLimit(r.URL.Query().Get("limit"))
+	if err != nil {
+		p._writeAPIError(w, err)
+		return
+	}
+
+	recommendations, err := p._alsoBorrowed(pubId, limit)
+	if err != nil {
+		p._writeAPIError(w, err)
+		return
+	}
+
+	p._writeAPIResult(w, http.StatusOK, recommendations)
+}
+
+// The verdict of every rule if the user, or the requester, borrowed the book now.
+func (p *Plugin) _eligibilityV1(userId string, pubId string, w http.ResponseWriter, r *http.Request) {
+	explanation, err := p._explainEligibility(userId, pubId, r.URL.Query().Get(ELIGIBILITY_PARAM_USER))
+	if err != nil {
+		p._writeAPIError(w, err)
+		return
+	}
+
+	p._writeAPIResult(w, http.StatusOK, explanation)
+}
+
+func (p *Plugin) _recommendationsV1(userId string, w http.ResponseWriter, r *http.Request) {
+	limit, err := _parseRecommendLimit(r.URL.Query().Get("limit"))
+	if err != nil {
+		p._writeAPIError(w, err)
+		return
+	}
+
+	recommendations, err := p._suggestForUser(userId, limit)
+	if err != nil {
+		p._writeAPIError(w, err)
+		return
+	}
+
+	p._writeAPIResult(w, http.StatusOK, recommendations)
+}
+
+// GET returns the feed URLs, POST reset replaces the token so that the old URLs stop working.
+func (p *Plugin) _serveICalV1(userId string, segs []string, w http.ResponseWriter, r *http.Request) {
+	reset := false
+	switch {
+	case len(segs) == 0 || segs[0] == "":
+		if r.Method != http.MethodGet {
+			p._writeMethodNotAllowed(w, http.MethodGet)
+			return
+		}
+	case len(segs) == 1 && segs[0] == "reset":
+		if r.Method != http.MethodPost {
+			p._writeMethodNotAllowed(w, http.MethodPost)
+			return
+		}
+		reset = true
+	default:
+		p._writeAPIError(w, errors.Wrapf(ErrNotFound, "unknown resource ical/%v", strings.Join(segs, "/")))
+		return
+	}
+
+	feeds, err := p._icalFeeds(userId, reset)
+	if err != nil {
+		p._writeAPIError(w, err)
+		return
+	}
+
+	p._writeAPIResult(w, http.StatusOK, feeds)
+}
+
+// Library admins only.
+func (p *Plugin) _serveWebhooksV1(userId string, segs []string, w http.ResponseWriter, r *http.Request) {
+	switch {
+	case len(segs) == 0 || segs[0] == "":
+		switch r.Method {
+		case http.MethodGet:
+			targets, err := p._listWebhookTargets(userId)
+			if err != nil {
+				p._writeAPIError(w, err)
+				return
+			}
+			p._writeAPIResult(w, http.StatusOK, targets)
+		case http.MethodPost:
+			p._addWebhookV1(userId, w, r)
+		default:
+			p._writeMethodNotAllowed(w, http.MethodGet, http.MethodPost)
+		}
+
+	case len(segs) == 1 && segs[0] == "deliveries":
+		if r.Method != http.MethodGet {
+			p._writeMethodNotAllowed(w, http.MethodGet)
+			return
+		}
+		deliveries, err := p._listWebhookDeliveries(userId)
+		if err != nil {
+			p._writeAPIError(w, err)
+			return
+		}
+		p._writeAPIResult(w, http.StatusOK, deliveries)
+
+	case len(segs) == 1:
+		if r.Method != http.MethodDelete {
+			p._writeMethodNotAllowed(w, http.MethodDelete)
+			return
+		}
+		if err := p._removeWebhookTarget(userId, segs[0]); err != nil {
+			p._writeAPIError(w, err)
+			return
+		}
+		p._writeAPIResult(w, http.StatusOK, Result{})
+
+	default:
+		p._writeAPIError(w, errors.Wrapf(ErrNotFound, "unknown resource %v", strings.Join(segs, "/")))
+	}
+}
+
+func (p *Plugin) _addWebhookV1(userId string, w http.ResponseWriter, r *http.Request) {
+	var req WebhookTarget
+	if err := _decodeAPIBody(r, &req); err != nil {
+		p._writeAPIError(w, err)
+		return
+	}
+
+	target, err := p._addWebhookTarget(userId, &req)
+	if err != nil {
+		p._writeAPIError(w, err)
+		return
+	}
+
+	p._writeAPIResult(w, http.StatusCreated, target)
+}
+
+// A PNG of the QR code on the label of the copy.
+func (p *Plugin) _copyQRCodeV1(userId string, pubId string, copyId string, w http.ResponseWriter) {
+	image, err := p._copyQRCode(userId, pubId, copyId)
+	if err != nil {
+		p._writeAPIError(w, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "image/png")
+	w.WriteHeader(http.StatusOK)
+	w.Write(image)
+}
+
+// A PDF sheet of the labels of a book, of the copies a keeper keeps, or of the whole collection.
+func (p *Plugin) _labelsV1(userId string, w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	labels, err := p._copyLabels(userId, query.Get(SCAN_PARAM_BOOK), query.Get(LABELS_PARAM_KEEPER))
+	if err != nil {
+		p._writeAPIError(w, err)
+		return
+	}
+
+	sheet, err := p._renderLabelSheet(labels)
+	if err != nil {
+		p._writeAPIError(w, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/pdf")
+	w.Header().Set("Content-Disposition", `inline; filename="labels.pdf"`)
+	w.WriteHeader(http.StatusOK)
+	w.Write(sheet)
+}
+
+// Library admins only. The issued token is in the result of POST only.
+func (p *Plugin) _serveTokensV1(userId string, segs []string, w http.ResponseWriter, r *http.Request) {
+	switch {
+	case len(segs) == 0 || segs[0] == "":
+		switch r.Method {
+		case http.MethodGet:
+			tokens, err := p._listApiTokens(userId)
+			if err != nil {
+				p._writeAPIError(w, err)
+				return
+			}
+			p._writeAPIResult(w, http.StatusOK, tokens)
+		case http.MethodPost:
+			var req ApiToken
+			if err := _decodeAPIBody(r, &req); err != nil {
+				p._writeAPIError(w, err)
+				return
+			}
+			token, err := p._issueApiToken(userId, &req)
+			if err != nil {
+				p._writeAPIError(w, err)
+				return
+			}
+			p._writeAPIResult(w, http.StatusCreated, token)
+		default:
+			p._writeMethodNotAllowed(w, http.MethodGet, http.MethodPost)
+		}
+
+	case len(segs) == 1:
+		if r.Method != http.MethodDelete {
+			p._writeMethodNotAllowed(w, http.MethodDelete)
+			return
+		}
+		if err := p._revokeApiToken(userId, segs[0]); err != nil {
+			p._writeAPIError(w, err)
+			return
+		}
+		p._writeAPIResult(w, http.StatusOK, Result{})
+
+	default:
+		p._writeAPIError(w, errors.Wrapf(ErrNotFound, "unknown resource tokens/%v", strings.Join(segs, "/")))
+	}
+}
+
+// Library admins only. A lost copy is recorded by POST {user}/lost,
+// a suspension is lifted by DELETE {user}/suspension.
+func (p *Plugin) _servePenaltiesV1(userId string, segs []string, w http.ResponseWriter, r *http.Request) {
+	switch {
+	case len(segs) == 0 || segs[0] == "":
+		if r.Method != http.MethodGet {
+			p._writeMethodNotAllowed(w, http.MethodGet)
+			return
+		}
+		penalties, err := p._listPenalties(userId)
+		if err != nil {
+			p._writeAPIError(w, err)
+			return
+		}
+		p._writeAPIResult(w, http.StatusOK, penalties)
+
+	case len(segs) == 2 && segs[1] == "lost":
+		if r.Method != http.MethodPost {
+			p._writeMethodNotAllowed(w, http.MethodPost)
+			return
+		}
+		penalty, err := p._recordLostCopy(userId, segs[0])
+		if err != nil {
+			p._writeAPIError(w, err)
+			return
+		}
+		p._writeAPIResult(w, http.StatusOK, penalty)
+
+	case len(segs) == 2 && segs[1] == "suspension":
+		if r.Method != http.MethodDelete {
+			p._writeMethodNotAllowed(w, http.MethodDelete)
+			return
+		}
+		if err := p._liftSuspension(userId, segs[0]); err != nil {
+			p._writeAPIError(w, err)
+			return
+		}
+		p._writeAPIResult(w, http.StatusOK, Result{})
+
+	default:
+		p._writeAPIError(w, errors.Wrapf(ErrNotFound, "unknown resource penalties/%v", strings.Join(segs, "/")))
+	}
+}
+
+func _decodeAPIBody(r *http.Request, v interface{}) error {
+	if err := json.NewDecoder(r.Body).Decode(v); err != nil {
+		return KindError(ErrInvalidRequest, "invalid request body: %v", err)
+	}
+	return nil
+}
+
+func _etagOf(etag string, r *http.Request) string {
+	if etag != "" {
+		return etag
+	}
+	return strings.Trim(r.Header.Get("If-Match"), `"`)
+}
+
+func _httpStatusOf(err error) int {
+	switch {
+	case errors.Is(err, ErrInvalidRequest):
+		return http.StatusBadRequest
+	case errors.Is(err, ErrNotPermitted):
+		return http.StatusForbidden
+	case errors.Is(err, ErrNotFound):
+		return http.StatusNotFound
+	case errors.Is(err, ErrStale), errors.Is(err, ErrLocked):
+		return http.StatusConflict
+	case errors.Is(err, ErrBorrowingLimited),
+		errors.Is(err, ErrNoStock),
+		errors.Is(err, ErrRenewLimited),
+		errors.Is(err, ErrChooseInStockCopy),
+		errors.Is(err, ErrInvalidIsbn),
+		errors.Is(err, ErrDuplicateBook),
+		errors.Is(err, ErrInvalidCopyKeeper),
+		errors.Is(err, ErrInvalidRole),
+		errors.Is(err, ErrRuleViolation),
+		errors.Is(err, ErrSuspended),
+		errors.Is(err, ErrCategoryLimited),
+		errors.Is(err, ErrDuplicateBorrow):
+		return http.StatusUnprocessableEntity
+	default:
+		return http.StatusInternalServerError
+	}
+}
+
+func (p *Plugin) _writeAPIError(w http.ResponseWriter, err error) {
+	status := _httpStatusOf(err)
+	if status == http.StatusInternalServerError {
+		p.API.LogError("api error.", "err", fmt.Sprintf("%+v", err))
+	}
+
+	p._writeAPIResult(w, status, p._errorResult(err, p._errorText(err, "internal-error")))
+}
+
+func (p *Plugin) _writeMethodNotAllowed(w http.ResponseWriter, allowed ...string) {
+	w.Header().Set("Allow", strings.Join(allowed, ", "))
+	p._writeAPIResult(w, http.StatusMethodNotAllowed, Result{
+		Error: "method not allowed.",
+		Code:  ErrInvalidRequest.Error(),
+	})
+}
+
+func (p *Plugin) _writeAPIResult(w http.ResponseWriter, status int, result interface{}) {
+	resp, _ := json.Marshal(result)
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	w.Write(resp)
+}
@@ -0,0 +1,158 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/mattermost/mattermost-server/v5/model"
+	"github.com/mattermost/mattermost-server/v5/plugin/plugintest"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/require"
+)
+
+func TestAPIv1(t *testing.T) {
+
+	setup := func() (*TestData, *Plugin, *plugintest.API) {
+		td := NewTestData()
+		plugin := td.NewMockPlugin()
+		api := td.ApiMockCommon()
+		plugin.SetAPI(api)
+		api.On("SearchPostsInTeam", plugin.team.Id, mock.AnythingOfType("[]*model.SearchParams")).
+			Return([]*model.Post{}, nil)
+
+		notMember := model.NewAppError("GetChannelMember", "app.channel.get_member.missing.app_error", nil, "", http.StatusNotFound)
+		for _, channelId := range []string{td.BookChIdPri, td.BookChIdInv} {
+			api.On("GetChannelMember", channelId, td.Worker1Id).Return(&model.ChannelMember{}, nil)
+			api.On("GetChannelMember", channelId, mock.AnythingOfType("string")).Return(nil, notMember)
+		}
+		return td, plugin, api
+	}
+
+	call := func(plugin *Plugin, userId string, method string, path string, body string, etag string) (*httptest.ResponseRecorder, *Result) {
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest(method, path, bytes.NewReader([]byte(body)))
+		if userId != "" {
+			r.Header.Set("Mattermost-User-ID", userId)
+		}
+		if etag != "" {
+			r.Header.Set("If-Match", `"`+etag+`"`)
+		}
+		plugin.ServeHTTP(nil, w, r)
+
+		var result Result
+		json.Unmarshal(w.Body.Bytes(), &result)
+		return w, &result
+	}
+
+	t.Run("get_book", func(t *testing.T) {
+		td, plugin, _ := setup()
+
+		w, _ := call(plugin, td.Worker1Id, "GET", "/api/v1/books/"+td.BookPostIdPub, "", "")
+		require.Equal(t, http.StatusOK, w.Code)
+		assert.Equal(t, td.ABookPub.MatchId, w.Header().Get("ETag"))
+
+		var book Book
+		require.Nil(t, json.Unmarshal(w.Body.Bytes(), &book))
+		assert.Equal(t, td.ABookPub.Id, book.BookPublic.Id)
+		require.NotNil(t, book.BookInventory)
+		assert.Equal(t, td.ABookInv.Copies, book.BookInventory.Copies)
+
+		w, _ = call(plugin, td.BorId, "GET", "/api/v1/books/"+td.BookPostIdPub, "", "")
+		require.Equal(t, http.StatusOK, w.Code)
+		assert.NotContains(t, w.Body.String(), "copy_keeper_map")
+	})
+
+	t.Run("get_book_not_found", func(t *testing.T) {
+		td, plugin, api := setup()
+		missing := model.NewId()
+		api.On("GetPost", missing).Return(nil, model.NewAppError("GetPost", "app.post.get.app_error", nil, "", http.StatusNotFound))
+
+		w, _ := call(plugin, td.BorId, "GET", "/api/v1/books/"+missing, "", "")
+		assert.Equal(t, http.StatusNotFound, w.Code)
+	})
+
+	t.Run("patch_book", func(t *testing.T) {
+		td, plugin, _ := setup()
+		etag := td.ABookPub.MatchId
+
+		w, _ := call(plugin, td.Worker1Id, "PATCH", "/api/v1/books/"+td.BookPostIdPub,
+			`{"public":{"name_pub":"a patched book"}}`, etag)
+		require.Equal(t, http.StatusOK, w.Code)
+		var msg BooksMessage
+		json.Unmarshal(w.Body.Bytes(), &msg)
+		assert.Equal(t, BOOK_UPLOAD_SUCC, msg.Status)
+		assert.Equal(t, "a patched book", td.ABookPub.Name)
+
+		w, result := call(plugin, td.Worker1Id, "PATCH", "/api/v1/books/"+td.BookPostIdPub,
+			`{"public":{"name_pub":"again"}}`, etag)
+		assert.Equal(t, http.StatusConflict, w.Code)
+		assert.Equal(t, ErrStale.Error(), result.Code)
+		assert.Equal(t, td.ABookPub.MatchId, result.Details[ERROR_DETAIL_ETAG])
+	})
+
+	t.Run("status_codes", func(t *testing.T) {
+		td, plugin, _ := setup()
+		td.ABookInv.Stock = 2
+		td.ABookInv.Lending = 1
+		td.ABookInv.Copies["zzh-book-001 b2"] = BookCopy{Status: COPY_STATUS_LENDING}
+		bookPath := "/api/v1/books/" + td.BookPostIdPub
+
+		for _, test := range []struct {
+			name   string
+			userId string
+			method string
+			path   string
+			body   string
+			etag   string
+			status int
+		}{
+			{"unauthorized", "", "GET", bookPath, "", "", http.StatusUnauthorized},
+			{"unknown_resource", td.BorId, "GET", "/api/v1/shelves", "", "", http.StatusNotFound},
+			{"method_not_allowed", td.BorId, "POST", bookPath, "{}", "", http.StatusMethodNotAllowed},
+			{"bad_json", td.Worker1Id, "POST", "/api/v1/books", "{", "", http.StatusBadRequest},
+			{"patch_without_etag", td.Worker1Id, "PATCH", bookPath, `{"public":{}}`, "", http.StatusBadRequest},
+			{"create_not_editor", td.BorId, "POST", "/api/v1/books", "{}", "", http.StatusForbidden},
+			{"retire_lent_copy", td.Worker1Id, "POST", bookPath + "/copies/retire",
+				`{"copies":["zzh-book-001 b2"]}`, "", http.StatusUnprocessableEntity},
+			{"add_existing_copy", td.Worker1Id, "POST", bookPath + "/copies",
+				`{"copies":["zzh-book-001 b1"],"keeper":"kpuser1"}`, "", http.StatusUnprocessableEntity},
+			{"delete_not_returned", td.Worker1Id, "DELETE", bookPath, "", "", http.StatusUnprocessableEntity},
+			{"borrow_for_other", td.Keeper1Id, "POST", "/api/v1/borrows",
+				`{"book_post_id":"` + td.BookPostIdPub + `","borrower_user":"bor"}`, "", http.StatusForbidden},
+		} {
+			t.Run(test.name, func(t *testing.T) {
+				w, result := call(plugin, test.userId, test.method, test.path, test.body, test.etag)
+				assert.Equal(t, test.status, w.Code)
+				assert.NotEmpty(t, result.Error)
+			})
+		}
+	})
+
+	t.Run("locked", func(t *testing.T) {
+		td, plugin, _ := setup()
+		lockmap.Store(td.BookPostIdPub, struct{}{})
+		defer lockmap.Delete(td.BookPostIdPub)
+
+		w, result := call(plugin, td.Worker1Id, "POST", "/api/v1/books/"+td.BookPostIdPub+"/copies/retire",
+			`{"copies":["zzh-book-001 b1"]}`, "")
+		assert.Equal(t, http.StatusConflict, w.Code)
+		assert.Equal(t, plugin.i18n.GetText("system-busy"), result.Error)
+		assert.Equal(t, ErrLocked.Error(), result.Code)
+	})
+
+	t.Run("borrow_not_found", func(t *testing.T) {
+		td, plugin, api := setup()
+		missing := model.NewId()
+		api.On("GetPost", missing).Return(nil, model.NewAppError("GetPost", "app.post.get.app_error", nil, "", http.StatusNotFound))
+
+		w, _ := call(plugin, td.BorId, "POST", "/api/v1/borrows/"+missing+"/transitions", `{"next_step_index":1}`, "")
+		assert.Equal(t, http.StatusNotFound, w.Code)
+
+		w, _ = call(plugin, td.BorId, "DELETE", "/api/v1/borrows/"+missing, "", "")
+		assert.Equal(t, http.StatusNotFound, w.Code)
+	})
+}
@@ -0,0 +1,485 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/mattermost/mattermost-server/v5/model"
+	"github.com/pkg/errors"
+)
+
+const backupPostsPerPage = 200
+
+// Every book part, borrow and transfer record of the library,
+// with the status changes told in the threads of the records.
+// Copies are kept in the book parts.
+func (p *Plugin) _backup() (*exportFile, error) {
+	records, err := p._collectBackupRecords()
+	if err != nil {
+		return nil, err
+	}
+
+	audit, err := p._collectBackupAudit(records)
+	if err != nil {
+		return nil, err
+	}
+
+	data, err := _writeBackupArchive(BackupManifest{
+		FormatVersion: BACKUP_FORMAT_VERSION,
+		SchemaVersion: SCHEMA_VERSION,
+		LibraryId:     p.library.id,
+		CreateAt:      GetNowTime(),
+	}, records, audit)
+	if err != nil {
+		return nil, errors.Wrapf(err, "write backup archive error.")
+	}
+
+	name := "library_backup_" + p.library.id + "_" + time.Now().Format("20060102150405") + ".zip"
+	return &exportFile{name, "application/zip", data}, nil
+}
+
+func (p *Plugin) _backupChannels() []struct {
+	name    string
+	channel *model.Channel
+} {
+	return []struct {
+		name    string
+		channel *model.Channel
+	}{
+		{BACKUP_CHANNEL_BOOKS, p.booksChannel},
+		{BACKUP_CHANNEL_BOOKS_PRI, p.booksPriChannel},
+		{BACKUP_CHANNEL_BOOKS_INV, p.booksInvChannel},
+		{BACKUP_CHANNEL_BORROW, p.borrowChannel},
+	}
+}
+
+// The records of the roles are in the direct channels, which can't be listed,
+// so they are found by the relations of their master.
+// The oldest comes first, so that restoring keeps the order of the channels.
+func (p *Plugin) _collectBackupRecords() ([]BackupRecord, error) {
+	records := []BackupRecord{}
+	directUsers := map[string]string{}
+
+	for _, ch := range p._backupChannels() {
+		for page := 0; ; page++ {
+			posts, err := p._repo().List(ch.channel, page, backupPostsPerPage)
+			if err != nil {
+				return nil, errors.Wrapf(err, "list records error. channel: %v, page: %v", ch.name, page)
+			}
+
+			for _, post := range posts {
+				if _newRecordDocument(post.Type) == nil || post.RootId != "" {
+					continue
+				}
+				records = append(records, BackupRecord{
+					Id:       post.Id,
+					Type:     post.Type,
+					Channel:  ch.name,
+					CreateAt: post.CreateAt,
+					Message:  post.Message,
+				})
+
+				if ch.name != BACKUP_CHANNEL_BORROW {
+					continue
+				}
+				roleRecords, err := p._collectRoleRecords(post, directUsers)
+				if err != nil {
+					return nil, err
+				}
+				records = append(records, roleRecords...)
+			}
+
+			if len(posts) < backupPostsPerPage {
+				break
+			}
+		}
+	}
+
+	sort.SliceStable(records, func(i, j int) bool {
+		return records[i].CreateAt < records[j].CreateAt
+	})
+
+	return records, nil
+}
+
+func (p *Plugin) _collectRoleRecords(master *model.Post, directUsers map[string]string) ([]BackupRecord, error) {
+	doc := map[string]interface{}{}
+	if err := json.Unmarshal([]byte(master.Message), &doc); err != nil {
+		//not written yet
+		return nil, nil
+	}
+
+	records := []BackupRecord{}
+	for _, id := range _roleRecordIds(doc) {
+		post, err := p._repo().Get(id)
+		if errors.Is(err, ErrNotFound) {
+			continue
+		}
+		if err != nil {
+			return nil, errors.Wrapf(err, "get record %v error.", id)
+		}
+
+		user, ok := directUsers[post.ChannelId]
+		if !ok {
+			if user, err = p._directChannelUser(post.ChannelId); err != nil {
+				return nil, err
+			}
+			directUsers[post.ChannelId] = user
+		}
+
+		records = append(records, BackupRecord{
+			Id:       post.Id,
+			Type:     post.Type,
+			Channel:  BACKUP_CHANNEL_DIRECT,
+			User:     user,
+			CreateAt: post.CreateAt,
+			Message:  post.Message,
+		})
+	}
+
+	return records, nil
+}
+
+// The username of the other member of a direct channel with the bot.
+func (p *Plugin) _directChannelUser(channelId string) (string, error) {
+	channel, appErr := p.API.GetChannel(channelId)
+	if appErr != nil {
+		return "", errors.Wrapf(appErr, "get channel %v error.", channelId)
+	}
+
+	userId := channel.GetOtherUserIdForDM(p.botID)
+	user, appErr := p.API.GetUser(userId)
+	if appErr != nil {
+		return "", errors.Wrapf(appErr, "get user %v of channel %v error.", userId, channelId)
+	}
+
+	return user.Username, nil
+}
+
+// Status changes are in the threads only when the records are posts.
+func (p *Plugin) _collectBackupAudit(records []BackupRecord) ([]BackupAudit, error) {
+	audit := []BackupAudit{}
+	if !p._recordsArePosts() {
+		return audit, nil
+	}
+
+	for _, record := range records {
+		switch record.Type {
+		case "custom_borrow_type", "custom_transfer_type", "custom_purchase_type", "custom_donation_type":
+		default:
+			continue
+		}
+
+		thread, appErr := p.API.GetPostThread(record.Id)
+		if appErr != nil {
+			return nil, errors.Wrapf(appErr, "get thread of record %v error.", record.Id)
+		}
+		for _, post := range thread.Posts {
+			if post.RootId != record.Id {
+				continue
+			}
+			audit = append(audit, BackupAudit{
+				RootId:   record.Id,
+				UserId:   post.UserId,
+				CreateAt: post.CreateAt,
+				Message:  post.Message,
+			})
+		}
+	}
+
+	sort.SliceStable(audit, func(i, j int) bool {
+		return audit[i].CreateAt < audit[j].CreateAt
+	})
+
+	return audit, nil
+}
+
+func _writeBackupArchive(manifest BackupManifest, records []BackupRecord, audit []BackupAudit) ([]byte, error) {
+	var buf bytes.Buffer
+	zw := zip.NewWriter(&buf)
+
+	write := func(name string, data []byte) error {
+		f, err := zw.Create(name)
+		if err != nil {
+			return err
+		}
+		_, err = f.Write(data)
+		return err
+	}
+
+	for _, file := range []struct {
+		name    string
+		records int
+		content interface{}
+	}{
+		{BACKUP_FILE_RECORDS, len(records), records},
+		{BACKUP_FILE_AUDIT, len(audit), audit},
+	} {
+		data, err := json.MarshalIndent(file.content, "", "  ")
+		if err != nil {
+			return nil, err
+		}
+		manifest.Files = append(manifest.Files, BackupFile{
+			Name:    file.name,
+			Records: file.records,
+			Sha256:  _sha256Hex(data),
+		})
+		if err := write(file.name, data); err != nil {
+			return nil, err
+		}
+	}
+
+	data, err := json.MarshalIndent(manifest, "", "  ")
+	if err != nil {
+		return nil, err
+	}
+	if err := write(BACKUP_FILE_MANIFEST, data); err != nil {
+		return nil, err
+	}
+
+	if err := zw.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// Every file is checked against the manifest before anything is restored.
+func _readBackupArchive(data []byte) (*BackupManifest, []BackupRecord, []BackupAudit, error) {
+	zr, err := zip.NewReader(bytes.NewReader(data), int64(len(data)))
+	if err != nil {
+		return nil, nil, nil, KindError(ErrInvalidRequest, "not a backup archive: %v", err)
+	}
+
+	files := map[string][]byte{}
+	for _, f := range zr.File {
+		rc, err := f.Open()
+		if err != nil {
+			return nil, nil, nil, KindError(ErrInvalidRequest, "open %v error: %v", f.Name, err)
+		}
+		content, err := ioutil.ReadAll(rc)
+		rc.Close()
+		if err != nil {
+			return nil, nil, nil, KindError(ErrInvalidRequest, "read %v error: %v", f.Name, err)
+		}
+		files[f.Name] = content
+	}
+
+	manifest := new(BackupManifest)
+	if err := json.Unmarshal(files[BACKUP_FILE_MANIFEST], manifest); err != nil {
+		return nil, nil, nil, KindError(ErrInvalidRequest, "invalid manifest: %v", err)
+	}
+	if manifest.FormatVersion != BACKUP_FORMAT_VERSION {
+		return nil, nil, nil, KindError(ErrInvalidRequest, "unknown backup format version %v", manifest.FormatVersion)
+	}
+	if manifest.SchemaVersion > SCHEMA_VERSION {
+		return nil, nil, nil, KindError(ErrInvalidRequest,
+			"the backup is of schema version %v, newer than %v", manifest.SchemaVersion, SCHEMA_VERSION)
+	}
+
+	records := []BackupRecord{}
+	audit := []BackupAudit{}
+	targets := map[string]interface{}{
+		BACKUP_FILE_RECORDS: &records,
+		BACKUP_FILE_AUDIT:   &audit,
+	}
+	counts := map[string]func() int{
+		BACKUP_FILE_RECORDS: func() int { return len(records) },
+		BACKUP_FILE_AUDIT:   func() int { return len(audit) },
+	}
+
+	for _, file := range manifest.Files {
+		content, ok := files[file.Name]
+		if !ok {
+			return nil, nil, nil, KindError(ErrInvalidRequest, "%v is missing", file.Name)
+		}
+		if _sha256Hex(content) != file.Sha256 {
+			return nil, nil, nil, KindError(ErrInvalidRequest, "checksum of %v mismatched", file.Name)
+		}
+		target, ok := targets[file.Name]
+		if !ok {
+			continue
+		}
+		if err := json.Unmarshal(content, target); err != nil {
+			return nil, nil, nil, KindError(ErrInvalidRequest, "invalid %v: %v", file.Name, err)
+		}
+		if counts[file.Name]() != file.Records {
+			return nil, nil, nil, KindError(ErrInvalidRequest, "%v has %v records, but %v in manifest",
+				file.Name, counts[file.Name](), file.Records)
+		}
+		delete(targets, file.Name)
+	}
+	for name := range targets {
+		return nil, nil, nil, KindError(ErrInvalidRequest, "%v is not in manifest", name)
+	}
+
+	return manifest, records, audit, nil
+}
+
+func _sha256Hex(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+// Records are restored to the library p works on, which must have no books, borrows or transfers.
+// All records are created first to have their new ids,
+// then every old id in the messages(relations, relation keys and book post ids) is replaced by the new one.
+// Restored records of an older schema version are migrated.
+func (p *Plugin) _restore(data []byte) (Messages, error) {
+	manifest, records, audit, err := _readBackupArchive(data)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := p._checkLibraryEmpty(); err != nil {
+		return nil, err
+	}
+
+	created := []*model.Post{}
+	createdAudit := []string{}
+	rollback := func(err error) error {
+		for _, id := range createdAudit {
+			if appErr := p.API.DeletePost(id); appErr != nil {
+				p.API.LogError("Fatal Error: rollback restored audit error.", "err", appErr.Error())
+				return errors.Wrapf(err, "Fatal Error: rollback error: %v", appErr)
+			}
+		}
+		if rbErr := p._rollBackCreated(created); rbErr != nil {
+			p.API.LogError("Fatal Error: rollback restored records error.", "err", fmt.Sprintf("%+v", rbErr))
+			return errors.Wrapf(err, "Fatal Error: rollback error: %v", rbErr)
+		}
+		return err
+	}
+
+	idMap := map[string]string{}
+	directChannels := map[string]string{}
+	for _, record := range records {
+		channelId, err := p._restoreChannelId(record, directChannels)
+		if err != nil {
+			return nil, rollback(err)
+		}
+		post, err := p._repo().Create(&model.Post{
+			UserId:    p.botID,
+			ChannelId: channelId,
+			Type:      record.Type,
+			Message:   "",
+			CreateAt:  record.CreateAt,
+		})
+		if err != nil {
+			return nil, rollback(errors.Wrapf(err, "create record of %v error.", record.Id))
+		}
+		created = append(created, post)
+		idMap[record.Id] = post.Id
+	}
+
+	replacer := _idReplacer(idMap)
+	for i, record := range records {
+		post := created[i].Clone()
+		post.Message = replacer.Replace(record.Message)
+		updated, err := p._repo().Update(post)
+		if err != nil {
+			return nil, rollback(errors.Wrapf(err, "update record of %v error.", record.Id))
+		}
+		created[i] = updated
+	}
+
+	restoredAudit := 0
+	if p._recordsArePosts() {
+		channelOf := map[string]string{}
+		for _, post := range created {
+			channelOf[post.Id] = post.ChannelId
+		}
+		for _, a := range audit {
+			rootId, ok := idMap[a.RootId]
+			if !ok {
+				continue
+			}
+			post, appErr := p.API.CreatePost(&model.Post{
+				UserId:    a.UserId,
+				ChannelId: channelOf[rootId],
+				RootId:    rootId,
+				Message:   a.Message,
+				CreateAt:  a.CreateAt,
+			})
+			if appErr != nil {
+				return nil, rollback(errors.Wrapf(appErr, "create audit of %v error.", a.RootId))
+			}
+			createdAudit = append(createdAudit, post.Id)
+			restoredAudit++
+		}
+	}
+
+	if manifest.SchemaVersion < SCHEMA_VERSION {
+		for _, post := range created {
+			if _, err := p._migrateRecord(post, false); err != nil {
+				return nil, rollback(err)
+			}
+		}
+	}
+
+	p.API.LogInfo("Library restored.", "library", p.library.id, "from", manifest.LibraryId,
+		"records", fmt.Sprint(len(created)), "audit", fmt.Sprint(restoredAudit))
+
+	return Messages{
+		"records": fmt.Sprint(len(created)),
+		"audit":   fmt.Sprint(restoredAudit),
+	}, nil
+}
+
+func (p *Plugin) _checkLibraryEmpty() error {
+	for _, ch := range p._backupChannels() {
+		for page := 0; ; page++ {
+			posts, err := p._repo().List(ch.channel, page, backupPostsPerPage)
+			if err != nil {
+				return errors.Wrapf(err, "list records error. channel: %v, page: %v", ch.name, page)
+			}
+			for _, post := range posts {
+				if _newRecordDocument(post.Type) != nil && post.RootId == "" {
+					return KindError(ErrInvalidRequest, "library %v is not empty, channel %v has records.", p.library.id, ch.name)
+				}
+			}
+			if len(posts) < backupPostsPerPage {
+				break
+			}
+		}
+	}
+	return nil
+}
+
+func (p *Plugin) _restoreChannelId(record BackupRecord, directChannels map[string]string) (string, error) {
+	for _, ch := range p._backupChannels() {
+		if ch.name == record.Channel {
+			return ch.channel.Id, nil
+		}
+	}
+
+	if record.Channel != BACKUP_CHANNEL_DIRECT {
+		return "", KindError(ErrInvalidRequest, "unknown channel %v of record %v", record.Channel, record.Id)
+	}
+
+	if channelId, ok := directChannels[record.User]; ok {
+		return channelId, nil
+	}
+	channel, err := p._getBotDirectChannel(record.User)
+	if err != nil {
+		return "", err
+	}
+	directChannels[record.User] = channel.Id
+	return channel.Id, nil
+}
+
+// Ids are only replaced as whole JSON strings.
+func _idReplacer(idMap map[string]string) *strings.Replacer {
+	pairs := []string{}
+	for oldId, newId := range idMap {
+		pairs = append(pairs, `"`+oldId+`"`, `"`+newId+`"`)
+	}
+	return strings.NewReplacer(pairs...)
+}
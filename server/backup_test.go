@@ -0,0 +1,241 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"testing"
+
+	"github.com/mattermost/mattermost-server/v5/model"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/require"
+)
+
+func TestBackup(t *testing.T) {
+
+	type backupEnv struct {
+		td       *TestData
+		plugin   *Plugin
+		repo     *memRepository
+		bookId   string
+		masterId string
+	}
+
+	newPlugin := func(td *TestData) (*Plugin, *memRepository) {
+		api := td.ApiMockCommon()
+		api.On("CreatePost", mock.Anything).Return(&model.Post{}, nil)
+
+		directUsers := map[string]string{
+			td.BorId_botId:     td.BorId,
+			td.Worker1Id_botId: td.Worker1Id,
+			td.Worker2Id_botId: td.Worker2Id,
+			td.Keeper1Id_botId: td.Keeper1Id,
+			td.Keeper2Id_botId: td.Keeper2Id,
+		}
+		api.On("GetChannel", mock.MatchedBy(func(id string) bool {
+			_, ok := directUsers[id]
+			return ok
+		})).Return(
+			func(id string) *model.Channel {
+				return &model.Channel{
+					Id:   id,
+					Type: model.CHANNEL_DIRECT,
+					Name: model.GetDMNameFromIds(directUsers[id], td.BotId),
+				}
+			}, nil)
+
+		plugin := td.NewMockPlugin()
+		plugin.SetAPI(api)
+		repo := newMemRepository()
+		plugin.repo = repo
+		return plugin, repo
+	}
+
+	setup := func() *backupEnv {
+		td := NewTestData()
+		plugin, repo := newPlugin(td)
+
+		var book Book
+		DeepCopy(&book, td.ABook)
+		book.BookPublic.Id = ""
+		bookId, err := plugin._createABook(&book)
+		require.Nil(t, err)
+
+		masterId, _, err := plugin._borrowABook(td.BorId, &BorrowRequestKey{
+			BookPostId:   bookId,
+			BorrowerUser: td.BorrowUser,
+		}, otherRequestData{processTime: GetNowTime()})
+		require.Nil(t, err)
+
+		return &backupEnv{td, plugin, repo, bookId, masterId}
+	}
+
+	getBorrow := func(t *testing.T, repo Repository, id string) (*model.Post, *Borrow) {
+		post, err := repo.Get(id)
+		require.Nil(t, err)
+		borrow := new(Borrow)
+		require.Nil(t, json.Unmarshal([]byte(post.Message), borrow))
+		return post, borrow
+	}
+
+	// replaces a file of an archive, keeping the manifest
+	replaceFile := func(t *testing.T, data []byte, name string, content []byte) []byte {
+		zr, err := zip.NewReader(bytes.NewReader(data), int64(len(data)))
+		require.Nil(t, err)
+
+		var buf bytes.Buffer
+		zw := zip.NewWriter(&buf)
+		for _, f := range zr.File {
+			rc, err := f.Open()
+			require.Nil(t, err)
+			old, err := ioutil.ReadAll(rc)
+			rc.Close()
+			require.Nil(t, err)
+
+			w, err := zw.Create(f.Name)
+			require.Nil(t, err)
+			if f.Name == name {
+				old = content
+			}
+			_, err = w.Write(old)
+			require.Nil(t, err)
+		}
+		require.Nil(t, zw.Close())
+		return buf.Bytes()
+	}
+
+	t.Run("backup_and_restore", func(t *testing.T) {
+		env := setup()
+
+		file, err := env.plugin._backup()
+		require.Nil(t, err)
+		assert.Equal(t, "application/zip", file.contentType)
+
+		manifest, records, audit, err := _readBackupArchive(file.data)
+		require.Nil(t, err)
+		assert.Equal(t, SCHEMA_VERSION, manifest.SchemaVersion)
+		assert.Equal(t, DEFAULT_LIBRARY_ID, manifest.LibraryId)
+		assert.Empty(t, audit, "no threads without posts")
+
+		_, master := getBorrow(t, env.repo, env.masterId)
+		roleIds := []string{master.RelationKeys.Borrower, master.RelationKeys.Libworker}
+		roleIds = append(roleIds, master.RelationKeys.Keepers...)
+		// 3 book parts, the master and the roles
+		assert.Equal(t, 4+len(roleIds), len(records))
+		for _, record := range records {
+			if record.Channel == BACKUP_CHANNEL_DIRECT {
+				assert.Contains(t, roleIds, record.Id)
+				assert.NotEmpty(t, record.User)
+			}
+		}
+
+		restored, repo := newPlugin(env.td)
+		messages, err := restored._restore(file.data)
+		require.Nil(t, err)
+		assert.Equal(t, Messages{"records": fmt.Sprint(len(records)), "audit": "0"}, messages)
+
+		masters, err := repo.List(restored.borrowChannel, 0, 10)
+		require.Nil(t, err)
+		require.Equal(t, 1, len(masters))
+		assert.NotEqual(t, env.masterId, masters[0].Id)
+
+		_, restoredMaster := getBorrow(t, repo, masters[0].Id)
+		books, err := repo.List(restored.booksChannel, 0, 10)
+		require.Nil(t, err)
+		require.Equal(t, 1, len(books))
+		newBookId := books[0].Id
+		assert.Equal(t, newBookId, restoredMaster.RelationKeys.Book)
+		assert.Equal(t, newBookId, restoredMaster.DataOrImage.BookPostId)
+
+		borrowerRecord, borrower := getBorrow(t, repo, restoredMaster.RelationKeys.Borrower)
+		assert.Equal(t, env.td.BorId_botId, borrowerRecord.ChannelId)
+		assert.Equal(t, newBookId, borrower.DataOrImage.BookPostId)
+		assert.Equal(t, master.DataOrImage.MatchId, restoredMaster.DataOrImage.MatchId)
+
+		origin, err := env.plugin.GetABook(env.bookId)
+		require.Nil(t, err)
+		got, err := restored.GetABook(newBookId)
+		require.Nil(t, err)
+		assert.Equal(t, Relations{REL_BOOK_PUBLIC: newBookId}, got.book.BookInventory.Relations)
+		assert.Equal(t, Relations{REL_BOOK_PUBLIC: newBookId}, got.book.BookPrivate.Relations)
+		origin.book.BookInventory.Relations = got.book.BookInventory.Relations
+		origin.book.BookPrivate.Relations = got.book.BookPrivate.Relations
+		assert.Equal(t, origin.book.BookInventory, got.book.BookInventory)
+		assert.Equal(t, origin.book.BookPrivate, got.book.BookPrivate)
+		assert.Equal(t, origin.book.BookPublic.Name, got.book.BookPublic.Name)
+	})
+
+	t.Run("library_not_empty", func(t *testing.T) {
+		env := setup()
+
+		file, err := env.plugin._backup()
+		require.Nil(t, err)
+
+		_, err = env.plugin._restore(file.data)
+		assert.ErrorIs(t, err, ErrInvalidRequest)
+		list, _ := env.repo.List(env.plugin.booksChannel, 0, 10)
+		assert.Equal(t, 1, len(list), "nothing should be restored")
+	})
+
+	t.Run("checksum_mismatched", func(t *testing.T) {
+		env := setup()
+
+		file, err := env.plugin._backup()
+		require.Nil(t, err)
+		tampered := replaceFile(t, file.data, BACKUP_FILE_RECORDS, []byte("[]"))
+
+		restored, repo := newPlugin(env.td)
+		_, err = restored._restore(tampered)
+		assert.ErrorIs(t, err, ErrInvalidRequest)
+		assert.Contains(t, err.Error(), "checksum")
+		list, _ := repo.List(restored.booksChannel, 0, 10)
+		assert.Empty(t, list)
+	})
+
+	t.Run("newer_schema", func(t *testing.T) {
+		data, err := _writeBackupArchive(BackupManifest{
+			FormatVersion: BACKUP_FORMAT_VERSION,
+			SchemaVersion: SCHEMA_VERSION + 1,
+		}, []BackupRecord{}, []BackupAudit{})
+		require.Nil(t, err)
+
+		_, _, _, err = _readBackupArchive(data)
+		assert.ErrorIs(t, err, ErrInvalidRequest)
+		assert.Contains(t, err.Error(), "newer")
+	})
+
+	t.Run("older_schema_migrated", func(t *testing.T) {
+		td := NewTestData()
+		pub, _ := json.MarshalIndent(td.ABookPub, "", "  ")
+		data, err := _writeBackupArchive(BackupManifest{
+			FormatVersion: BACKUP_FORMAT_VERSION,
+		}, []BackupRecord{
+			{Id: model.NewId(), Type: "custom_book_type", Channel: BACKUP_CHANNEL_BOOKS, Message: string(pub)},
+		}, []BackupAudit{})
+		require.Nil(t, err)
+
+		restored, repo := newPlugin(td)
+		_, err = restored._restore(data)
+		require.Nil(t, err)
+
+		list, _ := repo.List(restored.booksChannel, 0, 10)
+		require.Equal(t, 1, len(list))
+		var bookPub BookPublic
+		require.Nil(t, json.Unmarshal([]byte(list[0].Message), &bookPub))
+		assert.Equal(t, SCHEMA_VERSION, bookPub.SchemaVersion)
+	})
+
+	t.Run("command", func(t *testing.T) {
+		env := setup()
+
+		_, err := env.plugin._executeBackup(env.td.BorId, []string{})
+		assert.ErrorIs(t, err, ErrNotPermitted)
+
+		text, err := env.plugin._executeBackup(env.td.Worker1Id, []string{"restore"})
+		require.Nil(t, err)
+		assert.Contains(t, text, "Usage")
+	})
+}
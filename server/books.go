@@ -28,10 +28,14 @@ type bookInfo struct {
 
 func (p *Plugin) GetABook(id string) (*bookInfo, error) {
 
-	bookPost, appErr := p.API.GetPost(id)
+	bookPost, err := p._repo().Get(id)
 
-	if appErr != nil {
-		return nil, errors.Wrapf(appErr, "Failed to get book post id(pub) %s.", id)
+	if err != nil {
+		return nil, errors.Wrapf(err, "Failed to get book post id(pub) %s.", id)
+	}
+
+	if err := p._checkLibraryPost(bookPost, p.booksChannel); err != nil {
+		return nil, err
 	}
 
 	pubPost := bookPost
@@ -43,10 +47,10 @@ func (p *Plugin) GetABook(id string) (*bookInfo, error) {
 
 	priId := bookPub.Relations[REL_BOOK_PRIVATE]
 
-	bookPost, appErr = p.API.GetPost(priId)
+	bookPost, err = p._repo().Get(priId)
 
-	if appErr != nil {
-		return nil, errors.Wrapf(appErr, "Failed to get book post id(pri) %s.", id)
+	if err != nil {
+		return nil, errors.Wrapf(err, "Failed to get book post id(pri) %s.", id)
 	}
 
 	priPost := bookPost
@@ -58,10 +62,10 @@ func (p *Plugin) GetABook(id string) (*bookInfo, error) {
 
 	invId := bookPub.Relations[REL_BOOK_INVENTORY]
 
-	bookPost, appErr = p.API.GetPost(invId)
+	bookPost, err = p._repo().Get(invId)
 
-	if appErr != nil {
-		return nil, errors.Wrapf(appErr, "Failed to get book post id(inv) %s.", id)
+	if err != nil {
+		return nil, errors.Wrapf(err, "Failed to get book post id(inv) %s.", id)
 	}
 
 	invPost := bookPost
@@ -83,47 +87,41 @@ func (p *Plugin) GetABook(id string) (*bookInfo, error) {
 	}, nil
 }
 
-func (p *Plugin) _getFetchInvKeepers(username string) (string, error) {
-	user, appErr := p.API.GetUserByUsername(username)
-	if appErr != nil {
-		return "", appErr
-	}
-	_, appErr = p.API.GetChannelMember(p.borrowChannel.Id, user.Id)
-	if appErr != nil {
-		//not a supervisor
-		if appErr.Id == "app.channel.get_member.missing.app_error" {
-			return username, nil
-		}
-
-		return "", appErr
-	}
-
-	//supervisor, select from borrow channel
-	return "@", nil
-
-}
-
 func (p *Plugin) handleBooksRequest(c *plugin.Context, w http.ResponseWriter, r *http.Request) {
 
 	var booksRequest *BooksRequest
 	err := json.NewDecoder(r.Body).Decode(&booksRequest)
 	if err != nil {
 		p.API.LogError("Failed to convert from book request.", "err", fmt.Sprintf("%+v", err))
-		resp, _ := json.Marshal(Result{
-			Error: "Failed to convert from book request.",
-		})
+		resp, _ := json.Marshal(p._errorResult(ErrInvalidRequest, "Failed to convert from book request."))
 
 		w.Write(resp)
 		return
 
 	}
 
+	userId := r.Header.Get("Mattermost-User-ID")
+
+	switch booksRequest.Action {
+	case BOOKS_ACTION_UPLOAD, BOOKS_ACTION_PATCH,
+		BOOKS_ACTION_ADD_COPIES, BOOKS_ACTION_RETIRE_COPIES, BOOKS_ACTION_REASSIGN_COPIES:
+		if err := p._checkRole(userId, ROLE_CATALOG_EDITOR); err != nil {
+			p.API.LogError("check role error.", "err", fmt.Sprintf("%+v", err))
+			resp, _ := json.Marshal(p._errorResult(err, p._permissionErrorText(err)))
+
+			w.Write(resp)
+			return
+		}
+	}
+
 	switch booksRequest.Action {
 	case BOOKS_ACTION_UPLOAD:
 
 		var messages Messages
 
-		messages, err := p._uploadBooks(booksRequest.Body)
+		messages, err := p._uploadBooks(booksRequest.Body, uploadOptions{
+			dryRun: booksRequest.DryRun,
+		})
 		if err != nil {
 			p.API.LogError("upload books error.", "err", fmt.Sprintf("%+v", err))
 			var errorMessage string
@@ -132,10 +130,61 @@ func (p *Plugin) handleBooksRequest(c *plugin.Context, w http.ResponseWriter, r
 			} else {
 				errorMessage = p.i18n.GetText("upload-book-failed")
 			}
-			resp, _ := json.Marshal(Result{
-				Error:    errorMessage,
-				Messages: messages,
-			})
+			result := p._errorResult(err, errorMessage)
+			result.Messages = messages
+			resp, _ := json.Marshal(result)
+
+			w.Write(resp)
+			return
+		}
+
+		resp, _ := json.Marshal(Result{
+			Error:    "",
+			Messages: messages,
+		})
+
+		w.Write(resp)
+	case BOOKS_ACTION_PATCH:
+
+		messages, err := p._patchBooks(booksRequest.Body)
+		if err != nil {
+			p.API.LogError("patch books error.", "err", fmt.Sprintf("%+v", err))
+			var errorMessage string
+			if errors.Is(err, ErrLocked) || errors.Is(err, ErrStale) {
+				errorMessage = p.i18n.GetText("system-busy")
+			} else {
+				errorMessage = p.i18n.GetText("patch-book-failed")
+			}
+			result := p._errorResult(err, errorMessage)
+			result.Messages = messages
+			resp, _ := json.Marshal(result)
+
+			w.Write(resp)
+			return
+		}
+
+		resp, _ := json.Marshal(Result{
+			Error:    "",
+			Messages: messages,
+		})
+
+		w.Write(resp)
+	case BOOKS_ACTION_ADD_COPIES, BOOKS_ACTION_RETIRE_COPIES, BOOKS_ACTION_REASSIGN_COPIES:
+
+		messages, err := p._operateCopiesByJson(booksRequest.Action, booksRequest.Body)
+		if err != nil {
+			p.API.LogError("operate copies error.", "err", fmt.Sprintf("%+v", err))
+			var errorMessage string
+			if errors.Is(err, ErrLocked) || errors.Is(err, ErrStale) {
+				errorMessage = p.i18n.GetText("system-busy")
+			} else if errors.Is(err, ErrInvalidCopyKeeper) {
+				errorMessage = p.i18n.GetText("invalid-copy-keeper")
+			} else {
+				errorMessage = p.i18n.GetText("update-copies-failed")
+			}
+			result := p._errorResult(err, errorMessage)
+			result.Messages = messages
+			resp, _ := json.Marshal(result)
 
 			w.Write(resp)
 			return
@@ -149,12 +198,14 @@ func (p *Plugin) handleBooksRequest(c *plugin.Context, w http.ResponseWriter, r
 		w.Write(resp)
 	case BOOKS_ACTION_FETCH_INV_KEEPER:
 
-		keeperUser, appErr := p._getFetchInvKeepers(booksRequest.ActUser)
+		keeperUser, appErr := p._getFetchInvKeepers(userId, booksRequest.ActUser)
 		if appErr != nil {
 			p.API.LogError("_getFetchInvKeepers error.", "err", fmt.Sprintf("%+v", appErr))
-			resp, _ := json.Marshal(Result{
-				Error: "_getFetchInvKeepers error.",
-			})
+			errorMessage := "_getFetchInvKeepers error."
+			if errors.Is(appErr, ErrNotPermitted) {
+				errorMessage = p.i18n.GetText("not-permitted")
+			}
+			resp, _ := json.Marshal(p._errorResult(appErr, errorMessage))
 
 			w.Write(resp)
 			return
@@ -166,10 +217,9 @@ func (p *Plugin) handleBooksRequest(c *plugin.Context, w http.ResponseWriter, r
 			})
 		if err != nil {
 			p.API.LogError("fetch books error.", "err", fmt.Sprintf("%+v", err))
-			resp, _ := json.Marshal(Result{
-				Error:    "fetch books error.",
-				Messages: messages,
-			})
+			result := p._errorResult(err, "fetch books error.")
+			result.Messages = messages
+			resp, _ := json.Marshal(result)
 
 			w.Write(resp)
 			return
@@ -184,16 +234,18 @@ func (p *Plugin) handleBooksRequest(c *plugin.Context, w http.ResponseWriter, r
 
 	default:
 		p.API.LogError("invalidate action.")
-		resp, _ := json.Marshal(Result{
-			Error: "invalidate action.",
-		})
+		resp, _ := json.Marshal(p._errorResult(ErrInvalidRequest, "invalidate action."))
 
 		w.Write(resp)
 		return
 	}
 }
 
-func (p *Plugin) _uploadBooks(booksJson string) (Messages, error) {
+type uploadOptions struct {
+	dryRun bool
+}
+
+func (p *Plugin) _uploadBooks(booksJson string, opt uploadOptions) (Messages, error) {
 
 	var (
 		books  []*Book
@@ -207,7 +259,7 @@ func (p *Plugin) _uploadBooks(booksJson string) (Messages, error) {
 	}
 
 	for _, book := range books {
-		bookmsg, err := p._uploadABook(book)
+		bookmsg, err := p._uploadABook(book, opt)
 		if err != nil {
 			retErr = errors.Wrapf(err, "some error was occurred in books.")
 		}
@@ -218,7 +270,7 @@ func (p *Plugin) _uploadBooks(booksJson string) (Messages, error) {
 	return messages, retErr
 }
 
-func (p *Plugin) _uploadABook(book *Book) (*BooksMessage, error) {
+func (p *Plugin) _uploadABook(book *Book, opt uploadOptions) (*BooksMessage, error) {
 
 	var bookupl *Upload
 	if book.Upload == nil {
@@ -227,6 +279,45 @@ func (p *Plugin) _uploadABook(book *Book) (*BooksMessage, error) {
 		bookupl = book.Upload
 	}
 
+	var enriched map[string]string
+	if bookupl.Enrich && !bookupl.Delete && book.BookPublic != nil {
+		var err error
+		if enriched, err = p._enrichABook(book.BookPublic); err != nil {
+			return &BooksMessage{
+				PostId:  bookupl.Post_id,
+				Status:  BOOK_UPLOAD_ERROR,
+				Message: err.Error(),
+			}, err
+		}
+	}
+
+	if bookupl.Post_id == "" && bookupl.MatchIsbn && book.BookPublic != nil {
+		isbn := book.BookPublic.Isbn13
+		if isbn == "" {
+			isbn = book.BookPublic.Isbn10
+		}
+		if isbn != "" {
+			pid, err := p._findBookPostIdByIsbn(isbn)
+			if err != nil {
+				return &BooksMessage{
+					PostId:  "",
+					Status:  BOOK_UPLOAD_ERROR,
+					Message: err.Error(),
+				}, err
+			}
+			bookupl.Post_id = pid
+			book.Upload = bookupl
+		}
+	}
+
+	if opt.dryRun {
+		bookmsg, err := p._dryRunABook(book)
+		if bookmsg != nil {
+			bookmsg.Enriched = enriched
+		}
+		return bookmsg, err
+	}
+
 	if bookupl.Post_id != "" {
 		if bookupl.Delete == true {
 			//---------------------------------------
@@ -257,9 +348,10 @@ func (p *Plugin) _uploadABook(book *Book) (*BooksMessage, error) {
 				}, err
 			}
 			return &BooksMessage{
-				PostId:  bookupl.Post_id,
-				Status:  BOOK_UPLOAD_SUCC,
-				Message: "Successfully updated.",
+				PostId:   bookupl.Post_id,
+				Status:   BOOK_UPLOAD_SUCC,
+				Message:  "Successfully updated.",
+				Enriched: enriched,
 			}, nil
 		}
 	}
@@ -275,9 +367,10 @@ func (p *Plugin) _uploadABook(book *Book) (*BooksMessage, error) {
 		}, err
 	}
 	return &BooksMessage{
-		PostId:  pid,
-		Status:  BOOK_UPLOAD_SUCC,
-		Message: "Successfully created.",
+		PostId:   pid,
+		Status:   BOOK_UPLOAD_SUCC,
+		Message:  "Successfully created.",
+		Enriched: enriched,
 	}, nil
 
 }
@@ -320,8 +413,8 @@ func (p *Plugin) _updateBookParts(opts updateOptions) error {
 	return nil
 }
 
-func (p *Plugin) _updateBookPart(post *model.Post, part interface{}) error {
-	mjson, err := json.MarshalIndent(part, "", "  ")
+func (p *Plugin) _updateBookPart(post *model.Post, part schemaVersioned) error {
+	mjson, err := _marshalRecord(part)
 	if err != nil {
 		return err
 	}
@@ -330,8 +423,8 @@ func (p *Plugin) _updateBookPart(post *model.Post, part interface{}) error {
 	DeepCopy(newPost, post)
 	if newPost.Message != string(mjson) {
 		newPost.Message = string(mjson)
-		if _, appErr := p.API.UpdatePost(newPost); appErr != nil {
-			return appErr
+		if _, err := p._repo().Update(newPost); err != nil {
+			return err
 		}
 
 	}
@@ -350,8 +443,44 @@ func (p *Plugin) _updateABook(book *Book) error {
 
 	defer lockmap.Delete(pubId)
 
+	plan, err := p._planUpdateABook(book)
+	if err != nil {
+		return err
+	}
+
+	if err := p._updateBookParts(plan.opts); err != nil {
+		return errors.Wrapf(err, "update posts error.")
+	}
+	p._grantKeeperRoleOf(plan.opts.pri)
+
+	p._emitBookEvent(WEBHOOK_EVENT_BOOK_UPDATED, pubId, nil)
+	return nil
+}
+
+// The keepers of an uploaded or patched private part, nil if it is not updated.
+func (p *Plugin) _grantKeeperRoleOf(bookPri *BookPrivate) {
+	if bookPri == nil {
+		return
+	}
+	p._grantKeeperRole(bookPri.KeeperUsers...)
+}
+
+//old parts are kept for comparing, new parts are in opts.
+type bookUpdatePlan struct {
+	opts   updateOptions
+	oldPub *BookPublic
+	oldPri *BookPrivate
+	oldInv *BookInventory
+}
+
+//Make the new parts from an uploaded book and the current posts, with all the checks.
+//Nothing is written, so it is also used by dry run.
+func (p *Plugin) _planUpdateABook(book *Book) (*bookUpdatePlan, error) {
+
+	pubId := book.Upload.Post_id
+
 	if err := p._fillABookCommon(book); err != nil {
-		return errors.Wrapf(err, "fill error.")
+		return nil, errors.Wrapf(err, "fill error.")
 	}
 
 	//------------------------------
@@ -365,11 +494,16 @@ func (p *Plugin) _updateABook(book *Book) error {
 	bookPubOld := &BookPublic{}
 	bookPubOldPost, err := p._getUnmarshaledPost(pubId, bookPubOld)
 	if err != nil {
-		return errors.Wrapf(err, "get pub error.")
+		return nil, errors.Wrapf(err, "get pub error.")
 	}
         
 	if book.Upload.Etag != "" &&  bookPubOld.MatchId != book.Upload.Etag {
-		return errors.Wrapf(ErrStale, "update stale")
+		return nil, WithDetails(errors.Wrapf(ErrStale, "update stale"),
+			ErrorDetails{ERROR_DETAIL_ETAG: bookPubOld.MatchId})
+	}
+
+	if err := p._checkDuplicateBook(bookPub, pubId); err != nil {
+		return nil, err
 	}
 
 	//IsAllowedToBorrow is not updated when updating
@@ -386,6 +520,8 @@ func (p *Plugin) _updateABook(book *Book) error {
 		}
 	}
 	bookPub.Relations = bookPubOld.Relations
+	bookPub.Rating = bookPubOld.Rating
+	bookPub.RatingCount = bookPubOld.RatingCount
 	//------------------------------
 	//get private part
 	//------------------------------
@@ -399,9 +535,15 @@ func (p *Plugin) _updateABook(book *Book) error {
 	priId := bookPubOld.Relations[REL_BOOK_PRIVATE]
 	bookPriOldPost, err = p._getUnmarshaledPost(priId, bookPriOld)
 	if err != nil {
-		return errors.Wrapf(err, "get pri error.")
+		return nil, errors.Wrapf(err, "get pri error.")
 	}
 	if bookPri != nil {
+		if err := _checkCopyKeepers(bookPri); err != nil {
+			return nil, err
+		}
+		if err := p._checkKeepersExist(bookPri.KeeperUsers...); err != nil {
+			return nil, err
+		}
 		bookPri.Relations = bookPriOld.Relations
 	}
 
@@ -418,12 +560,12 @@ func (p *Plugin) _updateABook(book *Book) error {
 	invId := bookPubOld.Relations[REL_BOOK_INVENTORY]
 	bookInvOldPost, err = p._getUnmarshaledPost(invId, bookInvOld)
 	if err != nil {
-		return errors.Wrapf(err, "get inv error.")
+		return nil, errors.Wrapf(err, "get inv error.")
 	}
 
 	if bookInv != nil {
 		//udpate stock
-		totalOld := bookInvOld.Stock + bookInvOld.TransmitOut + bookInvOld.Lending + bookInvOld.TransmitIn
+		totalOld := bookInvOld.Stock + bookInvOld.TransmitOut + bookInvOld.Lending + bookInvOld.TransmitIn + bookInvOld.InTransit
 		if bookInv.Stock > totalOld {
 			diff := bookInv.Stock - totalOld
 			bookInv.Stock = bookInvOld.Stock + diff
@@ -431,10 +573,11 @@ func (p *Plugin) _updateABook(book *Book) error {
 			diff := totalOld - bookInv.Stock
 			bookInv.Stock = bookInvOld.Stock - diff
 			if bookInv.Stock < 0 {
-				return errors.New("stock can not be negative.")
+				return nil, KindError(ErrRuleViolation, "stock can not be negative.")
 			}
 		}
 		bookInv.TransmitIn = bookInvOld.TransmitIn
+		bookInv.InTransit = bookInvOld.InTransit
 		bookInv.Lending = bookInvOld.Lending
 		bookInv.TransmitOut = bookInvOld.TransmitOut
 
@@ -457,7 +600,7 @@ func (p *Plugin) _updateABook(book *Book) error {
 		for id, val := range bookInvOld.Copies {
 			if _, ok := bookInv.Copies[id]; !ok {
 				if val.Status != COPY_STATUS_INSTOCK {
-					return errors.New(fmt.Sprintf("cannot delete copy %v with status %v is not InStock", id, val.Status))
+					return nil, KindError(ErrRuleViolation, "cannot delete copy %v with status %v is not InStock", id, val.Status)
 				}
 			}
 		}
@@ -466,8 +609,8 @@ func (p *Plugin) _updateABook(book *Book) error {
 		bookInv.Relations = bookInvOld.Relations
 	}
 
-	if err := p._updateBookParts(
-		updateOptions{
+	return &bookUpdatePlan{
+		opts: updateOptions{
 			pub:     bookPub,
 			pubPost: bookPubOldPost,
 			pri:     bookPri,
@@ -475,26 +618,23 @@ func (p *Plugin) _updateABook(book *Book) error {
 			inv:     bookInv,
 			invPost: bookInvOldPost,
 		},
-	); err != nil {
-		return errors.Wrapf(err, "update posts error.")
-	}
-
-	return nil
+		oldPub: bookPubOld,
+		oldPri: bookPriOld,
+		oldInv: bookInvOld,
+	}, nil
 }
 
 func (p *Plugin) _getUnmarshaledPost(id string, value interface{}) (*model.Post, error) {
 
-	var appErr *model.AppError
-
-	post, appErr := p.API.GetPost(id)
-	if appErr != nil {
-		if appErr.StatusCode == http.StatusNotFound {
-			return nil, ErrNotFound
-		}
-		return nil, errors.Wrapf(appErr, fmt.Sprintf("get post error."))
+	post, err := p._repo().Get(id)
+	if errors.Is(err, ErrNotFound) {
+		return nil, ErrNotFound
+	}
+	if err != nil {
+		return nil, errors.Wrapf(err, fmt.Sprintf("get post error."))
 	}
 
-	err := json.Unmarshal([]byte(post.Message), value)
+	err = json.Unmarshal([]byte(post.Message), value)
 	if err != nil {
 		return nil, errors.Wrapf(err, fmt.Sprintf("marshal error."))
 	}
@@ -529,16 +669,52 @@ func (p *Plugin) _deleteABook(book *Book) error {
 	pubId := book.Upload.Post_id
 
 	if pubId == "" {
-		return errors.New("post id is required.")
+		return KindError(ErrInvalidRequest, "post id is required.")
 	}
 
 	//lock pub part only
 	if _, ok := lockmap.LoadOrStore(pubId, struct{}{}); ok {
-		return errors.New(fmt.Sprintf("lock error."))
+		return errors.Wrapf(ErrLocked, "lock error.")
 	}
 
 	defer lockmap.Delete(pubId)
 
+	plan, err := p._planDeleteABook(pubId, book.Upload.Etag)
+	if err != nil {
+		return err
+	}
+
+	//------------------------------
+	//Start deleting
+	//------------------------------
+	if plan.invPost != nil {
+		if err := p._repo().Delete(plan.invPost.Id); err != nil {
+			return errors.Wrapf(err, "delete inventory record error. record is broken!, please retry.")
+		}
+	}
+
+	if plan.priPost != nil {
+		if err := p._repo().Delete(plan.priPost.Id); err != nil {
+			return errors.Wrapf(err, "delete private record error. record is broken!, please retry.")
+		}
+	}
+
+	if plan.pubPost != nil {
+		//Because the broken records maybe ocurred, make the public record is the lastest to be deleted.
+		//so as to retry the deletion
+		if err := p._repo().Delete(pubId); err != nil {
+			return errors.Wrapf(err, "delete pub record error. record is broken!, please retry.")
+		}
+	}
+
+	p._emitBookEvent(WEBHOOK_EVENT_BOOK_DELETED, pubId, plan.book.BookPublic)
+	return nil
+}
+
+//Get the current parts of a book to be deleted, and check it can be deleted.
+//A missing private or inventory post is allowed, so as to retry a broken deletion.
+func (p *Plugin) _planDeleteABook(pubId string, etag string) (*bookInfo, error) {
+
 	//------------------------------
 	//get public part
 	//------------------------------
@@ -546,7 +722,12 @@ func (p *Plugin) _deleteABook(book *Book) error {
 	bookPubOldPost, err := p._getUnmarshaledPost(pubId, bookPubOld)
 	if err != nil {
 		//fail to get pub is fatal, so just return
-		return errors.Wrapf(err, "get pub error.")
+		return nil, errors.Wrapf(err, "get pub error.")
+	}
+
+	if etag != "" && bookPubOld.MatchId != etag {
+		return nil, WithDetails(errors.Wrapf(ErrStale, "delete stale"),
+			ErrorDetails{ERROR_DETAIL_ETAG: bookPubOld.MatchId})
 	}
 
 	//------------------------------
@@ -557,7 +738,7 @@ func (p *Plugin) _deleteABook(book *Book) error {
 	bookPriOldPost, err := p._getUnmarshaledPost(priId, bookPriOld)
 	if err != nil {
 		if !errors.Is(err, ErrNotFound) {
-			return errors.Wrapf(err, "get pri error.")
+			return nil, errors.Wrapf(err, "get pri error.")
 		}
 	}
 
@@ -569,39 +750,26 @@ func (p *Plugin) _deleteABook(book *Book) error {
 	bookInvOldPost, err := p._getUnmarshaledPost(invId, bookInvOld)
 	if err != nil {
 		if !errors.Is(err, ErrNotFound) {
-			return errors.Wrapf(err, "get inv error.")
+			return nil, errors.Wrapf(err, "get inv error.")
 		}
 	}
 
-	totalOld := bookInvOld.Stock + bookInvOld.TransmitOut + bookInvOld.Lending + bookInvOld.TransmitIn
+	totalOld := bookInvOld.Stock + bookInvOld.TransmitOut + bookInvOld.Lending + bookInvOld.TransmitIn + bookInvOld.InTransit
 
 	if totalOld != bookInvOld.Stock {
-		return errors.New("all books should be returned before deletion.")
+		return nil, KindError(ErrRuleViolation, "all books should be returned before deletion.")
 	}
 
-	//------------------------------
-	//Start deleting
-	//------------------------------
-	if bookInvOldPost != nil {
-		if err := p.API.DeletePost(invId); err != nil {
-			return errors.Wrapf(err, "delete inventory record error. record is broken!, please retry.")
-		}
-	}
-
-	if bookPriOldPost != nil {
-		if err := p.API.DeletePost(priId); err != nil {
-			return errors.Wrapf(err, "delete private record error. record is broken!, please retry.")
-		}
-	}
-
-	if bookPubOldPost != nil {
-		//Because the broken records maybe ocurred, make the public record is the lastest to be deleted.
-		//so as to retry the deletion
-		if err := p.API.DeletePost(pubId); err != nil {
-			return errors.Wrapf(err, "delete pub record error. record is broken!, please retry.")
-		}
-	}
-	return nil
+	return &bookInfo{
+		book: &Book{
+			BookPublic:    bookPubOld,
+			BookPrivate:   bookPriOld,
+			BookInventory: bookInvOld,
+		},
+		pubPost: bookPubOldPost,
+		priPost: bookPriOldPost,
+		invPost: bookInvOldPost,
+	}, nil
 }
 
 func (p *Plugin) _fillABookCommon(book *Book) error {
@@ -610,12 +778,22 @@ func (p *Plugin) _fillABookCommon(book *Book) error {
 	//public part
 	bookpub := book.BookPublic
 	bookpub.IsAllowedToBorrow = book.IsAllowedToBorrow
+	if err := p._normalizeBookIsbn(bookpub); err != nil {
+		return err
+	}
 	bookpub.Tags = []string{
 		TAG_PREFIX_ID + bookpub.Id,
 		TAG_PREFIX_C1 + bookpub.Category1,
 		TAG_PREFIX_C2 + bookpub.Category2,
 		TAG_PREFIX_C3 + bookpub.Category3,
 	}
+	//both forms are tagged, so searching either one finds the book
+	if bookpub.Isbn13 != "" {
+		bookpub.Tags = append(bookpub.Tags, TAG_PREFIX_ISBN+bookpub.Isbn13)
+	}
+	if bookpub.Isbn10 != "" {
+		bookpub.Tags = append(bookpub.Tags, TAG_PREFIX_ISBN+bookpub.Isbn10)
+	}
 
 	bookpub.LibworkerNames = []string{}
 	for _, username := range bookpub.LibworkerUsers {
@@ -654,16 +832,35 @@ func (p *Plugin) _fillABookCommon(book *Book) error {
 	return nil
 }
 
-func (p *Plugin) _createABook(book *Book) (string, error) {
-	if err := p._fillABookCommon(book); err != nil {
-		return "", errors.Wrapf(err, "fill a book error.")
-	}
-
+//The checks of _createABook before any post is created.
+func (p *Plugin) _checkCreateABook(book *Book) error {
 	if book.BookPublic == nil ||
 		book.BookPrivate == nil ||
 		book.BookInventory == nil {
-		return "", errors.New("pub, pri or inv part should not be nil.")
+		return errors.New("pub, pri or inv part should not be nil.")
+	}
+
+	if err := p._fillABookCommon(book); err != nil {
+		return errors.Wrapf(err, "fill a book error.")
+	}
+
+	if err := _checkCopyKeepers(book.BookPrivate); err != nil {
+		return err
 	}
+	if err := p._checkKeepersExist(book.BookPrivate.KeeperUsers...); err != nil {
+		return err
+	}
+
+	return p._checkDuplicateBook(book.BookPublic, "")
+}
+
+func (p *Plugin) _createABook(book *Book) (string, error) {
+	if err := p._checkCreateABook(book); err != nil {
+		return "", err
+	}
+	//ratings come from reviews only
+	book.BookPublic.Rating = 0
+	book.BookPublic.RatingCount = 0
 
 	//---------------------------------------
 	// Create a  post
@@ -674,7 +871,7 @@ func (p *Plugin) _createABook(book *Book) (string, error) {
 	created := []*model.Post{}
 
 	//Public
-	postPub, appErr := p.API.CreatePost(
+	postPub, err := p._repo().Create(
 		&model.Post{
 			UserId:    p.botID,
 			Type:      "custom_book_type",
@@ -683,14 +880,14 @@ func (p *Plugin) _createABook(book *Book) (string, error) {
 		},
 	)
 
-	if appErr != nil {
-		return "", errors.Wrapf(appErr, "create pub post error.")
+	if err != nil {
+		return "", errors.Wrapf(err, "create pub post error.")
 	}
 
 	created = append(created, postPub)
 
 	//Private
-	postPri, appErr := p.API.CreatePost(
+	postPri, err := p._repo().Create(
 		&model.Post{
 			UserId:    p.botID,
 			Type:      "custom_book_private_type",
@@ -699,17 +896,17 @@ func (p *Plugin) _createABook(book *Book) (string, error) {
 		},
 	)
 
-	if appErr != nil {
-		if err := p._rollBackCreated(created); err != nil {
-			return "", errors.Wrapf(err, "Fatal Error: rollback error by pri create")
+	if err != nil {
+		if rbErr := p._rollBackCreated(created); rbErr != nil {
+			return "", errors.Wrapf(rbErr, "Fatal Error: rollback error by pri create")
 		}
-		return "", errors.Wrapf(appErr, "create pri post error.")
+		return "", errors.Wrapf(err, "create pri post error.")
 	}
 
 	created = append(created, postPri)
 
 	//inventory
-	postInv, appErr := p.API.CreatePost(
+	postInv, err := p._repo().Create(
 		&model.Post{
 			UserId:    p.botID,
 			Type:      "custom_book_inventory_type",
@@ -718,12 +915,12 @@ func (p *Plugin) _createABook(book *Book) (string, error) {
 		},
 	)
 
-	if appErr != nil {
-		if err := p._rollBackCreated(created); err != nil {
+	if err != nil {
+		if rbErr := p._rollBackCreated(created); rbErr != nil {
 
-			return "", errors.Wrapf(err, "Fatal Error: rollback error by creating inv post error.")
+			return "", errors.Wrapf(rbErr, "Fatal Error: rollback error by creating inv post error.")
 		}
-		return "", errors.Wrapf(appErr, "create inv post error.")
+		return "", errors.Wrapf(err, "create inv post error.")
 	}
 
 	created = append(created, postInv)
@@ -759,7 +956,9 @@ func (p *Plugin) _createABook(book *Book) (string, error) {
 		}
 		return "", errors.Wrapf(err, "update created post error.")
 	}
+	p._grantKeeperRoleOf(book.BookPrivate)
 
+	p._emitBookEvent(WEBHOOK_EVENT_BOOK_CREATED, postPub.Id, book.BookPublic)
 	return postPub.Id, nil
 }
 
@@ -799,14 +998,14 @@ func (p *Plugin) _fetchABook(book *Book, opt fetchOptions) (id string, bm *Books
 
 	var bookupl *Upload
 	if book.Upload == nil {
-		retErr = errors.New("upload section must not be empty")
+		retErr = KindError(ErrInvalidRequest, "upload section must not be empty")
 		return
 	} else {
 		bookupl = book.Upload
 	}
 
 	if bookupl.Post_id == "" {
-		retErr = errors.New("post id in upload section must not be empty")
+		retErr = KindError(ErrInvalidRequest, "post id in upload section must not be empty")
 		return
 	}
 
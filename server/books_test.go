@@ -24,6 +24,8 @@ func TestBooks(t *testing.T) {
 			excludeBookUpdAPI: true,
 		})
 	plugin.SetAPI(api)
+	api.On("SearchPostsInTeam", plugin.team.Id, mock.AnythingOfType("[]*model.SearchParams")).
+		Return([]*model.Post{}, nil)
 
 	type bookPids map[string]string
 
@@ -185,6 +187,11 @@ func TestBooks(t *testing.T) {
 		reqJson, _ := json.Marshal(bq)
 		w := httptest.NewRecorder()
 		r := httptest.NewRequest("POST", "/books", bytes.NewReader(reqJson))
+		if bq.Action == BOOKS_ACTION_FETCH_INV_KEEPER {
+			r.Header.Set("Mattermost-User-ID", td.UserIdOf(bq.ActUser))
+		} else {
+			r.Header.Set("Mattermost-User-ID", td.Worker1Id)
+		}
 		// fmt.Println(string(reqJson))
 		plugin.ServeHTTP(nil, w, r)
 		_checkBookMessageResult(t, w, assertError, expMessages)
@@ -194,9 +201,19 @@ func TestBooks(t *testing.T) {
 
 	resetLastUpdated := ""
 
+	//stored documents are written with the schema version,
+	//which is lost by copying a whole book, as each part has one.
+	stampSchemaVersion := func(books Books) {
+		for _, book := range books {
+			book.BookPublic.SchemaVersion = SCHEMA_VERSION
+			book.BookPrivate.SchemaVersion = SCHEMA_VERSION
+			book.BookInventory.SchemaVersion = SCHEMA_VERSION
+		}
+	}
+
 	resetSomeBooksInDB := func() Books {
 		resetLastUpdated = model.NewId() 
-		return Books{
+		books := Books{
 			{
 				&BookPublic{
 					Id:                "zzh-book-001",
@@ -351,6 +368,8 @@ func TestBooks(t *testing.T) {
 			},
 		}
 
+		stampSchemaVersion(books)
+		return books
 	}
 
 	someBooksInDB := resetSomeBooksInDB()
@@ -590,6 +609,7 @@ func TestBooks(t *testing.T) {
 
 		w := httptest.NewRecorder()
 		r := httptest.NewRequest("POST", "/books", bytes.NewReader(reqJson))
+		r.Header.Set("Mattermost-User-ID", td.Worker1Id)
 		// fmt.Println(string(reqJson))
 		plugin.ServeHTTP(nil, w, r)
 
@@ -607,6 +627,7 @@ func TestBooks(t *testing.T) {
 
 		var expectBooks Books
 		DeepCopy(&expectBooks, &someBooksInDB)
+		stampSchemaVersion(expectBooks)
 
 		// validate create
 		for i, somebook := range expectBooks {
@@ -646,6 +667,7 @@ func TestBooks(t *testing.T) {
 
 		w := httptest.NewRecorder()
 		r := httptest.NewRequest("POST", "/books", bytes.NewReader(reqJson))
+		r.Header.Set("Mattermost-User-ID", td.Worker1Id)
 		someBooksInDB = resetSomeBooksInDB()
 		resetMockChannels(mockChannels)
 		// mockChannels = initMockChannel()
@@ -774,6 +796,7 @@ func TestBooks(t *testing.T) {
 
 			w := httptest.NewRecorder()
 			r := httptest.NewRequest("POST", "/books", bytes.NewReader(reqJson))
+			r.Header.Set("Mattermost-User-ID", td.Worker1Id)
 
 			//check result
 			// mockChannels = initMockChannel()
@@ -808,6 +831,8 @@ func TestBooks(t *testing.T) {
 		//don't update isAllowedToBorrow when updating
 		theseBooksUpl[0].BookPublic.IsAllowedToBorrow = false
 		theseBooksUpl[0].BookPrivate.KeeperUsers = []string{td.ABook.KeeperUsers[1]}
+		//every copy should be kept by one of the keeper users
+		theseBooksUpl[0].BookPrivate.CopyKeeperMap = keptBy(theseBooksUpl[0].BookPrivate.CopyKeeperMap, td.ABook.KeeperUsers[1])
 		theseBooksUpl[0].BookInventory.Stock = 8
 		theseBooksUpl[0].BookInventory.Copies["zzh-book-001 b8"] = BookCopy{Status: COPY_STATUS_INSTOCK}
 
@@ -815,6 +840,7 @@ func TestBooks(t *testing.T) {
 		//don't update isAllowedToBorrow when updating
 		theseBooksUpl[1].BookPublic.IsAllowedToBorrow = false
 		theseBooksUpl[1].BookPrivate.KeeperUsers = []string{td.ABook.KeeperUsers[0]}
+		theseBooksUpl[1].BookPrivate.CopyKeeperMap = keptBy(theseBooksUpl[1].BookPrivate.CopyKeeperMap, td.ABook.KeeperUsers[0])
 		theseBooksUpl[1].BookInventory.Stock = 6
 		delete(theseBooksUpl[1].Copies, "zzh-book-002 b7")
 		delete(theseBooksUpl[1].Copies, "zzh-book-002 b8")
@@ -823,8 +849,10 @@ func TestBooks(t *testing.T) {
 
 		var expectBooks Books
 		DeepCopy(&expectBooks, &someBooksInDB)
+		stampSchemaVersion(expectBooks)
 		expectBooks[0].BookPublic.Author = "new Author"
 		expectBooks[0].BookPrivate.KeeperUsers = []string{td.ABook.KeeperUsers[1]}
+		expectBooks[0].BookPrivate.CopyKeeperMap = keptBy(expectBooks[0].BookPrivate.CopyKeeperMap, td.ABook.KeeperUsers[1])
 		expectBooks[0].BookPrivate.KeeperInfos = KeeperInfoMap{
 			td.ABook.KeeperUsers[1]: td.ABook.KeeperInfos[td.ABook.KeeperUsers[1]],
 		}
@@ -845,6 +873,7 @@ func TestBooks(t *testing.T) {
 
 		expectBooks[1].BookPublic.Author = "new Author 2"
 		expectBooks[1].BookPrivate.KeeperUsers = []string{td.ABook.KeeperUsers[0]}
+		expectBooks[1].BookPrivate.CopyKeeperMap = keptBy(expectBooks[1].BookPrivate.CopyKeeperMap, td.ABook.KeeperUsers[0])
 		expectBooks[1].BookPrivate.KeeperInfos = KeeperInfoMap{
 			td.ABook.KeeperUsers[0]: td.ABook.KeeperInfos[td.ABook.KeeperUsers[0]],
 		}
@@ -904,6 +933,7 @@ func TestBooks(t *testing.T) {
 
 			w := httptest.NewRecorder()
 			r := httptest.NewRequest("POST", "/books", bytes.NewReader(reqJson))
+			r.Header.Set("Mattermost-User-ID", td.Worker1Id)
 
 			someBooksInDB[0].BookPublic.IsAllowedToBorrow = false
 			someBooksInDB[1].BookPublic.IsAllowedToBorrow = true
@@ -991,6 +1021,7 @@ func TestBooks(t *testing.T) {
 
 		var expectBooks Books
 		DeepCopy(&expectBooks, &someBooksInDB)
+		stampSchemaVersion(expectBooks)
 		expectBooks[0].BookPublic.IsAllowedToBorrow = false
 		expectBooks[0].BookPublic.ManuallyDisallowed = true
 		expectBooks[1].BookPublic.IsAllowedToBorrow = true
@@ -1008,6 +1039,7 @@ func TestBooks(t *testing.T) {
 
 		w := httptest.NewRecorder()
 		r := httptest.NewRequest("POST", "/books", bytes.NewReader(reqJson))
+		r.Header.Set("Mattermost-User-ID", td.Worker1Id)
 
 		errctrls = initErrControl()
 
@@ -1074,6 +1106,7 @@ func TestBooks(t *testing.T) {
 
 		w := httptest.NewRecorder()
 		r := httptest.NewRequest("POST", "/books", bytes.NewReader(reqJson))
+		r.Header.Set("Mattermost-User-ID", td.Worker1Id)
 
 		plugin.ServeHTTP(nil, w, r)
 
@@ -1128,6 +1161,7 @@ func TestBooks(t *testing.T) {
 		go func() {
 			w := httptest.NewRecorder()
 			r := httptest.NewRequest("POST", "/books", bytes.NewReader(reqJson))
+			r.Header.Set("Mattermost-User-ID", td.Worker1Id)
 			plugin.ServeHTTP(nil, w, r)
 			// validate messages
 			_checkBookMessageResult(t, w, false, map[string]BooksMessage{
@@ -1143,6 +1177,7 @@ func TestBooks(t *testing.T) {
 			<-block1
 			w := httptest.NewRecorder()
 			r := httptest.NewRequest("POST", "/books", bytes.NewReader(reqJson))
+			r.Header.Set("Mattermost-User-ID", td.Worker1Id)
 			plugin.ServeHTTP(nil, w, r)
 
 			// validate messages
@@ -1231,6 +1266,7 @@ func TestBooks(t *testing.T) {
 		theseBooksUpl = Books{theseBooksUpl[0]}
 		theseBooksUpl[0].BookPublic.Author = "new Author"
 		theseBooksUpl[0].BookPrivate.KeeperUsers = []string{td.ABook.KeeperUsers[1]}
+		theseBooksUpl[0].BookPrivate.CopyKeeperMap = keptBy(theseBooksUpl[0].BookPrivate.CopyKeeperMap, td.ABook.KeeperUsers[1])
 		theseBooksUpl[0].BookInventory.Stock = 10
 		theseBooksUpl[0].Upload = &Upload{
 			Post_id: booksPids[0]["pub_id"],
@@ -1296,6 +1332,7 @@ func TestBooks(t *testing.T) {
 
 			w := httptest.NewRecorder()
 			r := httptest.NewRequest("POST", "/books", bytes.NewReader(reqJson))
+			r.Header.Set("Mattermost-User-ID", td.Worker1Id)
 
 			errctrls = []errControls{test.erc}
 			plugin.ServeHTTP(nil, w, r)
@@ -1383,6 +1420,7 @@ func TestBooks(t *testing.T) {
 
 		var expectBooks Books
 		DeepCopy(&expectBooks, &someBooksInDB)
+		stampSchemaVersion(expectBooks)
 		expectBooks[0].BookPublic.IsAllowedToBorrow = true
 		expectBooks[0].BookPublic.ManuallyDisallowed = false
 		expectBooks[0].BookInventory.Stock = 1
@@ -1413,6 +1451,7 @@ func TestBooks(t *testing.T) {
 
 		w := httptest.NewRecorder()
 		r := httptest.NewRequest("POST", "/books", bytes.NewReader(reqJson))
+		r.Header.Set("Mattermost-User-ID", td.Worker1Id)
 
 		plugin.ServeHTTP(nil, w, r)
 
@@ -1461,6 +1500,7 @@ func TestBooks(t *testing.T) {
 
 		w := httptest.NewRecorder()
 		r := httptest.NewRequest("POST", "/books", bytes.NewReader(reqJson))
+		r.Header.Set("Mattermost-User-ID", td.Worker1Id)
 
 		plugin.ServeHTTP(nil, w, r)
 
@@ -1510,6 +1550,7 @@ func TestBooks(t *testing.T) {
 		reqJson, _ := json.Marshal(req)
 		w := httptest.NewRecorder()
 		r := httptest.NewRequest("POST", "/books", bytes.NewReader(reqJson))
+		r.Header.Set("Mattermost-User-ID", td.Worker1Id)
 		plugin.ServeHTTP(nil, w, r)
 
 		// Validation
@@ -1558,6 +1599,7 @@ func TestBooks(t *testing.T) {
 		reqJson, _ := json.Marshal(req)
 		w := httptest.NewRecorder()
 		r := httptest.NewRequest("POST", "/books", bytes.NewReader(reqJson))
+		r.Header.Set("Mattermost-User-ID", td.Worker1Id)
 		plugin.ServeHTTP(nil, w, r)
 
 		// Validation
@@ -1658,6 +1700,7 @@ func TestBooks(t *testing.T) {
 
 			w := httptest.NewRecorder()
 			r := httptest.NewRequest("POST", "/books", bytes.NewReader(reqJson))
+			r.Header.Set("Mattermost-User-ID", td.Worker1Id)
 
 			//check result
 			resetMockChannels(mockChannels)
@@ -1732,9 +1775,9 @@ func TestBooks(t *testing.T) {
 			Body:    key,
 		}, false, map[string]BooksMessage{
 			"zzh-book-001": {
-				booksPids[0]["pub_id"],
-				BOOK_ACTION_SUCC,
-				string(result),
+				PostId:  booksPids[0]["pub_id"],
+				Status:  BOOK_ACTION_SUCC,
+				Message: string(result),
 			},
 		})
 	})
@@ -1761,9 +1804,9 @@ func TestBooks(t *testing.T) {
 			Body:    key,
 		}, false, map[string]BooksMessage{
 			"zzh-book-001": {
-				booksPids[0]["pub_id"],
-				BOOK_ACTION_SUCC,
-				string(result),
+				PostId:  booksPids[0]["pub_id"],
+				Status:  BOOK_ACTION_SUCC,
+				Message: string(result),
 			},
 		})
 	})
@@ -1802,9 +1845,9 @@ func TestBooks(t *testing.T) {
 			Body:    key,
 		}, false, map[string]BooksMessage{
 			"zzh-book-001": {
-				booksPids[0]["pub_id"],
-				BOOK_ACTION_SUCC,
-				string(result),
+				PostId:  booksPids[0]["pub_id"],
+				Status:  BOOK_ACTION_SUCC,
+				Message: string(result),
 			},
 		})
 	})
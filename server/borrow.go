@@ -27,88 +27,84 @@ func (p *Plugin) handleBorrowRequest(c *plugin.Context, w http.ResponseWriter, r
 	err := json.NewDecoder(r.Body).Decode(&borrowRequestKey)
 	if err != nil {
 		p.API.LogError("Failed to convert from borrow request.", "err", fmt.Sprintf("%+v", err))
-		resp, _ := json.Marshal(Result{
-			Error: "Failed to convert from borrow request.",
-		})
+		resp, _ := json.Marshal(p._errorResult(ErrInvalidRequest, "Failed to convert from borrow request."))
 
 		w.Write(resp)
 		return
 
 	}
 
-	bookInfo, err := p._lockAndGetABook(borrowRequestKey.BookPostId)
+	_, warnings, err := p._borrowABook(r.Header.Get("Mattermost-User-ID"), borrowRequestKey, otherData)
 	if err != nil {
-		defer lockmap.Delete(borrowRequestKey.BookPostId)
-		p.API.LogError("Failed to lock or get a book.", "err", fmt.Sprintf("%+v", err))
-		var errorMessage string
-		if errors.Is(err, ErrLocked) || errors.Is(err, ErrStale) {
-			errorMessage = p.i18n.GetText("system-busy")
-		} else {
-			errorMessage = p.i18n.GetText("failed-to-get-book")
-		}
-		resp, _ := json.Marshal(Result{
-			Error: errorMessage,
-		})
+		p.API.LogError("Failed to borrow a book.", "err", fmt.Sprintf("%+v", err))
+		resp, _ := json.Marshal(p._errorResult(err, p._borrowErrorText(err)))
 
 		w.Write(resp)
 		return
+	}
+
+	resp, _ := json.Marshal(Result{
+		Error:    "",
+		Warnings: warnings,
+	})
+
+	w.Write(resp)
 
+}
+
+func (p *Plugin) _borrowErrorText(err error) string {
+	if errors.Is(err, ErrNotFound) {
+		return p.i18n.GetText("failed-to-get-book")
 	}
-	defer lockmap.Delete(borrowRequestKey.BookPostId)
+	return p._errorText(err, "borrow-failed")
+}
 
-	if err := p._checkConditions(borrowRequestKey, bookInfo); err != nil {
-
-		var resp []byte
-
-		switch {
-		case errors.Is(err, ErrBorrowingLimited):
-			resp, _ = json.Marshal(Result{
-				Error: p.i18n.GetText(err.Error()),
-			})
-		case errors.Is(err, ErrNoStock):
-			resp, _ = json.Marshal(Result{
-				Error: p.i18n.GetText(err.Error()),
-			})
-		default:
-			p.API.LogError("Failed to call check conditons.", "err", fmt.Sprintf("%+v", err))
-			resp, _ = json.Marshal(Result{
-				Error: "Failed to call check conditons",
-			})
-		}
+// Post a master record to the borrow channel, and a record to each role by the bot.
+// All posted records are rolled back if any of them fails.
+// The warnings of the rules let the borrow through are returned with the master key.
+func (p *Plugin) _borrowABook(userId string, borrowRequestKey *BorrowRequestKey, otherData otherRequestData) (string, []EligibilityVerdict, error) {
 
-		w.Write(resp)
-		return
+	if err := p._checkBorrowPermission(userId, borrowRequestKey.BorrowerUser); err != nil {
+		return "", nil, err
+	}
+
+	bookInfo, err := p._lockAndGetABook(borrowRequestKey.BookPostId)
+	if errors.Is(err, ErrLocked) {
+		return "", nil, err
+	}
+	defer lockmap.Delete(borrowRequestKey.BookPostId)
+	if err != nil {
+		return "", nil, err
+	}
+
+	warnings, err := p._checkConditions(borrowRequestKey, bookInfo)
+	if err != nil {
+		return "", nil, err
 	}
 
 	//make borrow request from key
 	borrowRequestMaster, err := p._makeBorrowRequest(borrowRequestKey, borrowRequestKey.BorrowerUser, []string{MASTER}, nil,
 		otherData)
 	if err != nil {
-		p.API.LogError("Failed to make borrow request.", "err", fmt.Sprintf("%+v", err), "role", MASTER)
-		resp, _ := json.Marshal(Result{
-			Error: "Failed to make borrow request.",
-		})
-
-		w.Write(resp)
-		return
-
+		return "", nil, errors.Wrapf(err, "Failed to make borrow request. role:%v", MASTER)
 	}
 
 	// start a simple transaction
 	// created save all the posted post, to be able to rollback
 	created := []*model.Post{}
 
+	rollback := func(err error) error {
+		if rbErr := p._rollBackCreated(created); rbErr != nil {
+			p.API.LogError("Fatal Error: rollback error.", "err", fmt.Sprintf("%+v", rbErr))
+			return errors.Wrapf(err, "Fatal Error: rollback error: %v", rbErr)
+		}
+		return err
+	}
+
 	//post a masterPost
 	mb, mp, err := p._makeAndSendBorrowRequest("", p.borrowChannel.Id, []string{MASTER}, borrowRequestMaster)
 	if err != nil {
-		p.API.LogError("Failed to post.", "role", MASTER, "err", fmt.Sprintf("%+v", err))
-		resp, _ := json.Marshal(Result{
-			Error: "Failed to post a master record.",
-		})
-
-		w.Write(resp)
-		return
-
+		return "", nil, errors.Wrapf(err, "Failed to post a master record.")
 	}
 	created = append(created, mp)
 
@@ -125,30 +121,11 @@ func (p *Plugin) handleBorrowRequest(c *plugin.Context, w http.ResponseWriter, r
 		borrowRequest, err := p._makeBorrowRequest(borrowRequestKey, borrowRequestKey.BorrowerUser, roles, borrowRequestMaster,
 			otherData)
 		if err != nil {
-			p.API.LogError("Failed to make borrow request.", "err", fmt.Sprintf("%+v", err), "roles", strings.Join(roles, ","))
-			resp, _ := json.Marshal(Result{
-				Error: "Failed to make borrow request.",
-			})
-
-			w.Write(resp)
-			return
-
+			return "", nil, rollback(errors.Wrapf(err, "Failed to make borrow request. roles:%v", strings.Join(roles, ",")))
 		}
 		bb, bp, err := p._makeAndSendBorrowRequest(user, "", roles, borrowRequest)
 		if err != nil {
-			p.API.LogError("Failed to post.", "roles", strings.Join(roles, ","), "user", user, "err", fmt.Sprintf("%+v", err))
-			resp, _ := json.Marshal(Result{
-				Error: fmt.Sprintf("Failed to post to role: %v, user: %v.", strings.Join(roles, ","), user),
-			})
-			if err := p._rollBackCreated(created); err != nil {
-				p.API.LogError("Fatal Error: Failed to post and rollback error.", "roles", strings.Join(roles, ","), "user", user, "err", fmt.Sprintf("%+v", err))
-				resp, _ = json.Marshal(Result{
-					Error: fmt.Sprintf("Fatal Error: Failed to post to role: %v, user: %v and rollback error.", strings.Join(roles, ","), user),
-				})
-			}
-			w.Write(resp)
-			return
-
+			return "", nil, rollback(errors.Wrapf(err, "Failed to post to role: %v, user: %v.", strings.Join(roles, ","), user))
 		}
 		created = append(created, bp)
 
@@ -177,19 +154,7 @@ func (p *Plugin) handleBorrowRequest(c *plugin.Context, w http.ResponseWriter, r
 		Keepers:   kpIds,
 	}, mb)
 	if err != nil {
-		p.API.LogError("Failed to update master record's relationships.", "role", MASTER, "err", fmt.Sprintf("%+v", err))
-		resp, _ := json.Marshal(Result{
-			Error: "Failed to update master record's relationships.",
-		})
-		if err := p._rollBackCreated(created); err != nil {
-			p.API.LogError("Fatal Error: Failed to update master record's relationships. and rollback error", "role", MASTER, "err", fmt.Sprintf("%+v", err))
-			resp, _ = json.Marshal(Result{
-				Error: "Fatal Error: Failed to update master record's relationships, and rollback error",
-			})
-		}
-		w.Write(resp)
-		return
-
+		return "", nil, rollback(errors.Wrapf(err, "Failed to update master record's relationships."))
 	}
 
 	for user, post := range postByUser {
@@ -199,29 +164,13 @@ func (p *Plugin) handleBorrowRequest(c *plugin.Context, w http.ResponseWriter, r
 			Master: mp.Id,
 		}, borrowByUser[user])
 		if err != nil {
-			p.API.LogError("Failed to update relationships.",
-				"role", strings.Join(roleByUser[user], ","), "user", user, "err", fmt.Sprintf("%+v", err))
-			resp, _ := json.Marshal(Result{
-				Error: "Failed to update relationships.",
-			})
-			if err := p._rollBackCreated(created); err != nil {
-				p.API.LogError("Fatal Error: Failed to update relationships and rollback error.",
-					"role", strings.Join(roleByUser[user], ","), "user", user, "err", fmt.Sprintf("%+v", err))
-				resp, _ = json.Marshal(Result{
-					Error: "Fatal Error: Failed to update relationships and rollback error.",
-				})
-			}
-			w.Write(resp)
-			return
+			return "", nil, rollback(errors.Wrapf(err, "Failed to update relationships. roles:%v, user:%v",
+				strings.Join(roleByUser[user], ","), user))
 		}
 	}
 
-	resp, _ := json.Marshal(Result{
-		Error: "",
-	})
-
-	w.Write(resp)
-
+	p._emitBorrowCreated(userId, mp.Id, mb.DataOrImage, bookInfo.book.BookPublic)
+	return mp.Id, warnings, nil
 }
 
 func (p *Plugin) _getRoleByUser(borrowRequestMaster *BorrowRequest) map[string][]string {
@@ -270,17 +219,15 @@ func (p *Plugin) _makeAndSendBorrowRequest(user string, channelId string, role [
 		channelId = directChannel.Id
 	}
 
-	var post *model.Post
-	var appErr *model.AppError
-
-	if post, appErr = p.API.CreatePost(&model.Post{
+	post, err := p._repo().Create(&model.Post{
 		UserId:    p.botID,
 		ChannelId: channelId,
 		// Message:   string(borrow_data_bytes),
 		Message: "",
 		Type:    "custom_borrow_type",
-	}); appErr != nil {
-		return nil, nil, errors.Wrapf(appErr, "Failed to post a borrow record. role: %v, user: %v", role, user)
+	})
+	if err != nil {
+		return nil, nil, errors.Wrapf(err, "Failed to post a borrow record. role: %v, user: %v", role, user)
 	}
 
 	return &borrow, post, nil
@@ -288,8 +235,8 @@ func (p *Plugin) _makeAndSendBorrowRequest(user string, channelId string, role [
 
 func (p *Plugin) _rollBackCreated(posts []*model.Post) error {
 	for _, post := range posts {
-		if appErr := p.API.DeletePost(post.Id); appErr != nil {
-			return appErr
+		if err := p._repo().Delete(post.Id); err != nil {
+			return err
 		}
 	}
 
@@ -300,14 +247,14 @@ func (p *Plugin) _updateRelations(post *model.Post, relations RelationKeys, borr
 
 	borrow.RelationKeys = relations
 
-	borrow_data_bytes, err := json.MarshalIndent(borrow, "", "  ")
+	borrow_data_bytes, err := _marshalRecord(borrow)
 	if err != nil {
 		return errors.Wrapf(err, "Failed to convert to a borrow record. role: %v", borrow.Role)
 	}
 
 	post.Message = string(borrow_data_bytes)
 
-	if _, err := p.API.UpdatePost(post); err != nil {
+	if _, err := p._repo().Update(post); err != nil {
 		return errors.Wrapf(err, "Failed to update a borrow record. role: %v", borrow.Role)
 	}
 
@@ -390,6 +337,7 @@ func (p *Plugin) _makeBorrowRequest(bqk *BorrowRequestKey, borrowerUser string,
 	}
 
 	bq.Worflow = p._createWFTemplate(otherData.processTime)
+	p._applyWorkflowActors(bq.Worflow)
 	p._setStatusTag(STATUS_REQUESTED, bq)
 
 	if masterBr != nil && masterBr.ChosenCopyId != "" {
@@ -578,76 +526,6 @@ func (p *Plugin) _createWFTemplate(prt int64) []Step {
 
 }
 
-func (p *Plugin) _checkConditions(brk *BorrowRequestKey, bookInfo *bookInfo) error {
-
-	book := bookInfo.book
-	//check if stock is sufficent.
-	if book.BookInventory.Stock <= 0 {
-
-		if book.BookPublic.IsAllowedToBorrow {
-			book.BookPublic.IsAllowedToBorrow = false
-			book.BookPublic.ReasonOfDisallowed = p.i18n.GetText("no-stock")
-
-			if err := p._updateBookParts(updateOptions{
-				pub:     book.BookPublic,
-				pubPost: bookInfo.pubPost,
-			}); err != nil {
-				return errors.New("update pub error.")
-			}
-		}
-
-		return ErrNoStock
-
-	}
-
-	//check if max borrowing concurrent limit is obeyed
-	posts, err := p.API.SearchPostsInTeam(p.team.Id, []*model.SearchParams{
-		{
-			Terms:     TAG_PREFIX_BORROWER + brk.BorrowerUser,
-			IsHashtag: true,
-			InChannels: []string{
-				p.borrowChannel.Name,
-			},
-		},
-	})
-
-	if err != nil {
-		return errors.Wrapf(err, "search posts error.")
-	}
-
-	count := 0
-
-	for _, post := range posts {
-		if post.Type != "custom_borrow_type" {
-			continue
-		}
-		var br Borrow
-		json.Unmarshal([]byte(post.Message), &br)
-
-		//even not very possible, this makes the result safe
-		if br.DataOrImage.BorrowerUser != brk.BorrowerUser {
-			continue
-		}
-
-		status := br.DataOrImage.Worflow[br.DataOrImage.StepIndex].Status
-
-		switch {
-		case status == STATUS_RETURN_CONFIRMED ||
-			status == STATUS_RETURNED:
-		default:
-			count++
-		}
-
-	}
-
-	if count >= p.borrowTimes {
-		return ErrBorrowingLimited
-	}
-
-	return nil
-}
-
-
 func (p *Plugin) _lockAndGetABook(id string) (*bookInfo, error) {
 
 	//lock pub part only
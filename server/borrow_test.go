@@ -284,6 +284,7 @@ func TestBorrowHandle(t *testing.T) {
 			assert.NotEmpty(t, updatedBr.DataOrImage.MatchId)
 
 			borrowExp.DataOrImage.MatchId = updatedBr.DataOrImage.MatchId
+			borrowExp.SchemaVersion = SCHEMA_VERSION
 
 			borrowExpJson, _ = json.MarshalIndent(borrowExp, "", "  ")
 			expPost = &model.Post{
@@ -448,6 +449,7 @@ func TestBorrowHandle(t *testing.T) {
 
 			w := httptest.NewRecorder()
 			r := httptest.NewRequest("POST", "/borrow", bytes.NewReader(reqKeyJson))
+			r.Header.Set("Mattermost-User-ID", td.BorId)
 			plugin.ServeHTTP(nil, w, r)
 
 			result := w.Result()
@@ -586,7 +588,8 @@ func TestBorrowHandle(t *testing.T) {
 			thisBookJson, _ := json.Marshal(thisBook)
 
 			api.On("GetPost", thisBookPostId).Return(&model.Post{
-				Message: string(thisBookJson),
+				ChannelId: td.BookChIdPub,
+				Message:   string(thisBookJson),
 			}, nil)
 
 			api.On("CreatePost", mock.MatchedBy(matchPost(test.borId_botId))).
@@ -613,6 +616,7 @@ func TestBorrowHandle(t *testing.T) {
 
 			w := httptest.NewRecorder()
 			r := httptest.NewRequest("POST", "/borrow", bytes.NewReader(reqKeyJson))
+			r.Header.Set("Mattermost-User-ID", td.UserIdOf(test.borrower))
 			plugin.ServeHTTP(nil, w, r)
 
 			assert.Equalf(t, 1, len(realbrPosts[test.borId_botId]), "post to borrower: %v should be 1 time", test.borrower)
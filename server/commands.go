@@ -9,10 +9,12 @@ import (
 	"net/http/httptest"
 	"os"
 	"path/filepath"
+	"sort"
 	"strconv"
 
 	// "strconv"
 	"strings"
+	"time"
 
 	"github.com/mattermost/mattermost-server/v5/model"
 	"github.com/mattermost/mattermost-server/v5/plugin"
@@ -22,6 +24,19 @@ import (
 const (
 	commandPostTestBook   = "post_test_book"
 	commandPostTestBorrow = "post_test_borrow"
+	commandExportBooks    = "export_books"
+	commandLibraryRoles   = "library_roles"
+	commandMigrations     = "library_migrations"
+	commandBackup         = "library_backup"
+	commandStats          = "library_stats"
+	commandReview         = "library_review"
+	commandRecommend      = "library_recommend"
+	commandPurchase       = "library_purchase"
+	commandDonate         = "library_donate"
+	commandICal           = "library_ical"
+	commandWebhook        = "library_webhook"
+	commandToken          = "library_token"
+	commandPenalty        = "library_penalty"
 )
 
 func (p *Plugin) registerCommands() error {
@@ -41,16 +56,179 @@ func (p *Plugin) registerCommands() error {
 	}); err != nil {
 		return errors.Wrapf(err, "failed to register %s command", commandPostTestBook)
 	}
+
+	if err := p.API.RegisterCommand(&model.Command{
+		Trigger:          commandExportBooks,
+		AutoComplete:     true,
+		AutoCompleteDesc: "Export books. Format: json(default), csv or xlsx.",
+		AutoCompleteHint: "[json|csv|xlsx] [--library <id>]",
+	}); err != nil {
+		return errors.Wrapf(err, "failed to register %s command", commandExportBooks)
+	}
+
+	if err := p.API.RegisterCommand(&model.Command{
+		Trigger:          commandLibraryRoles,
+		AutoComplete:     true,
+		AutoCompleteDesc: "Manage library roles: " + strings.Join(allRoles, ", ") + ".",
+		AutoCompleteHint: "[list [username]|add|remove|set <username> <role>...] [--library <id>]",
+	}); err != nil {
+		return errors.Wrapf(err, "failed to register %s command", commandLibraryRoles)
+	}
+
+	if err := p.API.RegisterCommand(&model.Command{
+		Trigger:          commandMigrations,
+		AutoComplete:     true,
+		AutoCompleteDesc: "Show migrations of the stored data, or run them again.",
+		AutoCompleteHint: "[status|run]",
+	}); err != nil {
+		return errors.Wrapf(err, "failed to register %s command", commandMigrations)
+	}
+
+	if err := p.API.RegisterCommand(&model.Command{
+		Trigger:          commandBackup,
+		AutoComplete:     true,
+		AutoCompleteDesc: "Back up the library to an archive sent by bot, or restore an uploaded archive to an empty library.",
+		AutoCompleteHint: "[restore <file_id>] [--library <id>]",
+	}); err != nil {
+		return errors.Wrapf(err, "failed to register %s command", commandBackup)
+	}
+
+	if err := p.API.RegisterCommand(&model.Command{
+		Trigger:          commandStats,
+		AutoComplete:     true,
+		AutoCompleteDesc: "Show statistics of the borrows requested in a date range, the current month by default.",
+		AutoCompleteHint: "[<from YYYY-MM-DD> [<to YYYY-MM-DD>]] [--library <id>]",
+	}); err != nil {
+		return errors.Wrapf(err, "failed to register %s command", commandStats)
+	}
+
+	if err := p.API.RegisterCommand(&model.Command{
+		Trigger:          commandReview,
+		AutoComplete:     true,
+		AutoCompleteDesc: "Show the reviews of a book, or rate a book you have returned with a short review.",
+		AutoCompleteHint: "<book_post_id> [<rating 1-5> [review]] [--library <id>]",
+	}); err != nil {
+		return errors.Wrapf(err, "failed to register %s command", commandReview)
+	}
+
+	if err := p.API.RegisterCommand(&model.Command{
+		Trigger:          commandRecommend,
+		AutoComplete:     true,
+		AutoCompleteDesc: "Suggest books for you, or the books also borrowed by the readers of a book.",
+		AutoCompleteHint: "[<book_post_id>|rebuild] [--library <id>]",
+	}); err != nil {
+		return errors.Wrapf(err, "failed to register %s command", commandRecommend)
+	}
+
+	if err := p.API.RegisterCommand(&model.Command{
+		Trigger:          commandPurchase,
+		AutoComplete:     true,
+		AutoCompleteDesc: "Propose a book for the library to buy, vote for a proposal, or manage the purchases by admin.",
+		AutoCompleteHint: "[list [status]|propose <book name> [isbn]|vote|withdraw <id>|approve|decline|order <id>|receive <id> <book_id> <keeper> [copies]] [--library <id>]",
+	}); err != nil {
+		return errors.Wrapf(err, "failed to register %s command", commandPurchase)
+	}
+
+	if err := p.API.RegisterCommand(&model.Command{
+		Trigger:          commandDonate,
+		AutoComplete:     true,
+		AutoCompleteDesc: "Offer copies of a book to keep or to give to the library, or review the offers by libworker.",
+		AutoCompleteHint: "[list [status]|offer <keep|give> <copies> <book name> [isbn]|withdraw <id>|accept <id> [<book_id> [<keeper>]]|reject <id>] [--library <id>]",
+	}); err != nil {
+		return errors.Wrapf(err, "failed to register %s command", commandDonate)
+	}
+
+	if err := p.API.RegisterCommand(&model.Command{
+		Trigger:          commandICal,
+		AutoComplete:     true,
+		AutoCompleteDesc: "Show the calendar feeds of your due dates and expected returns, or reset them.",
+		AutoCompleteHint: "[reset] [--library <id>]",
+	}); err != nil {
+		return errors.Wrapf(err, "failed to register %s command", commandICal)
+	}
+
+	if err := p.API.RegisterCommand(&model.Command{
+		Trigger:          commandWebhook,
+		AutoComplete:     true,
+		AutoCompleteDesc: "Manage the webhooks notified of library events, by library admin.",
+		AutoCompleteHint: "[list|add <url> [event...]|remove <id>|log] [--library <id>]",
+	}); err != nil {
+		return errors.Wrapf(err, "failed to register %s command", commandWebhook)
+	}
+
+	if err := p.API.RegisterCommand(&model.Command{
+		Trigger:          commandToken,
+		AutoComplete:     true,
+		AutoCompleteDesc: "Manage the api tokens of the kiosks, by library admin.",
+		AutoCompleteHint: "[list|issue <name> <scope...>|revoke <id>] [--library <id>]",
+	}); err != nil {
+		return errors.Wrapf(err, "failed to register %s command", commandToken)
+	}
+
+	if err := p.API.RegisterCommand(&model.Command{
+		Trigger:          commandPenalty,
+		AutoComplete:     true,
+		AutoCompleteDesc: "Manage the penalties and suspensions of borrowers, by library admin.",
+		AutoCompleteHint: "[list|lost <user>|lift <user>] [--library <id>]",
+	}); err != nil {
+		return errors.Wrapf(err, "failed to register %s command", commandPenalty)
+	}
 	return nil
 }
 
+// Every command works on the default library unless --library <id> is given.
 func (p *Plugin) ExecuteCommand(c *plugin.Context, args *model.CommandArgs) (*model.CommandResponse, *model.AppError) {
-	trigger := strings.TrimPrefix(strings.Fields(args.Command)[0], "/")
+	libId, command, err := _splitLibraryArg(args.Command)
+	if err != nil {
+		return &model.CommandResponse{
+			ResponseType: model.COMMAND_RESPONSE_TYPE_EPHEMERAL,
+			Text:         p._errorText(err, "internal-error"),
+		}, nil
+	}
+
+	lp, err := p._withLibrary(libId)
+	if err != nil {
+		return &model.CommandResponse{
+			ResponseType: model.COMMAND_RESPONSE_TYPE_EPHEMERAL,
+			Text:         p.i18n.GetText("library-not-found"),
+		}, nil
+	}
+
+	libArgs := *args
+	libArgs.Command = command
+
+	trigger := strings.TrimPrefix(strings.Fields(command)[0], "/")
 	switch trigger {
 	case commandPostTestBook:
-		return p.executePostBook(args), nil
+		return lp.executePostBook(&libArgs), nil
 	case commandPostTestBorrow:
-		return p.executePostBorrow(args), nil
+		return lp.executePostBorrow(&libArgs), nil
+	case commandExportBooks:
+		return lp.executeExportBooks(&libArgs), nil
+	case commandLibraryRoles:
+		return lp.executeLibraryRoles(&libArgs), nil
+	case commandMigrations:
+		return lp.executeMigrations(&libArgs), nil
+	case commandBackup:
+		return lp.executeBackup(&libArgs), nil
+	case commandStats:
+		return lp.executeStats(&libArgs), nil
+	case commandReview:
+		return lp.executeReview(&libArgs), nil
+	case commandRecommend:
+		return lp.executeRecommend(&libArgs), nil
+	case commandPurchase:
+		return lp.executePurchase(&libArgs), nil
+	case commandDonate:
+		return lp.executeDonate(&libArgs), nil
+	case commandICal:
+		return lp.executeICal(&libArgs), nil
+	case commandWebhook:
+		return lp.executeWebhook(&libArgs), nil
+	case commandToken:
+		return lp.executeToken(&libArgs), nil
+	case commandPenalty:
+		return lp.executePenalty(&libArgs), nil
 	default:
 		return &model.CommandResponse{
 			ResponseType: model.COMMAND_RESPONSE_TYPE_EPHEMERAL,
@@ -69,6 +247,13 @@ func (p *Plugin) executePostBook(args *model.CommandArgs) *model.CommandResponse
 		}
 	}
 
+	if err := p._checkRole(args.UserId, ROLE_CATALOG_EDITOR); err != nil {
+		return &model.CommandResponse{
+			ResponseType: model.COMMAND_RESPONSE_TYPE_EPHEMERAL,
+			Text:         p._permissionErrorText(err),
+		}
+	}
+
 	path := filepath.Join("plugins", PLUGIN_ID, "assets", argsarr[1])
 	booksJsonStr, err := ioutil.ReadFile(path)
 	if err != nil {
@@ -79,7 +264,7 @@ func (p *Plugin) executePostBook(args *model.CommandArgs) *model.CommandResponse
 		}
 	}
 
-	messages, err := p._uploadBooks(string(booksJsonStr))
+	messages, err := p._uploadBooks(string(booksJsonStr), uploadOptions{})
 	if err != nil {
 		// p.API.LogError("Failded uplolad.", "json", brqJson)
 		return &model.CommandResponse{
@@ -105,6 +290,13 @@ func (p *Plugin) executePostBorrow(args *model.CommandArgs) *model.CommandRespon
 		}
 	}
 
+	if err := p._checkRole(args.UserId, ROLE_LIBRARY_ADMIN); err != nil {
+		return &model.CommandResponse{
+			ResponseType: model.COMMAND_RESPONSE_TYPE_EPHEMERAL,
+			Text:         p._permissionErrorText(err),
+		}
+	}
+
 	count, _ := strconv.Atoi(argsarr[1])
 
 	userName := argsarr[2]
@@ -118,6 +310,7 @@ func (p *Plugin) executePostBorrow(args *model.CommandArgs) *model.CommandRespon
 	for i := 0; i < count; i++ {
 		w := httptest.NewRecorder()
 		r, _ := http.NewRequest("POST", "/borrow", bytes.NewReader([]byte(borReq)))
+		r.Header.Set("Mattermost-User-ID", args.UserId)
 		p.ServeHTTP(nil, w, r)
 
 		res := new(Result)
@@ -137,3 +330,760 @@ func (p *Plugin) executePostBorrow(args *model.CommandArgs) *model.CommandRespon
 	}
 
 }
+
+func (p *Plugin) executeExportBooks(args *model.CommandArgs) *model.CommandResponse {
+	argsarr := strings.Fields(args.Command)
+
+	format := EXPORT_FORMAT_JSON
+	if len(argsarr) > 1 {
+		format = argsarr[1]
+	}
+
+	file, err := p._exportBooksByUser(args.UserId, format)
+	if err != nil {
+		return &model.CommandResponse{
+			ResponseType: model.COMMAND_RESPONSE_TYPE_EPHEMERAL,
+			Text:         fmt.Sprintf("Failed to export books. err:%v", err),
+		}
+	}
+
+	if err := p._postExportFile(args.UserId, file); err != nil {
+		return &model.CommandResponse{
+			ResponseType: model.COMMAND_RESPONSE_TYPE_EPHEMERAL,
+			Text:         fmt.Sprintf("Failed to send exported file. err:%v", err),
+		}
+	}
+
+	return &model.CommandResponse{
+		ResponseType: model.COMMAND_RESPONSE_TYPE_EPHEMERAL,
+		Text:         fmt.Sprintf("Succ. File %v is sent by bot.", file.name),
+	}
+}
+
+func (p *Plugin) executeLibraryRoles(args *model.CommandArgs) *model.CommandResponse {
+	text, err := p._executeLibraryRoles(args.UserId, strings.Fields(args.Command)[1:])
+	if err != nil {
+		p.API.LogError("library roles command error.", "err", fmt.Sprintf("%+v", err))
+		switch {
+		case errors.Is(err, ErrNotPermitted), errors.Is(err, ErrInvalidRole):
+			text = p.i18n.GetText(errors.Cause(err).Error())
+		default:
+			text = fmt.Sprintf("Failed to manage roles. err:%v", err)
+		}
+	}
+
+	return &model.CommandResponse{
+		ResponseType: model.COMMAND_RESPONSE_TYPE_EPHEMERAL,
+		Text:         text,
+	}
+}
+
+func (p *Plugin) _executeLibraryRoles(userId string, argsarr []string) (string, error) {
+	if err := p._checkRole(userId, ROLE_LIBRARY_ADMIN); err != nil {
+		return "", err
+	}
+
+	usage := fmt.Sprintf("Usage: /%v list [username] | add|remove|set <username> <role>...", commandLibraryRoles)
+	if len(argsarr) == 0 {
+		return usage, nil
+	}
+
+	if argsarr[0] == "list" {
+		return p._listLibraryRoles(argsarr[1:])
+	}
+
+	if len(argsarr) < 2 {
+		return usage, nil
+	}
+
+	user, appErr := p.API.GetUserByUsername(argsarr[1])
+	if appErr != nil {
+		return "", errors.Wrapf(appErr, "get user %v error.", argsarr[1])
+	}
+	roles := argsarr[2:]
+
+	var newRoles []string
+	var err error
+	switch argsarr[0] {
+	case "add":
+		newRoles, err = p._grantRoles(user.Id, roles...)
+	case "remove":
+		newRoles, err = p._revokeRoles(user.Id, roles...)
+	case "set":
+		newRoles, err = p._setRoles(user.Id, roles...)
+	default:
+		return usage, nil
+	}
+	if err != nil {
+		return "", err
+	}
+
+	return p._formatUserRoles(argsarr[1], newRoles), nil
+}
+
+func (p *Plugin) _listLibraryRoles(usernames []string) (string, error) {
+	roles, _, err := p._loadRoles()
+	if err != nil {
+		return "", err
+	}
+
+	lines := []string{}
+	if len(usernames) > 0 {
+		for _, username := range usernames {
+			user, appErr := p.API.GetUserByUsername(username)
+			if appErr != nil {
+				return "", errors.Wrapf(appErr, "get user %v error.", username)
+			}
+			lines = append(lines, p._formatUserRoles(username, roles[user.Id]))
+		}
+		return strings.Join(lines, "\n"), nil
+	}
+
+	for id, userRoles := range roles {
+		user, appErr := p.API.GetUser(id)
+		if appErr != nil {
+			return "", errors.Wrapf(appErr, "get user %v error.", id)
+		}
+		lines = append(lines, p._formatUserRoles(user.Username, userRoles))
+	}
+	sort.Strings(lines)
+
+	return strings.Join(lines, "\n"), nil
+}
+
+func (p *Plugin) executeMigrations(args *model.CommandArgs) *model.CommandResponse {
+	text, err := p._executeMigrations(args.UserId, strings.Fields(args.Command)[1:])
+	if err != nil {
+		p.API.LogError("migrations command error.", "err", fmt.Sprintf("%+v", err))
+		text = p._errorText(err, "migration-failed")
+	}
+
+	return &model.CommandResponse{
+		ResponseType: model.COMMAND_RESPONSE_TYPE_EPHEMERAL,
+		Text:         text,
+	}
+}
+
+// Migrations are of the whole installation, an admin of any library can run them.
+func (p *Plugin) _executeMigrations(userId string, argsarr []string) (string, error) {
+	if err := p._checkRole(userId, ROLE_LIBRARY_ADMIN); err != nil {
+		return "", err
+	}
+
+	action := "status"
+	if len(argsarr) > 0 {
+		action = argsarr[0]
+	}
+
+	var state *MigrationState
+	var err error
+	switch action {
+	case "status":
+		state, err = p._loadMigrationState()
+	case "run":
+		state, err = p._runMigrations(true)
+	default:
+		return fmt.Sprintf("Usage: /%v [status|run]", commandMigrations), nil
+	}
+	if err != nil {
+		return "", err
+	}
+
+	return p._formatMigrations(state), nil
+}
+
+func (p *Plugin) executeBackup(args *model.CommandArgs) *model.CommandResponse {
+	text, err := p._executeBackup(args.UserId, strings.Fields(args.Command)[1:])
+	if err != nil {
+		p.API.LogError("backup command error.", "err", fmt.Sprintf("%+v", err))
+		text = p._errorText(err, "backup-failed")
+	}
+
+	return &model.CommandResponse{
+		ResponseType: model.COMMAND_RESPONSE_TYPE_EPHEMERAL,
+		Text:         text,
+	}
+}
+
+// The archive to restore is a file uploaded to Mattermost, e.g. the one sent by backup.
+func (p *Plugin) _executeBackup(userId string, argsarr []string) (string, error) {
+	if err := p._checkRole(userId, ROLE_LIBRARY_ADMIN); err != nil {
+		return "", err
+	}
+
+	if len(argsarr) == 0 {
+		file, err := p._backup()
+		if err != nil {
+			return "", err
+		}
+		if err := p._postExportFile(userId, file); err != nil {
+			return "", err
+		}
+		return fmt.Sprintf("Succ. File %v is sent by bot.", file.name), nil
+	}
+
+	if argsarr[0] != "restore" || len(argsarr) < 2 {
+		return fmt.Sprintf("Usage: /%v [restore <file_id>]", commandBackup), nil
+	}
+
+	data, appErr := p.API.GetFile(argsarr[1])
+	if appErr != nil {
+		return "", errors.Wrapf(appErr, "get file %v error.", argsarr[1])
+	}
+
+	messages, err := p._restore(data)
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("Succ. %v records and %v status changes are restored.", messages["records"], messages["audit"]), nil
+}
+
+func (p *Plugin) executeStats(args *model.CommandArgs) *model.CommandResponse {
+	text, err := p._executeStats(args.UserId, strings.Fields(args.Command)[1:])
+	if err != nil {
+		p.API.LogError("stats command error.", "err", fmt.Sprintf("%+v", err))
+		text = p._errorText(err, "stats-failed")
+	}
+
+	return &model.CommandResponse{
+		ResponseType: model.COMMAND_RESPONSE_TYPE_EPHEMERAL,
+		Text:         text,
+	}
+}
+
+func (p *Plugin) _executeStats(userId string, argsarr []string) (string, error) {
+	if err := p._checkRole(userId, ROLE_LIBRARY_ADMIN, ROLE_LIBWORKER); err != nil {
+		return "", err
+	}
+
+	if len(argsarr) > 2 {
+		return fmt.Sprintf("Usage: /%v [<from YYYY-MM-DD> [<to YYYY-MM-DD>]]", commandStats), nil
+	}
+	var fromDate, toDate string
+	if len(argsarr) > 0 {
+		fromDate = argsarr[0]
+	}
+	if len(argsarr) > 1 {
+		toDate = argsarr[1]
+	}
+	from, to, err := _parseStatsRange(fromDate, toDate, time.Now())
+	if err != nil {
+		return "", err
+	}
+
+	stats, err := p._computeStats(from, to)
+	if err != nil {
+		return "", err
+	}
+	return p._formatStats(stats), nil
+}
+
+func (p *Plugin) executeReview(args *model.CommandArgs) *model.CommandResponse {
+	text, err := p._executeReview(args.UserId, strings.Fields(args.Command)[1:])
+	if err != nil {
+		p.API.LogError("review command error.", "err", fmt.Sprintf("%+v", err))
+		text = p._errorText(err, "review-failed")
+	}
+
+	return &model.CommandResponse{
+		ResponseType: model.COMMAND_RESPONSE_TYPE_EPHEMERAL,
+		Text:         text,
+	}
+}
+
+func (p *Plugin) _executeReview(userId string, argsarr []string) (string, error) {
+	if len(argsarr) == 0 {
+		return fmt.Sprintf("Usage: /%v <book_post_id> [<rating %v-%v> [review]]",
+			commandReview, REVIEW_RATING_MIN, REVIEW_RATING_MAX), nil
+	}
+
+	if len(argsarr) == 1 {
+		reviews, err := p._getBookReviews(argsarr[0])
+		if err != nil {
+			return "", err
+		}
+		return p._formatBookReviews(reviews), nil
+	}
+
+	rating, err := strconv.Atoi(argsarr[1])
+	if err != nil {
+		return "", KindError(ErrInvalidRequest, "rating should be a number from %v to %v.", REVIEW_RATING_MIN, REVIEW_RATING_MAX)
+	}
+
+	review, err := p._reviewABook(userId, &ReviewRequest{
+		BookPostId: argsarr[0],
+		Rating:     rating,
+		Text:       strings.Join(argsarr[2:], " "),
+	})
+	if err != nil {
+		return "", err
+	}
+	return "Succ. Thank you for your review.\n" + _formatReview(review), nil
+}
+
+func (p *Plugin) executeRecommend(args *model.CommandArgs) *model.CommandResponse {
+	text, err := p._executeRecommend(args.UserId, strings.Fields(args.Command)[1:])
+	if err != nil {
+		p.API.LogError("recommend command error.", "err", fmt.Sprintf("%+v", err))
+		text = p._errorText(err, "recommend-failed")
+	}
+
+	return &model.CommandResponse{
+		ResponseType: model.COMMAND_RESPONSE_TYPE_EPHEMERAL,
+		Text:         text,
+	}
+}
+
+// Only a library admin can rebuild the index before the background job does.
+func (p *Plugin) _executeRecommend(userId string, argsarr []string) (string, error) {
+	if len(argsarr) > 1 {
+		return fmt.Sprintf("Usage: /%v [<book_post_id>|rebuild]", commandRecommend), nil
+	}
+
+	if len(argsarr) == 0 {
+		recommendations, err := p._suggestForUser(userId, RECOMMEND_DEFAULT_LIMIT)
+		if err != nil {
+			return "", err
+		}
+		return _formatRecommendations("Books you may like:", recommendations), nil
+	}
+
+	if argsarr[0] == "rebuild" {
+		if err := p._checkRole(userId, ROLE_LIBRARY_ADMIN); err != nil {
+			return "", err
+		}
+		index, err := p._rebuildRecommendations()
+		if err != nil {
+			return "", err
+		}
+		return fmt.Sprintf("Succ. Recommendations of %v books are rebuilt.", len(index.Books)), nil
+	}
+
+	recommendations, err := p._alsoBorrowed(argsarr[0], RECOMMEND_DEFAULT_LIMIT)
+	if err != nil {
+		return "", err
+	}
+	return _formatRecommendations("Readers of this book also borrowed:", recommendations), nil
+}
+
+func (p *Plugin) executePurchase(args *model.CommandArgs) *model.CommandResponse {
+	text, err := p._executePurchase(args.UserId, strings.Fields(args.Command)[1:])
+	if err != nil {
+		p.API.LogError("purchase command error.", "err", fmt.Sprintf("%+v", err))
+		text = p._errorText(err, "purchase-failed")
+	}
+
+	return &model.CommandResponse{
+		ResponseType: model.COMMAND_RESPONSE_TYPE_EPHEMERAL,
+		Text:         text,
+	}
+}
+
+// An isbn at the end of a proposal is taken as the isbn of the book.
+// A received book gets the given copies kept by the keeper, 1 by default.
+func (p *Plugin) _executePurchase(userId string, argsarr []string) (string, error) {
+	usage := fmt.Sprintf("Usage: /%v [list [status]|propose <book name> [isbn]|vote <id>|withdraw <id>|"+
+		"approve <id>|decline <id>|order <id>|receive <id> <book_id> <keeper> [copies]]", commandPurchase)
+
+	if len(argsarr) == 0 || argsarr[0] == "list" {
+		var status string
+		if len(argsarr) > 1 {
+			status = argsarr[1]
+		}
+		entries, err := p._listPurchases(status)
+		if err != nil {
+			return "", err
+		}
+		return _formatPurchases(entries), nil
+	}
+
+	if len(argsarr) < 2 {
+		return usage, nil
+	}
+
+	switch argsarr[0] {
+	case "propose":
+		proposal := &PurchaseProposal{BookName: strings.Join(argsarr[1:], " ")}
+		if last := argsarr[len(argsarr)-1]; len(argsarr) > 2 {
+			if _, _, err := NormalizeIsbn(last); err == nil {
+				proposal.BookName = strings.Join(argsarr[1:len(argsarr)-1], " ")
+				proposal.Isbn = last
+			}
+		}
+		masterKey, err := p._proposePurchase(userId, proposal)
+		if err != nil {
+			return "", err
+		}
+		return fmt.Sprintf("Succ. %v is proposed, ask others to vote with `/%v vote %v`.", proposal.BookName, commandPurchase, masterKey), nil
+
+	case "vote":
+		master, err := p._votePurchase(userId, argsarr[1])
+		if err != nil {
+			return "", err
+		}
+		return fmt.Sprintf("Succ. %v has %v votes.", master.BookName, len(master.VoterUsers)), nil
+
+	case "withdraw":
+		return p._transitPurchaseByCommand(userId, argsarr[1], "", nil)
+
+	case "approve":
+		return p._transitPurchaseByCommand(userId, argsarr[1], PURCHASE_STATUS_APPROVED, nil)
+
+	case "decline":
+		return p._transitPurchaseByCommand(userId, argsarr[1], PURCHASE_STATUS_DECLINED, nil)
+
+	case "order":
+		return p._transitPurchaseByCommand(userId, argsarr[1], PURCHASE_STATUS_ORDERED, nil)
+
+	case "receive":
+		if len(argsarr) < 4 || len(argsarr) > 5 {
+			return usage, nil
+		}
+		copies := 1
+		if len(argsarr) == 5 {
+			n, err := strconv.Atoi(argsarr[4])
+			if err != nil || n < 0 {
+				return "", KindError(ErrInvalidRequest, "copies should be a number not less than 0.")
+			}
+			copies = n
+		}
+		return p._transitPurchaseByCommand(userId, argsarr[1], PURCHASE_STATUS_RECEIVED, func(master *PurchaseRequest) *Book {
+			return _newPurchasedBook(master, argsarr[2], argsarr[3], copies)
+		})
+
+	default:
+		return usage, nil
+	}
+}
+
+// The purchase is moved to the status from the latest version, or deleted if status is empty.
+func (p *Plugin) _transitPurchaseByCommand(userId string, masterKey string, status string, book func(*PurchaseRequest) *Book) (string, error) {
+	pwp, err := p._getPurchaseById(masterKey)
+	if err != nil {
+		return "", err
+	}
+	master := pwp.purchase.DataOrImage
+
+	req := &PurchaseWorkflowRequest{
+		WorkflowRequest: WorkflowRequest{
+			MasterPostKey: masterKey,
+			NextStepIndex: -1,
+			Delete:        status == "",
+			Etag:          master.MatchId,
+		},
+	}
+	for i, step := range master.Worflow {
+		if step.Status == status {
+			req.NextStepIndex = i
+		}
+	}
+	if book != nil {
+		req.Book = book(master)
+	}
+
+	if err := p._processPurchaseRequest(userId, req); err != nil {
+		return "", err
+	}
+	if status == "" {
+		return fmt.Sprintf("Succ. The purchase of %v is deleted.", master.BookName), nil
+	}
+	return fmt.Sprintf("Succ. The purchase of %v is %v.", master.BookName, status), nil
+}
+
+func (p *Plugin) executeDonate(args *model.CommandArgs) *model.CommandResponse {
+	text, err := p._executeDonate(args.UserId, strings.Fields(args.Command)[1:])
+	if err != nil {
+		p.API.LogError("donate command error.", "err", fmt.Sprintf("%+v", err))
+		text = p._errorText(err, "donation-failed")
+	}
+
+	return &model.CommandResponse{
+		ResponseType: model.COMMAND_RESPONSE_TYPE_EPHEMERAL,
+		Text:         text,
+	}
+}
+
+// An isbn at the end of an offer is taken as the isbn of the book.
+func (p *Plugin) _executeDonate(userId string, argsarr []string) (string, error) {
+	usage := fmt.Sprintf("Usage: /%v [list [status]|offer <keep|give> <copies> <book name> [isbn]|withdraw <id>|"+
+		"accept <id> [<book_id> [<keeper>]]|reject <id>]", commandDonate)
+
+	if len(argsarr) == 0 || argsarr[0] == "list" {
+		var status string
+		if len(argsarr) > 1 {
+			status = argsarr[1]
+		}
+		entries, err := p._listDonations(status)
+		if err != nil {
+			return "", err
+		}
+		return _formatDonations(entries), nil
+	}
+
+	if len(argsarr) < 2 {
+		return usage, nil
+	}
+
+	switch argsarr[0] {
+	case "offer":
+		if len(argsarr) < 4 || argsarr[1] != "keep" && argsarr[1] != "give" {
+			return usage, nil
+		}
+		copies, err := strconv.Atoi(argsarr[2])
+		if err != nil || copies <= 0 {
+			return "", KindError(ErrInvalidRequest, "copies should be a number not less than 1.")
+		}
+		offer := &DonationOffer{
+			BookName:   strings.Join(argsarr[3:], " "),
+			Copies:     copies,
+			DonorKeeps: argsarr[1] == "keep",
+		}
+		if last := argsarr[len(argsarr)-1]; len(argsarr) > 4 {
+			if _, _, err := NormalizeIsbn(last); err == nil {
+				offer.BookName = strings.Join(argsarr[3:len(argsarr)-1], " ")
+				offer.Isbn = last
+			}
+		}
+		if _, err := p._offerDonation(userId, offer); err != nil {
+			return "", err
+		}
+		return fmt.Sprintf("Succ. Thank you for offering %v, a libworker will review it soon.", offer.BookName), nil
+
+	case "withdraw":
+		return p._transitDonationByCommand(userId, argsarr[1], "", &DonationWorkflowRequest{})
+
+	case "accept":
+		if len(argsarr) > 4 {
+			return usage, nil
+		}
+		req := &DonationWorkflowRequest{}
+		if len(argsarr) > 2 {
+			req.BookId = argsarr[2]
+		}
+		if len(argsarr) > 3 {
+			req.Keeper = argsarr[3]
+		}
+		return p._transitDonationByCommand(userId, argsarr[1], DONATION_STATUS_ACCEPTED, req)
+
+	case "reject":
+		return p._transitDonationByCommand(userId, argsarr[1], DONATION_STATUS_REJECTED, &DonationWorkflowRequest{})
+
+	default:
+		return usage, nil
+	}
+}
+
+// The donation is moved to the status from the latest version, or deleted if status is empty.
+func (p *Plugin) _transitDonationByCommand(userId string, masterKey string, status string, req *DonationWorkflowRequest) (string, error) {
+	dwp, err := p._getDonationById(masterKey)
+	if err != nil {
+		return "", err
+	}
+	master := dwp.donation.DataOrImage
+
+	req.MasterPostKey = masterKey
+	req.NextStepIndex = -1
+	req.Delete = status == ""
+	req.Etag = master.MatchId
+	for i, step := range master.Worflow {
+		if step.Status == status {
+			req.NextStepIndex = i
+		}
+	}
+
+	if err := p._processDonationRequest(userId, req); err != nil {
+		return "", err
+	}
+	if status == "" {
+		return fmt.Sprintf("Succ. The donation of %v is deleted.", master.BookName), nil
+	}
+	return fmt.Sprintf("Succ. The donation of %v is %v.", master.BookName, status), nil
+}
+
+func (p *Plugin) executeICal(args *model.CommandArgs) *model.CommandResponse {
+	text, err := p._executeICal(args.UserId, strings.Fields(args.Command)[1:])
+	if err != nil {
+		p.API.LogError("ical command error.", "err", fmt.Sprintf("%+v", err))
+		text = p._errorText(err, "ical-failed")
+	}
+
+	return &model.CommandResponse{
+		ResponseType: model.COMMAND_RESPONSE_TYPE_EPHEMERAL,
+		Text:         text,
+	}
+}
+
+// Anyone with the URLs can read the feeds, reset them if they are leaked.
+func (p *Plugin) _executeICal(userId string, argsarr []string) (string, error) {
+	if len(argsarr) > 1 || (len(argsarr) == 1 && argsarr[0] != "reset") {
+		return fmt.Sprintf("Usage: /%v [reset]", commandICal), nil
+	}
+
+	reset := len(argsarr) == 1
+	feeds, err := p._icalFeeds(userId, reset)
+	if err != nil {
+		return "", err
+	}
+
+	text := fmt.Sprintf("Subscribe in your calendar app, keep the URLs private.\n"+
+		"Books due: %v\nExpected returns: %v", feeds.Loans, feeds.Returns)
+	if reset {
+		text = "Succ. The old URLs no longer work.\n" + text
+	}
+	return text, nil
+}
+
+func (p *Plugin) executeWebhook(args *model.CommandArgs) *model.CommandResponse {
+	text, err := p._executeWebhook(args.UserId, strings.Fields(args.Command)[1:])
+	if err != nil {
+		p.API.LogError("webhook command error.", "err", fmt.Sprintf("%+v", err))
+		text = p._errorText(err, "webhook-failed")
+	}
+
+	return &model.CommandResponse{
+		ResponseType: model.COMMAND_RESPONSE_TYPE_EPHEMERAL,
+		Text:         text,
+	}
+}
+
+// A webhook without events is notified of all of them.
+func (p *Plugin) _executeWebhook(userId string, argsarr []string) (string, error) {
+	usage := fmt.Sprintf("Usage: /%v [list|add <url> [event...]|remove <id>|log]\nEvents: %v",
+		commandWebhook, strings.Join(webhookEvents, ", "))
+
+	action := "list"
+	if len(argsarr) > 0 {
+		action = argsarr[0]
+	}
+
+	switch {
+	case action == "list" && len(argsarr) <= 1:
+		targets, err := p._listWebhookTargets(userId)
+		if err != nil {
+			return "", err
+		}
+		return _formatWebhookTargets(targets), nil
+
+	case action == "add" && len(argsarr) >= 2:
+		target, err := p._addWebhookTarget(userId, &WebhookTarget{URL: argsarr[1], Events: argsarr[2:]})
+		if err != nil {
+			return "", err
+		}
+		return fmt.Sprintf("Succ. Webhook %v is added, the payloads are signed with the secret: %v", target.Id, target.Secret), nil
+
+	case action == "remove" && len(argsarr) == 2:
+		if err := p._removeWebhookTarget(userId, argsarr[1]); err != nil {
+			return "", err
+		}
+		return fmt.Sprintf("Succ. Webhook %v is removed.", argsarr[1]), nil
+
+	case action == "log" && len(argsarr) == 1:
+		deliveries, err := p._listWebhookDeliveries(userId)
+		if err != nil {
+			return "", err
+		}
+		return _formatWebhookDeliveries(deliveries), nil
+
+	default:
+		return usage, nil
+	}
+}
+
+func (p *Plugin) executeToken(args *model.CommandArgs) *model.CommandResponse {
+	text, err := p._executeToken(args.UserId, strings.Fields(args.Command)[1:])
+	if err != nil {
+		p.API.LogError("token command error.", "err", fmt.Sprintf("%+v", err))
+		text = p._errorText(err, "token-failed")
+	}
+
+	return &model.CommandResponse{
+		ResponseType: model.COMMAND_RESPONSE_TYPE_EPHEMERAL,
+		Text:         text,
+	}
+}
+
+func (p *Plugin) _executeToken(userId string, argsarr []string) (string, error) {
+	usage := fmt.Sprintf("Usage: /%v [list|issue <name> <scope...>|revoke <id>]\nScopes: %v",
+		commandToken, strings.Join(apiTokenScopes, ", "))
+
+	action := "list"
+	if len(argsarr) > 0 {
+		action = argsarr[0]
+	}
+
+	switch {
+	case action == "list" && len(argsarr) <= 1:
+		tokens, err := p._listApiTokens(userId)
+		if err != nil {
+			return "", err
+		}
+		return _formatApiTokens(tokens), nil
+
+	case action == "issue" && len(argsarr) >= 3:
+		token, err := p._issueApiToken(userId, &ApiToken{Name: argsarr[1], Scopes: argsarr[2:]})
+		if err != nil {
+			return "", err
+		}
+		return fmt.Sprintf("Succ. Token %v is issued, it is shown only once: %v", token.Name, token.Token), nil
+
+	case action == "revoke" && len(argsarr) == 2:
+		if err := p._revokeApiToken(userId, argsarr[1]); err != nil {
+			return "", err
+		}
+		return fmt.Sprintf("Succ. Token %v is revoked.", argsarr[1]), nil
+
+	default:
+		return usage, nil
+	}
+}
+
+func (p *Plugin) executePenalty(args *model.CommandArgs) *model.CommandResponse {
+	text, err := p._executePenalty(args.UserId, strings.Fields(args.Command)[1:])
+	if err != nil {
+		p.API.LogError("penalty command error.", "err", fmt.Sprintf("%+v", err))
+		text = p._errorText(err, "penalty-failed")
+	}
+
+	return &model.CommandResponse{
+		ResponseType: model.COMMAND_RESPONSE_TYPE_EPHEMERAL,
+		Text:         text,
+	}
+}
+
+func (p *Plugin) _executePenalty(userId string, argsarr []string) (string, error) {
+	usage := fmt.Sprintf("Usage: /%v [list|lost <user>|lift <user>]", commandPenalty)
+
+	action := "list"
+	if len(argsarr) > 0 {
+		action = argsarr[0]
+	}
+
+	switch {
+	case action == "list" && len(argsarr) <= 1:
+		penalties, err := p._listPenalties(userId)
+		if err != nil {
+			return "", err
+		}
+		return p._formatPenalties(penalties), nil
+
+	case action == "lost" && len(argsarr) == 2:
+		penalty, err := p._recordLostCopy(userId, argsarr[1])
+		if err != nil {
+			return "", err
+		}
+		if penalty.Suspension != nil {
+			return fmt.Sprintf("Succ. A lost copy is recorded, @%v is suspended until %v.", penalty.User,
+				_timeOfMillis(penalty.Suspension.Until).Format("2006-01-02 15:04")), nil
+		}
+		return fmt.Sprintf("Succ. A lost copy is recorded, @%v has lost %v.", penalty.User, penalty.LostCopies), nil
+
+	case action == "lift" && len(argsarr) == 2:
+		if err := p._liftSuspension(userId, argsarr[1]); err != nil {
+			return "", err
+		}
+		return fmt.Sprintf("Succ. The suspension of %v is lifted.", argsarr[1]), nil
+
+	default:
+		return usage, nil
+	}
+}
@@ -12,16 +12,23 @@ import (
 
 func (p *Plugin) handleConfigRequest(c *plugin.Context, w http.ResponseWriter, r *http.Request) {
 	config := Config{
+		LibraryId:     p.library.id,
+		BorrowLimit:   p.borrowTimes,
 		MaxRenewTimes: p.maxRenewTimes,
 		ExpiredDays:   p.expiredDays,
+		Libraries:     []LibraryInfo{},
+	}
+	for _, id := range p.libraryIds {
+		config.Libraries = append(config.Libraries, LibraryInfo{
+			Id:   id,
+			Name: p.libraries[id].name,
+		})
 	}
 
 	data, err := json.Marshal(config)
 	if err != nil {
 		p.API.LogError("mashal config error", "err", fmt.Sprintf("%+v", err))
-		resp, _ := json.Marshal(Result{
-			Error: "mashal config error",
-		})
+		resp, _ := json.Marshal(p._errorResult(err, "mashal config error"))
 
 		w.Write(resp)
 		return
@@ -39,9 +46,7 @@ func (p *Plugin) handleConfigRequest(c *plugin.Context, w http.ResponseWriter, r
 	if err != nil {
 
 		p.API.LogError("mashal result error", "err", fmt.Sprintf("%+v", err))
-		resp, _ := json.Marshal(Result{
-			Error: "mashal result error",
-		})
+		resp, _ := json.Marshal(p._errorResult(err, "mashal result error"))
 
 		w.Write(resp)
 		return
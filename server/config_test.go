@@ -20,6 +20,7 @@ func TestConfig(t *testing.T) {
 
 	w := httptest.NewRecorder()
 	r := httptest.NewRequest("GET", "/config", bytes.NewReader([]byte{}))
+	r.Header.Set("Mattermost-User-ID", td.BorId)
 	plugin.ServeHTTP(nil, w, r)
 
 	result := w.Result()
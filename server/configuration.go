@@ -2,7 +2,9 @@ package main
 
 import (
 	// "fmt"
+	"encoding/json"
 	"reflect"
+	"strings"
 
 	"github.com/mattermost/mattermost-server/v5/model"
 	"github.com/pkg/errors"
@@ -30,6 +32,41 @@ type configuration struct {
 	InitialAdmin              string
 	MaxRenewTimes             int
 	ExpiredDays               int
+	MetadataFile              string
+	// JSON list of LibraryConfig, the single library above is used if it's empty.
+	Libraries string
+	// post(default), kv or memory, see Repository
+	Storage string
+	// post a report of the last month in the books channel of every library
+	MonthlyReport bool
+	// reply to the book's public post with every new review
+	AnnounceReviews bool
+	// see PenaltyPolicy
+	PenaltyPointsPerOverdueDay int
+	SuspendAtPoints            int
+	SuspendAtLostCopies        int
+	SuspensionDays             int
+	// JSON list of EligibilityRuleConfig, the default rules are used if it's empty.
+	EligibilityRules string
+}
+
+// The definition of a library, see library.
+type LibraryConfig struct {
+	Id                        string `json:"id"`
+	Name                      string `json:"name"`
+	TeamName                  string `json:"team_name"`
+	BooksChannelName          string `json:"books_channel_name"`
+	BooksPrivateChannelName   string `json:"books_private_channel_name"`
+	BooksInventoryChannelName string `json:"books_inventory_channel_name"`
+	BorrowWorkflowChannelName string `json:"borrow_workflow_channel_name"`
+	BorrowLimit               int    `json:"borrow_limit"`
+	MaxRenewTimes             int    `json:"max_renew_times"`
+	ExpiredDays               int    `json:"expired_days"`
+	// status -> actor role, e.g. {"C":"LIBWORKER"} lets libworkers confirm instead of keepers.
+	WorkflowActors map[string]string `json:"workflow_actors,omitempty"`
+	Penalty        PenaltyPolicy     `json:"penalty"`
+	// the default rules if it's empty, see defaultEligibilityRules
+	EligibilityRules []EligibilityRuleConfig `json:"eligibility_rules,omitempty"`
 }
 
 // Clone shallow copies the configuration. Your implementation may require a deep copy if
@@ -39,6 +76,78 @@ func (c *configuration) Clone() *configuration {
 	return &clone
 }
 
+// getLibraryConfigs returns the configured libraries, the first one is the default.
+func (c *configuration) getLibraryConfigs() ([]LibraryConfig, error) {
+	if strings.TrimSpace(c.Libraries) == "" {
+		var rules []EligibilityRuleConfig
+		if strings.TrimSpace(c.EligibilityRules) != "" {
+			if err := json.Unmarshal([]byte(c.EligibilityRules), &rules); err != nil {
+				return nil, errors.Wrap(err, "failed to parse eligibility rules")
+			}
+		}
+		return []LibraryConfig{{
+			Id:                        DEFAULT_LIBRARY_ID,
+			TeamName:                  c.TeamName,
+			BooksChannelName:          c.BooksChannelName,
+			BooksPrivateChannelName:   c.BooksPrivateChannelName,
+			BooksInventoryChannelName: c.BooksInventoryChannelName,
+			BorrowWorkflowChannelName: c.BorrowWorkflowChannelName,
+			BorrowLimit:               c.BorrowLimit,
+			MaxRenewTimes:             c.MaxRenewTimes,
+			ExpiredDays:               c.ExpiredDays,
+			Penalty: PenaltyPolicy{
+				PointsPerOverdueDay: c.PenaltyPointsPerOverdueDay,
+				SuspendAtPoints:     c.SuspendAtPoints,
+				SuspendAtLostCopies: c.SuspendAtLostCopies,
+				SuspensionDays:      c.SuspensionDays,
+			},
+			EligibilityRules: rules,
+		}}, nil
+	}
+
+	var libs []LibraryConfig
+	if err := json.Unmarshal([]byte(c.Libraries), &libs); err != nil {
+		return nil, errors.Wrap(err, "failed to parse libraries")
+	}
+	if len(libs) == 0 {
+		return nil, errors.New("no library is defined")
+	}
+
+	ids := map[string]bool{}
+	channels := map[string]string{}
+	for _, lib := range libs {
+		if lib.Id == "" {
+			return nil, errors.New("library id is required")
+		}
+		if ids[lib.Id] {
+			return nil, errors.Errorf("duplicate library id %v", lib.Id)
+		}
+		ids[lib.Id] = true
+
+		if lib.TeamName == "" {
+			return nil, errors.Errorf("team name of library %v is required", lib.Id)
+		}
+		for _, name := range []string{
+			lib.BooksChannelName,
+			lib.BooksPrivateChannelName,
+			lib.BooksInventoryChannelName,
+			lib.BorrowWorkflowChannelName,
+		} {
+			if name == "" {
+				return nil, errors.Errorf("channel names of library %v are required", lib.Id)
+			}
+			// libraries in one team must not share channels
+			key := lib.TeamName + "/" + name
+			if other, ok := channels[key]; ok {
+				return nil, errors.Errorf("channel %v is used by both library %v and %v", key, other, lib.Id)
+			}
+			channels[key] = lib.Id
+		}
+	}
+
+	return libs, nil
+}
+
 // getConfiguration retrieves the active configuration under lock, making it safe to use
 // concurrently. The active configuration may change underneath the client of this method, but
 // the struct returned by this API call is considered immutable.
@@ -103,46 +212,39 @@ func (p *Plugin) OnConfigurationChange() error {
 
 	p.botID = botID
 
-	// initial admin is must
-
-	// ensure team
-	team, appErr := p.ensureTeam(configuration.TeamName)
-	if appErr != nil {
-		return errors.Wrap(appErr, "failed to ensure team.")
+	repo, err := p._newRepository(configuration.Storage)
+	if err != nil {
+		return errors.Wrap(err, "invalid storage")
 	}
-	p.team = team
+	p.repo = repo
 
-	// ensure books public channel
-	bkchannel, appErr := p.ensureChannel(team.Id, configuration.BooksChannelName, "Books", "Channel for books library.", model.CHANNEL_OPEN)
-	if appErr != nil {
-		return errors.Wrap(appErr, "failed to ensure channel")
+	// ensure team and channels of every library
+	libConfigs, err := configuration.getLibraryConfigs()
+	if err != nil {
+		return errors.Wrap(err, "invalid libraries")
 	}
-	p.booksChannel = bkchannel
 
-	// ensure books private channel
-	bkprichannel, appErr := p.ensureChannel(team.Id, configuration.BooksPrivateChannelName,
-		"Books Private", "Channel for books private infomation.", model.CHANNEL_PRIVATE)
-	if appErr != nil {
-		return errors.Wrap(appErr, "failed to ensure channel")
-	}
-	p.booksPriChannel = bkprichannel
-
-	// ensure books inventory channel
-	bkinvchannel, appErr := p.ensureChannel(team.Id, configuration.BooksInventoryChannelName,
-		"Books Inventory", "Channel for books inventory infomation.", model.CHANNEL_PRIVATE)
-	if appErr != nil {
-		return errors.Wrap(appErr, "failed to ensure channel")
-	}
-	p.booksInvChannel = bkinvchannel
+	libraries := map[string]*library{}
+	libraryIds := []string{}
+	for _, libConfig := range libConfigs {
+		if err := p._validateWorkflowActors(libConfig.WorkflowActors); err != nil {
+			return errors.Wrapf(err, "invalid workflow of library %v", libConfig.Id)
+		}
+		if err := _validatePenaltyPolicy(libConfig.Penalty); err != nil {
+			return errors.Wrapf(err, "invalid penalty of library %v", libConfig.Id)
+		}
 
-	// ensure workflow
-	bchannel, appErr := p.ensureChannel(team.Id, configuration.BorrowWorkflowChannelName, "Borrows", "Channel for borrowing workflow.", model.CHANNEL_PRIVATE)
-	if appErr != nil {
-		return errors.Wrap(appErr, "failed to ensure channel")
+		lib, err := p._ensureLibrary(libConfig)
+		if err != nil {
+			return err
+		}
+		libraries[lib.id] = lib
+		libraryIds = append(libraryIds, lib.id)
 	}
-	p.borrowChannel = bchannel
 
-	p.borrowTimes = configuration.BorrowLimit
+	p.libraries = libraries
+	p.libraryIds = libraryIds
+	p.library = libraries[libraryIds[0]]
 
 	// assign initial admin
 	if configuration.InitialAdmin != "" {
@@ -152,33 +254,33 @@ func (p *Plugin) OnConfigurationChange() error {
 			return errors.Wrap(appErr, "failed to find initial admin")
 		}
 
-		if appErr := p.ensureMemberInTeam(team, admin); appErr != nil {
-			return errors.Wrap(appErr, "failed to add member to books team")
-		}
-
-		err := p.ensureMemberInChannel(bkchannel, admin)
-		if err != nil {
-			return errors.Wrap(err, "failed to assign inital user to book channel")
-		}
-
-		err = p.ensureMemberInChannel(bkprichannel, admin)
-		if err != nil {
-			return errors.Wrap(err, "failed to assign inital user to book channel(private)")
-		}
-
-		err = p.ensureMemberInChannel(bkinvchannel, admin)
-		if err != nil {
-			return errors.Wrap(err, "failed to assign inital user to book channel(inventory)")
-		}
-
-		err = p.ensureMemberInChannel(bchannel, admin)
-		if err != nil {
-			return errors.Wrap(err, "failed to assign inital user to borrow channel")
+		for _, id := range libraryIds {
+			lp, err := p._withLibrary(id)
+			if err != nil {
+				return err
+			}
+
+			if appErr := lp.ensureMemberInTeam(lp.team, admin); appErr != nil {
+				return errors.Wrap(appErr, "failed to add member to books team")
+			}
+
+			err = lp.ensureMemberInChannel(lp.booksChannel, admin)
+			if err != nil {
+				return errors.Wrap(err, "failed to assign inital user to book channel")
+			}
+
+			// private channels follow the roles
+			if _, err := lp._grantRoles(admin.Id, ROLE_LIBRARY_ADMIN); err != nil {
+				return errors.Wrap(err, "failed to grant library admin to inital user")
+			}
 		}
 	}
 
-	p.maxRenewTimes = configuration.MaxRenewTimes
-	p.expiredDays = configuration.ExpiredDays
+	metadataProvider, err := p._newMetadataProvider(configuration.MetadataFile)
+	if err != nil {
+		return errors.Wrap(err, "failed to create metadata provider")
+	}
+	p.metadataProvider = metadataProvider
 
         i18n, err := NewI18n("zh")
         if err != nil{
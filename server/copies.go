@@ -0,0 +1,272 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+
+	"github.com/pkg/errors"
+)
+
+func (p *Plugin) _operateCopiesByJson(action string, opJson string) (Messages, error) {
+	var op CopyOperation
+	if err := json.Unmarshal([]byte(opJson), &op); err != nil {
+		return nil, errors.Wrapf(err, "convert to copy operation error.")
+	}
+
+	bookmsg, err := p._operateCopies(action, &op)
+	mj, _ := json.Marshal(bookmsg)
+
+	return Messages{op.Post_id: string(mj)}, err
+}
+
+func (p *Plugin) _operateCopies(action string, op *CopyOperation) (*BooksMessage, error) {
+	if err := p._applyCopyOperation(action, op); err != nil {
+		return &BooksMessage{
+			PostId:  op.Post_id,
+			Status:  BOOK_UPLOAD_ERROR,
+			Message: err.Error(),
+		}, err
+	}
+
+	return &BooksMessage{
+		PostId:  op.Post_id,
+		Status:  BOOK_UPLOAD_SUCC,
+		Message: "Successfully updated copies.",
+	}, nil
+}
+
+func (p *Plugin) _applyCopyOperation(action string, op *CopyOperation) error {
+
+	pubId := op.Post_id
+	if pubId == "" {
+		return KindError(ErrInvalidRequest, "post id is required.")
+	}
+	if len(op.Copies) == 0 {
+		return KindError(ErrInvalidRequest, "copies are required.")
+	}
+	seen := map[string]bool{}
+	for _, id := range op.Copies {
+		if seen[id] {
+			return KindError(ErrInvalidRequest, "copy %v is given more than once", id)
+		}
+		seen[id] = true
+	}
+
+	if _, ok := lockmap.LoadOrStore(pubId, struct{}{}); ok {
+		return errors.Wrapf(ErrLocked, "lock error")
+	}
+
+	defer lockmap.Delete(pubId)
+
+	info, err := p.GetABook(pubId)
+	if err != nil {
+		return errors.Wrapf(err, "get book error.")
+	}
+
+	bookPub := info.book.BookPublic
+	bookPri := info.book.BookPrivate
+	bookInv := info.book.BookInventory
+
+	if op.Etag != "" && bookPub.MatchId != op.Etag {
+		return WithDetails(errors.Wrapf(ErrStale, "copy operation stale"),
+			ErrorDetails{ERROR_DETAIL_ETAG: bookPub.MatchId})
+	}
+
+	if bookInv.Copies == nil {
+		bookInv.Copies = BookCopies{}
+	}
+	if bookPri.CopyKeeperMap == nil {
+		bookPri.CopyKeeperMap = map[string]Keeper{}
+	}
+
+	//keepers who may have no copy left after the operation
+	leaving := map[string]bool{}
+
+	switch action {
+	case BOOKS_ACTION_ADD_COPIES:
+		if op.Keeper == "" {
+			return KindError(ErrInvalidRequest, "keeper is required.")
+		}
+		for _, id := range op.Copies {
+			if _, ok := bookInv.Copies[id]; ok {
+				return KindError(ErrRuleViolation, "copy %v already exists", id)
+			}
+			bookInv.Copies[id] = BookCopy{Status: COPY_STATUS_INSTOCK}
+			bookPri.CopyKeeperMap[id] = Keeper{User: op.Keeper}
+			bookInv.Stock++
+		}
+
+	case BOOKS_ACTION_RETIRE_COPIES:
+		for _, id := range op.Copies {
+			if err := _checkCopyInStock(bookInv, id); err != nil {
+				return err
+			}
+			leaving[bookPri.CopyKeeperMap[id].User] = true
+			delete(bookInv.Copies, id)
+			delete(bookPri.CopyKeeperMap, id)
+			bookInv.Stock--
+		}
+
+	case BOOKS_ACTION_REASSIGN_COPIES:
+		if op.Keeper == "" {
+			return KindError(ErrInvalidRequest, "keeper is required.")
+		}
+		for _, id := range op.Copies {
+			if err := _checkCopyInStock(bookInv, id); err != nil {
+				return err
+			}
+			leaving[bookPri.CopyKeeperMap[id].User] = true
+			bookPri.CopyKeeperMap[id] = Keeper{User: op.Keeper}
+		}
+
+	default:
+		return KindError(ErrInvalidRequest, "unknown copy action %v", action)
+	}
+
+	if bookInv.Stock < 0 {
+		return KindError(ErrRuleViolation, "stock can not be negative.")
+	}
+
+	added, err := p._syncCopyKeepers(bookPri, leaving)
+	if err != nil {
+		return err
+	}
+
+	if bookInv.Stock > 0 && !bookPub.ManuallyDisallowed && !bookPub.IsAllowedToBorrow {
+		bookPub.IsAllowedToBorrow = true
+	}
+
+	if err := p._updateBookParts(updateOptions{
+		pub:     bookPub,
+		pubPost: info.pubPost,
+		pri:     bookPri,
+		priPost: info.priPost,
+		inv:     bookInv,
+		invPost: info.invPost,
+	}); err != nil {
+		return errors.Wrapf(err, "update posts error.")
+	}
+	p._grantKeeperRole(added...)
+
+	p._emitBookEvent(WEBHOOK_EVENT_BOOK_UPDATED, pubId, bookPub)
+	return nil
+}
+
+func _checkCopyInStock(bookInv *BookInventory, id string) error {
+	bookCopy, ok := bookInv.Copies[id]
+	if !ok {
+		return errors.Wrapf(ErrNotFound, "copy %v", id)
+	}
+	if bookCopy.Status != COPY_STATUS_INSTOCK {
+		return WithDetails(errors.Wrapf(ErrChooseInStockCopy, "copy %v with status %v is not InStock", id, bookCopy.Status),
+			ErrorDetails{ERROR_DETAIL_COPY_ID: id, ERROR_DETAIL_STATUS: bookCopy.Status})
+	}
+	return nil
+}
+
+// Make KeeperUsers and KeeperInfos follow CopyKeeperMap: new keepers are added,
+// and the leaving keepers are removed if they keep no copy any more.
+// Keepers not involved are kept as they are.
+// The added keepers are returned, they are granted the keeper role once the book is written.
+func (p *Plugin) _syncCopyKeepers(bookPri *BookPrivate, leaving map[string]bool) ([]string, error) {
+
+	keeping := map[string]bool{}
+	for _, keeper := range bookPri.CopyKeeperMap {
+		keeping[keeper.User] = true
+	}
+
+	users := []string{}
+	known := map[string]bool{}
+	for _, user := range bookPri.KeeperUsers {
+		known[user] = true
+		if leaving[user] && !keeping[user] {
+			continue
+		}
+		users = append(users, user)
+	}
+
+	added := []string{}
+	for user := range keeping {
+		if !known[user] {
+			added = append(added, user)
+		}
+	}
+	sort.Strings(added)
+	users = append(users, added...)
+
+	infos := KeeperInfoMap{}
+	for _, user := range users {
+		if info, ok := bookPri.KeeperInfos[user]; ok {
+			infos[user] = info
+			continue
+		}
+		disName, err := p._getDisplayNameByUser(user)
+		if err != nil {
+			return nil, errors.Wrapf(ErrInvalidCopyKeeper, "keeper %v: %v", user, err)
+		}
+		infos[user] = KeeperInfo{Name: disName}
+	}
+
+	bookPri.KeeperUsers = users
+	bookPri.KeeperInfos = infos
+
+	return added, nil
+}
+
+// Every copy should be kept by one of the keeper users.
+// An uploaded or patched private part is checked, the copy actions keep it by _syncCopyKeepers.
+func _checkCopyKeepers(bookPri *BookPrivate) error {
+	keepers := map[string]bool{}
+	for _, user := range bookPri.KeeperUsers {
+		keepers[user] = true
+	}
+
+	for id, keeper := range bookPri.CopyKeeperMap {
+		if !keepers[keeper.User] {
+			return errors.Wrapf(ErrInvalidCopyKeeper, "keeper %v of copy %v is not in keeper users", keeper.User, id)
+		}
+	}
+
+	return nil
+}
+
+// Copy ids "<book id> b<n>" not used by the existing copies, n from the number of copies on.
+func _newCopyIds(bookId string, existing BookCopies, count int) []string {
+	ids := []string{}
+	for n := len(existing) + 1; len(ids) < count; n++ {
+		id := fmt.Sprintf("%v b%v", bookId, n)
+		if _, ok := existing[id]; ok {
+			continue
+		}
+		ids = append(ids, id)
+	}
+	return ids
+}
+
+// A new book with its copies kept by the keeper, the public part is completed in place.
+func _newBookWithCopies(pub *BookPublic, keeper string, copies int) *Book {
+	pri := &BookPrivate{
+		KeeperUsers:   []string{keeper},
+		CopyKeeperMap: map[string]Keeper{},
+	}
+	inv := &BookInventory{
+		Stock:  copies,
+		Copies: BookCopies{},
+	}
+	for _, id := range _newCopyIds(pub.Id, inv.Copies, copies) {
+		pri.CopyKeeperMap[id] = Keeper{User: keeper}
+		inv.Copies[id] = BookCopy{Status: COPY_STATUS_INSTOCK}
+	}
+
+	if pub.LibworkerUsers == nil {
+		pub.LibworkerUsers = []string{}
+	}
+	pub.IsAllowedToBorrow = copies > 0
+
+	return &Book{
+		BookPublic:    pub,
+		BookPrivate:   pri,
+		BookInventory: inv,
+	}
+}
@@ -0,0 +1,214 @@
+package main
+
+import (
+	"net/http"
+	"testing"
+
+	"github.com/mattermost/mattermost-server/v5/model"
+	"github.com/mattermost/mattermost-server/v5/plugin/plugintest"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCopies(t *testing.T) {
+
+	setup := func() (*TestData, *Plugin, *plugintest.API) {
+		td := NewTestData()
+		plugin := td.NewMockPlugin()
+		api := td.ApiMockCommon()
+		api.On("GetTeamMember", td.BorTeamId, mock.AnythingOfType("string")).Return(&model.TeamMember{}, nil)
+		plugin.SetAPI(api)
+		return td, plugin, api
+	}
+
+	t.Run("add_copies_new_keeper", func(t *testing.T) {
+		td, plugin, _ := setup()
+		etag := td.ABookPub.MatchId
+
+		msg, err := plugin._operateCopies(BOOKS_ACTION_ADD_COPIES, &CopyOperation{
+			Post_id: td.BookPostIdPub,
+			Etag:    etag,
+			Copies:  []string{"zzh-book-001 b4", "zzh-book-001 b5"},
+			Keeper:  "worker1",
+		})
+		require.Nil(t, err)
+		assert.Equal(t, BOOK_UPLOAD_SUCC, msg.Status)
+		assert.Equal(t, 5, td.ABookInv.Stock)
+		assert.Equal(t, COPY_STATUS_INSTOCK, td.ABookInv.Copies["zzh-book-001 b4"].Status)
+		assert.Equal(t, Keeper{User: "worker1"}, td.ABookPri.CopyKeeperMap["zzh-book-001 b5"])
+		assert.Equal(t, []string{"kpuser1", "kpuser2", "worker1"}, td.ABookPri.KeeperUsers)
+		assert.Equal(t, KeeperInfo{Name: "wkname1"}, td.ABookPri.KeeperInfos["worker1"])
+		assert.NotEqual(t, etag, td.ABookPub.MatchId)
+	})
+
+	t.Run("add_existing_copy", func(t *testing.T) {
+		td, plugin, _ := setup()
+
+		_, err := plugin._operateCopies(BOOKS_ACTION_ADD_COPIES, &CopyOperation{
+			Post_id: td.BookPostIdPub,
+			Copies:  []string{"zzh-book-001 b1"},
+			Keeper:  "kpuser1",
+		})
+		assert.NotNil(t, err)
+		assert.Equal(t, 3, td.ABookInv.Stock)
+	})
+
+	t.Run("add_unknown_keeper", func(t *testing.T) {
+		td, plugin, api := setup()
+		api.On("GetUserByUsername", "nobody").Return(nil,
+			model.NewAppError("", "", nil, "", http.StatusNotFound))
+
+		_, err := plugin._operateCopies(BOOKS_ACTION_ADD_COPIES, &CopyOperation{
+			Post_id: td.BookPostIdPub,
+			Copies:  []string{"zzh-book-001 b4"},
+			Keeper:  "nobody",
+		})
+		assert.ErrorIs(t, err, ErrInvalidCopyKeeper)
+		assert.Equal(t, 3, td.ABookInv.Stock)
+	})
+
+	t.Run("retire_copy", func(t *testing.T) {
+		td, plugin, _ := setup()
+
+		_, err := plugin._operateCopies(BOOKS_ACTION_RETIRE_COPIES, &CopyOperation{
+			Post_id: td.BookPostIdPub,
+			Copies:  []string{"zzh-book-001 b3"},
+		})
+		require.Nil(t, err)
+		assert.Equal(t, 2, td.ABookInv.Stock)
+		assert.NotContains(t, td.ABookInv.Copies, "zzh-book-001 b3")
+		assert.NotContains(t, td.ABookPri.CopyKeeperMap, "zzh-book-001 b3")
+		assert.Equal(t, []string{"kpuser1"}, td.ABookPri.KeeperUsers)
+		assert.Equal(t, KeeperInfoMap{"kpuser1": {"kpname1"}}, td.ABookPri.KeeperInfos)
+	})
+
+	t.Run("retire_lent_copy", func(t *testing.T) {
+		td, plugin, _ := setup()
+		td.ABookInv.Stock = 2
+		td.ABookInv.Lending = 1
+		td.ABookInv.Copies["zzh-book-001 b2"] = BookCopy{Status: COPY_STATUS_LENDING}
+
+		_, err := plugin._operateCopies(BOOKS_ACTION_RETIRE_COPIES, &CopyOperation{
+			Post_id: td.BookPostIdPub,
+			Copies:  []string{"zzh-book-001 b1", "zzh-book-001 b2"},
+		})
+		assert.ErrorIs(t, err, ErrChooseInStockCopy)
+		assert.Equal(t, 2, td.ABookInv.Stock)
+		assert.Contains(t, td.ABookInv.Copies, "zzh-book-001 b1")
+	})
+
+	t.Run("retire_unknown_copy", func(t *testing.T) {
+		td, plugin, _ := setup()
+
+		_, err := plugin._operateCopies(BOOKS_ACTION_RETIRE_COPIES, &CopyOperation{
+			Post_id: td.BookPostIdPub,
+			Copies:  []string{"zzh-book-001 b9"},
+		})
+		assert.ErrorIs(t, err, ErrNotFound)
+	})
+
+	t.Run("reassign_copy", func(t *testing.T) {
+		td, plugin, _ := setup()
+
+		_, err := plugin._operateCopies(BOOKS_ACTION_REASSIGN_COPIES, &CopyOperation{
+			Post_id: td.BookPostIdPub,
+			Copies:  []string{"zzh-book-001 b1"},
+			Keeper:  "kpuser2",
+		})
+		require.Nil(t, err)
+		assert.Equal(t, Keeper{User: "kpuser2"}, td.ABookPri.CopyKeeperMap["zzh-book-001 b1"])
+		assert.Equal(t, []string{"kpuser1", "kpuser2"}, td.ABookPri.KeeperUsers)
+		assert.Equal(t, 3, td.ABookInv.Stock)
+	})
+
+	t.Run("reassign_all_copies_of_a_keeper", func(t *testing.T) {
+		td, plugin, _ := setup()
+
+		_, err := plugin._operateCopies(BOOKS_ACTION_REASSIGN_COPIES, &CopyOperation{
+			Post_id: td.BookPostIdPub,
+			Copies:  []string{"zzh-book-001 b1", "zzh-book-001 b2"},
+			Keeper:  "worker2",
+		})
+		require.Nil(t, err)
+		assert.Equal(t, []string{"kpuser2", "worker2"}, td.ABookPri.KeeperUsers)
+		assert.Equal(t, KeeperInfoMap{
+			"kpuser2": {"kpname2"},
+			"worker2": {"wkname2"},
+		}, td.ABookPri.KeeperInfos)
+		roles, err := plugin._getUserRoles(td.Worker2Id)
+		require.Nil(t, err)
+		assert.Equal(t, []string{ROLE_LIBWORKER, ROLE_KEEPER, ROLE_BORROWER}, roles, "a new keeper")
+	})
+
+	t.Run("upload_copy_keeper_not_in_keepers", func(t *testing.T) {
+		td, plugin, api := setup()
+		api.On("SearchPostsInTeam", plugin.team.Id, mock.AnythingOfType("[]*model.SearchParams")).
+			Return([]*model.Post{}, nil)
+
+		var book Book
+		DeepCopy(&book, td.ABook)
+		book.BookPrivate.KeeperUsers = []string{"kpuser1"}
+		book.BookPrivate.CopyKeeperMap["zzh-book-001 b3"] = Keeper{User: "kpuser2"}
+		book.Upload = &Upload{Post_id: td.BookPostIdPub}
+
+		msg, err := plugin._uploadABook(&book, uploadOptions{})
+		assert.ErrorIs(t, err, ErrInvalidCopyKeeper)
+		assert.Equal(t, BOOK_UPLOAD_ERROR, msg.Status)
+		assert.Equal(t, []string{"kpuser1", "kpuser2"}, td.ABookPri.KeeperUsers)
+
+		book.Upload = nil
+		book.BookPublic.Id = "zzh-book-new"
+		_, err = plugin._createABook(&book)
+		assert.ErrorIs(t, err, ErrInvalidCopyKeeper)
+	})
+
+	t.Run("upload_new_keeper", func(t *testing.T) {
+		td, plugin, api := setup()
+		api.On("SearchPostsInTeam", plugin.team.Id, mock.AnythingOfType("[]*model.SearchParams")).
+			Return([]*model.Post{}, nil)
+
+		var book Book
+		DeepCopy(&book, td.ABook)
+		book.BookPrivate.KeeperUsers = append(book.BookPrivate.KeeperUsers, "worker2")
+		book.BookPrivate.CopyKeeperMap["zzh-book-001 b3"] = Keeper{User: "worker2"}
+		book.Upload = &Upload{Post_id: td.BookPostIdPub}
+
+		msg, err := plugin._uploadABook(&book, uploadOptions{})
+		require.Nil(t, err)
+		assert.Equal(t, BOOK_UPLOAD_SUCC, msg.Status)
+		roles, err := plugin._getUserRoles(td.Worker2Id)
+		require.Nil(t, err)
+		assert.Equal(t, []string{ROLE_LIBWORKER, ROLE_KEEPER, ROLE_BORROWER}, roles)
+	})
+
+	t.Run("upload_failed_no_keeper_role", func(t *testing.T) {
+		td, plugin, api := setup()
+		api.On("SearchPostsInTeam", plugin.team.Id, mock.AnythingOfType("[]*model.SearchParams")).
+			Return([]*model.Post{}, nil)
+		plugin.repo = &failingUpdateRepository{Repository: plugin._repo()}
+
+		var book Book
+		DeepCopy(&book, td.ABook)
+		book.BookPrivate.KeeperUsers = append(book.BookPrivate.KeeperUsers, "worker2")
+		book.BookPrivate.CopyKeeperMap["zzh-book-001 b3"] = Keeper{User: "worker2"}
+		book.Upload = &Upload{Post_id: td.BookPostIdPub}
+
+		_, err := plugin._uploadABook(&book, uploadOptions{})
+		assert.NotNil(t, err)
+		roles, err := plugin._getUserRoles(td.Worker2Id)
+		require.Nil(t, err)
+		assert.Equal(t, []string{ROLE_LIBWORKER, ROLE_BORROWER}, roles, "not granted")
+	})
+
+	t.Run("stale", func(t *testing.T) {
+		td, plugin, _ := setup()
+
+		_, err := plugin._operateCopies(BOOKS_ACTION_RETIRE_COPIES, &CopyOperation{
+			Post_id: td.BookPostIdPub,
+			Etag:    model.NewId(),
+			Copies:  []string{"zzh-book-001 b1"},
+		})
+		assert.ErrorIs(t, err, ErrStale)
+	})
+}
@@ -0,0 +1,416 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/mattermost/mattermost-server/v5/model"
+	"github.com/pkg/errors"
+)
+
+type donationWithPost struct {
+	post     *model.Post
+	donation *Donation
+}
+
+// Anyone can offer copies of a book, reviewed by a libworker.
+func (p *Plugin) _offerDonation(userId string, offer *DonationOffer) (string, error) {
+	name := strings.TrimSpace(offer.BookName)
+	if name == "" {
+		return "", KindError(ErrInvalidRequest, "book name is required.")
+	}
+	copies := offer.Copies
+	if copies == 0 {
+		copies = 1
+	}
+	if copies < 0 {
+		return "", KindError(ErrInvalidRequest, "copies should be at least 1.")
+	}
+
+	var isbn13 string
+	if offer.Isbn != "" {
+		var err error
+		if _, isbn13, err = NormalizeIsbn(offer.Isbn); err != nil {
+			return "", err
+		}
+	}
+
+	donor, appErr := p.API.GetUser(userId)
+	if appErr != nil {
+		return "", errors.Wrapf(appErr, "get donor error.")
+	}
+	donorName, err := p._getDisplayNameByUser(donor.Username)
+	if err != nil {
+		return "", errors.Wrapf(err, "Failed to get donor display name. user:%s", donor.Username)
+	}
+
+	master := &DonationRequest{
+		BookName:   name,
+		BookId:     strings.TrimSpace(offer.BookId),
+		Author:     strings.TrimSpace(offer.Author),
+		Isbn13:     isbn13,
+		Copies:     copies,
+		DonorUser:  donor.Username,
+		DonorName:  donorName,
+		DonorKeeps: offer.DonorKeeps,
+		Note:       strings.TrimSpace(offer.Note),
+		Worflow:    p._createDonationWFTemplate(GetNowTime()),
+		StepIndex:  0,
+		MatchId:    model.NewId(),
+	}
+	p._resetDonationTags(master)
+
+	data, err := _marshalRecord(&Donation{
+		DataOrImage: master,
+		Role:        []string{MASTER},
+	})
+	if err != nil {
+		return "", errors.Wrapf(err, "Marshal donation error.")
+	}
+
+	post, err := p._repo().Create(&model.Post{
+		UserId:    p.botID,
+		ChannelId: p.borrowChannel.Id,
+		Message:   string(data),
+		Type:      "custom_donation_type",
+	})
+	if err != nil {
+		return "", errors.Wrapf(err, "Failed to post a donation record.")
+	}
+
+	return post.Id, nil
+}
+
+func (p *Plugin) _createDonationWFTemplate(prt int64) []Step {
+	return []Step{
+		{
+			WorkflowType:        WORKFLOW_DONATION,
+			Status:              DONATION_STATUS_OFFERED,
+			ActorRole:           ROLE_LIBWORKER,
+			Completed:           true,
+			ActionDate:          prt,
+			NextStepIndex:       []int{1, 2},
+			RelatedRoles:        []string{MASTER},
+			LastActualStepIndex: -1,
+		},
+		{
+			WorkflowType:        WORKFLOW_DONATION,
+			Status:              DONATION_STATUS_ACCEPTED,
+			ActorRole:           "",
+			Completed:           false,
+			ActionDate:          0,
+			NextStepIndex:       nil,
+			RelatedRoles:        []string{MASTER},
+			LastActualStepIndex: -1,
+		},
+		{
+			WorkflowType:        WORKFLOW_DONATION,
+			Status:              DONATION_STATUS_REJECTED,
+			ActorRole:           "",
+			Completed:           false,
+			ActionDate:          0,
+			NextStepIndex:       nil,
+			RelatedRoles:        []string{MASTER},
+			LastActualStepIndex: -1,
+		},
+	}
+}
+
+func (p *Plugin) _resetDonationTags(dr *DonationRequest) {
+	dr.Tags = []string{
+		TAG_PREFIX_DONOR + dr.DonorUser,
+		TAG_PREFIX_STATUS + dr.Worflow[dr.StepIndex].Status,
+	}
+	if dr.Isbn13 != "" {
+		dr.Tags = append(dr.Tags, TAG_PREFIX_ISBN+dr.Isbn13)
+	}
+}
+
+// Accept or reject an offer by a libworker, or delete it.
+// The donor can withdraw the offer before it is reviewed.
+func (p *Plugin) _processDonationRequest(userId string, req *DonationWorkflowRequest) error {
+
+	if req.Backward {
+		return KindError(ErrInvalidRequest, "a donation can't go backward, delete it instead.")
+	}
+
+	actor, appErr := p.API.GetUser(userId)
+	if appErr != nil {
+		return errors.Wrapf(appErr, "get actor error.")
+	}
+
+	dwp, err := p._lockAndGetDonation(req.MasterPostKey)
+	if errors.Is(err, ErrLocked) {
+		return err
+	}
+	defer lockmap.Delete(req.MasterPostKey)
+	if err != nil {
+		return err
+	}
+
+	master := dwp.donation.DataOrImage
+	if master.MatchId != req.Etag {
+		return WithDetails(errors.Wrapf(ErrStale, "Get %v donation stale", MASTER),
+			ErrorDetails{ERROR_DETAIL_ETAG: master.MatchId})
+	}
+
+	currStep := &master.Worflow[master.StepIndex]
+
+	if req.Delete {
+		donorWithdraws := actor.Username == master.DonorUser && currStep.Status == DONATION_STATUS_OFFERED
+		if !donorWithdraws {
+			if err := p._checkRole(userId, ROLE_LIBRARY_ADMIN); err != nil {
+				return errors.Wrapf(err, "only an admin or the donor before review can delete a donation.")
+			}
+		}
+		if err := p._repo().Delete(dwp.post.Id); err != nil {
+			return errors.Wrapf(err, "delete error, please retry or contact admin")
+		}
+		return nil
+	}
+
+	var allowed bool
+	for _, i := range currStep.NextStepIndex {
+		if i == req.NextStepIndex {
+			allowed = true
+			break
+		}
+	}
+	if !allowed {
+		return KindError(ErrRuleViolation, "step %v can't be reached from status %v", req.NextStepIndex, currStep.Status)
+	}
+	if err := p._checkRole(userId, ROLE_LIBWORKER); err != nil {
+		return err
+	}
+
+	nextStep := &master.Worflow[req.NextStepIndex]
+
+	//undo the catalog changes of an accepted donation if it's not saved
+	rollback := func() error { return nil }
+	switch nextStep.Status {
+	case DONATION_STATUS_ACCEPTED:
+		master.ReviewerUser = actor.Username
+		if rollback, err = p._acceptDonation(master, req); err != nil {
+			return err
+		}
+	case DONATION_STATUS_REJECTED:
+		master.ReviewerUser = actor.Username
+	default:
+		return errors.New(fmt.Sprintf("Unknown status: %v in workflow: %v", nextStep.Status, nextStep.WorkflowType))
+	}
+
+	nextStep.ActionDate = GetNowTime()
+	nextStep.Completed = true
+	nextStep.LastActualStepIndex = master.StepIndex
+	master.StepIndex = req.NextStepIndex
+	master.MatchId = model.NewId()
+	p._resetDonationTags(master)
+
+	if err := p._saveDonation(dwp); err != nil {
+		if rbErr := rollback(); rbErr != nil {
+			return errors.Wrapf(err, "Fatal Error: copies %v of book %v are added, but the donation is not saved, and rollback error: %v",
+				master.CopyIds, master.BookPostId, rbErr)
+		}
+		return err
+	}
+
+	//the donation is saved anyway, a failed notification is only logged
+	if err := p._notifyRecord(dwp.post, fmt.Sprintf("Status was changed to %v, by @%v.", nextStep.Status, actor.Username)); err != nil {
+		p.API.LogError("Failed to notify status change.", "err", fmt.Sprintf("%+v", err))
+	}
+
+	if err := p._notifyDonor(master); err != nil {
+		p.API.LogError("Failed to notify the donor.", "err", fmt.Sprintf("%+v", err))
+	}
+	return nil
+}
+
+// The copies are kept by the donor, or by the keeper who takes them over, the reviewer by default.
+// They go to the book with the same isbn or id, otherwise to a new book with the reviewer as its libworker.
+// The returned rollback removes the added copies, or the created book, if the donation can't be saved,
+// so a retry doesn't add them again.
+func (p *Plugin) _acceptDonation(master *DonationRequest, req *DonationWorkflowRequest) (func() error, error) {
+	keeper := master.DonorUser
+	if !master.DonorKeeps {
+		keeper = req.Keeper
+		if keeper == "" {
+			keeper = master.ReviewerUser
+		}
+	}
+	if req.BookId != "" {
+		master.BookId = req.BookId
+	}
+
+	bookPostId, err := p._findDonatedBook(master)
+	if err != nil {
+		return nil, err
+	}
+
+	if bookPostId != "" {
+		info, err := p.GetABook(bookPostId)
+		if err != nil {
+			return nil, err
+		}
+		copyIds := _newCopyIds(info.book.BookPublic.Id, info.book.BookInventory.Copies, master.Copies)
+		if err := p._applyCopyOperation(BOOKS_ACTION_ADD_COPIES, &CopyOperation{
+			Post_id: bookPostId,
+			Copies:  copyIds,
+			Keeper:  keeper,
+		}); err != nil {
+			return nil, errors.Wrapf(err, "add donated copies to book %v error.", bookPostId)
+		}
+		master.BookId = info.book.BookPublic.Id
+		master.BookPostId = bookPostId
+		master.CopyIds = copyIds
+		master.KeeperUser = keeper
+		return func() error {
+			return p._applyCopyOperation(BOOKS_ACTION_RETIRE_COPIES, &CopyOperation{
+				Post_id: bookPostId,
+				Copies:  copyIds,
+			})
+		}, nil
+	}
+
+	if master.BookId == "" {
+		return nil, KindError(ErrInvalidRequest, "book id is required for a book not in the library.")
+	}
+	book := _newBookWithCopies(&BookPublic{
+		Id:             master.BookId,
+		Name:           master.BookName,
+		Author:         master.Author,
+		Isbn13:         master.Isbn13,
+		LibworkerUsers: []string{master.ReviewerUser},
+	}, keeper, master.Copies)
+	bookPostId, err = p._createABook(book)
+	if err != nil {
+		return nil, errors.Wrapf(err, "create donated book error.")
+	}
+
+	master.BookPostId = bookPostId
+	master.CopyIds = []string{}
+	for id := range book.BookInventory.Copies {
+		master.CopyIds = append(master.CopyIds, id)
+	}
+	sort.Strings(master.CopyIds)
+	master.KeeperUser = keeper
+	return func() error {
+		return p._deleteABook(&Book{Upload: &Upload{Post_id: bookPostId}})
+	}, nil
+}
+
+// The public post of the book with the isbn, or else the id, of the donation. Empty if none.
+func (p *Plugin) _findDonatedBook(master *DonationRequest) (string, error) {
+	if master.Isbn13 != "" {
+		bookPostId, err := p._findBookPostIdByIsbn(master.Isbn13)
+		if err != nil || bookPostId != "" {
+			return bookPostId, err
+		}
+	}
+	if master.BookId != "" {
+		posts, _, err := p._findBookPostsByTag(TAG_PREFIX_ID + master.BookId)
+		if err != nil {
+			return "", err
+		}
+		if len(posts) > 0 {
+			return posts[0].Id, nil
+		}
+	}
+	return "", nil
+}
+
+func (p *Plugin) _notifyDonor(master *DonationRequest) error {
+	channel, err := p._getBotDirectChannel(master.DonorUser)
+	if err != nil {
+		return err
+	}
+
+	message := fmt.Sprintf("Sorry, your donation of %v is declined by @%v.", master.BookName, master.ReviewerUser)
+	if master.Worflow[master.StepIndex].Status == DONATION_STATUS_ACCEPTED {
+		message = fmt.Sprintf("Thank you! Your donation of %v is accepted by @%v, copies: %v, kept by @%v.",
+			master.BookName, master.ReviewerUser, strings.Join(master.CopyIds, ", "), master.KeeperUser)
+	}
+
+	if _, appErr := p.API.CreatePost(&model.Post{
+		UserId:    p.botID,
+		ChannelId: channel.Id,
+		Message:   message,
+	}); appErr != nil {
+		return errors.Wrapf(appErr, "notify donor %v error.", master.DonorUser)
+	}
+	return nil
+}
+
+func (p *Plugin) _getDonationById(id string) (*donationWithPost, error) {
+	dn := new(Donation)
+	post, err := p._getMasterRecord(id, "custom_donation_type", dn)
+	if err != nil {
+		return nil, err
+	}
+	return &donationWithPost{post: post, donation: dn}, nil
+}
+
+// The caller deletes the lock of the master key unless ErrLocked is returned.
+func (p *Plugin) _lockAndGetDonation(masterKey string) (*donationWithPost, error) {
+	dn := new(Donation)
+	post, err := p._lockAndGetMasterRecord(masterKey, "custom_donation_type", dn)
+	if err != nil {
+		return nil, err
+	}
+	return &donationWithPost{post: post, donation: dn}, nil
+}
+
+func (p *Plugin) _saveDonation(dwp *donationWithPost) error {
+	post, err := p._saveMasterRecord(dwp.post, dwp.donation)
+	if err != nil {
+		return err
+	}
+	dwp.post = post
+	return nil
+}
+
+// The donations at the status, the offered ones if status is empty. The oldest first.
+func (p *Plugin) _listDonations(status string) ([]DonationEntry, error) {
+	if status == "" {
+		status = DONATION_STATUS_OFFERED
+	}
+
+	entries := []DonationEntry{}
+	if err := p._eachMasterRecord("custom_donation_type", func(record *model.Post) {
+		var dn Donation
+		if err := json.Unmarshal([]byte(record.Message), &dn); err != nil || dn.DataOrImage == nil {
+			return
+		}
+		dr := dn.DataOrImage
+		if dr.Worflow[dr.StepIndex].Status != status {
+			return
+		}
+		entries = append(entries, DonationEntry{MasterKey: record.Id, DonationRequest: dr})
+	}); err != nil {
+		return nil, err
+	}
+
+	// listed newest first
+	for i, j := 0, len(entries)-1; i < j; i, j = i+1, j-1 {
+		entries[i], entries[j] = entries[j], entries[i]
+	}
+	return entries, nil
+}
+
+func _formatDonations(entries []DonationEntry) string {
+	if len(entries) == 0 {
+		return "No donations."
+	}
+
+	lines := []string{"| Book | Isbn | Copies | Donor | Kept by donor | Status | Id |", "|:--|:--|--:|:--|:--|:--|:--|"}
+	for _, e := range entries {
+		kept := "no"
+		if e.DonorKeeps {
+			kept = "yes"
+		}
+		lines = append(lines, fmt.Sprintf("| %v | %v | %v | @%v | %v | %v | %v |",
+			e.BookName, e.Isbn13, e.Copies, e.DonorUser, kept, e.Worflow[e.StepIndex].Status, e.MasterKey))
+	}
+	return strings.Join(lines, "\n")
+}
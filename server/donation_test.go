@@ -0,0 +1,286 @@
+package main
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/mattermost/mattermost-server/v5/model"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDonation(t *testing.T) {
+
+	const isbn = "9780306406157"
+
+	getMaster := func(t *testing.T, env *requestEnv, masterKey string) *DonationRequest {
+		dwp, err := env.plugin._getDonationById(masterKey)
+		require.Nil(t, err)
+		return dwp.donation.DataOrImage
+	}
+
+	transit := func(env *requestEnv, userId string, masterKey string, status string, req DonationWorkflowRequest) error {
+		master := getMaster(t, env, masterKey)
+		req.MasterPostKey = masterKey
+		req.NextStepIndex = _getIndexByStatus(status, master.Worflow)
+		req.Etag = master.MatchId
+		return env.plugin._processDonationRequest(userId, &req)
+	}
+
+	t.Run("give_to_existing_book", func(t *testing.T) {
+		env := newRequestEnv(nil)
+		var book Book
+		DeepCopy(&book, env.td.ABook)
+		bookPostId, err := env.plugin._createABook(&book)
+		require.Nil(t, err)
+
+		masterKey, err := env.plugin._offerDonation(env.td.BorId, &DonationOffer{
+			BookName: "a test book",
+			BookId:   "zzh-book-001",
+			Copies:   2,
+		})
+		require.Nil(t, err)
+		master := getMaster(t, env, masterKey)
+		assert.Equal(t, "bookbor", master.DonorName)
+		assert.Contains(t, master.Tags, TAG_PREFIX_DONOR+"bor")
+
+		err = transit(env, env.td.BorId, masterKey, DONATION_STATUS_ACCEPTED, DonationWorkflowRequest{})
+		assert.ErrorIs(t, err, ErrNotPermitted)
+
+		require.Nil(t, transit(env, env.td.Worker2Id, masterKey, DONATION_STATUS_ACCEPTED, DonationWorkflowRequest{Keeper: "kpuser2"}))
+
+		master = getMaster(t, env, masterKey)
+		assert.Equal(t, DONATION_STATUS_ACCEPTED, master.Worflow[master.StepIndex].Status)
+		assert.Equal(t, bookPostId, master.BookPostId)
+		assert.Equal(t, []string{"zzh-book-001 b4", "zzh-book-001 b5"}, master.CopyIds)
+		assert.Equal(t, "worker2", master.ReviewerUser)
+
+		info, err := env.plugin.GetABook(bookPostId)
+		require.Nil(t, err)
+		assert.Equal(t, 5, info.book.BookInventory.Stock)
+		assert.Equal(t, Keeper{User: "kpuser2"}, info.book.BookPrivate.CopyKeeperMap["zzh-book-001 b5"])
+
+		env.api.AssertCalled(t, "CreatePost", mock.MatchedBy(func(post *model.Post) bool {
+			return post.ChannelId == env.td.BorId_botId && post.Message ==
+				"Thank you! Your donation of a test book is accepted by @worker2, copies: zzh-book-001 b4, zzh-book-001 b5, kept by @kpuser2."
+		}))
+	})
+
+	t.Run("keep_a_new_book", func(t *testing.T) {
+		env := newRequestEnv(nil)
+
+		masterKey, err := env.plugin._offerDonation(env.td.Keeper1Id, &DonationOffer{
+			BookName:   "a new book",
+			Isbn:       isbn,
+			DonorKeeps: true,
+		})
+		require.Nil(t, err)
+		assert.Equal(t, 1, getMaster(t, env, masterKey).Copies)
+
+		err = transit(env, env.td.Worker2Id, masterKey, DONATION_STATUS_ACCEPTED, DonationWorkflowRequest{})
+		assert.ErrorIs(t, err, ErrInvalidRequest, "book id is required")
+		require.Nil(t, transit(env, env.td.Worker2Id, masterKey, DONATION_STATUS_ACCEPTED,
+			DonationWorkflowRequest{BookId: "zzh-book-200", Keeper: "kpuser2"}))
+
+		bookPostId := getMaster(t, env, masterKey).BookPostId
+		info, err := env.plugin.GetABook(bookPostId)
+		require.Nil(t, err)
+		assert.Equal(t, "zzh-book-200", info.book.BookPublic.Id)
+		assert.Equal(t, isbn, info.book.BookPublic.Isbn13)
+		assert.Equal(t, []string{"worker2"}, info.book.BookPublic.LibworkerUsers)
+		assert.Equal(t, []string{"kpuser1"}, info.book.BookPrivate.KeeperUsers, "kept by the donor")
+		assert.Equal(t, map[string]Keeper{"zzh-book-200 b1": {User: "kpuser1"}}, info.book.BookPrivate.CopyKeeperMap)
+
+		// matched by isbn
+		masterKey, err = env.plugin._offerDonation(env.td.Keeper2Id, &DonationOffer{
+			BookName:   "the same book",
+			Isbn:       "0-306-40615-2",
+			DonorKeeps: true,
+		})
+		require.Nil(t, err)
+		require.Nil(t, transit(env, env.td.Worker1Id, masterKey, DONATION_STATUS_ACCEPTED, DonationWorkflowRequest{}))
+		assert.Equal(t, bookPostId, getMaster(t, env, masterKey).BookPostId)
+
+		info, err = env.plugin.GetABook(bookPostId)
+		require.Nil(t, err)
+		assert.Equal(t, []string{"kpuser1", "kpuser2"}, info.book.BookPrivate.KeeperUsers)
+		assert.Equal(t, Keeper{User: "kpuser2"}, info.book.BookPrivate.CopyKeeperMap["zzh-book-200 b2"])
+		assert.Equal(t, 2, info.book.BookInventory.Stock)
+	})
+
+	t.Run("donor_keeps_as_keeper", func(t *testing.T) {
+		env := newRequestEnv(nil)
+
+		masterKey, err := env.plugin._offerDonation(env.td.BorId, &DonationOffer{
+			BookName:   "a new book",
+			BookId:     "zzh-book-200",
+			DonorKeeps: true,
+		})
+		require.Nil(t, err)
+		require.Nil(t, transit(env, env.td.Worker2Id, masterKey, DONATION_STATUS_ACCEPTED, DonationWorkflowRequest{}))
+
+		roles, err := env.plugin._getUserRoles(env.td.BorId)
+		require.Nil(t, err)
+		assert.Equal(t, []string{ROLE_KEEPER, ROLE_BORROWER}, roles)
+		assert.Nil(t, env.plugin._checkWorkflowPermission(env.td.BorId, &BorrowRequest{
+			BorrowerUser: "worker2",
+			KeeperUsers:  []string{"bor"},
+		}), "moves the borrows of the donated copy")
+	})
+
+	t.Run("reject_and_delete", func(t *testing.T) {
+		env := newRequestEnv(nil)
+
+		_, err := env.plugin._offerDonation(env.td.BorId, &DonationOffer{BookName: " "})
+		assert.ErrorIs(t, err, ErrInvalidRequest)
+		_, err = env.plugin._offerDonation(env.td.BorId, &DonationOffer{BookName: "a book", Copies: -1})
+		assert.ErrorIs(t, err, ErrInvalidRequest)
+		_, err = env.plugin._offerDonation(env.td.BorId, &DonationOffer{BookName: "a book", Isbn: "123"})
+		assert.ErrorIs(t, err, ErrInvalidIsbn)
+
+		masterKey, err := env.plugin._offerDonation(env.td.BorId, &DonationOffer{BookName: "a book"})
+		require.Nil(t, err)
+		require.Nil(t, transit(env, env.td.Worker2Id, masterKey, DONATION_STATUS_REJECTED, DonationWorkflowRequest{}))
+		err = transit(env, env.td.Worker2Id, masterKey, DONATION_STATUS_ACCEPTED, DonationWorkflowRequest{})
+		assert.ErrorIs(t, err, ErrRuleViolation)
+		env.api.AssertCalled(t, "CreatePost", mock.MatchedBy(func(post *model.Post) bool {
+			return post.ChannelId == env.td.BorId_botId && strings.Contains(post.Message, "declined by @worker2")
+		}))
+
+		remove := func(userId string, masterKey string) error {
+			return env.plugin._processDonationRequest(userId, &DonationWorkflowRequest{WorkflowRequest: WorkflowRequest{
+				MasterPostKey: masterKey,
+				Delete:        true,
+				Etag:          getMaster(t, env, masterKey).MatchId,
+			}})
+		}
+		assert.ErrorIs(t, remove(env.td.BorId, masterKey), ErrNotPermitted, "reviewed already")
+		require.Nil(t, remove(env.td.Worker1Id, masterKey))
+
+		masterKey, err = env.plugin._offerDonation(env.td.BorId, &DonationOffer{BookName: "another book"})
+		require.Nil(t, err)
+		assert.ErrorIs(t, remove(env.td.Worker2Id, masterKey), ErrNotPermitted)
+		require.Nil(t, remove(env.td.BorId, masterKey))
+		_, err = env.plugin._getDonationById(masterKey)
+		assert.ErrorIs(t, err, ErrNotFound)
+	})
+
+	t.Run("donor_not_notified", func(t *testing.T) {
+		env := newRequestEnv(failNotifyingBor)
+
+		masterKey, err := env.plugin._offerDonation(env.td.BorId, &DonationOffer{BookName: "a book"})
+		require.Nil(t, err)
+		require.Nil(t, transit(env, env.td.Worker2Id, masterKey, DONATION_STATUS_REJECTED, DonationWorkflowRequest{}),
+			"the donation is rejected anyway")
+		master := getMaster(t, env, masterKey)
+		assert.Equal(t, DONATION_STATUS_REJECTED, master.Worflow[master.StepIndex].Status)
+		env.api.AssertCalled(t, "LogError", "Failed to notify the donor.", "err", mock.AnythingOfType("string"))
+	})
+
+	t.Run("not_saved_copies_removed", func(t *testing.T) {
+		env := newRequestEnv(nil)
+		var book Book
+		DeepCopy(&book, env.td.ABook)
+		bookPostId, err := env.plugin._createABook(&book)
+		require.Nil(t, err)
+
+		masterKey, err := env.plugin._offerDonation(env.td.BorId, &DonationOffer{
+			BookName: "a test book",
+			BookId:   "zzh-book-001",
+			Copies:   2,
+		})
+		require.Nil(t, err)
+
+		repo := env.plugin.repo
+		env.plugin.repo = &failingUpdateRepository{Repository: repo, id: masterKey}
+		assert.NotNil(t, transit(env, env.td.Worker2Id, masterKey, DONATION_STATUS_ACCEPTED, DonationWorkflowRequest{}))
+		env.plugin.repo = repo
+
+		assert.Equal(t, DONATION_STATUS_OFFERED, getMaster(t, env, masterKey).Worflow[0].Status)
+		info, err := env.plugin.GetABook(bookPostId)
+		require.Nil(t, err)
+		assert.Equal(t, 3, info.book.BookInventory.Stock)
+		assert.NotContains(t, info.book.BookInventory.Copies, "zzh-book-001 b4")
+
+		// a retry adds the copies once
+		require.Nil(t, transit(env, env.td.Worker2Id, masterKey, DONATION_STATUS_ACCEPTED, DonationWorkflowRequest{}))
+		info, err = env.plugin.GetABook(bookPostId)
+		require.Nil(t, err)
+		assert.Equal(t, 5, info.book.BookInventory.Stock)
+	})
+
+	t.Run("not_saved_book_removed", func(t *testing.T) {
+		env := newRequestEnv(nil)
+		masterKey, err := env.plugin._offerDonation(env.td.Keeper1Id, &DonationOffer{
+			BookName:   "a new book",
+			Isbn:       isbn,
+			DonorKeeps: true,
+		})
+		require.Nil(t, err)
+
+		repo := env.plugin.repo
+		env.plugin.repo = &failingUpdateRepository{Repository: repo, id: masterKey}
+		assert.NotNil(t, transit(env, env.td.Worker2Id, masterKey, DONATION_STATUS_ACCEPTED,
+			DonationWorkflowRequest{BookId: "zzh-book-200"}))
+		env.plugin.repo = repo
+
+		bookPostId, err := env.plugin._findBookPostIdByIsbn(isbn)
+		require.Nil(t, err)
+		assert.Empty(t, bookPostId)
+
+		require.Nil(t, transit(env, env.td.Worker2Id, masterKey, DONATION_STATUS_ACCEPTED,
+			DonationWorkflowRequest{BookId: "zzh-book-200"}))
+		assert.NotEmpty(t, getMaster(t, env, masterKey).BookPostId)
+	})
+
+	t.Run("command", func(t *testing.T) {
+		env := newRequestEnv(nil)
+
+		text, err := env.plugin._executeDonate(env.td.BorId, []string{"offer", "lend", "1", "a", "book"})
+		require.Nil(t, err)
+		assert.True(t, strings.HasPrefix(text, "Usage:"))
+		_, err = env.plugin._executeDonate(env.td.BorId, []string{"offer", "give", "none", "a", "book"})
+		assert.ErrorIs(t, err, ErrInvalidRequest)
+
+		_, err = env.plugin._executeDonate(env.td.BorId, []string{"offer", "give", "2", "a", "given", "book", isbn})
+		require.Nil(t, err)
+		_, err = env.plugin._executeDonate(env.td.Keeper1Id, []string{"offer", "keep", "1", "a", "kept", "book"})
+		require.Nil(t, err)
+
+		entries, err := env.plugin._listDonations("")
+		require.Nil(t, err)
+		require.Equal(t, 2, len(entries))
+		var given, kept string
+		for _, e := range entries {
+			switch e.BookName {
+			case "a given book":
+				assert.Equal(t, isbn, e.Isbn13)
+				assert.Equal(t, 2, e.Copies)
+				assert.False(t, e.DonorKeeps)
+				given = e.MasterKey
+			case "a kept book":
+				assert.True(t, e.DonorKeeps)
+				kept = e.MasterKey
+			}
+		}
+
+		text, err = env.plugin._executeDonate(env.td.Worker2Id, []string{"list"})
+		require.Nil(t, err)
+		assert.Contains(t, text, "| a given book | "+isbn+" | 2 | @bor | no | DO | "+given+" |")
+
+		text, err = env.plugin._executeDonate(env.td.Worker2Id, []string{"accept", given, "zzh-book-300"})
+		require.Nil(t, err)
+		assert.Equal(t, "Succ. The donation of a given book is DA.", text)
+		info, err := env.plugin.GetABook(getMaster(t, env, given).BookPostId)
+		require.Nil(t, err)
+		assert.Equal(t, []string{"worker2"}, info.book.BookPrivate.KeeperUsers, "handed over to the reviewer")
+
+		_, err = env.plugin._executeDonate(env.td.Keeper1Id, []string{"withdraw", kept})
+		require.Nil(t, err)
+
+		entries, err = env.plugin._listDonations(DONATION_STATUS_ACCEPTED)
+		require.Nil(t, err)
+		assert.Equal(t, 1, len(entries))
+	})
+}
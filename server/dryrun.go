@@ -0,0 +1,190 @@
+package main
+
+import (
+	"encoding/json"
+	"reflect"
+	"sort"
+)
+
+const (
+	BOOK_DRYRUN_CREATE    = "create"
+	BOOK_DRYRUN_UPDATE    = "update"
+	BOOK_DRYRUN_DELETE    = "delete"
+	BOOK_DRYRUN_UNCHANGED = "unchanged"
+)
+
+// FieldDiff is a changed field of a book part. Field is the json name,
+// a changed entry of a map field is named as "field.key".
+type FieldDiff struct {
+	Part  string      `json:"part"`
+	Field string      `json:"field"`
+	Old   interface{} `json:"old"`
+	New   interface{} `json:"new"`
+}
+
+// fields maintained by the plugin, they always change and say nothing to the uploader
+var dryRunIgnoredFields = map[string]bool{
+	"match_id":      true,
+	"relations_pub": true,
+	"relations_pri": true,
+	"relations_inv": true,
+}
+
+// Run all the checks of a real upload without writing anything,
+// and report what would be changed.
+func (p *Plugin) _dryRunABook(book *Book) (*BooksMessage, error) {
+
+	bookupl := book.Upload
+	if bookupl == nil {
+		bookupl = &Upload{}
+	}
+
+	var (
+		action string
+		diffs  []FieldDiff
+	)
+
+	switch {
+	case bookupl.Post_id != "" && bookupl.Delete:
+		old, err := p._planDeleteABook(bookupl.Post_id, bookupl.Etag)
+		if err != nil {
+			return &BooksMessage{
+				PostId:  bookupl.Post_id,
+				Status:  BOOK_UPLOAD_ERROR,
+				Message: err.Error(),
+			}, err
+		}
+		action = BOOK_DRYRUN_DELETE
+		diffs = _diffBookParts(old.book.BookPublic, old.book.BookPrivate, old.book.BookInventory, nil, nil, nil)
+
+	case bookupl.Post_id != "":
+		plan, err := p._planUpdateABook(book)
+		if err != nil {
+			return &BooksMessage{
+				PostId:  bookupl.Post_id,
+				Status:  BOOK_UPLOAD_ERROR,
+				Message: err.Error(),
+			}, err
+		}
+		var oldPri *BookPrivate
+		if plan.opts.pri != nil {
+			oldPri = plan.oldPri
+		}
+		var oldInv *BookInventory
+		if plan.opts.inv != nil {
+			oldInv = plan.oldInv
+		}
+		diffs = _diffBookParts(plan.oldPub, oldPri, oldInv, plan.opts.pub, plan.opts.pri, plan.opts.inv)
+		action = BOOK_DRYRUN_UPDATE
+		if len(diffs) == 0 {
+			action = BOOK_DRYRUN_UNCHANGED
+		}
+
+	default:
+		if err := p._checkCreateABook(book); err != nil {
+			return &BooksMessage{
+				PostId:  "",
+				Status:  BOOK_UPLOAD_ERROR,
+				Message: err.Error(),
+			}, err
+		}
+		action = BOOK_DRYRUN_CREATE
+		diffs = _diffBookParts(nil, nil, nil, book.BookPublic, book.BookPrivate, book.BookInventory)
+	}
+
+	return &BooksMessage{
+		PostId:  bookupl.Post_id,
+		Status:  BOOK_UPLOAD_SUCC,
+		Message: "Dry run, nothing is written.",
+		Action:  action,
+		Diffs:   diffs,
+	}, nil
+}
+
+// A nil part on both sides means the part is not touched.
+func _diffBookParts(oldPub *BookPublic, oldPri *BookPrivate, oldInv *BookInventory,
+	newPub *BookPublic, newPri *BookPrivate, newInv *BookInventory) []FieldDiff {
+
+	diffs := []FieldDiff{}
+
+	for _, part := range []struct {
+		name string
+		old  interface{}
+		new  interface{}
+	}{
+		{REL_BOOK_PUBLIC, oldPub, newPub},
+		{REL_BOOK_PRIVATE, oldPri, newPri},
+		{REL_BOOK_INVENTORY, oldInv, newInv},
+	} {
+		oldMap := _toFieldMap(part.old)
+		newMap := _toFieldMap(part.new)
+		if oldMap == nil && newMap == nil {
+			continue
+		}
+		diffs = append(diffs, _diffFieldMaps(part.name, oldMap, newMap)...)
+	}
+
+	return diffs
+}
+
+func _toFieldMap(part interface{}) map[string]interface{} {
+	if part == nil || reflect.ValueOf(part).IsNil() {
+		return nil
+	}
+	data, err := json.Marshal(part)
+	if err != nil {
+		return nil
+	}
+	fields := map[string]interface{}{}
+	if err := json.Unmarshal(data, &fields); err != nil {
+		return nil
+	}
+	return fields
+}
+
+func _diffFieldMaps(part string, oldMap map[string]interface{}, newMap map[string]interface{}) []FieldDiff {
+	diffs := []FieldDiff{}
+
+	for _, name := range _unionKeys(oldMap, newMap) {
+		if dryRunIgnoredFields[name] {
+			continue
+		}
+		oldVal := oldMap[name]
+		newVal := newMap[name]
+		if reflect.DeepEqual(oldVal, newVal) {
+			continue
+		}
+
+		//go into map fields such as copies, so that a changed copy is reported by itself
+		oldSub, oldIsMap := oldVal.(map[string]interface{})
+		newSub, newIsMap := newVal.(map[string]interface{})
+		if (oldIsMap || oldVal == nil) && (newIsMap || newVal == nil) && (oldIsMap || newIsMap) {
+			for _, key := range _unionKeys(oldSub, newSub) {
+				if !reflect.DeepEqual(oldSub[key], newSub[key]) {
+					diffs = append(diffs, FieldDiff{part, name + "." + key, oldSub[key], newSub[key]})
+				}
+			}
+			continue
+		}
+
+		diffs = append(diffs, FieldDiff{part, name, oldVal, newVal})
+	}
+
+	return diffs
+}
+
+func _unionKeys(a map[string]interface{}, b map[string]interface{}) []string {
+	set := map[string]bool{}
+	for k := range a {
+		set[k] = true
+	}
+	for k := range b {
+		set[k] = true
+	}
+	keys := []string{}
+	for k := range set {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
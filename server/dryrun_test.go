@@ -0,0 +1,131 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/mattermost/mattermost-server/v5/model"
+	"github.com/mattermost/mattermost-server/v5/plugin/plugintest"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDryRun(t *testing.T) {
+
+	setup := func() (*TestData, *Plugin, *plugintest.API) {
+		td := NewTestData()
+		plugin := td.NewMockPlugin()
+		api := td.ApiMockCommon()
+		plugin.SetAPI(api)
+		api.On("SearchPostsInTeam", plugin.team.Id, mock.AnythingOfType("[]*model.SearchParams")).
+			Return([]*model.Post{}, nil)
+		return td, plugin, api
+	}
+
+	dryRun := uploadOptions{dryRun: true}
+
+	t.Run("update_diffs", func(t *testing.T) {
+		td, plugin, api := setup()
+
+		var book Book
+		DeepCopy(&book, td.ABook)
+		book.BookPublic.Name = "a renamed book"
+		book.BookInventory.Stock = 4
+		book.BookInventory.Copies["zzh-book-001 b4"] = BookCopy{Status: COPY_STATUS_INSTOCK}
+		book.BookPrivate.CopyKeeperMap["zzh-book-001 b4"] = Keeper{User: "kpuser2"}
+		book.Upload = &Upload{Post_id: td.BookPostIdPub}
+
+		msg, err := plugin._uploadABook(&book, dryRun)
+		require.Nil(t, err)
+		assert.Equal(t, BOOK_UPLOAD_SUCC, msg.Status)
+		assert.Equal(t, BOOK_DRYRUN_UPDATE, msg.Action)
+		assert.Contains(t, msg.Diffs, FieldDiff{REL_BOOK_PUBLIC, "name_pub", "a test book", "a renamed book"})
+		assert.Contains(t, msg.Diffs, FieldDiff{REL_BOOK_INVENTORY, "stock", float64(3), float64(4)})
+		assert.Contains(t, msg.Diffs, FieldDiff{REL_BOOK_INVENTORY, "copies.zzh-book-001 b4",
+			nil, map[string]interface{}{"status": COPY_STATUS_INSTOCK}})
+
+		assert.Equal(t, "a test book", td.ABookPub.Name)
+		assert.Equal(t, 3, td.ABookInv.Stock)
+		api.AssertNotCalled(t, "UpdatePost", mock.Anything)
+	})
+
+	t.Run("update_unchanged", func(t *testing.T) {
+		td, plugin, _ := setup()
+		td.ABookPub.Tags = []string{"#id_zzh-book-001", "#c1_C1", "#c2_C2", "#c3_C3"}
+
+		var book Book
+		DeepCopy(&book, td.ABook)
+		book.Upload = &Upload{Post_id: td.BookPostIdPub}
+
+		msg, err := plugin._uploadABook(&book, dryRun)
+		require.Nil(t, err)
+		assert.Equal(t, BOOK_DRYRUN_UNCHANGED, msg.Action)
+		assert.Empty(t, msg.Diffs)
+	})
+
+	t.Run("update_stale_etag", func(t *testing.T) {
+		td, plugin, _ := setup()
+
+		var book Book
+		DeepCopy(&book, td.ABook)
+		book.Upload = &Upload{Post_id: td.BookPostIdPub, Etag: model.NewId()}
+
+		msg, err := plugin._uploadABook(&book, dryRun)
+		assert.NotNil(t, err)
+		assert.Equal(t, BOOK_UPLOAD_ERROR, msg.Status)
+	})
+
+	t.Run("update_delete_lent_copy", func(t *testing.T) {
+		td, plugin, api := setup()
+		td.ABookInv.Copies["zzh-book-001 b2"] = BookCopy{Status: COPY_STATUS_LENDING}
+
+		var book Book
+		DeepCopy(&book, td.ABook)
+		delete(book.BookInventory.Copies, "zzh-book-001 b2")
+		delete(book.BookPrivate.CopyKeeperMap, "zzh-book-001 b2")
+		book.Upload = &Upload{Post_id: td.BookPostIdPub}
+
+		msg, err := plugin._uploadABook(&book, dryRun)
+		assert.NotNil(t, err)
+		assert.Equal(t, BOOK_UPLOAD_ERROR, msg.Status)
+		assert.Contains(t, msg.Message, "cannot delete copy")
+		api.AssertNotCalled(t, "UpdatePost", mock.Anything)
+	})
+
+	t.Run("delete", func(t *testing.T) {
+		td, plugin, api := setup()
+
+		msg, err := plugin._uploadABook(&Book{
+			Upload: &Upload{Post_id: td.BookPostIdPub, Delete: true},
+		}, dryRun)
+		require.Nil(t, err)
+		assert.Equal(t, BOOK_DRYRUN_DELETE, msg.Action)
+		assert.Contains(t, msg.Diffs, FieldDiff{REL_BOOK_PUBLIC, "id_pub", "zzh-book-001", nil})
+		api.AssertNotCalled(t, "DeletePost", mock.Anything)
+	})
+
+	t.Run("delete_not_returned", func(t *testing.T) {
+		td, plugin, _ := setup()
+		td.ABookInv.Lending = 1
+
+		msg, err := plugin._uploadABook(&Book{
+			Upload: &Upload{Post_id: td.BookPostIdPub, Delete: true},
+		}, dryRun)
+		assert.NotNil(t, err)
+		assert.Equal(t, BOOK_UPLOAD_ERROR, msg.Status)
+	})
+
+	t.Run("create", func(t *testing.T) {
+		td, plugin, api := setup()
+
+		var book Book
+		DeepCopy(&book, td.ABook)
+		book.BookPublic.Id = "zzh-book-new"
+
+		msg, err := plugin._uploadABook(&book, dryRun)
+		require.Nil(t, err)
+		assert.Equal(t, BOOK_DRYRUN_CREATE, msg.Action)
+		assert.Contains(t, msg.Diffs, FieldDiff{REL_BOOK_PUBLIC, "id_pub", nil, "zzh-book-new"})
+		api.AssertNotCalled(t, "CreatePost", mock.Anything)
+	})
+}
@@ -0,0 +1,375 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// A rule tells whether a borrower may borrow a book.
+// A rule not met denies the borrow, or only warns, with the reason as a coded error.
+// A failure to check is a deny too, a borrow is never let through by mistake.
+type eligibilityRule interface {
+	check(p *Plugin, req *eligibilityRequest) eligibilityResult
+}
+
+type eligibilityRequest struct {
+	brk  *BorrowRequestKey
+	info *bookInfo
+	now  time.Time
+
+	//loaded once by the first rule asking for them
+	openBorrows       []openBorrow
+	openBorrowsErr    error
+	openBorrowsLoaded bool
+}
+
+// The open borrows of the borrower, shared by the rules of a check.
+func (req *eligibilityRequest) _openBorrows(p *Plugin) ([]openBorrow, error) {
+	if !req.openBorrowsLoaded {
+		req.openBorrows, req.openBorrowsErr = p._openBorrowsOf(req.brk.BorrowerUser)
+		req.openBorrowsLoaded = true
+	}
+	return req.openBorrows, req.openBorrowsErr
+}
+
+type eligibilityResult struct {
+	outcome string
+	reason  error
+}
+
+func _allow() eligibilityResult {
+	return eligibilityResult{outcome: ELIGIBILITY_ALLOW}
+}
+
+func _deny(reason error) eligibilityResult {
+	return eligibilityResult{outcome: ELIGIBILITY_DENY, reason: reason}
+}
+
+type eligibilityRuleEntry struct {
+	name     string
+	warnOnly bool
+	rule     eligibilityRule
+}
+
+// A rule configured as warn_only never denies.
+func (e eligibilityRuleEntry) check(p *Plugin, req *eligibilityRequest) eligibilityResult {
+	result := e.rule.check(p, req)
+	if result.outcome == ELIGIBILITY_DENY && e.warnOnly {
+		result.outcome = ELIGIBILITY_WARN
+	}
+	return result
+}
+
+var eligibilityRuleFactories = map[string]func(cfg EligibilityRuleConfig) (eligibilityRule, error){
+	ELIGIBILITY_RULE_SUSPENSION: func(EligibilityRuleConfig) (eligibilityRule, error) {
+		return suspensionRule{}, nil
+	},
+	ELIGIBILITY_RULE_STOCK: func(EligibilityRuleConfig) (eligibilityRule, error) {
+		return stockRule{}, nil
+	},
+	ELIGIBILITY_RULE_CONCURRENT_LIMIT: func(cfg EligibilityRuleConfig) (eligibilityRule, error) {
+		if cfg.Limit < 0 {
+			return nil, errors.New("limit can not be negative")
+		}
+		return concurrentLimitRule{limit: cfg.Limit}, nil
+	},
+	ELIGIBILITY_RULE_CATEGORY: func(cfg EligibilityRuleConfig) (eligibilityRule, error) {
+		if len(cfg.Categories) == 0 {
+			return nil, errors.New("categories are required")
+		}
+		if err := _validateRoles(cfg.Roles); err != nil {
+			return nil, err
+		}
+		return categoryRule{categories: ConvertStringArrayToSet(cfg.Categories), roles: cfg.Roles}, nil
+	},
+	ELIGIBILITY_RULE_DUPLICATE: func(EligibilityRuleConfig) (eligibilityRule, error) {
+		return duplicateRule{}, nil
+	},
+}
+
+// the rules before they were configurable
+var defaultEligibilityRules = []EligibilityRuleConfig{
+	{Rule: ELIGIBILITY_RULE_SUSPENSION},
+	{Rule: ELIGIBILITY_RULE_STOCK},
+	{Rule: ELIGIBILITY_RULE_CONCURRENT_LIMIT},
+}
+
+func _newEligibilityRules(cfgs []EligibilityRuleConfig) ([]eligibilityRuleEntry, error) {
+	if len(cfgs) == 0 {
+		cfgs = defaultEligibilityRules
+	}
+
+	entries := []eligibilityRuleEntry{}
+	seen := map[string]bool{}
+	for _, cfg := range cfgs {
+		factory, ok := eligibilityRuleFactories[cfg.Rule]
+		if !ok {
+			return nil, errors.Errorf("unknown eligibility rule %v", cfg.Rule)
+		}
+		// a category rule may be given for each group of categories
+		if seen[cfg.Rule] && cfg.Rule != ELIGIBILITY_RULE_CATEGORY {
+			return nil, errors.Errorf("eligibility rule %v is given more than once", cfg.Rule)
+		}
+		seen[cfg.Rule] = true
+
+		rule, err := factory(cfg)
+		if err != nil {
+			return nil, errors.Wrapf(err, "invalid eligibility rule %v", cfg.Rule)
+		}
+		entries = append(entries, eligibilityRuleEntry{cfg.Rule, cfg.WarnOnly, rule})
+	}
+	return entries, nil
+}
+
+func (p *Plugin) _eligibilityRules() []eligibilityRuleEntry {
+	if p.library != nil && p.library.eligibilityRules != nil {
+		return p.library.eligibilityRules
+	}
+	entries, _ := _newEligibilityRules(nil)
+	return entries
+}
+
+// Every rule is checked, the verdicts are in the order of the rules.
+func (p *Plugin) _evaluateEligibility(req *eligibilityRequest) []eligibilityResult {
+	results := []eligibilityResult{}
+	for _, entry := range p._eligibilityRules() {
+		results = append(results, entry.check(p, req))
+	}
+	return results
+}
+
+// The first deny stops the borrow.
+// The warnings are returned to be shown with the borrow, and logged.
+func (p *Plugin) _checkConditions(brk *BorrowRequestKey, bookInfo *bookInfo) ([]EligibilityVerdict, error) {
+	req := &eligibilityRequest{brk: brk, info: bookInfo, now: time.Now()}
+
+	warnings := []EligibilityVerdict{}
+	for _, entry := range p._eligibilityRules() {
+		result := entry.check(p, req)
+		switch result.outcome {
+		case ELIGIBILITY_ALLOW:
+			continue
+		case ELIGIBILITY_DENY:
+			if errors.Is(result.reason, ErrNoStock) {
+				if err := p._disallowWithoutStock(bookInfo); err != nil {
+					return nil, err
+				}
+			}
+			return nil, result.reason
+		}
+		p.API.LogWarn("A borrow is let through with a warning.", "rule", entry.name,
+			"borrower", brk.BorrowerUser, "book", brk.BookPostId, "reason", fmt.Sprintf("%v", result.reason))
+		warnings = append(warnings, p._verdictOf(entry.name, result))
+	}
+
+	return warnings, nil
+}
+
+func (p *Plugin) _verdictOf(rule string, result eligibilityResult) EligibilityVerdict {
+	verdict := EligibilityVerdict{Rule: rule, Outcome: result.outcome}
+	if result.reason != nil {
+		verdict.Code = ErrorCodeOf(result.reason)
+		verdict.Message = p._borrowErrorText(result.reason)
+		verdict.Details = DetailsOf(result.reason)
+	}
+	return verdict
+}
+
+// A book without stock is shown as not allowed to borrow.
+func (p *Plugin) _disallowWithoutStock(bookInfo *bookInfo) error {
+	book := bookInfo.book
+	if !book.BookPublic.IsAllowedToBorrow {
+		return nil
+	}
+
+	book.BookPublic.IsAllowedToBorrow = false
+	book.BookPublic.ReasonOfDisallowed = p.i18n.GetText("no-stock")
+
+	if err := p._updateBookParts(updateOptions{
+		pub:     book.BookPublic,
+		pubPost: bookInfo.pubPost,
+	}); err != nil {
+		return errors.New("update pub error.")
+	}
+	return nil
+}
+
+// Which rules would deny or warn, if the user borrowed the book now.
+// A borrower explains for himself/herself, a libworker for anyone.
+func (p *Plugin) _explainEligibility(userId string, bookPostId string, borrowerUser string) (*EligibilityExplanation, error) {
+	if borrowerUser == "" {
+		user, appErr := p.API.GetUser(userId)
+		if appErr != nil {
+			return nil, errors.Wrapf(appErr, "get user %v error.", userId)
+		}
+		borrowerUser = user.Username
+	}
+	borrowerUser = strings.TrimPrefix(borrowerUser, "@")
+
+	borrower, appErr := p.API.GetUserByUsername(borrowerUser)
+	if appErr != nil {
+		return nil, errors.Wrapf(ErrNotFound, "user %v: %v", borrowerUser, appErr.Error())
+	}
+	if borrower.Id != userId {
+		if err := p._checkRole(userId, ROLE_LIBWORKER); err != nil {
+			return nil, err
+		}
+	}
+
+	info, err := p.GetABook(bookPostId)
+	if err != nil {
+		return nil, err
+	}
+
+	brk := &BorrowRequestKey{BookPostId: bookPostId, BorrowerUser: borrowerUser}
+	results := p._evaluateEligibility(&eligibilityRequest{brk: brk, info: info, now: time.Now()})
+
+	explanation := &EligibilityExplanation{
+		BookPostId:   bookPostId,
+		BorrowerUser: borrowerUser,
+		Eligible:     true,
+		Verdicts:     []EligibilityVerdict{},
+	}
+	for i, entry := range p._eligibilityRules() {
+		result := results[i]
+		if result.outcome == ELIGIBILITY_DENY {
+			explanation.Eligible = false
+		}
+		explanation.Verdicts = append(explanation.Verdicts, p._verdictOf(entry.name, result))
+	}
+	return explanation, nil
+}
+
+type openBorrow struct {
+	masterKey string
+	borrow    *BorrowRequest
+}
+
+// The borrows of the borrower not returned yet.
+func (p *Plugin) _openBorrowsOf(borrowerUser string) ([]openBorrow, error) {
+	posts, err := p._repo().SearchByTag(p.borrowChannel, TAG_PREFIX_BORROWER+borrowerUser)
+	if err != nil {
+		return nil, errors.Wrapf(err, "search posts error.")
+	}
+
+	borrows := []openBorrow{}
+	for _, post := range posts {
+		if post.Type != "custom_borrow_type" {
+			continue
+		}
+		var br Borrow
+		if err := json.Unmarshal([]byte(post.Message), &br); err != nil || br.DataOrImage == nil {
+			continue
+		}
+
+		//even not very possible, this makes the result safe
+		if br.DataOrImage.BorrowerUser != borrowerUser ||
+			br.DataOrImage.StepIndex < 0 || br.DataOrImage.StepIndex >= len(br.DataOrImage.Worflow) {
+			continue
+		}
+
+		switch br.DataOrImage.Worflow[br.DataOrImage.StepIndex].Status {
+		case STATUS_RETURN_CONFIRMED, STATUS_RETURNED:
+		default:
+			borrows = append(borrows, openBorrow{post.Id, br.DataOrImage})
+		}
+	}
+	return borrows, nil
+}
+
+type suspensionRule struct{}
+
+func (suspensionRule) check(p *Plugin, req *eligibilityRequest) eligibilityResult {
+	if err := p._checkSuspension(req.brk.BorrowerUser, req.now); err != nil {
+		return _deny(err)
+	}
+	return _allow()
+}
+
+type stockRule struct{}
+
+func (stockRule) check(p *Plugin, req *eligibilityRequest) eligibilityResult {
+	if stock := req.info.book.BookInventory.Stock; stock <= 0 {
+		return _deny(WithDetails(ErrNoStock, ErrorDetails{ERROR_DETAIL_STOCK: stock}))
+	}
+	return _allow()
+}
+
+type concurrentLimitRule struct {
+	limit int
+}
+
+func (r concurrentLimitRule) check(p *Plugin, req *eligibilityRequest) eligibilityResult {
+	limit := r.limit
+	if limit == 0 {
+		limit = p.borrowTimes
+	}
+
+	borrows, err := req._openBorrows(p)
+	if err != nil {
+		return _deny(err)
+	}
+
+	if len(borrows) >= limit {
+		return _deny(WithDetails(ErrBorrowingLimited, ErrorDetails{
+			ERROR_DETAIL_LIMIT:     limit,
+			ERROR_DETAIL_BORROWING: len(borrows),
+		}))
+	}
+	return _allow()
+}
+
+type categoryRule struct {
+	categories map[string]bool
+	roles      []string
+}
+
+func (r categoryRule) check(p *Plugin, req *eligibilityRequest) eligibilityResult {
+	pub := req.info.book.BookPublic
+	category := ""
+	for _, c := range []string{pub.Category1, pub.Category2, pub.Category3} {
+		if c != "" && r.categories[c] {
+			category = c
+			break
+		}
+	}
+	if category == "" {
+		return _allow()
+	}
+
+	borrower, appErr := p.API.GetUserByUsername(req.brk.BorrowerUser)
+	if appErr != nil {
+		return _deny(errors.Wrapf(appErr, "get borrower %v error.", req.brk.BorrowerUser))
+	}
+	if len(r.roles) > 0 {
+		ok, err := p._hasRole(borrower.Id, r.roles...)
+		if err != nil {
+			return _deny(err)
+		}
+		if ok {
+			return _allow()
+		}
+	}
+
+	return _deny(WithDetails(ErrCategoryLimited, ErrorDetails{ERROR_DETAIL_CATEGORY: category}))
+}
+
+type duplicateRule struct{}
+
+func (duplicateRule) check(p *Plugin, req *eligibilityRequest) eligibilityResult {
+	borrows, err := req._openBorrows(p)
+	if err != nil {
+		return _deny(err)
+	}
+
+	for _, open := range borrows {
+		if open.borrow.BookPostId == req.brk.BookPostId {
+			return _deny(WithDetails(ErrDuplicateBorrow, ErrorDetails{ERROR_DETAIL_MASTER: open.masterKey}))
+		}
+	}
+	return _allow()
+}
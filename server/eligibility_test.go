@@ -0,0 +1,258 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/mattermost/mattermost-server/v5/model"
+	"github.com/mattermost/mattermost-server/v5/plugin/plugintest"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/require"
+)
+
+func TestEligibility(t *testing.T) {
+
+	type eligibilityEnv struct {
+		td     *TestData
+		api    *plugintest.API
+		plugin *Plugin
+		bookId string
+	}
+
+	setup := func(t *testing.T, rules []EligibilityRuleConfig) *eligibilityEnv {
+		td := NewTestData()
+		api := td.ApiMockCommon()
+		api.On("CreatePost", mock.Anything).Return(&model.Post{}, nil)
+		plugin := td.NewMockPlugin()
+		plugin.SetAPI(api)
+		plugin.repo = newMemRepository()
+
+		entries, err := _newEligibilityRules(rules)
+		require.Nil(t, err)
+		plugin.eligibilityRules = entries
+
+		var book Book
+		DeepCopy(&book, td.ABook)
+		bookId, err := plugin._createABook(&book)
+		require.Nil(t, err)
+		return &eligibilityEnv{td, api, plugin, bookId}
+	}
+
+	borrow := func(env *eligibilityEnv, userId string, borrower string) error {
+		_, _, err := env.plugin._borrowABook(userId, &BorrowRequestKey{
+			BookPostId:   env.bookId,
+			BorrowerUser: borrower,
+		}, otherRequestData{processTime: GetNowTime()})
+		return err
+	}
+
+	t.Run("rules", func(t *testing.T) {
+		entries, err := _newEligibilityRules(nil)
+		require.Nil(t, err)
+		names := []string{}
+		for _, entry := range entries {
+			names = append(names, entry.name)
+		}
+		assert.Equal(t, []string{ELIGIBILITY_RULE_SUSPENSION, ELIGIBILITY_RULE_STOCK, ELIGIBILITY_RULE_CONCURRENT_LIMIT}, names)
+
+		entries, err = _newEligibilityRules([]EligibilityRuleConfig{
+			{Rule: ELIGIBILITY_RULE_CATEGORY, Categories: []string{"C1"}},
+			{Rule: ELIGIBILITY_RULE_CATEGORY, Categories: []string{"C2"}, Roles: []string{ROLE_LIBWORKER}},
+			{Rule: ELIGIBILITY_RULE_DUPLICATE, WarnOnly: true},
+		})
+		require.Nil(t, err)
+		assert.Equal(t, 3, len(entries))
+		assert.True(t, entries[2].warnOnly)
+
+		for _, rules := range [][]EligibilityRuleConfig{
+			{{Rule: "unknown"}},
+			{{Rule: ELIGIBILITY_RULE_STOCK}, {Rule: ELIGIBILITY_RULE_STOCK}},
+			{{Rule: ELIGIBILITY_RULE_CATEGORY}},
+			{{Rule: ELIGIBILITY_RULE_CATEGORY, Categories: []string{"C1"}, Roles: []string{"nobody"}}},
+			{{Rule: ELIGIBILITY_RULE_CONCURRENT_LIMIT, Limit: -1}},
+		} {
+			_, err := _newEligibilityRules(rules)
+			assert.NotNil(t, err, "%v", rules)
+		}
+
+		config := &configuration{EligibilityRules: `[{"rule":"stock"},{"rule":"duplicate_borrow","warn_only":true}]`}
+		libs, err := config.getLibraryConfigs()
+		require.Nil(t, err)
+		assert.Equal(t, []EligibilityRuleConfig{{Rule: "stock"}, {Rule: "duplicate_borrow", WarnOnly: true}}, libs[0].EligibilityRules)
+		config.EligibilityRules = "not json"
+		_, err = config.getLibraryConfigs()
+		assert.NotNil(t, err)
+	})
+
+	t.Run("duplicate_borrow", func(t *testing.T) {
+		env := setup(t, []EligibilityRuleConfig{
+			{Rule: ELIGIBILITY_RULE_STOCK},
+			{Rule: ELIGIBILITY_RULE_DUPLICATE},
+		})
+		require.Nil(t, borrow(env, env.td.BorId, env.td.BorrowUser))
+		err := borrow(env, env.td.BorId, env.td.BorrowUser)
+		assert.ErrorIs(t, err, ErrDuplicateBorrow)
+		assert.Equal(t, "您已在借阅这本书", env.plugin._borrowErrorText(err))
+		assert.NotEmpty(t, DetailsOf(err)[ERROR_DETAIL_MASTER])
+
+		env.plugin.eligibilityRules[1].warnOnly = true
+		env.api.On("LogWarn", "A borrow is let through with a warning.", "rule", ELIGIBILITY_RULE_DUPLICATE,
+			"borrower", env.td.BorrowUser, "book", env.bookId, "reason", ErrDuplicateBorrow.Error()).Return().Times(2)
+		_, warnings, err := env.plugin._borrowABook(env.td.BorId, &BorrowRequestKey{
+			BookPostId:   env.bookId,
+			BorrowerUser: env.td.BorrowUser,
+		}, otherRequestData{processTime: GetNowTime()})
+		assert.Nil(t, err, "only a warning")
+		require.Equal(t, 1, len(warnings))
+		assert.Equal(t, ELIGIBILITY_RULE_DUPLICATE, warnings[0].Rule)
+		assert.Equal(t, ELIGIBILITY_WARN, warnings[0].Outcome)
+		assert.Equal(t, ErrDuplicateBorrow.Error(), warnings[0].Code)
+		assert.Equal(t, "您已在借阅这本书", warnings[0].Message)
+
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest(http.MethodPost, "/api/v1/borrows",
+			strings.NewReader(`{"book_post_id":"`+env.bookId+`","borrower_user":"bor"}`))
+		r.Header.Set("Mattermost-User-ID", env.td.BorId)
+		env.plugin.ServeHTTP(nil, w, r)
+		require.Equal(t, http.StatusCreated, w.Code)
+		var result Result
+		require.Nil(t, json.Unmarshal(w.Body.Bytes(), &result))
+		assert.NotEmpty(t, result.Messages["master_key"])
+		require.Equal(t, 1, len(result.Warnings))
+		assert.Equal(t, ErrDuplicateBorrow.Error(), result.Warnings[0].Code)
+		env.api.AssertNumberOfCalls(t, "LogWarn", 2)
+	})
+
+	t.Run("open_borrows", func(t *testing.T) {
+		env := setup(t, []EligibilityRuleConfig{
+			{Rule: ELIGIBILITY_RULE_CONCURRENT_LIMIT},
+			{Rule: ELIGIBILITY_RULE_DUPLICATE},
+		})
+		repo := &countingRepository{Repository: env.plugin.repo}
+		env.plugin.repo = repo
+
+		broken, _ := json.Marshal(&Borrow{
+			DataOrImage: &BorrowRequest{
+				BorrowerUser: env.td.BorrowUser,
+				StepIndex:    9,
+				Tags:         []string{TAG_PREFIX_BORROWER + env.td.BorrowUser},
+			},
+			Role: []string{MASTER},
+		})
+		_, err := repo.Create(&model.Post{
+			ChannelId: env.td.BorChannelId,
+			Type:      "custom_borrow_type",
+			Message:   string(broken),
+		})
+		require.Nil(t, err)
+
+		require.Nil(t, borrow(env, env.td.BorId, env.td.BorrowUser), "a broken record is skipped")
+		assert.Equal(t, 1, repo.searches, "loaded once for both rules")
+	})
+
+	t.Run("category_restriction", func(t *testing.T) {
+		env := setup(t, []EligibilityRuleConfig{
+			{Rule: ELIGIBILITY_RULE_CATEGORY, Categories: []string{"C2"}, Roles: []string{ROLE_LIBWORKER}},
+		})
+		err := borrow(env, env.td.BorId, env.td.BorrowUser)
+		assert.ErrorIs(t, err, ErrCategoryLimited)
+		assert.Equal(t, "C2", DetailsOf(err)[ERROR_DETAIL_CATEGORY])
+		assert.Nil(t, borrow(env, env.td.Worker2Id, "worker2"))
+	})
+
+	t.Run("no_stock", func(t *testing.T) {
+		env := setup(t, nil)
+		info, err := env.plugin.GetABook(env.bookId)
+		require.Nil(t, err)
+		info.book.BookInventory.Stock = 0
+		require.Nil(t, env.plugin._updateBookParts(updateOptions{
+			inv:     info.book.BookInventory,
+			invPost: info.invPost,
+		}))
+
+		explanation, err := env.plugin._explainEligibility(env.td.BorId, env.bookId, "")
+		require.Nil(t, err)
+		assert.False(t, explanation.Eligible)
+		info, err = env.plugin.GetABook(env.bookId)
+		require.Nil(t, err)
+		assert.True(t, info.book.BookPublic.IsAllowedToBorrow, "explaining changes nothing")
+
+		assert.ErrorIs(t, borrow(env, env.td.BorId, env.td.BorrowUser), ErrNoStock)
+		info, err = env.plugin.GetABook(env.bookId)
+		require.Nil(t, err)
+		assert.False(t, info.book.BookPublic.IsAllowedToBorrow)
+	})
+
+	t.Run("explain", func(t *testing.T) {
+		env := setup(t, []EligibilityRuleConfig{
+			{Rule: ELIGIBILITY_RULE_SUSPENSION},
+			{Rule: ELIGIBILITY_RULE_CONCURRENT_LIMIT, Limit: 1},
+			{Rule: ELIGIBILITY_RULE_DUPLICATE, WarnOnly: true},
+		})
+
+		explanation, err := env.plugin._explainEligibility(env.td.BorId, env.bookId, "")
+		require.Nil(t, err)
+		assert.Equal(t, &EligibilityExplanation{
+			BookPostId:   env.bookId,
+			BorrowerUser: "bor",
+			Eligible:     true,
+			Verdicts: []EligibilityVerdict{
+				{Rule: ELIGIBILITY_RULE_SUSPENSION, Outcome: ELIGIBILITY_ALLOW},
+				{Rule: ELIGIBILITY_RULE_CONCURRENT_LIMIT, Outcome: ELIGIBILITY_ALLOW},
+				{Rule: ELIGIBILITY_RULE_DUPLICATE, Outcome: ELIGIBILITY_ALLOW},
+			},
+		}, explanation)
+
+		require.Nil(t, borrow(env, env.td.BorId, env.td.BorrowUser))
+		explanation, err = env.plugin._explainEligibility(env.td.Worker1Id, env.bookId, "@bor")
+		require.Nil(t, err)
+		assert.False(t, explanation.Eligible)
+		limited := explanation.Verdicts[1]
+		assert.Equal(t, ELIGIBILITY_DENY, limited.Outcome)
+		assert.Equal(t, ErrBorrowingLimited.Error(), limited.Code)
+		assert.Equal(t, "到达借书上限", limited.Message)
+		assert.EqualValues(t, 1, limited.Details[ERROR_DETAIL_LIMIT])
+		assert.Equal(t, ELIGIBILITY_WARN, explanation.Verdicts[2].Outcome)
+		assert.Equal(t, ErrDuplicateBorrow.Error(), explanation.Verdicts[2].Code)
+
+		_, err = env.plugin._explainEligibility(env.td.BorId, env.bookId, "worker1")
+		assert.ErrorIs(t, err, ErrNotPermitted)
+		_, err = env.plugin._explainEligibility(env.td.BorId, "unknown", "")
+		assert.ErrorIs(t, err, ErrNotFound)
+	})
+
+	t.Run("http", func(t *testing.T) {
+		env := setup(t, nil)
+		get := func(userId string, target string) *httptest.ResponseRecorder {
+			w := httptest.NewRecorder()
+			r := httptest.NewRequest(http.MethodGet, target, nil)
+			r.Header.Set("Mattermost-User-ID", userId)
+			env.plugin.ServeHTTP(nil, w, r)
+			return w
+		}
+
+		w := get(env.td.Worker1Id, "/api/v1/books/"+env.bookId+"/eligibility?user=bor")
+		require.Equal(t, http.StatusOK, w.Code)
+		var explanation EligibilityExplanation
+		require.Nil(t, json.Unmarshal(w.Body.Bytes(), &explanation))
+		assert.True(t, explanation.Eligible)
+		assert.Equal(t, 3, len(explanation.Verdicts))
+
+		w = get(env.td.BorId, "/api/v1/books/"+env.bookId+"/eligibility?user=worker1")
+		assert.Equal(t, http.StatusForbidden, w.Code)
+	})
+}
+
+type countingRepository struct {
+	Repository
+	searches int
+}
+
+func (r *countingRepository) SearchByTag(channel *model.Channel, tag string) ([]*model.Post, error) {
+	r.searches++
+	return r.Repository.SearchByTag(channel, tag)
+}
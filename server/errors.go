@@ -0,0 +1,136 @@
+package main
+
+import (
+	"fmt"
+
+	"github.com/pkg/errors"
+)
+
+// The codes clients branch on. A code is the text of its sentinel,
+// which is also the i18n key of the message.
+var codedErrors = []error{
+	ErrBorrowingLimited,
+	ErrLocked,
+	ErrNotFound,
+	ErrNoStock,
+	ErrRenewLimited,
+	ErrChooseInStockCopy,
+	ErrStale,
+	ErrInvalidIsbn,
+	ErrDuplicateBook,
+	ErrInvalidCopyKeeper,
+	ErrNotPermitted,
+	ErrInvalidRole,
+	ErrInvalidRequest,
+	ErrRuleViolation,
+	ErrSuspended,
+	ErrCategoryLimited,
+	ErrDuplicateBorrow,
+}
+
+// An error whose message is shown to users as it is,
+// while errors.Is still tells its kind, e.g. ErrRuleViolation.
+type kindError struct {
+	kind error
+	msg  string
+}
+
+func (e *kindError) Error() string {
+	return e.msg
+}
+
+func (e *kindError) Is(target error) bool {
+	return target == e.kind
+}
+
+func KindError(kind error, format string, args ...interface{}) error {
+	return errors.WithStack(&kindError{kind, fmt.Sprintf(format, args...)})
+}
+
+// An error carrying the details of a failure, e.g. the current stock,
+// errors.Is and errors.Cause see through it.
+type detailedError struct {
+	cause   error
+	details ErrorDetails
+}
+
+func (e *detailedError) Error() string {
+	return e.cause.Error()
+}
+
+func (e *detailedError) Cause() error {
+	return e.cause
+}
+
+func (e *detailedError) Unwrap() error {
+	return e.cause
+}
+
+func WithDetails(err error, details ErrorDetails) error {
+	if err == nil {
+		return nil
+	}
+	return &detailedError{err, details}
+}
+
+// The details of all detailed errors in the chain,
+// the outer ones win if a key is set twice.
+func DetailsOf(err error) ErrorDetails {
+	var details ErrorDetails
+
+	for ; err != nil; err = errors.Unwrap(err) {
+		de, ok := err.(*detailedError)
+		if !ok {
+			continue
+		}
+		if details == nil {
+			details = ErrorDetails{}
+		}
+		for k, v := range de.details {
+			if _, ok := details[k]; !ok {
+				details[k] = v
+			}
+		}
+	}
+
+	return details
+}
+
+func ErrorCodeOf(err error) string {
+	for _, sentinel := range codedErrors {
+		if errors.Is(err, sentinel) {
+			return sentinel.Error()
+		}
+	}
+	return ERROR_CODE_INTERNAL
+}
+
+// The message of a KindError is for users already,
+// a sentinel is translated, and anything else is hidden behind the fallback text.
+func (p *Plugin) _errorText(err error, fallbackKey string) string {
+	cause := errors.Cause(err)
+
+	var ke *kindError
+	if errors.As(cause, &ke) {
+		return ke.Error()
+	}
+
+	switch {
+	case errors.Is(err, ErrLocked), errors.Is(err, ErrStale):
+		return p.i18n.GetText("system-busy")
+	}
+
+	if text := p.i18n.GetText(cause.Error()); text != "" {
+		return text
+	}
+
+	return p.i18n.GetText(fallbackKey)
+}
+
+func (p *Plugin) _errorResult(err error, text string) Result {
+	return Result{
+		Error:   text,
+		Code:    ErrorCodeOf(err),
+		Details: DetailsOf(err),
+	}
+}
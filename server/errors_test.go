@@ -0,0 +1,56 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestErrorCodes(t *testing.T) {
+
+	t.Run("code_of_sentinels", func(t *testing.T) {
+		for _, sentinel := range codedErrors {
+			assert.Equal(t, sentinel.Error(), ErrorCodeOf(sentinel))
+			assert.Equal(t, sentinel.Error(), ErrorCodeOf(errors.Wrapf(sentinel, "wrapped")))
+		}
+
+		assert.Equal(t, ErrRuleViolation.Error(), ErrorCodeOf(KindError(ErrRuleViolation, "not allowed")))
+		assert.Equal(t, ERROR_CODE_INTERNAL, ErrorCodeOf(errors.New("update pub error.")))
+	})
+
+	t.Run("details", func(t *testing.T) {
+		err := WithDetails(errors.Wrapf(ErrStale, "patch stale"), ErrorDetails{ERROR_DETAIL_ETAG: "new"})
+		err = errors.Wrapf(WithDetails(err, ErrorDetails{ERROR_DETAIL_ETAG: "outer", ERROR_DETAIL_STOCK: 1}), "lock error")
+
+		assert.ErrorIs(t, err, ErrStale)
+		assert.Equal(t, ErrStale, errors.Cause(err))
+		assert.Equal(t, ErrorDetails{ERROR_DETAIL_ETAG: "outer", ERROR_DETAIL_STOCK: 1}, DetailsOf(err))
+
+		assert.Nil(t, DetailsOf(ErrStale))
+		assert.Nil(t, WithDetails(nil, ErrorDetails{}))
+	})
+
+	t.Run("result", func(t *testing.T) {
+		td := NewTestData()
+		plugin := td.NewMockPlugin()
+
+		res := plugin._errorResult(WithDetails(ErrNoStock, ErrorDetails{ERROR_DETAIL_STOCK: 0}), "no stock")
+		assert.Equal(t, Result{
+			Error:   "no stock",
+			Code:    ErrNoStock.Error(),
+			Details: ErrorDetails{ERROR_DETAIL_STOCK: 0},
+		}, res)
+	})
+
+	t.Run("internal_text_not_leaked", func(t *testing.T) {
+		td := NewTestData()
+		plugin := td.NewMockPlugin()
+
+		err := errors.New("update master post error: connection refused")
+		assert.Equal(t, plugin.i18n.GetText("workflow-failed"), plugin._workflowErrorText(err))
+		assert.Equal(t, plugin.i18n.GetText("renew-limited"), plugin._workflowErrorText(WithDetails(ErrRenewLimited, nil)))
+		assert.Equal(t, "not allowed", plugin._workflowErrorText(KindError(ErrRuleViolation, "not allowed")))
+		assert.Equal(t, plugin.i18n.GetText("system-busy"), plugin._workflowErrorText(ErrLocked))
+	})
+}
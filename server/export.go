@@ -0,0 +1,401 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/mattermost/mattermost-server/v5/model"
+	"github.com/mattermost/mattermost-server/v5/plugin"
+	"github.com/pkg/errors"
+)
+
+const (
+	EXPORT_FORMAT_JSON = "json"
+	EXPORT_FORMAT_CSV  = "csv"
+	EXPORT_FORMAT_XLSX = "xlsx"
+)
+
+const exportPostsPerPage = 200
+
+type exportOptions struct {
+	withPri bool
+	withInv bool
+}
+
+type exportFile struct {
+	name        string
+	contentType string
+	data        []byte
+}
+
+func (p *Plugin) handleExportRequest(c *plugin.Context, w http.ResponseWriter, r *http.Request) {
+
+	userID := r.Header.Get("Mattermost-User-ID")
+	format := r.URL.Query().Get("format")
+	if format == "" {
+		format = EXPORT_FORMAT_JSON
+	}
+
+	file, err := p._exportBooksByUser(userID, format)
+	if err != nil {
+		p.API.LogError("export books error.", "err", fmt.Sprintf("%+v", err))
+		resp, _ := json.Marshal(p._errorResult(err, p.i18n.GetText("export-books-failed")))
+
+		w.Write(resp)
+		return
+	}
+
+	w.Header().Set("Content-Type", file.contentType)
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", file.name))
+	w.Write(file.data)
+}
+
+func (p *Plugin) _exportBooksByUser(userId string, format string) (*exportFile, error) {
+
+	opts, err := p._getExportOptions(userId)
+	if err != nil {
+		return nil, errors.Wrapf(err, "get export options error.")
+	}
+
+	books, err := p._exportBooks(opts)
+	if err != nil {
+		return nil, errors.Wrapf(err, "export books error.")
+	}
+
+	name := "books_" + time.Now().Format("20060102150405") + "." + format
+
+	switch format {
+	case EXPORT_FORMAT_JSON:
+		data, err := json.MarshalIndent(books, "", "  ")
+		if err != nil {
+			return nil, errors.Wrapf(err, "marshal books error.")
+		}
+		return &exportFile{name, "application/json", data}, nil
+	case EXPORT_FORMAT_CSV:
+		data, err := p._writeCsv(p._exportRows(books, opts))
+		if err != nil {
+			return nil, errors.Wrapf(err, "write csv error.")
+		}
+		return &exportFile{name, "text/csv", data}, nil
+	case EXPORT_FORMAT_XLSX:
+		data, err := p._writeXlsx(p._exportRows(books, opts))
+		if err != nil {
+			return nil, errors.Wrapf(err, "write xlsx error.")
+		}
+		return &exportFile{name, "application/vnd.openxmlformats-officedocument.spreadsheetml.sheet", data}, nil
+	default:
+		return nil, errors.New(fmt.Sprintf("unknown export format: %v", format))
+	}
+}
+
+// Private and inventory parts follow the same visibility as their channels.
+// A user who can't read the channel can't export the part either.
+func (p *Plugin) _getExportOptions(userId string) (exportOptions, error) {
+	var opts exportOptions
+	var err error
+
+	if opts.withPri, err = p._isChannelMember(p.booksPriChannel.Id, userId); err != nil {
+		return opts, err
+	}
+
+	if opts.withInv, err = p._isChannelMember(p.booksInvChannel.Id, userId); err != nil {
+		return opts, err
+	}
+
+	return opts, nil
+}
+
+func (p *Plugin) _isChannelMember(channelId string, userId string) (bool, error) {
+	if userId == "" {
+		return false, nil
+	}
+
+	_, appErr := p.API.GetChannelMember(channelId, userId)
+	if appErr != nil {
+		if appErr.Id == "app.channel.get_member.missing.app_error" {
+			return false, nil
+		}
+		return false, errors.Wrapf(appErr, "get channel member error.")
+	}
+
+	return true, nil
+}
+
+func (p *Plugin) _getAllBookPostIds() ([]string, error) {
+	ids := []string{}
+
+	for page := 0; ; page++ {
+		posts, err := p._repo().List(p.booksChannel, page, exportPostsPerPage)
+		if err != nil {
+			return nil, errors.Wrapf(err, "get posts for books channel error. page: %v", page)
+		}
+
+		for _, post := range posts {
+			if post.Type != "custom_book_type" || post.RootId != "" {
+				continue
+			}
+			ids = append(ids, post.Id)
+		}
+
+		if len(posts) < exportPostsPerPage {
+			break
+		}
+	}
+
+	return ids, nil
+}
+
+// The result can be sent back to _uploadBooks as is.
+// Upload section is filled so that uploading it again updates the same posts,
+// and the stock is the total of copies, as an uploaded stock is.
+func (p *Plugin) _exportBooks(opts exportOptions) (Books, error) {
+
+	ids, err := p._getAllBookPostIds()
+	if err != nil {
+		return nil, err
+	}
+
+	books := Books{}
+
+	for _, id := range ids {
+		info, err := p.GetABook(id)
+		if err != nil {
+			return nil, errors.Wrapf(err, "get a book error. post id: %v", id)
+		}
+
+		book := info.book
+		if !opts.withPri {
+			book.BookPrivate = nil
+		}
+		if !opts.withInv {
+			book.BookInventory = nil
+		} else {
+			inv := book.BookInventory
+			inv.Stock = inv.Stock + inv.TransmitOut + inv.Lending + inv.TransmitIn + inv.InTransit
+		}
+		book.Upload = &Upload{
+			Post_id: info.pubPost.Id,
+			Etag:    book.BookPublic.MatchId,
+		}
+
+		books = append(books, *book)
+	}
+
+	sort.SliceStable(books, func(i, j int) bool {
+		return books[i].BookPublic.Id < books[j].BookPublic.Id
+	})
+
+	return books, nil
+}
+
+// Flatten books into one row per copy.
+// A book without any visible copy still has one row.
+func (p *Plugin) _exportRows(books Books, opts exportOptions) [][]string {
+
+	header := []string{
+		"post_id", "id_pub", "name_pub", "name_en",
+		"category1", "category2", "category3",
+		"author", "author_en", "translator", "translator_en",
+		"publisher", "publisher_en", "publish_date", "isbn10", "isbn13",
+		"libworker_users", "isAllowedToBorrow",
+	}
+	if opts.withPri || opts.withInv {
+		header = append(header, "copy_id")
+	}
+	if opts.withPri {
+		header = append(header, "keeper_user", "keeper_name")
+	}
+	if opts.withInv {
+		header = append(header, "copy_status", "stock", "transmit_out", "lending", "transmit_in")
+	}
+
+	rows := [][]string{header}
+
+	for _, book := range books {
+		pub := book.BookPublic
+		bookCols := []string{
+			book.Upload.Post_id, pub.Id, pub.Name, pub.NameEn,
+			pub.Category1, pub.Category2, pub.Category3,
+			pub.Author, pub.AuthorEn, pub.Translator, pub.TranslatorEn,
+			pub.Publisher, pub.PublisherEn, pub.PublishDate, pub.Isbn10, pub.Isbn13,
+			fmt.Sprintf("%v", pub.LibworkerUsers), strconv.FormatBool(pub.IsAllowedToBorrow),
+		}
+
+		copyIdSet := map[string]bool{}
+		if opts.withPri && book.BookPrivate != nil {
+			for id := range book.BookPrivate.CopyKeeperMap {
+				copyIdSet[id] = true
+			}
+		}
+		if opts.withInv && book.BookInventory != nil {
+			for id := range book.BookInventory.Copies {
+				copyIdSet[id] = true
+			}
+		}
+
+		copyIds := []string{}
+		for id := range copyIdSet {
+			copyIds = append(copyIds, id)
+		}
+		sort.Strings(copyIds)
+
+		if len(copyIds) == 0 {
+			copyIds = append(copyIds, "")
+		}
+
+		for _, copyId := range copyIds {
+			row := append([]string{}, bookCols...)
+			if opts.withPri || opts.withInv {
+				row = append(row, copyId)
+			}
+			if opts.withPri {
+				keeperUser := ""
+				keeperName := ""
+				if book.BookPrivate != nil {
+					keeperUser = book.BookPrivate.CopyKeeperMap[copyId].User
+					keeperName = book.BookPrivate.KeeperInfos[keeperUser].Name
+				}
+				row = append(row, keeperUser, keeperName)
+			}
+			if opts.withInv {
+				inv := book.BookInventory
+				if inv == nil {
+					inv = &BookInventory{}
+				}
+				row = append(row,
+					inv.Copies[copyId].Status,
+					strconv.Itoa(inv.Stock),
+					strconv.Itoa(inv.TransmitOut),
+					strconv.Itoa(inv.Lending),
+					strconv.Itoa(inv.TransmitIn),
+				)
+			}
+			rows = append(rows, row)
+		}
+	}
+
+	return rows
+}
+
+func (p *Plugin) _writeCsv(rows [][]string) ([]byte, error) {
+	var buf bytes.Buffer
+	cw := csv.NewWriter(&buf)
+	if err := cw.WriteAll(rows); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// A minimal single sheet workbook with inline strings.
+// It is enough for spreadsheet tools to open and edit the exported rows.
+func (p *Plugin) _writeXlsx(rows [][]string) ([]byte, error) {
+
+	var sheet bytes.Buffer
+	sheet.WriteString(xml.Header)
+	sheet.WriteString(`<worksheet xmlns="http://schemas.openxmlformats.org/spreadsheetml/2006/main"><sheetData>`)
+	for i, row := range rows {
+		fmt.Fprintf(&sheet, `<row r="%d">`, i+1)
+		for j, col := range row {
+			fmt.Fprintf(&sheet, `<c r="%s%d" t="inlineStr"><is><t xml:space="preserve">`, _xlsxColumnName(j), i+1)
+			if err := xml.EscapeText(&sheet, []byte(col)); err != nil {
+				return nil, err
+			}
+			sheet.WriteString(`</t></is></c>`)
+		}
+		sheet.WriteString(`</row>`)
+	}
+	sheet.WriteString(`</sheetData></worksheet>`)
+
+	parts := []struct {
+		name    string
+		content string
+	}{
+		{
+			"[Content_Types].xml",
+			xml.Header + `<Types xmlns="http://schemas.openxmlformats.org/package/2006/content-types">` +
+				`<Default Extension="rels" ContentType="application/vnd.openxmlformats-package.relationships+xml"/>` +
+				`<Default Extension="xml" ContentType="application/xml"/>` +
+				`<Override PartName="/xl/workbook.xml" ContentType="application/vnd.openxmlformats-officedocument.spreadsheetml.sheet.main+xml"/>` +
+				`<Override PartName="/xl/worksheets/sheet1.xml" ContentType="application/vnd.openxmlformats-officedocument.spreadsheetml.worksheet+xml"/>` +
+				`</Types>`,
+		},
+		{
+			"_rels/.rels",
+			xml.Header + `<Relationships xmlns="http://schemas.openxmlformats.org/package/2006/relationships">` +
+				`<Relationship Id="rId1" Type="http://schemas.openxmlformats.org/officeDocument/2006/relationships/officeDocument" Target="xl/workbook.xml"/>` +
+				`</Relationships>`,
+		},
+		{
+			"xl/workbook.xml",
+			xml.Header + `<workbook xmlns="http://schemas.openxmlformats.org/spreadsheetml/2006/main" xmlns:r="http://schemas.openxmlformats.org/officeDocument/2006/relationships">` +
+				`<sheets><sheet name="books" sheetId="1" r:id="rId1"/></sheets></workbook>`,
+		},
+		{
+			"xl/_rels/workbook.xml.rels",
+			xml.Header + `<Relationships xmlns="http://schemas.openxmlformats.org/package/2006/relationships">` +
+				`<Relationship Id="rId1" Type="http://schemas.openxmlformats.org/officeDocument/2006/relationships/worksheet" Target="worksheets/sheet1.xml"/>` +
+				`</Relationships>`,
+		},
+		{
+			"xl/worksheets/sheet1.xml",
+			sheet.String(),
+		},
+	}
+
+	var buf bytes.Buffer
+	zw := zip.NewWriter(&buf)
+	for _, part := range parts {
+		f, err := zw.Create(part.name)
+		if err != nil {
+			return nil, err
+		}
+		if _, err := f.Write([]byte(part.content)); err != nil {
+			return nil, err
+		}
+	}
+	if err := zw.Close(); err != nil {
+		return nil, err
+	}
+
+	return buf.Bytes(), nil
+}
+
+func _xlsxColumnName(index int) string {
+	name := ""
+	for index >= 0 {
+		name = string(rune('A'+index%26)) + name
+		index = index/26 - 1
+	}
+	return name
+}
+
+func (p *Plugin) _postExportFile(userId string, file *exportFile) error {
+	directChannel, appErr := p.API.GetDirectChannel(userId, p.botID)
+	if appErr != nil {
+		return errors.Wrapf(appErr, "Failed to find or create a direct channel with user. user: %v", userId)
+	}
+
+	fileInfo, appErr := p.API.UploadFile(file.data, directChannel.Id, file.name)
+	if appErr != nil {
+		return errors.Wrapf(appErr, "upload export file error.")
+	}
+
+	if _, appErr := p.API.CreatePost(&model.Post{
+		UserId:    p.botID,
+		ChannelId: directChannel.Id,
+		Message:   fmt.Sprintf("Books exported: %v", file.name),
+		FileIds:   []string{fileInfo.Id},
+	}); appErr != nil {
+		return errors.Wrapf(appErr, "post export file error.")
+	}
+
+	return nil
+}
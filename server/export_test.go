@@ -0,0 +1,193 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/mattermost/mattermost-server/v5/model"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/require"
+)
+
+func TestExport(t *testing.T) {
+	td := NewTestData()
+	plugin := td.NewMockPlugin()
+	api := td.ApiMockCommon()
+	plugin.SetAPI(api)
+
+	otherPostId := model.NewId()
+	api.On("GetPostsForChannel", td.BookChIdPub, 0, exportPostsPerPage).Return(&model.PostList{
+		Order: []string{td.BookPostIdPub, otherPostId},
+		Posts: map[string]*model.Post{
+			td.BookPostIdPub: {Id: td.BookPostIdPub, Type: "custom_book_type"},
+			otherPostId:      {Id: otherPostId, Type: ""},
+		},
+	}, nil)
+
+	notMember := model.NewAppError("GetChannelMember", "app.channel.get_member.missing.app_error", nil, "", http.StatusNotFound)
+	api.On("GetChannelMember", td.BookChIdPri, td.Worker1Id).Return(&model.ChannelMember{}, nil)
+	api.On("GetChannelMember", td.BookChIdInv, td.Worker1Id).Return(&model.ChannelMember{}, nil)
+	api.On("GetChannelMember", td.BookChIdPri, td.BorId).Return(nil, notMember)
+	api.On("GetChannelMember", td.BookChIdInv, td.BorId).Return(nil, notMember)
+
+	export := func(userId string, format string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest("GET", "/export?format="+format, nil)
+		r.Header.Set("Mattermost-User-ID", userId)
+		plugin.ServeHTTP(nil, w, r)
+		return w
+	}
+
+	t.Run("json_roundtrip", func(t *testing.T) {
+		w := export(td.Worker1Id, EXPORT_FORMAT_JSON)
+		require.Equal(t, "application/json", w.Header().Get("Content-Type"))
+
+		var books []*Book
+		require.Nil(t, json.Unmarshal(w.Body.Bytes(), &books))
+		require.Len(t, books, 1)
+
+		book := books[0]
+		assert.Equal(t, td.BookPostIdPub, book.Upload.Post_id)
+		assert.Equal(t, td.ABookPub.MatchId, book.Upload.Etag)
+		assert.Equal(t, td.ABookPub.Id, book.BookPublic.Id)
+		require.NotNil(t, book.BookPrivate)
+		assert.Equal(t, td.ABookPri.CopyKeeperMap, book.BookPrivate.CopyKeeperMap)
+		require.NotNil(t, book.BookInventory)
+		assert.Equal(t, td.ABookInv.Copies, book.BookInventory.Copies)
+
+		//uploading an export again changes nothing, even with a copy lent
+		lent := NewTestData()
+		lentApi := lent.ApiMockCommon()
+		lentApi.On("CreatePost", mock.Anything).Return(&model.Post{}, nil)
+		for _, channelId := range []string{lent.BookChIdPri, lent.BookChIdInv} {
+			lentApi.On("GetChannelMember", channelId, lent.Worker1Id).Return(&model.ChannelMember{}, nil)
+		}
+		lentPlugin := lent.NewMockPlugin()
+		lentPlugin.SetAPI(lentApi)
+		lentPlugin.repo = newMemRepository()
+
+		var aBook Book
+		DeepCopy(&aBook, lent.ABook)
+		bookId, err := lentPlugin._createABook(&aBook)
+		require.Nil(t, err)
+		masterId, _, err := lentPlugin._borrowABook(lent.BorId, &BorrowRequestKey{
+			BookPostId:   bookId,
+			BorrowerUser: lent.BorrowUser,
+		}, otherRequestData{processTime: GetNowTime()})
+		require.Nil(t, err)
+		for _, status := range []string{STATUS_CONFIRMED, STATUS_KEEPER_CONFIRMED, STATUS_DELIVIED} {
+			master, err := lentPlugin._getBorrowById(masterId)
+			require.Nil(t, err)
+			br := master.borrow.DataOrImage
+			actor, chosen := br.LibworkerUser, ""
+			if status == STATUS_KEEPER_CONFIRMED {
+				actor, chosen = br.KeeperUsers[0], "zzh-book-001 b3"
+			}
+			if status == STATUS_DELIVIED {
+				actor = br.BorrowerUser
+			}
+			require.Nil(t, lentPlugin._processWorkflowRequest(lent.Worker1Id, &WorkflowRequest{
+				MasterPostKey: masterId,
+				ActorUser:     actor,
+				NextStepIndex: _getIndexByStatus(status, br.Worflow),
+				ChosenCopyId:  chosen,
+				Etag:          br.MatchId,
+			}))
+		}
+
+		before, err := lentPlugin.GetABook(bookId)
+		require.Nil(t, err)
+		require.Equal(t, 1, before.book.BookInventory.Lending)
+		inStock := before.book.BookInventory.Stock
+
+		exported, err := lentPlugin._exportBooks(exportOptions{withPri: true, withInv: true})
+		require.Nil(t, err)
+		require.Len(t, exported, 1)
+		assert.Equal(t, inStock+1, exported[0].BookInventory.Stock, "the total of copies")
+		data, err := json.Marshal(exported)
+		require.Nil(t, err)
+		_, err = lentPlugin._uploadBooks(string(data), uploadOptions{})
+		require.Nil(t, err)
+
+		after, err := lentPlugin.GetABook(bookId)
+		require.Nil(t, err)
+		assert.Equal(t, inStock, after.book.BookInventory.Stock)
+		assert.Equal(t, 1, after.book.BookInventory.Lending)
+	})
+
+	t.Run("json_without_permission", func(t *testing.T) {
+		w := export(td.BorId, EXPORT_FORMAT_JSON)
+
+		var books []*Book
+		require.Nil(t, json.Unmarshal(w.Body.Bytes(), &books))
+		require.Len(t, books, 1)
+		assert.Nil(t, books[0].BookPrivate)
+		assert.Nil(t, books[0].BookInventory)
+		assert.NotContains(t, w.Body.String(), "copy_keeper_map")
+	})
+
+	t.Run("csv_row_per_copy", func(t *testing.T) {
+		td.ABookInv.Copies["zzh-book-001 b2"] = BookCopy{COPY_STATUS_LENDING}
+		defer func() {
+			td.ABookInv.Copies["zzh-book-001 b2"] = BookCopy{COPY_STATUS_INSTOCK}
+		}()
+
+		w := export(td.Worker1Id, EXPORT_FORMAT_CSV)
+		rows, err := csv.NewReader(w.Body).ReadAll()
+		require.Nil(t, err)
+		require.Len(t, rows, 4)
+
+		col := map[string]int{}
+		for i, name := range rows[0] {
+			col[name] = i
+		}
+
+		assert.Equal(t, "zzh-book-001 b2", rows[2][col["copy_id"]])
+		assert.Equal(t, COPY_STATUS_LENDING, rows[2][col["copy_status"]])
+		assert.Equal(t, "kpuser1", rows[2][col["keeper_user"]])
+		assert.Equal(t, "kpname1", rows[2][col["keeper_name"]])
+		assert.Equal(t, "kpuser2", rows[3][col["keeper_user"]])
+	})
+
+	t.Run("csv_without_permission", func(t *testing.T) {
+		w := export(td.BorId, EXPORT_FORMAT_CSV)
+		rows, err := csv.NewReader(w.Body).ReadAll()
+		require.Nil(t, err)
+		require.Len(t, rows, 2)
+		assert.NotContains(t, rows[0], "copy_id")
+		assert.NotContains(t, rows[0], "keeper_user")
+		assert.NotContains(t, rows[0], "copy_status")
+	})
+
+	t.Run("xlsx", func(t *testing.T) {
+		w := export(td.Worker1Id, EXPORT_FORMAT_XLSX)
+		zr, err := zip.NewReader(bytes.NewReader(w.Body.Bytes()), int64(w.Body.Len()))
+		require.Nil(t, err)
+
+		names := []string{}
+		for _, f := range zr.File {
+			names = append(names, f.Name)
+		}
+		assert.Contains(t, names, "xl/worksheets/sheet1.xml")
+		assert.Contains(t, names, "[Content_Types].xml")
+	})
+
+	t.Run("unknown_format", func(t *testing.T) {
+		w := export(td.Worker1Id, "doc")
+		var res Result
+		require.Nil(t, json.Unmarshal(w.Body.Bytes(), &res))
+		assert.NotEmpty(t, res.Error)
+	})
+
+	t.Run("column_name", func(t *testing.T) {
+		assert.Equal(t, "A", _xlsxColumnName(0))
+		assert.Equal(t, "Z", _xlsxColumnName(25))
+		assert.Equal(t, "AA", _xlsxColumnName(26))
+	})
+}
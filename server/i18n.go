@@ -40,6 +40,99 @@ var TEXTJSON = `
       },
       "failed-to-get-borrow":{
         "zh":"取得借书请求数据失败"
+      },
+      "export-books-failed":{
+        "zh":"导出图书数据失败"
+      },
+      "invalid-isbn":{
+        "zh":"ISBN无效"
+      },
+      "duplicate-book":{
+        "zh":"图书编号或ISBN已存在"
+      },
+      "patch-book-failed":{
+        "zh":"修改图书数据失败"
+      },
+      "invalid-copy-keeper":{
+        "zh":"副本的保管人不在保管人列表中"
+      },
+      "update-copies-failed":{
+        "zh":"更新图书副本失败"
+      },
+      "not-permitted":{
+        "zh":"没有操作权限"
+      },
+      "transfer-failed":{
+        "zh":"书册转移操作失败"
+      },
+      "invalid-role":{
+        "zh":"无效的角色"
+      },
+      "invalid-request":{
+        "zh":"无效的请求"
+      },
+      "rule-violation":{
+        "zh":"不符合业务规则"
+      },
+      "internal-error":{
+        "zh":"系统内部错误"
+      },
+      "migration-failed":{
+        "zh":"数据迁移失败"
+      },
+      "backup-failed":{
+        "zh":"备份或恢复图书馆数据失败"
+      },
+      "stats-failed":{
+        "zh":"统计图书馆数据失败"
+      },
+      "review-failed":{
+        "zh":"评价图书失败"
+      },
+      "recommend-failed":{
+        "zh":"推荐图书失败"
+      },
+      "purchase-failed":{
+        "zh":"购书申请操作失败"
+      },
+      "donation-failed":{
+        "zh":"捐书操作失败"
+      },
+      "ical-failed":{
+        "zh":"日历订阅操作失败"
+      },
+      "webhook-failed":{
+        "zh":"Webhook操作失败"
+      },
+      "token-failed":{
+        "zh":"API令牌操作失败"
+      },
+      "borrowing-suspended":{
+        "zh":"借书权限已暂停至"
+      },
+      "suspension-reason-overdue":{
+        "zh":"逾期罚分达到上限"
+      },
+      "suspension-reason-lost":{
+        "zh":"丢失图书达到上限"
+      },
+      "category-limited":{
+        "zh":"该类别的图书不对您开放借阅"
+      },
+      "duplicate-borrow":{
+        "zh":"您已在借阅这本书"
+      },
+      "penalty-failed":{
+        "zh":"罚则操作失败"
+      },
+      "borrow-failed":{
+        "zh":"借书操作失败"
+      },
+      "workflow-failed":{
+        "zh":"借书流程操作失败"
+      },
+      "library-not-found":{
+        "zh":"没有找到该图书馆"
       }
     }
 `
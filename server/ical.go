@@ -0,0 +1,335 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/mattermost/mattermost-server/v5/model"
+	"github.com/pkg/errors"
+)
+
+// lines longer than this are folded, see RFC 5545 3.1
+const icalLineOctets = 75
+
+// the domain part of the event UIDs
+const icalUIDDomain = "bookslibrary"
+
+type icalEvent struct {
+	uid         string
+	date        time.Time
+	summary     string
+	description string
+}
+
+func _icalTokenKey(userId string) string {
+	return ICAL_TOKEN_KV_KEY_PREFIX + userId
+}
+
+// Only the hash is kept so that a token can't be found from the KV store.
+func _icalUserKey(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return ICAL_USER_KV_KEY_PREFIX + hex.EncodeToString(sum[:])
+}
+
+// The token is created on first use. Resetting it revokes the feeds subscribed with the old one.
+func (p *Plugin) _getICalToken(userId string, reset bool) (string, error) {
+	data, appErr := p.API.KVGet(_icalTokenKey(userId))
+	if appErr != nil {
+		return "", errors.Wrapf(appErr, "get calendar token error. user: %v", userId)
+	}
+	if data != nil && !reset {
+		return string(data), nil
+	}
+
+	if data != nil {
+		if appErr := p.API.KVDelete(_icalUserKey(string(data))); appErr != nil {
+			return "", errors.Wrapf(appErr, "revoke calendar token error. user: %v", userId)
+		}
+	}
+
+	token := model.NewId() + model.NewId()
+	if appErr := p.API.KVSet(_icalUserKey(token), []byte(userId)); appErr != nil {
+		return "", errors.Wrapf(appErr, "save calendar token error. user: %v", userId)
+	}
+	if appErr := p.API.KVSet(_icalTokenKey(userId), []byte(token)); appErr != nil {
+		return "", errors.Wrapf(appErr, "save calendar token error. user: %v", userId)
+	}
+
+	return token, nil
+}
+
+func (p *Plugin) _userOfICalToken(token string) (string, error) {
+	if token == "" {
+		return "", errors.Wrapf(ErrNotPermitted, "calendar token is required.")
+	}
+
+	data, appErr := p.API.KVGet(_icalUserKey(token))
+	if appErr != nil {
+		return "", errors.Wrapf(appErr, "get calendar token error.")
+	}
+	if data == nil {
+		return "", errors.Wrapf(ErrNotPermitted, "invalid calendar token.")
+	}
+
+	return string(data), nil
+}
+
+func (p *Plugin) _icalFeeds(userId string, reset bool) (*ICalFeeds, error) {
+	token, err := p._getICalToken(userId, reset)
+	if err != nil {
+		return nil, err
+	}
+
+	feedURL := func(feed string) string {
+		query := url.Values{}
+		query.Set(ICAL_TOKEN_PARAM, token)
+		query.Set(LIBRARY_PARAM, p.library.id)
+		return *p.API.GetConfig().ServiceSettings.SiteURL + "/plugins/" + PLUGIN_ID +
+			ICAL_PATH_PREFIX + feed + ".ics?" + query.Encode()
+	}
+
+	return &ICalFeeds{
+		Loans:   feedURL(ICAL_FEED_LOANS),
+		Returns: feedURL(ICAL_FEED_RETURNS),
+	}, nil
+}
+
+// Calendar clients don't have a session, the token identifies the user instead.
+func (p *Plugin) handleICalRequest(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		p._writeMethodNotAllowed(w, http.MethodGet)
+		return
+	}
+
+	lp, err := p._withLibrary(r.URL.Query().Get(LIBRARY_PARAM))
+	if err != nil {
+		p._writeAPIError(w, err)
+		return
+	}
+
+	feed := strings.TrimSuffix(strings.TrimPrefix(r.URL.Path, ICAL_PATH_PREFIX), ".ics")
+	if feed != ICAL_FEED_LOANS && feed != ICAL_FEED_RETURNS {
+		p._writeAPIError(w, errors.Wrapf(ErrNotFound, "unknown calendar %v", feed))
+		return
+	}
+
+	userId, err := lp._userOfICalToken(r.URL.Query().Get(ICAL_TOKEN_PARAM))
+	if err != nil {
+		p._writeAPIError(w, err)
+		return
+	}
+
+	calendar, err := lp._icalCalendar(userId, feed)
+	if err != nil {
+		p._writeAPIError(w, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/calendar; charset=utf-8")
+	w.Header().Set("Content-Disposition", fmt.Sprintf(`inline; filename="%v.ics"`, feed))
+	w.WriteHeader(http.StatusOK)
+	w.Write([]byte(calendar))
+}
+
+func (p *Plugin) _icalCalendar(userId string, feed string) (string, error) {
+	user, appErr := p.API.GetUser(userId)
+	if appErr != nil {
+		return "", errors.Wrapf(appErr, "get user error. id: %v", userId)
+	}
+
+	var events []icalEvent
+	var err error
+	var name string
+	if feed == ICAL_FEED_RETURNS {
+		events, err = p._icalReturnEvents(user.Username)
+		name = "Expected returns"
+	} else {
+		events, err = p._icalLoanEvents(user.Username)
+		name = "Books due"
+	}
+	if err != nil {
+		return "", err
+	}
+
+	if p.library.name != "" {
+		name = p.library.name + " - " + name
+	}
+	return _formatICal(name, events, time.Now()), nil
+}
+
+func (p *Plugin) _icalLoanEvents(username string) ([]icalEvent, error) {
+	loans, err := p._activeLoans(TAG_PREFIX_BORROWER+username, func(br *BorrowRequest) bool {
+		return br.BorrowerUser == username
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	var events []icalEvent
+	for id, br := range loans {
+		due, ok := p._loanDueDate(br)
+		if !ok {
+			continue
+		}
+		events = append(events, icalEvent{
+			uid:     id + "-" + ICAL_FEED_LOANS + "@" + icalUIDDomain,
+			date:    due,
+			summary: "Return " + br.BookName,
+			description: fmt.Sprintf("Copy %v is kept by @%v, renewed %v times.",
+				br.ChosenCopyId, strings.Join(br.KeeperUsers, ", @"), br.RenewedTimes),
+		})
+	}
+	return _sortedICalEvents(events), nil
+}
+
+func (p *Plugin) _icalReturnEvents(username string) ([]icalEvent, error) {
+	loans, err := p._activeLoans(TAG_PREFIX_KEEPER+username, func(br *BorrowRequest) bool {
+		return ConstainsInStringSet(ConvertStringArrayToSet(br.KeeperUsers), []string{username})
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	var events []icalEvent
+	for id, br := range loans {
+		due, ok := p._loanDueDate(br)
+		if !ok {
+			continue
+		}
+		events = append(events, icalEvent{
+			uid:     id + "-" + ICAL_FEED_RETURNS + "@" + icalUIDDomain,
+			date:    due,
+			summary: br.BookName + " comes back",
+			description: fmt.Sprintf("Copy %v is borrowed by %v(@%v), renewed %v times.",
+				br.ChosenCopyId, br.BorrowerName, br.BorrowerUser, br.RenewedTimes),
+		})
+	}
+	return _sortedICalEvents(events), nil
+}
+
+// The borrow masters found by the tag that are delivered and not returned yet, by post id.
+func (p *Plugin) _activeLoans(tag string, match func(*BorrowRequest) bool) (map[string]*BorrowRequest, error) {
+	posts, err := p._repo().SearchByTag(p.borrowChannel, tag)
+	if err != nil {
+		return nil, errors.Wrapf(err, "search borrows error. tag: %v", tag)
+	}
+
+	loans := map[string]*BorrowRequest{}
+	for _, post := range posts {
+		if post.Type != "custom_borrow_type" {
+			continue
+		}
+		var borrow Borrow
+		if err := json.Unmarshal([]byte(post.Message), &borrow); err != nil {
+			continue
+		}
+		br := borrow.DataOrImage
+		if br == nil || br.StepIndex >= len(br.Worflow) ||
+			!ConstainsInStringSet(ConvertStringArrayToSet(borrow.Role), []string{MASTER}) || !match(br) {
+			continue
+		}
+
+		switch br.Worflow[br.StepIndex].Status {
+		case STATUS_DELIVIED, STATUS_RENEW_REQUESTED, STATUS_RENEW_CONFIRMED, STATUS_RETURN_REQUESTED:
+			loans[post.Id] = br
+		}
+	}
+	return loans, nil
+}
+
+// A loan lasts ExpiredDays from the delivery, every renewal adds another ExpiredDays.
+func (p *Plugin) _loanDueDate(br *BorrowRequest) (time.Time, bool) {
+	if p.expiredDays <= 0 {
+		return time.Time{}, false
+	}
+
+	for _, step := range br.Worflow {
+		if step.Status == STATUS_DELIVIED && step.ActionDate != 0 {
+			return _timeOfMillis(step.ActionDate).AddDate(0, 0, p.expiredDays*(1+br.RenewedTimes)), true
+		}
+	}
+	return time.Time{}, false
+}
+
+func _sortedICalEvents(events []icalEvent) []icalEvent {
+	sort.Slice(events, func(i, j int) bool {
+		if !events[i].date.Equal(events[j].date) {
+			return events[i].date.Before(events[j].date)
+		}
+		return events[i].uid < events[j].uid
+	})
+	return events
+}
+
+// Events are all-day on the due date.
+func _formatICal(name string, events []icalEvent, now time.Time) string {
+	lines := []string{
+		"BEGIN:VCALENDAR",
+		"VERSION:2.0",
+		"PRODID:-//" + icalUIDDomain + "//Books Library//EN",
+		"CALSCALE:GREGORIAN",
+		"METHOD:PUBLISH",
+		"X-WR-CALNAME:" + _icalEscape(name),
+	}
+
+	stamp := now.UTC().Format("20060102T150405Z")
+	for _, e := range events {
+		lines = append(lines,
+			"BEGIN:VEVENT",
+			"UID:"+e.uid,
+			"DTSTAMP:"+stamp,
+			"DTSTART;VALUE=DATE:"+e.date.Format("20060102"),
+			"DTEND;VALUE=DATE:"+e.date.AddDate(0, 0, 1).Format("20060102"),
+			"SUMMARY:"+_icalEscape(e.summary),
+			"DESCRIPTION:"+_icalEscape(e.description),
+			"TRANSP:TRANSPARENT",
+			"END:VEVENT",
+		)
+	}
+	lines = append(lines, "END:VCALENDAR")
+
+	var sb strings.Builder
+	for _, line := range lines {
+		sb.WriteString(_icalFold(line))
+		sb.WriteString("\r\n")
+	}
+	return sb.String()
+}
+
+func _icalEscape(text string) string {
+	return strings.NewReplacer(
+		`\`, `\\`,
+		";", `\;`,
+		",", `\,`,
+		"\r\n", `\n`,
+		"\n", `\n`,
+	).Replace(text)
+}
+
+// Folds at rune boundaries, a continuation line starts with a space.
+func _icalFold(line string) string {
+	if len(line) <= icalLineOctets {
+		return line
+	}
+
+	var sb strings.Builder
+	size := 0
+	for _, r := range line {
+		n := utf8.RuneLen(r)
+		if size+n > icalLineOctets {
+			sb.WriteString("\r\n ")
+			size = 1
+		}
+		sb.WriteRune(r)
+		size += n
+	}
+	return sb.String()
+}
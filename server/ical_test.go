@@ -0,0 +1,174 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/mattermost/mattermost-server/v5/model"
+	"github.com/mattermost/mattermost-server/v5/plugin/plugintest"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestICal(t *testing.T) {
+
+	delivered := time.Date(2021, 3, 1, 10, 0, 0, 0, time.Local)
+
+	type icalEnv struct {
+		td     *TestData
+		api    *plugintest.API
+		plugin *Plugin
+		repo   *memRepository
+	}
+
+	setup := func(t *testing.T) *icalEnv {
+		td := NewTestData()
+		api := td.ApiMockCommon()
+		siteURL := "http://localhost:8065"
+		api.On("GetConfig").Return(&model.Config{ServiceSettings: model.ServiceSettings{SiteURL: &siteURL}})
+		plugin := td.NewMockPlugin()
+		plugin.SetAPI(api)
+		repo := newMemRepository()
+		plugin.repo = repo
+		return &icalEnv{td, api, plugin, repo}
+	}
+
+	createBorrow := func(t *testing.T, env *icalEnv, bookName string, borrower string, keeper string, status string, renewed int) string {
+		wf := env.plugin._createWFTemplate(GetNowTime())
+		wf[_getIndexByStatus(STATUS_DELIVIED, wf)].ActionDate = _millisOf(delivered)
+		br := &BorrowRequest{
+			BookName:     bookName,
+			BorrowerUser: borrower,
+			BorrowerName: "book" + borrower,
+			KeeperUsers:  []string{keeper},
+			ChosenCopyId: bookName + " b1",
+			Worflow:      wf,
+			StepIndex:    _getIndexByStatus(status, wf),
+			RenewedTimes: renewed,
+			Tags: []string{
+				TAG_PREFIX_BORROWER + borrower,
+				TAG_PREFIX_KEEPER + keeper,
+				TAG_PREFIX_STATUS + status,
+			},
+		}
+		data, _ := _marshalRecord(&Borrow{DataOrImage: br, Role: []string{MASTER}})
+		post, err := env.repo.Create(&model.Post{
+			ChannelId: env.plugin.borrowChannel.Id,
+			Type:      "custom_borrow_type",
+			Message:   string(data),
+		})
+		require.Nil(t, err)
+		return post.Id
+	}
+
+	get := func(env *icalEnv, feedURL string) *httptest.ResponseRecorder {
+		u, err := url.Parse(feedURL)
+		require.Nil(t, err)
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest(http.MethodGet, strings.TrimPrefix(u.Path, "/plugins/"+PLUGIN_ID)+"?"+u.RawQuery, nil)
+		env.plugin.ServeHTTP(nil, w, r)
+		return w
+	}
+
+	unfold := func(w *httptest.ResponseRecorder) string {
+		return strings.ReplaceAll(w.Body.String(), "\r\n ", "")
+	}
+
+	t.Run("loans_and_returns", func(t *testing.T) {
+		env := setup(t)
+		delivering := createBorrow(t, env, "book a", "bor", "kpuser1", STATUS_DELIVIED, 0)
+		renewed := createBorrow(t, env, "book b", "bor", "kpuser2", STATUS_RENEW_CONFIRMED, 1)
+		createBorrow(t, env, "book c", "bor", "kpuser1", STATUS_RETURNED, 0)
+		createBorrow(t, env, "book d", "bor", "kpuser1", STATUS_KEEPER_CONFIRMED, 0)
+		createBorrow(t, env, "book e", "worker2", "kpuser1", STATUS_RETURN_REQUESTED, 2)
+
+		feeds, err := env.plugin._icalFeeds(env.td.BorId, false)
+		require.Nil(t, err)
+		assert.True(t, strings.HasPrefix(feeds.Loans, "http://localhost:8065/plugins/"+PLUGIN_ID+"/ical/loans.ics?"))
+
+		w := get(env, feeds.Loans)
+		require.Equal(t, http.StatusOK, w.Code)
+		assert.Equal(t, "text/calendar; charset=utf-8", w.Header().Get("Content-Type"))
+		body := unfold(w)
+		assert.True(t, strings.HasPrefix(body, "BEGIN:VCALENDAR\r\n"))
+		assert.True(t, strings.HasSuffix(body, "END:VCALENDAR\r\n"))
+		assert.Equal(t, 2, strings.Count(body, "BEGIN:VEVENT"))
+		assert.Contains(t, body, "UID:"+delivering+"-loans@bookslibrary\r\n")
+		assert.Contains(t, body, "DTSTART;VALUE=DATE:20210331\r\nDTEND;VALUE=DATE:20210401\r\nSUMMARY:Return book a\r\n")
+		assert.Contains(t, body, "UID:"+renewed+"-loans@bookslibrary\r\n")
+		assert.Contains(t, body, "DTSTART;VALUE=DATE:20210430\r\n", "a renewal adds 30 days")
+		assert.Contains(t, body, `DESCRIPTION:Copy book b b1 is kept by @kpuser2\, renewed 1 times.`)
+		assert.Less(t, strings.Index(body, "book a"), strings.Index(body, "book b"), "the earlier first")
+
+		feeds, err = env.plugin._icalFeeds(env.td.Keeper1Id, false)
+		require.Nil(t, err)
+		body = unfold(get(env, feeds.Returns))
+		assert.Equal(t, 2, strings.Count(body, "BEGIN:VEVENT"))
+		assert.Contains(t, body, "SUMMARY:book a comes back\r\n")
+		assert.Contains(t, body, "DTSTART;VALUE=DATE:20210530\r\n")
+		assert.Contains(t, body, "DESCRIPTION:Copy book e b1 is borrowed by bookworker2(@worker2)\\, renewed 2 times.")
+
+		env.plugin.expiredDays = 0
+		body = unfold(get(env, feeds.Returns))
+		assert.NotContains(t, body, "BEGIN:VEVENT", "no due dates without the policy")
+	})
+
+	t.Run("tokens", func(t *testing.T) {
+		env := setup(t)
+
+		w := get(env, "/ical/loans.ics")
+		assert.Equal(t, http.StatusForbidden, w.Code)
+		w = get(env, "/ical/loans.ics?token=unknown")
+		assert.Equal(t, http.StatusForbidden, w.Code)
+
+		feeds, err := env.plugin._icalFeeds(env.td.BorId, false)
+		require.Nil(t, err)
+		again, err := env.plugin._icalFeeds(env.td.BorId, false)
+		require.Nil(t, err)
+		assert.Equal(t, feeds, again)
+
+		w = get(env, strings.Replace(feeds.Loans, "loans.ics", "others.ics", 1))
+		assert.Equal(t, http.StatusNotFound, w.Code)
+
+		reset, err := env.plugin._icalFeeds(env.td.BorId, true)
+		require.Nil(t, err)
+		assert.NotEqual(t, feeds.Loans, reset.Loans)
+		assert.Equal(t, http.StatusForbidden, get(env, feeds.Loans).Code, "revoked")
+		assert.Equal(t, http.StatusOK, get(env, reset.Loans).Code)
+	})
+
+	t.Run("escape_and_fold", func(t *testing.T) {
+		assert.Equal(t, `a\, b\; c\\d\ne`, _icalEscape("a, b; c\\d\ne"))
+
+		line := "SUMMARY:" + strings.Repeat("书", 30)
+		folded := _icalFold(line)
+		for _, l := range strings.Split(folded, "\r\n") {
+			assert.LessOrEqual(t, len(l), 75)
+		}
+		assert.Equal(t, line, strings.ReplaceAll(folded, "\r\n ", ""))
+	})
+
+	t.Run("command", func(t *testing.T) {
+		env := setup(t)
+
+		text, err := env.plugin._executeICal(env.td.BorId, []string{"renew"})
+		require.Nil(t, err)
+		assert.Equal(t, "Usage: /library_ical [reset]", text)
+
+		text, err = env.plugin._executeICal(env.td.BorId, nil)
+		require.Nil(t, err)
+		feeds, err := env.plugin._icalFeeds(env.td.BorId, false)
+		require.Nil(t, err)
+		assert.Contains(t, text, "Books due: "+feeds.Loans)
+		assert.Contains(t, text, "Expected returns: "+feeds.Returns)
+
+		text, err = env.plugin._executeICal(env.td.BorId, []string{"reset"})
+		require.Nil(t, err)
+		assert.True(t, strings.HasPrefix(text, "Succ."))
+		assert.NotContains(t, text, feeds.Loans)
+	})
+}
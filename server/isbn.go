@@ -0,0 +1,196 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	"github.com/mattermost/mattermost-server/v5/model"
+	"github.com/pkg/errors"
+)
+
+// NormalizeIsbn validates an ISBN-10 or ISBN-13 and returns both forms.
+// Hyphens and spaces are ignored. An ISBN-13 with the 979 prefix has no ISBN-10 form.
+func NormalizeIsbn(isbn string) (isbn10 string, isbn13 string, err error) {
+	s := strings.ToUpper(strings.NewReplacer("-", "", " ", "").Replace(isbn))
+
+	switch len(s) {
+	case 10:
+		if !_isValidIsbn10(s) {
+			return "", "", errors.Wrapf(ErrInvalidIsbn, "isbn: %v", isbn)
+		}
+		isbn10 = s
+		isbn13 = "978" + s[:9]
+		isbn13 += _isbn13CheckDigit(isbn13)
+	case 13:
+		if !_isValidIsbn13(s) {
+			return "", "", errors.Wrapf(ErrInvalidIsbn, "isbn: %v", isbn)
+		}
+		isbn13 = s
+		if strings.HasPrefix(s, "978") {
+			isbn10 = s[3:12] + _isbn10CheckDigit(s[3:12])
+		}
+	default:
+		return "", "", errors.Wrapf(ErrInvalidIsbn, "isbn: %v", isbn)
+	}
+
+	return isbn10, isbn13, nil
+}
+
+func _isDigits(s string) bool {
+	for _, c := range s {
+		if c < '0' || c > '9' {
+			return false
+		}
+	}
+	return true
+}
+
+func _isbn10CheckDigit(first9 string) string {
+	sum := 0
+	for i, c := range first9 {
+		sum += (10 - i) * int(c-'0')
+	}
+	check := (11 - sum%11) % 11
+	if check == 10 {
+		return "X"
+	}
+	return fmt.Sprintf("%d", check)
+}
+
+func _isbn13CheckDigit(first12 string) string {
+	sum := 0
+	for i, c := range first12 {
+		if i%2 == 0 {
+			sum += int(c - '0')
+		} else {
+			sum += 3 * int(c-'0')
+		}
+	}
+	return fmt.Sprintf("%d", (10-sum%10)%10)
+}
+
+func _isValidIsbn10(s string) bool {
+	if len(s) != 10 || !_isDigits(s[:9]) {
+		return false
+	}
+	return _isbn10CheckDigit(s[:9]) == s[9:]
+}
+
+func _isValidIsbn13(s string) bool {
+	if len(s) != 13 || !_isDigits(s) {
+		return false
+	}
+	if !strings.HasPrefix(s, "978") && !strings.HasPrefix(s, "979") {
+		return false
+	}
+	return _isbn13CheckDigit(s[:12]) == s[12:]
+}
+
+// Fill both isbn fields from whichever is given.
+// It is an error if both are given but refer to different books.
+func (p *Plugin) _normalizeBookIsbn(pub *BookPublic) error {
+	if pub.Isbn10 == "" && pub.Isbn13 == "" {
+		return nil
+	}
+
+	var isbn10, isbn13 string
+
+	if pub.Isbn13 != "" {
+		i10, i13, err := NormalizeIsbn(pub.Isbn13)
+		if err != nil {
+			return err
+		}
+		isbn10, isbn13 = i10, i13
+	}
+
+	if pub.Isbn10 != "" {
+		i10, i13, err := NormalizeIsbn(pub.Isbn10)
+		if err != nil {
+			return err
+		}
+		if isbn13 != "" && isbn13 != i13 {
+			return errors.Wrapf(ErrInvalidIsbn, "isbn10 %v and isbn13 %v do not match", pub.Isbn10, pub.Isbn13)
+		}
+		isbn10, isbn13 = i10, i13
+	}
+
+	pub.Isbn10 = isbn10
+	pub.Isbn13 = isbn13
+
+	return nil
+}
+
+// Books are indexed by the hashtags in their public record.
+// The search result is verified again, because hashtag search is not an exact match.
+func (p *Plugin) _findBookPostsByTag(tag string) ([]*model.Post, []*BookPublic, error) {
+	posts, err := p._repo().SearchByTag(p.booksChannel, tag)
+	if err != nil {
+		return nil, nil, errors.Wrapf(err, "search posts error.")
+	}
+
+	foundPosts := []*model.Post{}
+	foundPubs := []*BookPublic{}
+
+	for _, post := range posts {
+		if post.Type != "custom_book_type" {
+			continue
+		}
+		pub := new(BookPublic)
+		if err := json.Unmarshal([]byte(post.Message), pub); err != nil {
+			continue
+		}
+		for _, t := range pub.Tags {
+			if t == tag {
+				foundPosts = append(foundPosts, post)
+				foundPubs = append(foundPubs, pub)
+				break
+			}
+		}
+	}
+
+	return foundPosts, foundPubs, nil
+}
+
+// Find a book's public post by isbn. Return an empty id if not found.
+func (p *Plugin) _findBookPostIdByIsbn(isbn string) (string, error) {
+	_, isbn13, err := NormalizeIsbn(isbn)
+	if err != nil {
+		return "", err
+	}
+
+	posts, _, err := p._findBookPostsByTag(TAG_PREFIX_ISBN + isbn13)
+	if err != nil {
+		return "", err
+	}
+
+	if len(posts) == 0 {
+		return "", nil
+	}
+
+	return posts[0].Id, nil
+}
+
+// Refuse a book whose id or isbn is already used by another book.
+// selfPostId is the book's own public post, it is empty when creating.
+func (p *Plugin) _checkDuplicateBook(pub *BookPublic, selfPostId string) error {
+
+	tags := []string{TAG_PREFIX_ID + pub.Id}
+	if pub.Isbn13 != "" {
+		tags = append(tags, TAG_PREFIX_ISBN+pub.Isbn13)
+	}
+
+	for _, tag := range tags {
+		posts, _, err := p._findBookPostsByTag(tag)
+		if err != nil {
+			return err
+		}
+		for _, post := range posts {
+			if post.Id != selfPostId {
+				return errors.Wrapf(ErrDuplicateBook, "%v is already used by book post %v", tag, post.Id)
+			}
+		}
+	}
+
+	return nil
+}
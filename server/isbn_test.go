@@ -0,0 +1,121 @@
+package main
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/mattermost/mattermost-server/v5/model"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/require"
+)
+
+func TestIsbn(t *testing.T) {
+
+	t.Run("normalize", func(t *testing.T) {
+		for _, c := range []struct {
+			input  string
+			isbn10 string
+			isbn13 string
+			err    bool
+		}{
+			{"0-306-40615-2", "0306406152", "9780306406157", false},
+			{"978-0-306-40615-7", "0306406152", "9780306406157", false},
+			{"0-8044-2957-x", "080442957X", "9780804429573", false},
+			{"979-10-90636-07-1", "", "9791090636071", false},
+			{"0-306-40615-3", "", "", true},
+			{"978-0-306-40615-8", "", "", true},
+			{"123", "", "", true},
+			{"977-0-306-40615-7", "", "", true},
+		} {
+			isbn10, isbn13, err := NormalizeIsbn(c.input)
+			if c.err {
+				assert.ErrorIsf(t, err, ErrInvalidIsbn, "input: %v", c.input)
+				continue
+			}
+			require.Nilf(t, err, "input: %v", c.input)
+			assert.Equalf(t, c.isbn10, isbn10, "input: %v", c.input)
+			assert.Equalf(t, c.isbn13, isbn13, "input: %v", c.input)
+		}
+	})
+
+	t.Run("book_isbn_mismatch", func(t *testing.T) {
+		plugin := &Plugin{}
+		pub := &BookPublic{Isbn10: "0306406152", Isbn13: "9780804429573"}
+		assert.ErrorIs(t, plugin._normalizeBookIsbn(pub), ErrInvalidIsbn)
+
+		pub = &BookPublic{Isbn10: "0-306-40615-2"}
+		require.Nil(t, plugin._normalizeBookIsbn(pub))
+		assert.Equal(t, "9780306406157", pub.Isbn13)
+	})
+
+	td := NewTestData()
+	td.ABookPub.Isbn10 = "0306406152"
+	td.ABookPub.Isbn13 = "9780306406157"
+	td.ABookPub.Tags = []string{
+		TAG_PREFIX_ID + td.ABookPub.Id,
+		TAG_PREFIX_ISBN + td.ABookPub.Isbn13,
+		TAG_PREFIX_ISBN + td.ABookPub.Isbn10,
+	}
+
+	plugin := td.NewMockPlugin()
+	api := td.ApiMockCommon()
+	plugin.SetAPI(api)
+
+	api.On("SearchPostsInTeam", plugin.team.Id, mock.AnythingOfType("[]*model.SearchParams")).Return(
+		func(teamId string, params []*model.SearchParams) []*model.Post {
+			pubJson, _ := json.Marshal(td.ABookPub)
+			return []*model.Post{
+				{
+					Id:      td.BookPostIdPub,
+					Type:    "custom_book_type",
+					Message: string(pubJson),
+				},
+			}
+		}, nil)
+
+	newBook := func(id string, isbn string) *Book {
+		var book Book
+		DeepCopy(&book, td.ABook)
+		book.BookPublic.Id = id
+		book.BookPublic.Isbn10 = ""
+		book.BookPublic.Isbn13 = isbn
+		return &book
+	}
+
+	t.Run("create_duplicate_isbn", func(t *testing.T) {
+		_, err := plugin._createABook(newBook("zzh-book-new", "978-0-306-40615-7"))
+		assert.ErrorIs(t, err, ErrDuplicateBook)
+	})
+
+	t.Run("create_duplicate_isbn10", func(t *testing.T) {
+		book := newBook("zzh-book-new", "")
+		book.BookPublic.Isbn10 = "0306406152"
+		_, err := plugin._createABook(book)
+		assert.ErrorIs(t, err, ErrDuplicateBook)
+	})
+
+	t.Run("create_duplicate_id", func(t *testing.T) {
+		_, err := plugin._createABook(newBook(td.ABookPub.Id, ""))
+		assert.ErrorIs(t, err, ErrDuplicateBook)
+	})
+
+	t.Run("create_invalid_isbn", func(t *testing.T) {
+		_, err := plugin._createABook(newBook("zzh-book-new", "978-0-306-40615-8"))
+		assert.ErrorIs(t, err, ErrInvalidIsbn)
+	})
+
+	t.Run("upload_match_isbn", func(t *testing.T) {
+		book := newBook(td.ABookPub.Id, "0306406152")
+		book.BookPublic.Name = "renamed by isbn"
+		book.Upload = &Upload{MatchIsbn: true}
+
+		msg, err := plugin._uploadABook(book, uploadOptions{})
+		require.Nil(t, err)
+		assert.Equal(t, td.BookPostIdPub, msg.PostId)
+		assert.Equal(t, "renamed by isbn", td.ABookPub.Name)
+		assert.Equal(t, "9780306406157", td.ABookPub.Isbn13)
+		assert.Contains(t, td.ABookPub.Tags, TAG_PREFIX_ISBN+"9780306406157")
+		assert.Contains(t, td.ABookPub.Tags, TAG_PREFIX_ISBN+"0306406152")
+	})
+}
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"fmt"
+	"sync"
+	"time"
+)
+
+// how often the background job runs its tasks
+const backgroundJobInterval = time.Hour
+
+// how often the webhook deliveries are retried
+const webhookJobInterval = time.Minute
+
+// A periodic task decides itself if there is something to do at the time,
+// e.g. a monthly report is posted once a month.
+// Tasks share the KV store to run once in a cluster.
+type backgroundTask struct {
+	name string
+	run  func(p *Plugin, now time.Time) error
+}
+
+var backgroundTasks = []backgroundTask{
+	{"monthly reports", (*Plugin)._postMonthlyReports},
+	{"recommendations", (*Plugin)._refreshRecommendations},
+	{"overdue penalties", (*Plugin)._chargeOverduePenalties},
+}
+
+type backgroundJob struct {
+	stop chan struct{}
+	done sync.WaitGroup
+	// the webhooks are sent without waiting for the next retry
+	webhooks chan struct{}
+}
+
+// Safe on a nil job, e.g. in tests the deliveries are sent by calling _deliverWebhooks.
+func (job *backgroundJob) kickWebhooks() {
+	if job == nil {
+		return
+	}
+	select {
+	case job.webhooks <- struct{}{}:
+	default:
+	}
+}
+
+func (p *Plugin) _startBackgroundJob() {
+	job := &backgroundJob{stop: make(chan struct{}), webhooks: make(chan struct{}, 1)}
+	job.done.Add(1)
+	go func() {
+		defer job.done.Done()
+		ticker := time.NewTicker(backgroundJobInterval)
+		defer ticker.Stop()
+		webhookTicker := time.NewTicker(webhookJobInterval)
+		defer webhookTicker.Stop()
+		p._runBackgroundTasks(time.Now())
+		for {
+			select {
+			case <-job.stop:
+				return
+			case <-ticker.C:
+				p._runBackgroundTasks(time.Now())
+			case <-webhookTicker.C:
+				p._runWebhookDeliveries(time.Now())
+			case <-job.webhooks:
+				p._runWebhookDeliveries(time.Now())
+			}
+		}
+	}()
+	p.backgroundJob = job
+}
+
+func (p *Plugin) _stopBackgroundJob() {
+	if p.backgroundJob == nil {
+		return
+	}
+	close(p.backgroundJob.stop)
+	p.backgroundJob.done.Wait()
+	p.backgroundJob = nil
+}
+
+// A failed task doesn't stop the others, it's tried again by the next run.
+func (p *Plugin) _runBackgroundTasks(now time.Time) {
+	for _, task := range backgroundTasks {
+		if err := task.run(p, now); err != nil {
+			p.API.LogError(fmt.Sprintf("Failed to run background task %v.", task.name), "err", fmt.Sprintf("%+v", err))
+		}
+	}
+}
+
+func (p *Plugin) _runWebhookDeliveries(now time.Time) {
+	if err := p._deliverWebhooks(now); err != nil {
+		p.API.LogError("Failed to deliver webhooks.", "err", fmt.Sprintf("%+v", err))
+	}
+}
@@ -0,0 +1,322 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/mattermost/mattermost-server/v5/model"
+	"github.com/pkg/errors"
+)
+
+const (
+	kioskPathPrefix = apiV1Prefix + "kiosk/"
+	// the time of use of a token is recorded at most once a minute, in milliseconds
+	apiTokenUseInterval = 60 * 1000
+)
+
+var apiTokenScopes = []string{
+	API_TOKEN_SCOPE_CHECKOUT,
+	API_TOKEN_SCOPE_CHECKIN,
+}
+
+// status -> the scope to move a borrow to the status at a kiosk
+var kioskTransitions = map[string]string{
+	STATUS_DELIVIED:         API_TOKEN_SCOPE_CHECKOUT,
+	STATUS_RETURN_REQUESTED: API_TOKEN_SCOPE_CHECKIN,
+	STATUS_RETURN_CONFIRMED: API_TOKEN_SCOPE_CHECKIN,
+}
+
+func (p *Plugin) _apiTokensKey() string {
+	return API_TOKENS_KV_KEY_PREFIX + p.library.id
+}
+
+func _hashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+func (p *Plugin) _loadApiTokens() ([]ApiToken, error) {
+	data, appErr := p.API.KVGet(p._apiTokensKey())
+	if appErr != nil {
+		return nil, errors.Wrapf(appErr, "get api tokens error.")
+	}
+
+	tokens := []ApiToken{}
+	if data == nil {
+		return tokens, nil
+	}
+	if err := json.Unmarshal(data, &tokens); err != nil {
+		return nil, errors.Wrapf(err, "convert api tokens error.")
+	}
+	return tokens, nil
+}
+
+func (p *Plugin) _listApiTokens(userId string) ([]ApiToken, error) {
+	if err := p._checkRole(userId, ROLE_LIBRARY_ADMIN); err != nil {
+		return nil, err
+	}
+
+	tokens, err := p._loadApiTokens()
+	if err != nil {
+		return nil, err
+	}
+	for i := range tokens {
+		tokens[i].Hash = ""
+	}
+	return tokens, nil
+}
+
+// Only the hash is kept, the token is shown once in the result.
+func (p *Plugin) _issueApiToken(userId string, req *ApiToken) (*ApiToken, error) {
+	if err := p._checkRole(userId, ROLE_LIBRARY_ADMIN); err != nil {
+		return nil, err
+	}
+
+	name := strings.TrimSpace(req.Name)
+	if name == "" || strings.ContainsAny(name, " \t\n") {
+		return nil, KindError(ErrInvalidRequest, "name is required and should be one word.")
+	}
+	if len(req.Scopes) == 0 {
+		return nil, KindError(ErrInvalidRequest, "scopes are required, should be of %v.", strings.Join(apiTokenScopes, ", "))
+	}
+	valid := ConvertStringArrayToSet(apiTokenScopes)
+	scopes := []string{}
+	for _, scope := range req.Scopes {
+		if !valid[scope] {
+			return nil, KindError(ErrInvalidRequest, "unknown scope %v, should be of %v.", scope, strings.Join(apiTokenScopes, ", "))
+		}
+		scopes = _appendUnique(scopes, scope)
+	}
+
+	user, appErr := p.API.GetUser(userId)
+	if appErr != nil {
+		return nil, errors.Wrapf(appErr, "get user %v error.", userId)
+	}
+
+	secret := model.NewId() + model.NewId()
+	token := ApiToken{
+		Id:        model.NewId(),
+		Name:      name,
+		Scopes:    scopes,
+		Hash:      _hashToken(secret),
+		CreatedBy: user.Username,
+		CreateAt:  GetNowTime(),
+	}
+
+	var tokens []ApiToken
+	if err := p._compareAndUpdateKV(p._apiTokensKey(), &tokens, func() error {
+		for _, t := range tokens {
+			if t.Name == name {
+				return KindError(ErrRuleViolation, "token %v already exists.", name)
+			}
+		}
+		tokens = append(tokens, token)
+		return nil
+	}); err != nil {
+		return nil, err
+	}
+
+	token.Hash = ""
+	token.Token = secret
+	return &token, nil
+}
+
+func (p *Plugin) _revokeApiToken(userId string, id string) error {
+	if err := p._checkRole(userId, ROLE_LIBRARY_ADMIN); err != nil {
+		return err
+	}
+
+	var tokens []ApiToken
+	return p._compareAndUpdateKV(p._apiTokensKey(), &tokens, func() error {
+		for i, t := range tokens {
+			if t.Id == id {
+				tokens = append(tokens[:i], tokens[i+1:]...)
+				return nil
+			}
+		}
+		return errors.Wrapf(ErrNotFound, "api token %v", id)
+	})
+}
+
+// The time of use is recorded at best, and only once in apiTokenUseInterval,
+// so a busy kiosk doesn't rewrite the tokens on every request.
+func (p *Plugin) _authenticateApiToken(secret string) (*ApiToken, error) {
+	if secret == "" {
+		return nil, errors.Wrapf(ErrNotPermitted, "api token is required.")
+	}
+
+	tokens, err := p._loadApiTokens()
+	if err != nil {
+		return nil, err
+	}
+
+	hash := _hashToken(secret)
+	for _, t := range tokens {
+		if t.Hash != hash {
+			continue
+		}
+
+		now := GetNowTime()
+		if now-t.LastUsedAt < apiTokenUseInterval {
+			return &t, nil
+		}
+
+		var all []ApiToken
+		if err := p._compareAndUpdateKV(p._apiTokensKey(), &all, func() error {
+			for i := range all {
+				if all[i].Id == t.Id && now-all[i].LastUsedAt >= apiTokenUseInterval {
+					all[i].LastUsedAt = now
+				}
+			}
+			return nil
+		}); err != nil {
+			p.API.LogError("Failed to record the use of an api token.", "err", fmt.Sprintf("%+v", err))
+		}
+		return &t, nil
+	}
+	return nil, errors.Wrapf(ErrNotPermitted, "invalid api token.")
+}
+
+// A copy is lent to one borrow at a time, the returned ones are history.
+func (p *Plugin) _findOpenBorrowOfCopy(copyId string) (string, *Borrow, error) {
+	tag := TAG_PREFIX_COPYID + p._convertChosenCopyIdToTag(copyId)
+	posts, err := p._repo().SearchByTag(p.borrowChannel, tag)
+	if err != nil {
+		return "", nil, errors.Wrapf(err, "search borrows error. tag: %v", tag)
+	}
+
+	for _, post := range posts {
+		if post.Type != "custom_borrow_type" {
+			continue
+		}
+		var borrow Borrow
+		if err := json.Unmarshal([]byte(post.Message), &borrow); err != nil {
+			continue
+		}
+		br := borrow.DataOrImage
+		if br == nil || br.ChosenCopyId != copyId || br.StepIndex >= len(br.Worflow) ||
+			!ConstainsInStringSet(ConvertStringArrayToSet(borrow.Role), []string{MASTER}) {
+			continue
+		}
+		if br.Worflow[br.StepIndex].Status != STATUS_RETURNED {
+			return post.Id, &borrow, nil
+		}
+	}
+	return "", nil, errors.Wrapf(ErrNotFound, "no open borrow of copy %v", copyId)
+}
+
+// The borrow of the copy is moved to the first next step that a kiosk can do,
+// e.g. a delivered copy is to be returned, a scan does one step only.
+// The copy id may also be read from its label.
+func (p *Plugin) _scanAtKiosk(token *ApiToken, copyId string) (*KioskScanResult, error) {
+	copyId = _copyIdOfScan(strings.TrimSpace(copyId))
+	if copyId == "" {
+		return nil, KindError(ErrInvalidRequest, "copy id is required.")
+	}
+
+	masterKey, borrow, err := p._findOpenBorrowOfCopy(copyId)
+	if err != nil {
+		return nil, err
+	}
+	master := borrow.DataOrImage
+
+	curr := master.Worflow[master.StepIndex]
+	next := -1
+	for _, i := range curr.NextStepIndex {
+		if _, ok := kioskTransitions[master.Worflow[i].Status]; ok {
+			next = i
+			break
+		}
+	}
+	if next < 0 {
+		return nil, WithDetails(KindError(ErrRuleViolation, "the borrow of copy %v is %v, nothing to do at a kiosk.", copyId, curr.Status),
+			ErrorDetails{ERROR_DETAIL_STATUS: curr.Status})
+	}
+
+	scope := kioskTransitions[master.Worflow[next].Status]
+	if !ConstainsInStringSet(ConvertStringArrayToSet(token.Scopes), []string{scope}) {
+		return nil, errors.Wrapf(ErrNotPermitted, "token %v has no scope %v", token.Name, scope)
+	}
+
+	if err := p._processWorkflowRequestBy(workflowActor{kiosk: token.Name}, &WorkflowRequest{
+		MasterPostKey: masterKey,
+		ActorUser:     KIOSK_ACTOR_PREFIX + token.Name,
+		NextStepIndex: next,
+		Etag:          master.MatchId,
+	}); err != nil {
+		return nil, err
+	}
+
+	return &KioskScanResult{
+		MasterKey:      masterKey,
+		BookName:       master.BookName,
+		CopyId:         copyId,
+		BorrowerUser:   master.BorrowerUser,
+		PreviousStatus: curr.Status,
+		Status:         master.Worflow[next].Status,
+	}, nil
+}
+
+// A kiosk has no Mattermost session, it is authenticated by the bearer token.
+func (p *Plugin) handleKioskRequest(w http.ResponseWriter, r *http.Request) {
+	secret := strings.TrimSpace(strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer "))
+
+	lp, err := p._withLibrary(r.URL.Query().Get(LIBRARY_PARAM))
+	if err != nil {
+		p._writeAPIResult(w, http.StatusNotFound, p._errorResult(err, p.i18n.GetText("library-not-found")))
+		return
+	}
+
+	token, err := lp._authenticateApiToken(secret)
+	if errors.Is(err, ErrNotPermitted) {
+		p._writeAPIResult(w, http.StatusUnauthorized, p._errorResult(err, "Not authorized"))
+		return
+	}
+	if err != nil {
+		p._writeAPIError(w, err)
+		return
+	}
+
+	switch strings.Trim(strings.TrimPrefix(r.URL.Path, kioskPathPrefix), "/") {
+	case "scan":
+		if r.Method != http.MethodPost {
+			p._writeMethodNotAllowed(w, http.MethodPost)
+			return
+		}
+		var req KioskScanRequest
+		if err := _decodeAPIBody(r, &req); err != nil {
+			p._writeAPIError(w, err)
+			return
+		}
+		result, err := lp._scanAtKiosk(token, req.CopyId)
+		if err != nil {
+			p._writeAPIError(w, err)
+			return
+		}
+		p._writeAPIResult(w, http.StatusOK, result)
+
+	default:
+		p._writeAPIError(w, errors.Wrapf(ErrNotFound, "unknown resource %v", r.URL.Path))
+	}
+}
+
+func _formatApiTokens(tokens []ApiToken) string {
+	if len(tokens) == 0 {
+		return "No api tokens."
+	}
+
+	lines := []string{"| Name | Scopes | Issued by | Last used | Id |", "|:--|:--|:--|:--|:--|"}
+	for _, t := range tokens {
+		used := "never"
+		if t.LastUsedAt != 0 {
+			used = _timeOfMillis(t.LastUsedAt).Format("2006-01-02 15:04")
+		}
+		lines = append(lines, fmt.Sprintf("| %v | %v | @%v | %v | %v |",
+			t.Name, strings.Join(t.Scopes, ", "), t.CreatedBy, used, t.Id))
+	}
+	return strings.Join(lines, "\n")
+}
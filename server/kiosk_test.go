@@ -0,0 +1,260 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/mattermost/mattermost-server/v5/model"
+	"github.com/mattermost/mattermost-server/v5/plugin/plugintest"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/require"
+)
+
+func TestKiosk(t *testing.T) {
+
+	const copyId = "zzh-book-001 b3"
+
+	type kioskEnv struct {
+		td     *TestData
+		api    *plugintest.API
+		plugin *Plugin
+	}
+
+	setup := func(t *testing.T) *kioskEnv {
+		td := NewTestData()
+		api := td.ApiMockCommon()
+		siteURL := "http://localhost:8065"
+		api.On("GetConfig").Return(&model.Config{ServiceSettings: model.ServiceSettings{SiteURL: &siteURL}})
+		api.On("CreatePost", mock.Anything).Return(&model.Post{}, nil)
+		plugin := td.NewMockPlugin()
+		plugin.SetAPI(api)
+		plugin.repo = newMemRepository()
+		return &kioskEnv{td, api, plugin}
+	}
+
+	issue := func(t *testing.T, env *kioskEnv, name string, scopes ...string) *ApiToken {
+		token, err := env.plugin._issueApiToken(env.td.Worker1Id, &ApiToken{Name: name, Scopes: scopes})
+		require.Nil(t, err)
+		return token
+	}
+
+	// a borrow whose copy is chosen by the keeper
+	keeperConfirmed := func(t *testing.T, env *kioskEnv) string {
+		var book Book
+		DeepCopy(&book, env.td.ABook)
+		book.BookPublic.Id = ""
+		bookId, err := env.plugin._createABook(&book)
+		require.Nil(t, err)
+
+		masterId, _, err := env.plugin._borrowABook(env.td.BorId, &BorrowRequestKey{
+			BookPostId:   bookId,
+			BorrowerUser: env.td.BorrowUser,
+		}, otherRequestData{processTime: GetNowTime()})
+		require.Nil(t, err)
+
+		for _, status := range []string{STATUS_CONFIRMED, STATUS_KEEPER_CONFIRMED} {
+			master, err := env.plugin._getBorrowById(masterId)
+			require.Nil(t, err)
+			br := master.borrow.DataOrImage
+			actor, chosen := br.LibworkerUser, ""
+			if status == STATUS_KEEPER_CONFIRMED {
+				actor, chosen = br.KeeperUsers[0], copyId
+			}
+			require.Nil(t, env.plugin._processWorkflowRequest(env.td.BorId, &WorkflowRequest{
+				MasterPostKey: masterId,
+				ActorUser:     actor,
+				NextStepIndex: _getIndexByStatus(status, br.Worflow),
+				ChosenCopyId:  chosen,
+				Etag:          br.MatchId,
+			}))
+		}
+		return masterId
+	}
+
+	statusOf := func(t *testing.T, env *kioskEnv, masterId string) string {
+		master, err := env.plugin._getBorrowById(masterId)
+		require.Nil(t, err)
+		br := master.borrow.DataOrImage
+		return br.Worflow[br.StepIndex].Status
+	}
+
+	scan := func(env *kioskEnv, secret string, body string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest(http.MethodPost, "/api/v1/kiosk/scan", strings.NewReader(body))
+		if secret != "" {
+			r.Header.Set("Authorization", "Bearer "+secret)
+		}
+		env.plugin.ServeHTTP(nil, w, r)
+		return w
+	}
+
+	t.Run("tokens", func(t *testing.T) {
+		env := setup(t)
+
+		_, err := env.plugin._issueApiToken(env.td.Worker2Id, &ApiToken{Name: "desk", Scopes: []string{API_TOKEN_SCOPE_CHECKOUT}})
+		assert.ErrorIs(t, err, ErrNotPermitted)
+		_, err = env.plugin._issueApiToken(env.td.Worker1Id, &ApiToken{Name: "front desk", Scopes: []string{API_TOKEN_SCOPE_CHECKOUT}})
+		assert.ErrorIs(t, err, ErrInvalidRequest)
+		_, err = env.plugin._issueApiToken(env.td.Worker1Id, &ApiToken{Name: "desk"})
+		assert.ErrorIs(t, err, ErrInvalidRequest)
+		_, err = env.plugin._issueApiToken(env.td.Worker1Id, &ApiToken{Name: "desk", Scopes: []string{"books:write"}})
+		assert.ErrorIs(t, err, ErrInvalidRequest)
+
+		token := issue(t, env, "desk", API_TOKEN_SCOPE_CHECKIN, API_TOKEN_SCOPE_CHECKIN)
+		assert.NotEmpty(t, token.Token)
+		assert.Empty(t, token.Hash)
+		assert.Equal(t, []string{API_TOKEN_SCOPE_CHECKIN}, token.Scopes)
+		assert.Equal(t, "worker1", token.CreatedBy)
+		_, err = env.plugin._issueApiToken(env.td.Worker1Id, &ApiToken{Name: "desk", Scopes: []string{API_TOKEN_SCOPE_CHECKIN}})
+		assert.ErrorIs(t, err, ErrRuleViolation)
+
+		authenticated, err := env.plugin._authenticateApiToken(token.Token)
+		require.Nil(t, err)
+		assert.Equal(t, token.Id, authenticated.Id)
+		_, err = env.plugin._authenticateApiToken("unknown")
+		assert.ErrorIs(t, err, ErrNotPermitted)
+
+		tokens, err := env.plugin._listApiTokens(env.td.Worker1Id)
+		require.Nil(t, err)
+		require.Equal(t, 1, len(tokens))
+		assert.Empty(t, tokens[0].Token)
+		assert.Empty(t, tokens[0].Hash, "hidden")
+		assert.NotZero(t, tokens[0].LastUsedAt)
+		_, err = env.plugin._listApiTokens(env.td.BorId)
+		assert.ErrorIs(t, err, ErrNotPermitted)
+
+		assert.ErrorIs(t, env.plugin._revokeApiToken(env.td.Worker1Id, "unknown"), ErrNotFound)
+		require.Nil(t, env.plugin._revokeApiToken(env.td.Worker1Id, token.Id))
+		_, err = env.plugin._authenticateApiToken(token.Token)
+		assert.ErrorIs(t, err, ErrNotPermitted, "revoked")
+	})
+
+	t.Run("use_recorded_once_a_minute", func(t *testing.T) {
+		env := setup(t)
+		token := issue(t, env, "desk", API_TOKEN_SCOPE_CHECKOUT)
+
+		usedAt := func(t *testing.T, lastUsedAt int64) int64 {
+			var all []ApiToken
+			require.Nil(t, env.plugin._compareAndUpdateKV(env.plugin._apiTokensKey(), &all, func() error {
+				all[0].LastUsedAt = lastUsedAt
+				return nil
+			}))
+			_, err := env.plugin._authenticateApiToken(token.Token)
+			require.Nil(t, err)
+			tokens, err := env.plugin._loadApiTokens()
+			require.Nil(t, err)
+			return tokens[0].LastUsedAt
+		}
+
+		recent := GetNowTime() - 30*1000
+		assert.Equal(t, recent, usedAt(t, recent), "not rewritten")
+		old := GetNowTime() - 2*60*1000
+		assert.Greater(t, usedAt(t, old), old)
+	})
+
+	t.Run("checkout_and_checkin", func(t *testing.T) {
+		env := setup(t)
+		masterId := keeperConfirmed(t, env)
+		checkout := issue(t, env, "desk", API_TOKEN_SCOPE_CHECKOUT)
+		checkin := issue(t, env, "dropbox", API_TOKEN_SCOPE_CHECKIN)
+
+		result, err := env.plugin._scanAtKiosk(checkin, copyId)
+		assert.ErrorIs(t, err, ErrNotPermitted, "no checkout scope")
+		assert.Nil(t, result)
+		assert.Equal(t, STATUS_KEEPER_CONFIRMED, statusOf(t, env, masterId))
+
+		result, err = env.plugin._scanAtKiosk(checkout, copyId)
+		require.Nil(t, err)
+		assert.Equal(t, &KioskScanResult{
+			MasterKey:      masterId,
+			BookName:       env.td.ABook.BookPublic.Name,
+			CopyId:         copyId,
+			BorrowerUser:   "bor",
+			PreviousStatus: STATUS_KEEPER_CONFIRMED,
+			Status:         STATUS_DELIVIED,
+		}, result)
+
+		assert.Equal(t, STATUS_DELIVIED, statusOf(t, env, masterId))
+		notified := false
+		for _, call := range env.api.Calls {
+			if call.Method == "CreatePost" &&
+				call.Arguments.Get(0).(*model.Post).Message == "Status was changed to D, by @"+KIOSK_ACTOR_PREFIX+"desk." {
+				notified = true
+			}
+		}
+		assert.True(t, notified, "the kiosk is the actor")
+
+		// the second one scans the label
+		for i, status := range []string{STATUS_RETURN_REQUESTED, STATUS_RETURN_CONFIRMED} {
+			scanned := copyId
+			if i == 1 {
+				scanned = env.plugin._scanURL("", copyId)
+			}
+			result, err = env.plugin._scanAtKiosk(checkin, scanned)
+			require.Nil(t, err)
+			assert.Equal(t, copyId, result.CopyId)
+			assert.Equal(t, status, result.Status)
+			assert.Equal(t, status, statusOf(t, env, masterId))
+		}
+
+		_, err = env.plugin._scanAtKiosk(checkin, copyId)
+		assert.ErrorIs(t, err, ErrRuleViolation, "returned by a libworker")
+		_, err = env.plugin._scanAtKiosk(checkin, "zzh-book-001 b1")
+		assert.ErrorIs(t, err, ErrNotFound)
+	})
+
+	t.Run("http", func(t *testing.T) {
+		env := setup(t)
+		keeperConfirmed(t, env)
+		checkin := issue(t, env, "dropbox", API_TOKEN_SCOPE_CHECKIN)
+		checkout := issue(t, env, "desk", API_TOKEN_SCOPE_CHECKOUT)
+		body := `{"copy_id":"` + copyId + `"}`
+
+		w := scan(env, "", body)
+		assert.Equal(t, http.StatusUnauthorized, w.Code, "no session is needed but a token")
+		w = scan(env, "unknown", body)
+		assert.Equal(t, http.StatusUnauthorized, w.Code)
+		w = scan(env, checkin.Token, body)
+		assert.Equal(t, http.StatusForbidden, w.Code)
+		w = scan(env, checkout.Token, "{")
+		assert.Equal(t, http.StatusBadRequest, w.Code)
+
+		w = scan(env, checkout.Token, body)
+		require.Equal(t, http.StatusOK, w.Code)
+		var result KioskScanResult
+		require.Nil(t, json.Unmarshal(w.Body.Bytes(), &result))
+		assert.Equal(t, STATUS_DELIVIED, result.Status)
+	})
+
+	t.Run("command", func(t *testing.T) {
+		env := setup(t)
+
+		text, err := env.plugin._executeToken(env.td.Worker1Id, nil)
+		require.Nil(t, err)
+		assert.Equal(t, "No api tokens.", text)
+		_, err = env.plugin._executeToken(env.td.BorId, []string{"list"})
+		assert.ErrorIs(t, err, ErrNotPermitted)
+
+		text, err = env.plugin._executeToken(env.td.Worker1Id, []string{"issue", "desk"})
+		require.Nil(t, err)
+		assert.True(t, strings.HasPrefix(text, "Usage:"))
+		text, err = env.plugin._executeToken(env.td.Worker1Id, []string{"issue", "desk", API_TOKEN_SCOPE_CHECKOUT})
+		require.Nil(t, err)
+		assert.True(t, strings.HasPrefix(text, "Succ. Token desk is issued"))
+
+		tokens, err := env.plugin._listApiTokens(env.td.Worker1Id)
+		require.Nil(t, err)
+		require.Equal(t, 1, len(tokens))
+		text, err = env.plugin._executeToken(env.td.Worker1Id, []string{"list"})
+		require.Nil(t, err)
+		assert.Contains(t, text, "| desk | kiosk:checkout | @worker1 | never | "+tokens[0].Id+" |")
+
+		text, err = env.plugin._executeToken(env.td.Worker1Id, []string{"revoke", tokens[0].Id})
+		require.Nil(t, err)
+		assert.Equal(t, "Succ. Token "+tokens[0].Id+" is revoked.", text)
+	})
+}
@@ -0,0 +1,283 @@
+package main
+
+import (
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+
+	"github.com/mattermost/mattermost-server/v5/model"
+	"github.com/mattermost/mattermost-server/v5/plugin"
+	"github.com/pkg/errors"
+)
+
+// A4 in points, 3 x 7 labels of 70 x 38 mm between the top and bottom margins.
+const (
+	labelPageWidth  = 595.28
+	labelPageHeight = 841.89
+	labelColumns    = 3
+	labelRows       = 7
+	labelMarginY    = 36
+	labelPadding    = 6
+	labelFontSize   = 8
+	// pixels per module of a QR code image
+	labelPNGScale = 8
+)
+
+type copyLabel struct {
+	bookPostId string
+	bookId     string
+	bookName   string
+	copyId     string
+	keeper     string
+}
+
+// The label links to the book and the copy, see handleScanRequest.
+func (p *Plugin) _scanURL(bookPostId string, copyId string) string {
+	query := url.Values{}
+	query.Set(SCAN_PARAM_BOOK, bookPostId)
+	query.Set(SCAN_PARAM_COPY, copyId)
+	query.Set(LIBRARY_PARAM, p.library.id)
+	return *p.API.GetConfig().ServiceSettings.SiteURL + "/plugins/" + PLUGIN_ID + SCAN_PATH + "?" + query.Encode()
+}
+
+// A kiosk may scan either the copy id or the label.
+func _copyIdOfScan(scanned string) string {
+	u, err := url.Parse(scanned)
+	if err != nil || !strings.HasSuffix(u.Path, SCAN_PATH) || u.Query().Get(SCAN_PARAM_COPY) == "" {
+		return scanned
+	}
+	return u.Query().Get(SCAN_PARAM_COPY)
+}
+
+// Labels show the keepers, so they are for the users who can read the private and inventory parts.
+func (p *Plugin) _checkLabelPermission(userId string) error {
+	opts, err := p._getExportOptions(userId)
+	if err != nil {
+		return err
+	}
+	if !opts.withPri || !opts.withInv {
+		return errors.Wrapf(ErrNotPermitted, "user %v can't print labels", userId)
+	}
+	return nil
+}
+
+func (p *Plugin) _copyQRCode(userId string, bookPostId string, copyId string) ([]byte, error) {
+	if err := p._checkLabelPermission(userId); err != nil {
+		return nil, err
+	}
+
+	info, err := p.GetABook(bookPostId)
+	if err != nil {
+		return nil, err
+	}
+	if _, ok := info.book.BookInventory.Copies[copyId]; !ok {
+		return nil, errors.Wrapf(ErrNotFound, "copy %v of book %v", copyId, bookPostId)
+	}
+
+	q, err := _encodeQR([]byte(p._scanURL(bookPostId, copyId)))
+	if err != nil {
+		return nil, err
+	}
+	return q.png(labelPNGScale)
+}
+
+// The copies of a book, of a keeper, or all of them when both are empty.
+func (p *Plugin) _copyLabels(userId string, bookPostId string, keeper string) ([]copyLabel, error) {
+	if err := p._checkLabelPermission(userId); err != nil {
+		return nil, err
+	}
+
+	ids := []string{bookPostId}
+	if bookPostId == "" {
+		var err error
+		if ids, err = p._getAllBookPostIds(); err != nil {
+			return nil, err
+		}
+	}
+
+	labels := []copyLabel{}
+	for _, id := range ids {
+		info, err := p.GetABook(id)
+		if err != nil {
+			return nil, err
+		}
+
+		book := info.book
+		for copyId := range book.BookInventory.Copies {
+			copyKeeper := book.BookPrivate.CopyKeeperMap[copyId].User
+			if keeper != "" && copyKeeper != keeper {
+				continue
+			}
+			labels = append(labels, copyLabel{
+				bookPostId: id,
+				bookId:     book.BookPublic.Id,
+				bookName:   book.BookPublic.Name,
+				copyId:     copyId,
+				keeper:     copyKeeper,
+			})
+		}
+	}
+	if len(labels) == 0 {
+		return nil, errors.Wrapf(ErrNotFound, "no copies to label. book: %v, keeper: %v", bookPostId, keeper)
+	}
+
+	sort.Slice(labels, func(i, j int) bool {
+		if labels[i].bookId != labels[j].bookId {
+			return labels[i].bookId < labels[j].bookId
+		}
+		return labels[i].copyId < labels[j].copyId
+	})
+	return labels, nil
+}
+
+// The QR code is on the left, the book name, copy id, keeper and book id on the right.
+// The borders are the guides to cut along.
+func (p *Plugin) _renderLabelSheet(labels []copyLabel) ([]byte, error) {
+	doc := _newPDFDocument(labelPageWidth, labelPageHeight)
+	cellW := labelPageWidth / labelColumns
+	cellH := (labelPageHeight - 2*labelMarginY) / labelRows
+
+	var page *pdfPage
+	for i, label := range labels {
+		n := i % (labelColumns * labelRows)
+		if n == 0 {
+			page = doc.addPage()
+		}
+		x := float64(n%labelColumns) * cellW
+		y := labelPageHeight - labelMarginY - float64(n/labelColumns+1)*cellH
+		page.strokeRect(x, y, cellW, cellH, 0.8)
+
+		q, err := _encodeQR([]byte(p._scanURL(label.bookPostId, label.copyId)))
+		if err != nil {
+			return nil, err
+		}
+		qrSide := cellH - 2*labelPadding
+		module := qrSide / float64(q.size+2*qrQuietZone)
+		qx := x + labelPadding + qrQuietZone*module
+		qy := y + labelPadding + qrQuietZone*module
+		for row := 0; row < q.size; row++ {
+			for col := 0; col < q.size; {
+				if !q.modules[row][col] {
+					col++
+					continue
+				}
+				start := col
+				for col < q.size && q.modules[row][col] {
+					col++
+				}
+				page.fillRect(qx+float64(start)*module, qy+float64(q.size-1-row)*module, float64(col-start)*module, module)
+			}
+		}
+
+		tx := x + labelPadding + qrSide
+		tw := x + cellW - labelPadding - tx
+		names := _pdfWrapText(label.bookName, labelFontSize+1, tw, 3)
+		lines := append(names, "", _pdfFitText(label.copyId, labelFontSize, tw))
+		if label.keeper != "" {
+			lines = append(lines, _pdfFitText("@"+label.keeper, labelFontSize, tw))
+		}
+		lines = append(lines, _pdfFitText(label.bookId, labelFontSize, tw))
+
+		ty := y + cellH - labelPadding - labelFontSize
+		for j, line := range lines {
+			size := float64(labelFontSize)
+			if j < len(names) {
+				size++
+			}
+			if line != "" {
+				page.text(tx, ty, size, line)
+			}
+			ty -= size + 3
+		}
+	}
+
+	return doc.bytes()
+}
+
+// The record to open for a scanned label: the open borrow of the copy,
+// as the scanning user sees it in the direct channel with the bot if the user has a part in it,
+// otherwise the book.
+func (p *Plugin) _scanTarget(userId string, bookPostId string, copyId string) (*model.Post, error) {
+	if copyId != "" {
+		masterKey, master, err := p._findOpenBorrowOfCopy(copyId)
+		if err != nil && !errors.Is(err, ErrNotFound) {
+			return nil, err
+		}
+		if err == nil && (bookPostId == "" || master.DataOrImage.BookPostId == bookPostId) {
+			return p._borrowRecordOfUser(userId, masterKey, master)
+		}
+	}
+
+	if bookPostId == "" {
+		return nil, KindError(ErrInvalidRequest, "book or copy is required.")
+	}
+	info, err := p.GetABook(bookPostId)
+	if err != nil {
+		return nil, err
+	}
+	return info.pubPost, nil
+}
+
+func (p *Plugin) _borrowRecordOfUser(userId string, masterKey string, master *Borrow) (*model.Post, error) {
+	masterPost, err := p._repo().Get(masterKey)
+	if err != nil {
+		return nil, errors.Wrapf(err, "get borrow error. id: %v", masterKey)
+	}
+
+	dc, appErr := p.API.GetDirectChannel(userId, p.botID)
+	if appErr != nil {
+		return masterPost, nil
+	}
+
+	keys := append([]string{master.RelationKeys.Borrower, master.RelationKeys.Libworker}, master.RelationKeys.Keepers...)
+	for _, key := range keys {
+		if key == "" {
+			continue
+		}
+		post, err := p._repo().Get(key)
+		if err != nil {
+			continue
+		}
+		if post.ChannelId == dc.Id {
+			return post, nil
+		}
+	}
+	return masterPost, nil
+}
+
+// A permalink when the records are posts, otherwise the channel of the record.
+func (p *Plugin) _recordLink(record *model.Post) (string, error) {
+	base := *p.API.GetConfig().ServiceSettings.SiteURL + "/" + p.team.Name
+	if p._recordsArePosts() {
+		return base + "/pl/" + record.Id, nil
+	}
+
+	channel, appErr := p.API.GetChannel(record.ChannelId)
+	if appErr != nil {
+		return "", errors.Wrapf(appErr, "get channel error. id: %v", record.ChannelId)
+	}
+	return base + "/channels/" + channel.Name, nil
+}
+
+// Reached from a label by a phone or a scanner, the user is logged in by ServeHTTP.
+func (p *Plugin) handleScanRequest(c *plugin.Context, w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		p._writeMethodNotAllowed(w, http.MethodGet)
+		return
+	}
+
+	query := r.URL.Query()
+	record, err := p._scanTarget(r.Header.Get("Mattermost-User-ID"), query.Get(SCAN_PARAM_BOOK), query.Get(SCAN_PARAM_COPY))
+	if err != nil {
+		p._writeAPIError(w, err)
+		return
+	}
+
+	link, err := p._recordLink(record)
+	if err != nil {
+		p._writeAPIError(w, err)
+		return
+	}
+	http.Redirect(w, r, link, http.StatusFound)
+}
@@ -0,0 +1,204 @@
+package main
+
+import (
+	"bytes"
+	"image/png"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/mattermost/mattermost-server/v5/model"
+	"github.com/mattermost/mattermost-server/v5/plugin/plugintest"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/require"
+)
+
+func TestLabels(t *testing.T) {
+
+	type labelsEnv struct {
+		td     *TestData
+		api    *plugintest.API
+		plugin *Plugin
+		bookId string
+	}
+
+	setup := func(t *testing.T) *labelsEnv {
+		td := NewTestData()
+		api := td.ApiMockCommon()
+		siteURL := "http://localhost:8065"
+		api.On("GetConfig").Return(&model.Config{ServiceSettings: model.ServiceSettings{SiteURL: &siteURL}})
+		api.On("CreatePost", mock.Anything).Return(&model.Post{}, nil)
+		api.On("GetChannel", mock.AnythingOfType("string")).Return(
+			func(id string) *model.Channel { return &model.Channel{Id: id, Name: "channel-" + id} }, nil)
+		for _, channelId := range []string{td.BookChIdPri, td.BookChIdInv} {
+			api.On("GetChannelMember", channelId, td.Worker1Id).Return(&model.ChannelMember{}, nil)
+			api.On("GetChannelMember", channelId, mock.AnythingOfType("string")).Return(nil,
+				model.NewAppError("GetChannelMember", "app.channel.get_member.missing.app_error", nil, "", http.StatusNotFound))
+		}
+		plugin := td.NewMockPlugin()
+		plugin.SetAPI(api)
+		plugin.repo = newMemRepository()
+		plugin.team.Name = "library"
+
+		var book Book
+		DeepCopy(&book, td.ABook)
+		bookId, err := plugin._createABook(&book)
+		require.Nil(t, err)
+		return &labelsEnv{td, api, plugin, bookId}
+	}
+
+	get := func(env *labelsEnv, userId string, target string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest(http.MethodGet, target, nil)
+		if userId != "" {
+			r.Header.Set("Mattermost-User-ID", userId)
+		}
+		env.plugin.ServeHTTP(nil, w, r)
+		return w
+	}
+
+	t.Run("scan_url", func(t *testing.T) {
+		env := setup(t)
+
+		link := env.plugin._scanURL(env.bookId, "zzh-book-001 b3")
+		u, err := url.Parse(link)
+		require.Nil(t, err)
+		assert.Equal(t, "/plugins/"+PLUGIN_ID+SCAN_PATH, u.Path)
+		assert.Equal(t, env.bookId, u.Query().Get(SCAN_PARAM_BOOK))
+		assert.Equal(t, "zzh-book-001 b3", u.Query().Get(SCAN_PARAM_COPY))
+		assert.Equal(t, DEFAULT_LIBRARY_ID, u.Query().Get(LIBRARY_PARAM))
+
+		assert.Equal(t, "zzh-book-001 b3", _copyIdOfScan(link))
+		assert.Equal(t, "zzh-book-001 b3", _copyIdOfScan("zzh-book-001 b3"))
+		assert.Equal(t, "http://localhost/other?copy=b1", _copyIdOfScan("http://localhost/other?copy=b1"))
+	})
+
+	t.Run("qr_code", func(t *testing.T) {
+		env := setup(t)
+
+		w := get(env, env.td.Worker1Id, "/api/v1/books/"+env.bookId+"/copies/zzh-book-001%20b1/qr")
+		require.Equal(t, http.StatusOK, w.Code)
+		assert.Equal(t, "image/png", w.Header().Get("Content-Type"))
+		_, err := png.Decode(bytes.NewReader(w.Body.Bytes()))
+		assert.Nil(t, err)
+
+		w = get(env, env.td.Worker1Id, "/api/v1/books/"+env.bookId+"/copies/zzh-book-001%20b9/qr")
+		assert.Equal(t, http.StatusNotFound, w.Code)
+		w = get(env, env.td.BorId, "/api/v1/books/"+env.bookId+"/copies/zzh-book-001%20b1/qr")
+		assert.Equal(t, http.StatusForbidden, w.Code)
+	})
+
+	t.Run("label_sheet", func(t *testing.T) {
+		env := setup(t)
+		var book Book
+		DeepCopy(&book, env.td.ABook)
+		book.BookPublic.Id = "zzh-book-002"
+		book.BookPublic.Name = strings.Repeat("很长的书名", 10)
+		book.BookInventory.Copies = BookCopies{"zzh-book-002 b1": {Status: COPY_STATUS_INSTOCK}}
+		book.BookPrivate.CopyKeeperMap = map[string]Keeper{"zzh-book-002 b1": {User: "kpuser1"}}
+		another, err := env.plugin._createABook(&book)
+		require.Nil(t, err)
+
+		labels, err := env.plugin._copyLabels(env.td.Worker1Id, "", "")
+		require.Nil(t, err)
+		require.Equal(t, 4, len(labels))
+		assert.Equal(t, copyLabel{env.bookId, "zzh-book-001", "a test book", "zzh-book-001 b1", "kpuser1"}, labels[0])
+		assert.Equal(t, another, labels[3].bookPostId)
+
+		labels, err = env.plugin._copyLabels(env.td.Worker1Id, "", "kpuser1")
+		require.Nil(t, err)
+		assert.Equal(t, 3, len(labels))
+		labels, err = env.plugin._copyLabels(env.td.Worker1Id, another, "")
+		require.Nil(t, err)
+		assert.Equal(t, 1, len(labels))
+		_, err = env.plugin._copyLabels(env.td.Worker1Id, another, "kpuser2")
+		assert.ErrorIs(t, err, ErrNotFound)
+		_, err = env.plugin._copyLabels(env.td.BorId, "", "")
+		assert.ErrorIs(t, err, ErrNotPermitted)
+
+		w := get(env, env.td.Worker1Id, "/api/v1/labels?keeper=kpuser1")
+		require.Equal(t, http.StatusOK, w.Code)
+		assert.Equal(t, "application/pdf", w.Header().Get("Content-Type"))
+		contents := _readTestPDF(t, w.Body.Bytes())
+		require.Equal(t, 1, len(contents))
+		assert.Equal(t, 3, strings.Count(contents[0], " re S "), "three labels")
+		assert.Contains(t, contents[0], "(zzh-book-001 b1) Tj")
+		assert.Contains(t, contents[0], "(@kpuser1) Tj")
+		assert.Contains(t, contents[0], "(zzh-book-002) Tj")
+		assert.Contains(t, contents[0], "002E002E002E> Tj", "the long name is cut")
+
+		many := make([]copyLabel, labelColumns*labelRows+1)
+		for i := range many {
+			many[i] = labels[0]
+		}
+		sheet, err := env.plugin._renderLabelSheet(many)
+		require.Nil(t, err)
+		assert.Equal(t, 2, len(_readTestPDF(t, sheet)), "a page is full")
+	})
+
+	t.Run("scan", func(t *testing.T) {
+		env := setup(t)
+		masterId, _, err := env.plugin._borrowABook(env.td.BorId, &BorrowRequestKey{
+			BookPostId:   env.bookId,
+			BorrowerUser: env.td.BorrowUser,
+		}, otherRequestData{processTime: GetNowTime()})
+		require.Nil(t, err)
+		for _, status := range []string{STATUS_CONFIRMED, STATUS_KEEPER_CONFIRMED} {
+			master, err := env.plugin._getBorrowById(masterId)
+			require.Nil(t, err)
+			br := master.borrow.DataOrImage
+			actor, chosen := br.LibworkerUser, ""
+			if status == STATUS_KEEPER_CONFIRMED {
+				actor, chosen = br.KeeperUsers[0], "zzh-book-001 b3"
+			}
+			require.Nil(t, env.plugin._processWorkflowRequest(env.td.BorId, &WorkflowRequest{
+				MasterPostKey: masterId,
+				ActorUser:     actor,
+				NextStepIndex: _getIndexByStatus(status, br.Worflow),
+				ChosenCopyId:  chosen,
+				Etag:          br.MatchId,
+			}))
+		}
+
+		scanPath := func(copyId string) string {
+			u, err := url.Parse(env.plugin._scanURL(env.bookId, copyId))
+			require.Nil(t, err)
+			return SCAN_PATH + "?" + u.RawQuery
+		}
+
+		w := get(env, "", scanPath("zzh-book-001 b3"))
+		assert.Equal(t, http.StatusFound, w.Code)
+		assert.True(t, strings.HasPrefix(w.Header().Get("Location"), "http://localhost:8065/login?redirect_to="))
+
+		w = get(env, env.td.BorId, scanPath("zzh-book-001 b3"))
+		require.Equal(t, http.StatusFound, w.Code)
+		assert.Equal(t, "http://localhost:8065/library/channels/channel-"+env.td.BorId_botId, w.Header().Get("Location"),
+			"the borrow in the direct channel of the borrower")
+
+		record, err := env.plugin._scanTarget(env.td.BorId, "", "zzh-book-001 b3")
+		require.Nil(t, err)
+		assert.Equal(t, env.td.BorId_botId, record.ChannelId)
+
+		w = get(env, env.td.BorId, scanPath("zzh-book-001 b1"))
+		require.Equal(t, http.StatusFound, w.Code)
+		assert.Equal(t, "http://localhost:8065/library/channels/channel-"+env.td.BookChIdPub, w.Header().Get("Location"),
+			"the book when the copy is not lent")
+
+		record, err = env.plugin._scanTarget(env.td.BorId, env.bookId, "zzh-book-001 b1")
+		require.Nil(t, err)
+		assert.Equal(t, env.bookId, record.Id)
+
+		w = get(env, env.td.BorId, SCAN_PATH)
+		assert.Equal(t, http.StatusBadRequest, w.Code)
+		w = get(env, env.td.BorId, SCAN_PATH+"?book=unknown")
+		assert.Equal(t, http.StatusNotFound, w.Code)
+
+		env.plugin.repo = nil
+		link, err := env.plugin._recordLink(record)
+		require.Nil(t, err)
+		assert.Equal(t, "http://localhost:8065/library/pl/"+env.bookId, link, "a permalink of a post")
+	})
+}
@@ -0,0 +1,179 @@
+package main
+
+import (
+	"strings"
+
+	"github.com/mattermost/mattermost-server/v5/model"
+	"github.com/pkg/errors"
+)
+
+// A library is one collection with its own team, channels, staff and policies.
+// One installation can serve several libraries, each request works on one of them.
+type library struct {
+	id   string
+	name string
+
+	team *model.Team
+
+	borrowChannel *model.Channel
+
+	booksChannel    *model.Channel
+	booksPriChannel *model.Channel
+	booksInvChannel *model.Channel
+
+	borrowTimes int
+
+	maxRenewTimes int
+	expiredDays   int
+
+	// status -> actor role, overriding the standard borrow workflow
+	workflowActors map[string]string
+
+	penalty PenaltyPolicy
+
+	// checked in order before a borrow, the default ones if nil
+	eligibilityRules []eligibilityRuleEntry
+}
+
+// A view of the plugin working on another library, everything else is shared with p.
+// An empty id means the library p is working on.
+func (p *Plugin) _withLibrary(id string) (*Plugin, error) {
+	if id == "" || (p.library != nil && p.library.id == id) {
+		return p, nil
+	}
+
+	lib, ok := p.libraries[id]
+	if !ok {
+		return nil, errors.Wrapf(ErrNotFound, "library %v", id)
+	}
+
+	return &Plugin{
+		MattermostPlugin: p.MattermostPlugin,
+		configuration:    p.getConfiguration(),
+		botID:            p.botID,
+		library:          lib,
+		libraries:        p.libraries,
+		libraryIds:       p.libraryIds,
+		repo:             p.repo,
+		i18n:             p.i18n,
+		metadataProvider: p.metadataProvider,
+		backgroundJob:    p.backgroundJob,
+	}, nil
+}
+
+func (p *Plugin) _ensureLibrary(cfg LibraryConfig) (*library, error) {
+	//the rules are validated by building them, before anything is ensured
+	rules, err := _newEligibilityRules(cfg.EligibilityRules)
+	if err != nil {
+		return nil, errors.Wrapf(err, "invalid eligibility rules of library %v.", cfg.Id)
+	}
+
+	team, err := p.ensureTeam(cfg.TeamName)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to ensure team of library %v.", cfg.Id)
+	}
+
+	lib := &library{
+		id:               cfg.Id,
+		name:             cfg.Name,
+		team:             team,
+		borrowTimes:      cfg.BorrowLimit,
+		maxRenewTimes:    cfg.MaxRenewTimes,
+		expiredDays:      cfg.ExpiredDays,
+		workflowActors:   cfg.WorkflowActors,
+		penalty:          cfg.Penalty,
+		eligibilityRules: rules,
+	}
+
+	for _, ch := range []struct {
+		channel     **model.Channel
+		name        string
+		displayName string
+		purpose     string
+		chtype      string
+	}{
+		{&lib.booksChannel, cfg.BooksChannelName, "Books", "Channel for books library.", model.CHANNEL_OPEN},
+		{&lib.booksPriChannel, cfg.BooksPrivateChannelName,
+			"Books Private", "Channel for books private infomation.", model.CHANNEL_PRIVATE},
+		{&lib.booksInvChannel, cfg.BooksInventoryChannelName,
+			"Books Inventory", "Channel for books inventory infomation.", model.CHANNEL_PRIVATE},
+		{&lib.borrowChannel, cfg.BorrowWorkflowChannelName, "Borrows", "Channel for borrowing workflow.", model.CHANNEL_PRIVATE},
+	} {
+		channel, err := p.ensureChannel(team.Id, ch.name, ch.displayName, ch.purpose, ch.chtype)
+		if err != nil {
+			return nil, errors.Wrapf(err, "failed to ensure channel of library %v.", cfg.Id)
+		}
+		*ch.channel = channel
+	}
+
+	return lib, nil
+}
+
+// Roles of the default library stay in the key used before libraries were introduced.
+func (p *Plugin) _rolesKey() string {
+	if p.library == nil || p.library.id == DEFAULT_LIBRARY_ID {
+		return ROLES_KV_KEY
+	}
+	return ROLES_KV_KEY + "_" + p.library.id
+}
+
+// Records of other libraries are invisible, as if they did not exist.
+func (p *Plugin) _checkLibraryPost(post *model.Post, channel *model.Channel) error {
+	if post.ChannelId != channel.Id {
+		return errors.Wrapf(ErrNotFound, "post %v is not in library %v", post.Id, p.library.id)
+	}
+	return nil
+}
+
+func (p *Plugin) _applyWorkflowActors(workflow []Step) {
+	for i, step := range workflow {
+		if actor, ok := p.workflowActors[step.Status]; ok {
+			workflow[i].ActorRole = actor
+		}
+	}
+}
+
+func (p *Plugin) _validateWorkflowActors(actors map[string]string) error {
+	statuses := map[string]bool{}
+	for _, step := range p._createWFTemplate(0) {
+		statuses[step.Status] = true
+	}
+
+	for status, actor := range actors {
+		if !statuses[status] {
+			return errors.Errorf("unknown workflow status %v", status)
+		}
+		switch actor {
+		case BORROWER, LIBWORKER, KEEPER:
+		default:
+			return errors.Errorf("unknown workflow actor %v of status %v", actor, status)
+		}
+	}
+
+	return nil
+}
+
+// Commands name their library with --library <id> or --library=<id>,
+// the rest of the command is returned as it is without the option.
+func _splitLibraryArg(command string) (string, string, error) {
+	var libId string
+	rest := []string{}
+
+	fields := strings.Fields(command)
+	for i := 0; i < len(fields); i++ {
+		switch {
+		case fields[i] == "--library":
+			if i+1 >= len(fields) {
+				return "", "", KindError(ErrInvalidRequest, "--library needs a library id.")
+			}
+			libId = fields[i+1]
+			i++
+		case strings.HasPrefix(fields[i], "--library="):
+			libId = strings.TrimPrefix(fields[i], "--library=")
+		default:
+			rest = append(rest, fields[i])
+		}
+	}
+
+	return libId, strings.Join(rest, " "), nil
+}
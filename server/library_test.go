@@ -0,0 +1,205 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/mattermost/mattermost-server/v5/model"
+	"github.com/mattermost/mattermost-server/v5/plugin/plugintest"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/require"
+)
+
+func TestLibraries(t *testing.T) {
+
+	setup := func() (*TestData, *Plugin, *library) {
+		td := NewTestData()
+		plugin := td.NewMockPlugin()
+		api := td.ApiMockCommon()
+		plugin.SetAPI(api)
+
+		east := &library{
+			id:              "east",
+			name:            "East Office",
+			team:            &model.Team{Id: model.NewId()},
+			booksChannel:    &model.Channel{Id: model.NewId()},
+			booksPriChannel: &model.Channel{Id: model.NewId()},
+			booksInvChannel: &model.Channel{Id: model.NewId()},
+			borrowChannel:   &model.Channel{Id: model.NewId()},
+			borrowTimes:     5,
+			maxRenewTimes:   0,
+			expiredDays:     14,
+		}
+		plugin.libraries[east.id] = east
+		plugin.libraryIds = append(plugin.libraryIds, east.id)
+
+		return td, plugin, east
+	}
+
+	t.Run("library_configs", func(t *testing.T) {
+		conf := &configuration{
+			TeamName:                  "bookslibrary",
+			BooksChannelName:          "books",
+			BooksPrivateChannelName:   "books_private",
+			BooksInventoryChannelName: "books_inventory",
+			BorrowWorkflowChannelName: "borrow",
+			BorrowLimit:               2,
+		}
+		libs, err := conf.getLibraryConfigs()
+		require.Nil(t, err)
+		require.Len(t, libs, 1)
+		assert.Equal(t, DEFAULT_LIBRARY_ID, libs[0].Id)
+		assert.Equal(t, "borrow", libs[0].BorrowWorkflowChannelName)
+		assert.Equal(t, 2, libs[0].BorrowLimit)
+
+		conf.Libraries = `[
+		  {"id":"default","team_name":"hq","books_channel_name":"books","books_private_channel_name":"books_private",
+		   "books_inventory_channel_name":"books_inventory","borrow_workflow_channel_name":"borrow","borrow_limit":3},
+		  {"id":"east","team_name":"hq","books_channel_name":"east_books","books_private_channel_name":"east_private",
+		   "books_inventory_channel_name":"east_inventory","borrow_workflow_channel_name":"east_borrow",
+		   "workflow_actors":{"C":"LIBWORKER"}}
+		]`
+		libs, err = conf.getLibraryConfigs()
+		require.Nil(t, err)
+		require.Len(t, libs, 2)
+		assert.Equal(t, "east", libs[1].Id)
+		assert.Equal(t, map[string]string{STATUS_CONFIRMED: LIBWORKER}, libs[1].WorkflowActors)
+
+		for name, libraries := range map[string]string{
+			"none":           `[]`,
+			"no_id":          `[{"team_name":"hq","books_channel_name":"a","books_private_channel_name":"b","books_inventory_channel_name":"c","borrow_workflow_channel_name":"d"}]`,
+			"duplicate_id":   `[{"id":"a","team_name":"hq","books_channel_name":"a","books_private_channel_name":"b","books_inventory_channel_name":"c","borrow_workflow_channel_name":"d"},{"id":"a","team_name":"hq2","books_channel_name":"a","books_private_channel_name":"b","books_inventory_channel_name":"c","borrow_workflow_channel_name":"d"}]`,
+			"no_team":        `[{"id":"a","books_channel_name":"a","books_private_channel_name":"b","books_inventory_channel_name":"c","borrow_workflow_channel_name":"d"}]`,
+			"no_channel":     `[{"id":"a","team_name":"hq","books_channel_name":"a"}]`,
+			"shared_channel": `[{"id":"a","team_name":"hq","books_channel_name":"a","books_private_channel_name":"b","books_inventory_channel_name":"c","borrow_workflow_channel_name":"d"},{"id":"b","team_name":"hq","books_channel_name":"a2","books_private_channel_name":"b2","books_inventory_channel_name":"c2","borrow_workflow_channel_name":"d"}]`,
+			"bad_json":       `[{`,
+		} {
+			conf.Libraries = libraries
+			_, err := conf.getLibraryConfigs()
+			assert.NotNil(t, err, name)
+		}
+	})
+
+	t.Run("workflow_actors", func(t *testing.T) {
+		_, plugin, east := setup()
+		east.workflowActors = map[string]string{STATUS_CONFIRMED: LIBWORKER}
+
+		lp, err := plugin._withLibrary(east.id)
+		require.Nil(t, err)
+		wf := lp._createWFTemplate(0)
+		lp._applyWorkflowActors(wf)
+		assert.Equal(t, LIBWORKER, wf[_getIndexByStatus(STATUS_CONFIRMED, wf)].ActorRole)
+		assert.Equal(t, KEEPER, wf[_getIndexByStatus(STATUS_RETURN_CONFIRMED, wf)].ActorRole)
+
+		assert.Nil(t, plugin._validateWorkflowActors(east.workflowActors))
+		assert.NotNil(t, plugin._validateWorkflowActors(map[string]string{"XX": LIBWORKER}))
+		assert.NotNil(t, plugin._validateWorkflowActors(map[string]string{STATUS_CONFIRMED: MASTER}))
+	})
+
+	t.Run("invalid_eligibility_rules", func(t *testing.T) {
+		td, plugin, _ := setup()
+		api := td.ApiMockCommon()
+		plugin.SetAPI(api)
+
+		_, err := plugin._ensureLibrary(LibraryConfig{
+			Id:               "west",
+			TeamName:         "west",
+			EligibilityRules: []EligibilityRuleConfig{{Rule: "unknown"}},
+		})
+		assert.NotNil(t, err)
+		api.AssertNotCalled(t, "GetTeamByName", "west")
+	})
+
+	t.Run("split_library_arg", func(t *testing.T) {
+		for _, test := range []struct {
+			command string
+			libId   string
+			rest    string
+		}{
+			{"/export_books csv", "", "/export_books csv"},
+			{"/export_books --library east csv", "east", "/export_books csv"},
+			{"/library_roles list bor --library=east", "east", "/library_roles list bor"},
+		} {
+			libId, rest, err := _splitLibraryArg(test.command)
+			require.Nil(t, err)
+			assert.Equal(t, test.libId, libId)
+			assert.Equal(t, test.rest, rest)
+		}
+
+		_, _, err := _splitLibraryArg("/export_books --library")
+		assert.ErrorIs(t, err, ErrInvalidRequest)
+	})
+
+	t.Run("request_routed_to_library", func(t *testing.T) {
+		td, plugin, east := setup()
+
+		get := func(path string) (*httptest.ResponseRecorder, *Config) {
+			w := httptest.NewRecorder()
+			r := httptest.NewRequest("GET", path, bytes.NewReader([]byte{}))
+			r.Header.Set("Mattermost-User-ID", td.BorId)
+			plugin.ServeHTTP(nil, w, r)
+
+			var result Result
+			json.Unmarshal(w.Body.Bytes(), &result)
+			var config Config
+			json.Unmarshal([]byte(result.Messages["data"]), &config)
+			return w, &config
+		}
+
+		_, config := get("/config")
+		assert.Equal(t, DEFAULT_LIBRARY_ID, config.LibraryId)
+		assert.Equal(t, 2, config.BorrowLimit)
+		assert.Equal(t, []LibraryInfo{{DEFAULT_LIBRARY_ID, ""}, {"east", "East Office"}}, config.Libraries)
+
+		_, config = get("/config?library=east")
+		assert.Equal(t, "east", config.LibraryId)
+		assert.Equal(t, east.borrowTimes, config.BorrowLimit)
+		assert.Equal(t, east.expiredDays, config.ExpiredDays)
+
+		w, _ := get("/config?library=west")
+		assert.Equal(t, http.StatusNotFound, w.Code)
+		var result Result
+		json.Unmarshal(w.Body.Bytes(), &result)
+		assert.Equal(t, ErrNotFound.Error(), result.Code)
+	})
+
+	t.Run("roles_per_library", func(t *testing.T) {
+		td, plugin, east := setup()
+		api := plugin.API.(*plugintest.API)
+		api.On("GetTeamMember", mock.AnythingOfType("string"), mock.AnythingOfType("string")).Return(&model.TeamMember{}, nil)
+		api.On("GetChannelMember", mock.AnythingOfType("string"), mock.AnythingOfType("string")).Return(
+			nil, model.NewAppError("GetChannelMember", "app.channel.get_member.missing.app_error", nil, "", http.StatusNotFound))
+		api.On("AddChannelMember", mock.AnythingOfType("string"), mock.AnythingOfType("string")).Return(&model.ChannelMember{}, nil)
+
+		lp, err := plugin._withLibrary(east.id)
+		require.Nil(t, err)
+
+		ok, err := lp._hasRole(td.Worker1Id, ROLE_LIBWORKER)
+		require.Nil(t, err)
+		assert.False(t, ok, "roles of the default library should not be valid in others")
+
+		_, err = lp._grantRoles(td.BorId, ROLE_KEEPER)
+		require.Nil(t, err)
+		assert.Contains(t, td.kvStore, ROLES_KV_KEY+"_east")
+
+		ok, err = plugin._hasRole(td.BorId, ROLE_KEEPER)
+		require.Nil(t, err)
+		assert.False(t, ok)
+	})
+
+	t.Run("records_of_other_library_not_found", func(t *testing.T) {
+		td, plugin, east := setup()
+
+		lp, err := plugin._withLibrary(east.id)
+		require.Nil(t, err)
+		_, err = lp.GetABook(td.BookPostIdPub)
+		assert.ErrorIs(t, err, ErrNotFound)
+
+		_, err = plugin.GetABook(td.BookPostIdPub)
+		assert.Nil(t, err)
+	})
+}
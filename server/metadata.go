@@ -0,0 +1,291 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"github.com/pkg/errors"
+)
+
+// BookMetadata is the bibliographic information a provider can offer for a book.
+type BookMetadata struct {
+	Isbn13      string `json:"isbn13"`
+	Name        string `json:"name"`
+	Author      string `json:"author"`
+	Translator  string `json:"translator"`
+	Publisher   string `json:"publisher"`
+	PublishDate string `json:"publish_date"`
+	Intro       string `json:"introduction"`
+}
+
+// MetadataProvider looks up bibliographic information by a normalized ISBN-13.
+// It returns ErrNotFound if the provider knows nothing about the isbn.
+type MetadataProvider interface {
+	Lookup(isbn13 string) (*BookMetadata, error)
+}
+
+// fileMetadataProvider reads metadata from a local file. Two layouts are accepted:
+//   - a JSON array of BookMetadata
+//   - an Open Library editions dump, one edition per line, either the raw JSON
+//     or the tab separated dump line whose last column is the JSON
+//
+// The file is loaded on the first lookup and kept in memory.
+// A failed load is not kept, the next lookup loads the file again.
+type fileMetadataProvider struct {
+	path  string
+	mu    sync.Mutex
+	books map[string]*BookMetadata
+}
+
+func NewFileMetadataProvider(path string) MetadataProvider {
+	return &fileMetadataProvider{path: path}
+}
+
+func (fp *fileMetadataProvider) Lookup(isbn13 string) (*BookMetadata, error) {
+	books, err := fp._books()
+	if err != nil {
+		return nil, errors.Wrapf(err, "load metadata file error. path: %v", fp.path)
+	}
+
+	md, ok := books[isbn13]
+	if !ok {
+		return nil, ErrNotFound
+	}
+
+	return md, nil
+}
+
+func (fp *fileMetadataProvider) _books() (map[string]*BookMetadata, error) {
+	fp.mu.Lock()
+	defer fp.mu.Unlock()
+
+	if fp.books == nil {
+		books, err := _loadMetadataFile(fp.path)
+		if err != nil {
+			return nil, err
+		}
+		fp.books = books
+	}
+	return fp.books, nil
+}
+
+type openLibraryEdition struct {
+	Title       string   `json:"title"`
+	Subtitle    string   `json:"subtitle"`
+	ByStatement string   `json:"by_statement"`
+	Publishers  []string `json:"publishers"`
+	PublishDate string   `json:"publish_date"`
+	Isbn10      []string `json:"isbn_10"`
+	Isbn13      []string `json:"isbn_13"`
+	Contributor []struct {
+		Role string `json:"role"`
+		Name string `json:"name"`
+	} `json:"contributions_detail"`
+	Description json.RawMessage `json:"description"`
+}
+
+// The file is streamed, a dump may be too large to be read into memory at once.
+func _loadMetadataFile(path string) (map[string]*BookMetadata, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	reader := bufio.NewReader(f)
+	first, err := _peekNonSpace(reader)
+	if err != nil && err != io.EOF {
+		return nil, errors.Wrapf(err, "read metadata file error.")
+	}
+	if first == '[' {
+		return _loadMetadataList(reader)
+	}
+
+	books := map[string]*BookMetadata{}
+	scanner := bufio.NewScanner(reader)
+	scanner.Buffer(make([]byte, 1024*1024), 16*1024*1024)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if i := strings.LastIndex(line, "\t"); i >= 0 {
+			line = line[i+1:]
+		}
+		if strings.TrimSpace(line) == "" {
+			continue
+		}
+
+		var ed openLibraryEdition
+		if err := json.Unmarshal([]byte(line), &ed); err != nil {
+			//skip broken lines, a dump is usually too large to be perfect
+			continue
+		}
+
+		md := ed.toMetadata()
+		for _, isbn := range append(ed.Isbn13, ed.Isbn10...) {
+			_, isbn13, err := NormalizeIsbn(isbn)
+			if err != nil {
+				continue
+			}
+			if md.Isbn13 == "" {
+				md.Isbn13 = isbn13
+			}
+			if _, ok := books[isbn13]; !ok {
+				books[isbn13] = md
+			}
+		}
+	}
+
+	if err := scanner.Err(); err != nil {
+		return nil, errors.Wrapf(err, "scan metadata file error.")
+	}
+
+	return books, nil
+}
+
+// The first byte which is not a space, left unread.
+func _peekNonSpace(reader *bufio.Reader) (byte, error) {
+	for {
+		b, err := reader.Peek(1)
+		if err != nil {
+			return 0, err
+		}
+		switch b[0] {
+		case ' ', '\t', '\r', '\n':
+			if _, err := reader.Discard(1); err != nil {
+				return 0, err
+			}
+		default:
+			return b[0], nil
+		}
+	}
+}
+
+// A JSON array of BookMetadata, decoded one element at a time.
+func _loadMetadataList(reader io.Reader) (map[string]*BookMetadata, error) {
+	decoder := json.NewDecoder(reader)
+	if _, err := decoder.Token(); err != nil {
+		return nil, errors.Wrapf(err, "unmarshal metadata list error.")
+	}
+
+	books := map[string]*BookMetadata{}
+	for decoder.More() {
+		var md BookMetadata
+		if err := decoder.Decode(&md); err != nil {
+			return nil, errors.Wrapf(err, "unmarshal metadata list error.")
+		}
+		_, isbn13, err := NormalizeIsbn(md.Isbn13)
+		if err != nil {
+			continue
+		}
+		md.Isbn13 = isbn13
+		books[isbn13] = &md
+	}
+	if _, err := decoder.Token(); err != nil {
+		return nil, errors.Wrapf(err, "unmarshal metadata list error.")
+	}
+	return books, nil
+}
+
+func (ed *openLibraryEdition) toMetadata() *BookMetadata {
+	md := &BookMetadata{
+		Name:        ed.Title,
+		Author:      ed.ByStatement,
+		PublishDate: ed.PublishDate,
+	}
+
+	if ed.Subtitle != "" {
+		md.Name = ed.Title + ": " + ed.Subtitle
+	}
+
+	if len(ed.Publishers) > 0 {
+		md.Publisher = ed.Publishers[0]
+	}
+
+	for _, c := range ed.Contributor {
+		if strings.EqualFold(c.Role, "translator") {
+			md.Translator = c.Name
+			break
+		}
+	}
+
+	//description is either a string or {"type": ..., "value": ...}
+	if len(ed.Description) > 0 {
+		var s string
+		if err := json.Unmarshal(ed.Description, &s); err == nil {
+			md.Intro = s
+		} else {
+			var text struct {
+				Value string `json:"value"`
+			}
+			if err := json.Unmarshal(ed.Description, &text); err == nil {
+				md.Intro = text.Value
+			}
+		}
+	}
+
+	return md
+}
+
+// A relative file is in the assets of the plugin bundle.
+func (p *Plugin) _newMetadataProvider(file string) (MetadataProvider, error) {
+	if file == "" {
+		return nil, nil
+	}
+	if !filepath.IsAbs(file) {
+		bundlePath, err := p.API.GetBundlePath()
+		if err != nil {
+			return nil, errors.Wrapf(err, "get bundle path error.")
+		}
+		file = filepath.Join(bundlePath, "assets", file)
+	}
+	return NewFileMetadataProvider(file), nil
+}
+
+// Fill only the empty fields of pub from the metadata provider.
+// The returned map holds the changed fields by their json names.
+func (p *Plugin) _enrichABook(pub *BookPublic) (map[string]string, error) {
+	if p.metadataProvider == nil {
+		return nil, errors.New("no metadata provider is configured.")
+	}
+
+	if err := p._normalizeBookIsbn(pub); err != nil {
+		return nil, err
+	}
+
+	if pub.Isbn13 == "" {
+		return nil, errors.Wrapf(ErrInvalidIsbn, "isbn is required to enrich a book.")
+	}
+
+	md, err := p.metadataProvider.Lookup(pub.Isbn13)
+	if err != nil {
+		if errors.Is(err, ErrNotFound) {
+			return map[string]string{}, nil
+		}
+		return nil, err
+	}
+
+	changed := map[string]string{}
+	for _, f := range []struct {
+		name  string
+		field *string
+		value string
+	}{
+		{"name_pub", &pub.Name, md.Name},
+		{"author", &pub.Author, md.Author},
+		{"translator", &pub.Translator, md.Translator},
+		{"publisher", &pub.Publisher, md.Publisher},
+		{"publish_date", &pub.PublishDate, md.PublishDate},
+		{"introduction", &pub.Intro, md.Intro},
+	} {
+		if *f.field == "" && f.value != "" {
+			*f.field = f.value
+			changed[f.name] = f.value
+		}
+	}
+
+	return changed, nil
+}
@@ -0,0 +1,164 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/mattermost/mattermost-server/v5/model"
+	"github.com/mattermost/mattermost-server/v5/plugin/plugintest"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/require"
+)
+
+func TestMetadata(t *testing.T) {
+
+	dir, err := ioutil.TempDir("", "bookslibrary-metadata")
+	require.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	jsonFile := filepath.Join(dir, "books.json")
+	require.Nil(t, ioutil.WriteFile(jsonFile, []byte(`[
+	  {
+	    "isbn13": "0-306-40615-2",
+	    "name": "json title",
+	    "author": "json author",
+	    "publisher": "json publisher",
+	    "introduction": "json intro"
+	  }
+	]`), 0600))
+
+	dumpFile := filepath.Join(dir, "ol_dump_editions.txt")
+	require.Nil(t, ioutil.WriteFile(dumpFile, []byte(
+		"/type/edition\t/books/OL1M\t3\t2020-01-01T00:00:00\t"+
+			`{"title": "dump title", "subtitle": "sub", "by_statement": "dump author", "publishers": ["dump publisher"], "publish_date": "1999", "isbn_10": ["0306406152"], "description": {"type": "/type/text", "value": "dump intro"}}`+"\n"+
+			"broken line\n"+
+			`{"title": "raw title", "isbn_13": ["9780804429573"], "contributions_detail": [{"role": "Translator", "name": "raw translator"}], "description": "raw intro"}`+"\n",
+	), 0600))
+
+	t.Run("lookup_json", func(t *testing.T) {
+		provider := NewFileMetadataProvider(jsonFile)
+		md, err := provider.Lookup("9780306406157")
+		require.Nil(t, err)
+		assert.Equal(t, "json title", md.Name)
+		assert.Equal(t, "json intro", md.Intro)
+
+		_, err = provider.Lookup("9780804429573")
+		assert.ErrorIs(t, err, ErrNotFound)
+	})
+
+	t.Run("lookup_open_library_dump", func(t *testing.T) {
+		provider := NewFileMetadataProvider(dumpFile)
+		md, err := provider.Lookup("9780306406157")
+		require.Nil(t, err)
+		assert.Equal(t, "dump title: sub", md.Name)
+		assert.Equal(t, "dump author", md.Author)
+		assert.Equal(t, "dump publisher", md.Publisher)
+		assert.Equal(t, "1999", md.PublishDate)
+		assert.Equal(t, "dump intro", md.Intro)
+
+		md, err = provider.Lookup("9780804429573")
+		require.Nil(t, err)
+		assert.Equal(t, "raw translator", md.Translator)
+		assert.Equal(t, "raw intro", md.Intro)
+	})
+
+	t.Run("lookup_missing_file", func(t *testing.T) {
+		provider := NewFileMetadataProvider(filepath.Join(dir, "none.json"))
+		_, err := provider.Lookup("9780306406157")
+		assert.NotNil(t, err)
+		assert.NotErrorIs(t, err, ErrNotFound)
+	})
+
+	t.Run("retry_after_failed_load", func(t *testing.T) {
+		file := filepath.Join(dir, "later.json")
+		provider := NewFileMetadataProvider(file)
+		_, err := provider.Lookup("9780306406157")
+		assert.NotNil(t, err)
+
+		data, err := ioutil.ReadFile(jsonFile)
+		require.Nil(t, err)
+		require.Nil(t, ioutil.WriteFile(file, data, 0600))
+		md, err := provider.Lookup("9780306406157")
+		require.Nil(t, err)
+		assert.Equal(t, "json title", md.Name)
+	})
+
+	t.Run("corrupt_list", func(t *testing.T) {
+		file := filepath.Join(dir, "corrupt.json")
+		require.Nil(t, ioutil.WriteFile(file, []byte(`  [{"isbn13": "0-306-40615-2"}, {"isbn13":`), 0600))
+		_, err := NewFileMetadataProvider(file).Lookup("9780306406157")
+		assert.NotNil(t, err)
+	})
+
+	t.Run("bundle_path", func(t *testing.T) {
+		plugin := &Plugin{}
+		api := &plugintest.API{}
+		api.On("GetBundlePath").Return(dir, nil)
+		plugin.SetAPI(api)
+
+		provider, err := plugin._newMetadataProvider("books.json")
+		require.Nil(t, err)
+		assert.Equal(t, filepath.Join(dir, "assets", "books.json"), provider.(*fileMetadataProvider).path)
+
+		provider, err = plugin._newMetadataProvider(jsonFile)
+		require.Nil(t, err)
+		assert.Equal(t, jsonFile, provider.(*fileMetadataProvider).path)
+
+		provider, err = plugin._newMetadataProvider("")
+		require.Nil(t, err)
+		assert.Nil(t, provider)
+	})
+
+	t.Run("enrich_only_empty_fields", func(t *testing.T) {
+		plugin := &Plugin{metadataProvider: NewFileMetadataProvider(jsonFile)}
+		pub := &BookPublic{
+			Isbn10: "0306406152",
+			Name:   "kept name",
+		}
+		changed, err := plugin._enrichABook(pub)
+		require.Nil(t, err)
+		assert.Equal(t, "kept name", pub.Name)
+		assert.Equal(t, "json author", pub.Author)
+		assert.Equal(t, map[string]string{
+			"author":       "json author",
+			"publisher":    "json publisher",
+			"introduction": "json intro",
+		}, changed)
+	})
+
+	t.Run("enrich_without_provider", func(t *testing.T) {
+		plugin := &Plugin{}
+		_, err := plugin._enrichABook(&BookPublic{Isbn10: "0306406152"})
+		assert.NotNil(t, err)
+	})
+
+	t.Run("upload_enrich", func(t *testing.T) {
+		td := NewTestData()
+		plugin := td.NewMockPlugin()
+		plugin.metadataProvider = NewFileMetadataProvider(jsonFile)
+		api := td.ApiMockCommon()
+		plugin.SetAPI(api)
+		api.On("SearchPostsInTeam", plugin.team.Id, mock.AnythingOfType("[]*model.SearchParams")).
+			Return([]*model.Post{}, nil)
+
+		var book Book
+		DeepCopy(&book, td.ABook)
+		book.BookPublic.Isbn13 = "9780306406157"
+		book.BookPublic.Publisher = ""
+		book.BookPublic.Intro = ""
+		book.Upload = &Upload{Enrich: true, Post_id: td.BookPostIdPub}
+
+		msg, err := plugin._uploadABook(&book, uploadOptions{})
+		require.Nil(t, err)
+		assert.Equal(t, BOOK_UPLOAD_SUCC, msg.Status)
+		assert.Equal(t, map[string]string{
+			"publisher":    "json publisher",
+			"introduction": "json intro",
+		}, msg.Enriched)
+		assert.Equal(t, "json publisher", td.ABookPub.Publisher)
+		assert.Equal(t, "zzh", td.ABookPub.Author)
+	})
+}
@@ -0,0 +1,404 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	"github.com/mattermost/mattermost-server/v5/model"
+	"github.com/pkg/errors"
+)
+
+const (
+	migrationsLockExpiry = 10 * 60 // seconds
+	migrationsPerPage    = 100
+)
+
+// A migration raises stored documents of the previous version to its version.
+// It works on the raw JSON, so the documents are not limited to the current types.
+// The runner skips documents already at the version, so every migration is run once for a document.
+type migration struct {
+	version     int
+	description string
+	// the schema version of the document is set by the runner
+	migrate func(recordType string, doc map[string]interface{}) error
+	// optional, run once for every library before its records are migrated
+	library func(p *Plugin) error
+}
+
+// The last version must be SCHEMA_VERSION.
+var migrations = []migration{
+	{
+		version:     1,
+		description: "Add schema version to books, borrows and transfers.",
+		migrate: func(recordType string, doc map[string]interface{}) error {
+			return nil
+		},
+	},
+	{
+		version:     2,
+		description: "Seed roles from channel members, libworkers, keepers and borrows.",
+		migrate: func(recordType string, doc map[string]interface{}) error {
+			return nil
+		},
+		library: func(p *Plugin) error {
+			return p._seedRoles()
+		},
+	},
+}
+
+// Stored documents are written with the current schema version.
+type schemaVersioned interface {
+	_setSchemaVersion(version int)
+}
+
+func (b *BookPublic) _setSchemaVersion(version int)    { b.SchemaVersion = version }
+func (b *BookPrivate) _setSchemaVersion(version int)   { b.SchemaVersion = version }
+func (b *BookInventory) _setSchemaVersion(version int) { b.SchemaVersion = version }
+func (b *Borrow) _setSchemaVersion(version int)        { b.SchemaVersion = version }
+func (t *Transfer) _setSchemaVersion(version int)      { t.SchemaVersion = version }
+func (pc *Purchase) _setSchemaVersion(version int)     { pc.SchemaVersion = version }
+func (dn *Donation) _setSchemaVersion(version int)     { dn.SchemaVersion = version }
+
+func _marshalRecord(doc schemaVersioned) ([]byte, error) {
+	doc._setSchemaVersion(SCHEMA_VERSION)
+	return json.MarshalIndent(doc, "", "  ")
+}
+
+// The document type of a record, nil if the record is not a stored document.
+func _newRecordDocument(recordType string) schemaVersioned {
+	switch recordType {
+	case "custom_book_type":
+		return &BookPublic{}
+	case "custom_book_private_type":
+		return &BookPrivate{}
+	case "custom_book_inventory_type":
+		return &BookInventory{}
+	case "custom_borrow_type":
+		return &Borrow{}
+	case "custom_transfer_type":
+		return &Transfer{}
+	case "custom_purchase_type":
+		return &Purchase{}
+	case "custom_donation_type":
+		return &Donation{}
+	default:
+		return nil
+	}
+}
+
+// Runs the migrations not done yet, by one server of the cluster at a time.
+// A run stopped halfway is resumed from its cursor.
+// With rerun, every record is checked again from the beginning.
+func (p *Plugin) _runMigrations(rerun bool) (*MigrationState, error) {
+	token, err := p._lockMigrations()
+	if err != nil {
+		return nil, err
+	}
+	defer p._unlockMigrations(token)
+
+	state, err := p._loadMigrationState()
+	if err != nil {
+		return nil, err
+	}
+
+	if rerun {
+		state.Target = 0
+	} else if state.Version >= SCHEMA_VERSION {
+		return state, nil
+	}
+
+	type target struct {
+		library *Plugin
+		channel *model.Channel
+	}
+	targets := []target{}
+	start := -1
+	for _, id := range p.libraryIds {
+		lp, err := p._withLibrary(id)
+		if err != nil {
+			return nil, err
+		}
+		for _, channel := range []*model.Channel{lp.booksChannel, lp.booksPriChannel, lp.booksInvChannel, lp.borrowChannel} {
+			if state.Target == SCHEMA_VERSION && state.Library == id && state.Channel == channel.Id {
+				start = len(targets)
+			}
+			targets = append(targets, target{lp, channel})
+		}
+	}
+
+	//a run resumed runs them again, granting roles twice changes nothing
+	if !rerun {
+		for _, m := range migrations {
+			if m.version <= state.Version || m.library == nil {
+				continue
+			}
+			for _, id := range p.libraryIds {
+				lp, err := p._withLibrary(id)
+				if err != nil {
+					return nil, err
+				}
+				if err := m.library(lp); err != nil {
+					return nil, errors.Wrapf(err, "migration %v of library %v error.", m.version, id)
+				}
+			}
+		}
+	}
+
+	page := 0
+	if start >= 0 {
+		page = state.Page
+		p.API.LogInfo("Resuming migrations.", "to", state.Target, "library", state.Library, "channel", state.Channel, "page", page)
+	} else {
+		start = 0
+		state.Target = SCHEMA_VERSION
+		state.Migrated = 0
+		p.API.LogInfo("Running migrations.", "from", state.Version, "to", state.Target)
+	}
+
+	for _, t := range targets[start:] {
+		for ; ; page++ {
+			records, err := t.library._repo().List(t.channel, page, migrationsPerPage)
+			if err != nil {
+				return nil, errors.Wrapf(err, "list records of library %v error. channel: %v, page: %v",
+					t.library.library.id, t.channel.Id, page)
+			}
+
+			for _, record := range records {
+				count, err := t.library._migrateRecord(record, true)
+				if err != nil {
+					return nil, err
+				}
+				state.Migrated += count
+			}
+
+			state.Library = t.library.library.id
+			state.Channel = t.channel.Id
+			state.Page = page + 1
+			if err := p._saveMigrationState(state); err != nil {
+				return nil, err
+			}
+			if err := p._refreshMigrationsLock(token); err != nil {
+				return nil, err
+			}
+			p.API.LogInfo("Migrating records.", "to", state.Target, "library", state.Library,
+				"channel", state.Channel, "page", page, "migrated", state.Migrated)
+
+			if len(records) < migrationsPerPage {
+				break
+			}
+		}
+		page = 0
+	}
+
+	state.Version = state.Target
+	state.Target = 0
+	state.Library = ""
+	state.Channel = ""
+	state.Page = 0
+	if err := p._saveMigrationState(state); err != nil {
+		return nil, err
+	}
+	p.API.LogInfo("Migrations done.", "version", state.Version, "migrated", state.Migrated)
+
+	return state, nil
+}
+
+// Returns the count of records changed.
+// The records of all roles are migrated with the master record of a borrow or a transfer,
+// because they are in the direct channels, which can't be listed.
+func (p *Plugin) _migrateRecord(record *model.Post, withRoles bool) (int, error) {
+	typed := _newRecordDocument(record.Type)
+	if typed == nil || record.RootId != "" || record.Message == "" {
+		return 0, nil
+	}
+
+	doc := map[string]interface{}{}
+	if err := json.Unmarshal([]byte(record.Message), &doc); err != nil {
+		p.API.LogWarn("Skip migrating a record not in JSON.", "id", record.Id, "err", err.Error())
+		return 0, nil
+	}
+
+	count := 0
+	changed, err := _migrateDocument(record.Type, doc)
+	if err != nil {
+		return 0, errors.Wrapf(err, "migrate record %v error.", record.Id)
+	}
+	if changed {
+		//back to the current type, so the fields are kept in their order
+		data, err := json.Marshal(doc)
+		if err != nil {
+			return 0, errors.Wrapf(err, "convert record %v error.", record.Id)
+		}
+		if err := json.Unmarshal(data, typed); err != nil {
+			return 0, errors.Wrapf(err, "convert record %v error.", record.Id)
+		}
+		message, err := _marshalRecord(typed)
+		if err != nil {
+			return 0, errors.Wrapf(err, "convert record %v error.", record.Id)
+		}
+
+		updated := record.Clone()
+		updated.Message = string(message)
+		if _, err := p._repo().Update(updated); err != nil {
+			return 0, errors.Wrapf(err, "update record %v error.", record.Id)
+		}
+		count++
+	}
+
+	if !withRoles {
+		return count, nil
+	}
+
+	for _, id := range _roleRecordIds(doc) {
+		roleRecord, err := p._repo().Get(id)
+		if errors.Is(err, ErrNotFound) {
+			continue
+		}
+		if err != nil {
+			return 0, errors.Wrapf(err, "get record %v error.", id)
+		}
+		roleCount, err := p._migrateRecord(roleRecord, false)
+		if err != nil {
+			return 0, err
+		}
+		count += roleCount
+	}
+
+	return count, nil
+}
+
+func _migrateDocument(recordType string, doc map[string]interface{}) (bool, error) {
+	version := 0
+	if v, ok := doc["schema_version"].(float64); ok {
+		version = int(v)
+	}
+
+	changed := false
+	for _, m := range migrations {
+		if m.version <= version {
+			continue
+		}
+		if err := m.migrate(recordType, doc); err != nil {
+			return false, errors.Wrapf(err, "migration %v", m.version)
+		}
+		doc["schema_version"] = m.version
+		changed = true
+	}
+
+	return changed, nil
+}
+
+// The records of the roles of a master, other than the book.
+func _roleRecordIds(doc map[string]interface{}) []string {
+	relations, _ := doc["relations_keys"].(map[string]interface{})
+
+	ids := []string{}
+	for key, value := range relations {
+		if key == "book" || key == "master" {
+			continue
+		}
+		switch v := value.(type) {
+		case string:
+			if v != "" {
+				ids = append(ids, v)
+			}
+		case []interface{}:
+			for _, id := range v {
+				if s, ok := id.(string); ok && s != "" {
+					ids = append(ids, s)
+				}
+			}
+		}
+	}
+	return ids
+}
+
+func (p *Plugin) _loadMigrationState() (*MigrationState, error) {
+	data, appErr := p.API.KVGet(MIGRATIONS_KV_KEY)
+	if appErr != nil {
+		return nil, errors.Wrapf(appErr, "get migration state error.")
+	}
+
+	state := &MigrationState{}
+	if data == nil {
+		return state, nil
+	}
+	if err := json.Unmarshal(data, state); err != nil {
+		return nil, errors.Wrapf(err, "convert migration state error.")
+	}
+	return state, nil
+}
+
+func (p *Plugin) _saveMigrationState(state *MigrationState) error {
+	state.UpdateAt = GetNowTime()
+	data, err := json.Marshal(state)
+	if err != nil {
+		return errors.Wrapf(err, "convert migration state error.")
+	}
+	if appErr := p.API.KVSet(MIGRATIONS_KV_KEY, data); appErr != nil {
+		return errors.Wrapf(appErr, "set migration state error.")
+	}
+	return nil
+}
+
+// The lock expires, so a server stopped while migrating doesn't keep it forever.
+// It is refreshed after every page.
+func (p *Plugin) _lockMigrations() (string, error) {
+	token := model.NewId()
+	ok, appErr := p.API.KVSetWithOptions(MIGRATIONS_LOCK_KV_KEY, []byte(token), model.PluginKVSetOptions{
+		Atomic:          true,
+		OldValue:        nil,
+		ExpireInSeconds: migrationsLockExpiry,
+	})
+	if appErr != nil {
+		return "", errors.Wrapf(appErr, "lock migrations error.")
+	}
+	if !ok {
+		return "", errors.Wrapf(ErrLocked, "migrations are running on another server")
+	}
+	return token, nil
+}
+
+func (p *Plugin) _refreshMigrationsLock(token string) error {
+	ok, appErr := p.API.KVSetWithOptions(MIGRATIONS_LOCK_KV_KEY, []byte(token), model.PluginKVSetOptions{
+		Atomic:          true,
+		OldValue:        []byte(token),
+		ExpireInSeconds: migrationsLockExpiry,
+	})
+	if appErr != nil {
+		return errors.Wrapf(appErr, "refresh migrations lock error.")
+	}
+	if !ok {
+		return errors.Wrapf(ErrLocked, "migrations lock is lost")
+	}
+	return nil
+}
+
+func (p *Plugin) _unlockMigrations(token string) {
+	if _, appErr := p.API.KVSetWithOptions(MIGRATIONS_LOCK_KV_KEY, nil, model.PluginKVSetOptions{
+		Atomic:   true,
+		OldValue: []byte(token),
+	}); appErr != nil {
+		p.API.LogError("Failed to unlock migrations.", "err", appErr.Error())
+	}
+}
+
+func (p *Plugin) _formatMigrations(state *MigrationState) string {
+	lines := []string{
+		fmt.Sprintf("Schema version: %v, records are migrated to: %v, migrated by the last run: %v.",
+			SCHEMA_VERSION, state.Version, state.Migrated),
+	}
+	if state.Target != 0 {
+		lines = append(lines, fmt.Sprintf("A run to version %v stopped at library %v, channel %v, page %v. It is resumed by the next run.",
+			state.Target, state.Library, state.Channel, state.Page))
+	}
+	for _, m := range migrations {
+		done := "pending"
+		if m.version <= state.Version {
+			done = "done"
+		}
+		lines = append(lines, fmt.Sprintf("%v. %v (%v)", m.version, m.description, done))
+	}
+	return strings.Join(lines, "\n")
+}
@@ -0,0 +1,225 @@
+package main
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+
+	"github.com/mattermost/mattermost-server/v5/model"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/require"
+)
+
+func TestMigrations(t *testing.T) {
+
+	type migrationEnv struct {
+		td        *TestData
+		plugin    *Plugin
+		repo      *memRepository
+		pub       *model.Post
+		master    *model.Post
+		role      *model.Post
+		notifying *model.Post
+	}
+
+	// records written before schema versions
+	setup := func() *migrationEnv {
+		td := NewTestData()
+		api := td.ApiMockCommon()
+		api.On("LogInfo", mock.Anything, mock.Anything, mock.Anything, mock.Anything, mock.Anything, mock.Anything,
+			mock.Anything, mock.Anything, mock.Anything, mock.Anything, mock.Anything).Return()
+		api.On("LogWarn", mock.Anything, mock.Anything, mock.Anything, mock.Anything, mock.Anything).Return()
+		// members from before there were roles
+		api.On("GetChannelMembers", td.BookChIdPub, 0, migrationsPerPage).Return(
+			&model.ChannelMembers{{UserId: td.BorId}, {UserId: td.BotId}}, nil)
+		api.On("GetChannelMembers", td.BookChIdPri, 0, migrationsPerPage).Return(
+			&model.ChannelMembers{{UserId: td.Worker2Id}}, nil)
+		api.On("GetChannelMembers", mock.AnythingOfType("string"), 0, migrationsPerPage).Return(
+			&model.ChannelMembers{}, nil)
+		api.On("GetTeamMember", td.BorTeamId, mock.AnythingOfType("string")).Return(&model.TeamMember{}, nil)
+		api.On("GetChannelMember", mock.AnythingOfType("string"), mock.AnythingOfType("string")).Return(
+			&model.ChannelMember{}, nil)
+		plugin := td.NewMockPlugin()
+		plugin.SetAPI(api)
+		repo := newMemRepository()
+		plugin.repo = repo
+
+		create := func(channelId string, recordType string, doc interface{}) *model.Post {
+			data, _ := json.MarshalIndent(doc, "", "  ")
+			post, err := repo.Create(&model.Post{ChannelId: channelId, Type: recordType, Message: string(data)})
+			require.Nil(t, err)
+			return post
+		}
+
+		env := &migrationEnv{td: td, plugin: plugin, repo: repo}
+		env.pub = create(td.BookChIdPub, "custom_book_type", td.ABookPub)
+		env.role = create(td.BorId_botId, "custom_borrow_type", &Borrow{
+			DataOrImage: &BorrowRequest{BookPostId: env.pub.Id},
+			Role:        []string{BORROWER},
+		})
+		env.master = create(td.BorChannelId, "custom_borrow_type", &Borrow{
+			DataOrImage:  &BorrowRequest{BookPostId: env.pub.Id},
+			Role:         []string{MASTER},
+			RelationKeys: RelationKeys{Book: env.pub.Id, Borrower: env.role.Id},
+		})
+		env.notifying, _ = repo.Create(&model.Post{ChannelId: td.BorChannelId, Message: "Status was changed."})
+
+		return env
+	}
+
+	schemaVersionOf := func(t *testing.T, env *migrationEnv, id string) int {
+		post, err := env.repo.Get(id)
+		require.Nil(t, err)
+		doc := map[string]interface{}{}
+		require.Nil(t, json.Unmarshal([]byte(post.Message), &doc))
+		v, _ := doc["schema_version"].(float64)
+		return int(v)
+	}
+
+	t.Run("registry", func(t *testing.T) {
+		require.NotEmpty(t, migrations)
+		for i, m := range migrations {
+			assert.Equal(t, i+1, m.version, "versions should be one by one")
+		}
+		assert.Equal(t, SCHEMA_VERSION, migrations[len(migrations)-1].version)
+	})
+
+	t.Run("migrate_all", func(t *testing.T) {
+		env := setup()
+
+		state, err := env.plugin._runMigrations(false)
+		require.Nil(t, err)
+		assert.Equal(t, SCHEMA_VERSION, state.Version)
+		assert.Equal(t, 0, state.Target)
+		assert.Equal(t, 3, state.Migrated)
+
+		for _, id := range []string{env.pub.Id, env.master.Id, env.role.Id} {
+			assert.Equal(t, SCHEMA_VERSION, schemaVersionOf(t, env, id))
+		}
+
+		pub, _ := env.repo.Get(env.pub.Id)
+		assert.True(t, strings.HasPrefix(pub.Message, "{\n  \"name_pub\""), "fields should be kept in order")
+		var bookPub BookPublic
+		json.Unmarshal([]byte(pub.Message), &bookPub)
+		var expected BookPublic
+		DeepCopy(&expected, env.td.ABookPub)
+		expected.SchemaVersion = SCHEMA_VERSION
+		assert.Equal(t, expected, bookPub)
+
+		notifying, _ := env.repo.Get(env.notifying.Id)
+		assert.Equal(t, env.notifying.Message, notifying.Message, "should not touch other posts")
+
+		assert.NotContains(t, env.td.kvStore, MIGRATIONS_LOCK_KV_KEY, "should be unlocked")
+	})
+
+	t.Run("idempotent", func(t *testing.T) {
+		env := setup()
+
+		_, err := env.plugin._runMigrations(false)
+		require.Nil(t, err)
+		pub, _ := env.repo.Get(env.pub.Id)
+
+		state, err := env.plugin._runMigrations(false)
+		require.Nil(t, err)
+		assert.Equal(t, 3, state.Migrated, "should be the state of the last run")
+
+		state, err = env.plugin._runMigrations(true)
+		require.Nil(t, err)
+		assert.Equal(t, 0, state.Migrated)
+		rerun, _ := env.repo.Get(env.pub.Id)
+		assert.Equal(t, pub.UpdateAt, rerun.UpdateAt, "should not be written again")
+	})
+
+	t.Run("resume_from_cursor", func(t *testing.T) {
+		env := setup()
+
+		data, _ := json.Marshal(MigrationState{
+			Target:  SCHEMA_VERSION,
+			Library: DEFAULT_LIBRARY_ID,
+			Channel: env.td.BorChannelId,
+		})
+		env.td.kvStore[MIGRATIONS_KV_KEY] = data
+
+		state, err := env.plugin._runMigrations(false)
+		require.Nil(t, err)
+		assert.Equal(t, SCHEMA_VERSION, state.Version)
+		assert.Equal(t, 2, state.Migrated)
+		assert.Equal(t, 0, schemaVersionOf(t, env, env.pub.Id), "channels before the cursor are done")
+		assert.Equal(t, SCHEMA_VERSION, schemaVersionOf(t, env, env.master.Id))
+	})
+
+	t.Run("seed_roles", func(t *testing.T) {
+		env := setup()
+		delete(env.td.kvStore, ROLES_KV_KEY)
+		create := func(channelId string, recordType string, doc interface{}) {
+			data, _ := json.Marshal(doc)
+			_, err := env.repo.Create(&model.Post{ChannelId: channelId, Type: recordType, Message: string(data)})
+			require.Nil(t, err)
+		}
+		create(env.td.BookChIdPri, "custom_book_private_type", &BookPrivate{KeeperUsers: []string{"kpuser1"}})
+		create(env.td.BorChannelId, "custom_borrow_type", &Borrow{
+			DataOrImage: &BorrowRequest{BorrowerUser: "kpuser2", LibworkerUser: "worker2", KeeperUsers: []string{"kpuser1"}},
+			Role:        []string{MASTER},
+		})
+
+		_, err := env.plugin._runMigrations(false)
+		require.Nil(t, err)
+		roles, _, err := env.plugin._loadRoles()
+		require.Nil(t, err)
+		assert.Equal(t, UserRolesMap{
+			env.td.BorId:     {ROLE_BORROWER},
+			env.td.Worker1Id: {ROLE_LIBWORKER},
+			env.td.Worker2Id: {ROLE_CATALOG_EDITOR, ROLE_LIBWORKER},
+			env.td.Keeper1Id: {ROLE_KEEPER},
+			env.td.Keeper2Id: {ROLE_BORROWER},
+		}, roles)
+
+		_, err = env.plugin._revokeRoles(env.td.Worker2Id, ROLE_LIBWORKER)
+		require.Nil(t, err)
+		_, err = env.plugin._runMigrations(true)
+		require.Nil(t, err)
+		roles, _, err = env.plugin._loadRoles()
+		require.Nil(t, err)
+		assert.Equal(t, []string{ROLE_CATALOG_EDITOR}, roles[env.td.Worker2Id], "seeded only once")
+	})
+
+	t.Run("locked_by_another_server", func(t *testing.T) {
+		env := setup()
+		env.td.kvStore[MIGRATIONS_LOCK_KV_KEY] = []byte(model.NewId())
+
+		_, err := env.plugin._runMigrations(false)
+		assert.ErrorIs(t, err, ErrLocked)
+		assert.Equal(t, 0, schemaVersionOf(t, env, env.pub.Id))
+	})
+
+	t.Run("new_records_versioned", func(t *testing.T) {
+		env := setup()
+
+		var book Book
+		DeepCopy(&book, env.td.ABook)
+		book.BookPublic.Id = "zzh-book-009"
+		book.BookPublic.Isbn13 = ""
+		book.BookPublic.Isbn10 = ""
+		id, err := env.plugin._createABook(&book)
+		require.Nil(t, err)
+		assert.Equal(t, SCHEMA_VERSION, schemaVersionOf(t, env, id))
+	})
+
+	t.Run("command", func(t *testing.T) {
+		env := setup()
+
+		_, err := env.plugin._executeMigrations(env.td.BorId, []string{"run"})
+		assert.ErrorIs(t, err, ErrNotPermitted)
+
+		text, err := env.plugin._executeMigrations(env.td.Worker1Id, []string{"status"})
+		require.Nil(t, err)
+		assert.Contains(t, text, "records are migrated to: 0")
+		assert.Contains(t, text, "(pending)")
+
+		text, err = env.plugin._executeMigrations(env.td.Worker1Id, []string{"run"})
+		require.Nil(t, err)
+		assert.Contains(t, text, "migrated by the last run: 3")
+		assert.Contains(t, text, "(done)")
+	})
+}
@@ -1,6 +1,10 @@
 package main
 
-import "github.com/pkg/errors"
+import (
+	"encoding/json"
+
+	"github.com/pkg/errors"
+)
 
 type Book struct {
 	*BookPublic
@@ -27,6 +31,9 @@ const (
 	TAG_PREFIX_C1        = "#c1_"
 	TAG_PREFIX_C2        = "#c2_"
 	TAG_PREFIX_C3        = "#c3_"
+	TAG_PREFIX_ISBN      = "#isbn_"
+	TAG_PREFIX_PROPOSER  = "#p_"
+	TAG_PREFIX_DONOR     = "#d_"
 )
 
 type Relations map[string]string
@@ -45,6 +52,8 @@ type BookPublic struct {
 	Publisher          string    `json:"publisher"`
 	PublisherEn        string    `json:"publisher_en"`
 	PublishDate        string    `json:"publish_date"`
+	Isbn10             string    `json:"isbn10,omitempty"`
+	Isbn13             string    `json:"isbn13,omitempty"`
 	Intro              string    `json:"introduction"`
 	BookIndex          string    `json:"book_index"`
 	LibworkerUsers     []string  `json:"libworker_users"`
@@ -55,6 +64,10 @@ type BookPublic struct {
 	Tags               []string  `json:"tags,omitempty"`
 	Relations          Relations `json:"relations_pub,omitempty"`
 	MatchId            string    `json:"match_id"`
+	//average of the reviews, kept by _reviewABook only
+	Rating        float64 `json:"rating,omitempty"`
+	RatingCount   int     `json:"rating_count,omitempty"`
+	SchemaVersion int     `json:"schema_version,omitempty"`
 }
 
 type Keeper struct {
@@ -73,6 +86,7 @@ type BookPrivate struct {
 	KeeperInfos   KeeperInfoMap     `json:"keeper_infos,omitempty"`
 	CopyKeeperMap map[string]Keeper `json:"copy_keeper_map"`
 	Relations     Relations         `json:"relations_pri,omitempty"`
+	SchemaVersion int               `json:"schema_version,omitempty"`
 }
 
 const (
@@ -80,6 +94,8 @@ const (
 	COPY_STATUS_TRANSIN  = "transmit_in"
 	COPY_STATUS_TRANSOUT = "transmit_out"
 	COPY_STATUS_LENDING  = "lending"
+	//moving between keepers, see transfer workflow
+	COPY_STATUS_INTRANSIT = "in_transit"
 )
 
 //map CopyId
@@ -90,14 +106,16 @@ type BookCopy struct {
 }
 
 type BookInventory struct {
-	Name        string     `json:"name_inv,omitempty"`
-	Id          string     `json:"id_inv,omitempty"`
-	Stock       int        `json:"stock"`
-	TransmitOut int        `json:"transmit_out"`
-	Lending     int        `json:"lending"`
-	TransmitIn  int        `json:"transmit_in"`
-	Copies      BookCopies `json:"copies"`
-	Relations   Relations  `json:"relations_inv,omitempty"`
+	Name          string     `json:"name_inv,omitempty"`
+	Id            string     `json:"id_inv,omitempty"`
+	Stock         int        `json:"stock"`
+	TransmitOut   int        `json:"transmit_out"`
+	Lending       int        `json:"lending"`
+	TransmitIn    int        `json:"transmit_in"`
+	InTransit     int        `json:"in_transit"`
+	Copies        BookCopies `json:"copies"`
+	Relations     Relations  `json:"relations_inv,omitempty"`
+	SchemaVersion int        `json:"schema_version,omitempty"`
 }
 
 type Upload struct {
@@ -105,17 +123,46 @@ type Upload struct {
 	Delete               bool   `json:"delete"`
 	UpdIsAllowedToBorrow bool   `json:"upd_isAllowedToBorrow"`
 	Etag                 string `json:"etag"`
+	//create: update the existing book with the same isbn instead of refusing it
+	MatchIsbn bool `json:"match_isbn,omitempty"`
+	//fill empty public fields from the metadata provider by isbn
+	Enrich bool `json:"enrich,omitempty"`
 }
 
 const (
 	BOOKS_ACTION_UPLOAD           = "UPLOAD"
 	BOOKS_ACTION_FETCH_INV_KEEPER = "FETCH_INV_KEEPER"
+	BOOKS_ACTION_PATCH            = "PATCH"
+	BOOKS_ACTION_ADD_COPIES       = "ADD_COPIES"
+	BOOKS_ACTION_RETIRE_COPIES    = "RETIRE_COPIES"
+	BOOKS_ACTION_REASSIGN_COPIES  = "REASSIGN_COPIES"
 )
 
+//add: new copies kept by Keeper
+//retire: in stock copies, Keeper is not used
+//reassign: in stock copies moved to Keeper
+type CopyOperation struct {
+	Post_id string   `json:"post_id"`
+	Etag    string   `json:"etag"`
+	Copies  []string `json:"copies"`
+	Keeper  string   `json:"keeper"`
+}
+
+//A JSON merge patch(RFC 7386) for each part of a book, a part without patch is not touched.
+type BookPatch struct {
+	Post_id   string          `json:"post_id"`
+	Etag      string          `json:"etag"`
+	Public    json.RawMessage `json:"public,omitempty"`
+	Private   json.RawMessage `json:"private,omitempty"`
+	Inventory json.RawMessage `json:"inventory,omitempty"`
+}
+
 type BooksRequest struct {
 	Action  string `json:"action"`
 	ActUser string `json:"act_user"`
 	Body    string `json:"body"`
+	//upload: check and compare only, nothing is written
+	DryRun bool `json:"dry_run,omitempty"`
 }
 
 const (
@@ -199,9 +246,10 @@ type BorrowRequest struct {
 }
 
 type Borrow struct {
-	DataOrImage  *BorrowRequest `json:"dataOrImage"`
-	Role         []string       `json:"role"`
-	RelationKeys RelationKeys   `json:"relations_keys"`
+	DataOrImage   *BorrowRequest `json:"dataOrImage"`
+	Role          []string       `json:"role"`
+	RelationKeys  RelationKeys   `json:"relations_keys"`
+	SchemaVersion int            `json:"schema_version,omitempty"`
 }
 
 type RelationKeys struct {
@@ -212,9 +260,646 @@ type RelationKeys struct {
 	Keepers   []string `json:"keepers,omitempty"`
 }
 
+const (
+	WORKFLOW_TRANSFER = "TRANSFER"
+)
+
+const (
+	TRANSFER_STATUS_REQUESTED = "TFR"
+	TRANSFER_STATUS_SHIPPED   = "TFS"
+	TRANSFER_STATUS_RECEIVED  = "TFD"
+)
+
+const (
+	FROM_KEEPER = "FROM_KEEPER"
+	TO_KEEPER   = "TO_KEEPER"
+)
+
+type TransferRequestKey struct {
+	BookPostId string `json:"book_post_id"`
+	CopyId     string `json:"copy_id"`
+	ToKeeper   string `json:"to_keeper"`
+}
+
+//A copy moving from one keeper to another.
+//The copy is in transit from the request until it is received,
+//so it can't be chosen by a borrowing meanwhile.
+type TransferRequest struct {
+	//Make name first so as to show the JSON's name in changed thread view
+	BookName       string   `json:"book_name"`
+	BookPostId     string   `json:"book_post_id"`
+	BookId         string   `json:"book_id"`
+	CopyId         string   `json:"copy_id"`
+	RequesterUser  string   `json:"requester_user"`
+	FromKeeperUser string   `json:"from_keeper_user"`
+	FromKeeperName string   `json:"from_keeper_name"`
+	ToKeeperUser   string   `json:"to_keeper_user"`
+	ToKeeperName   string   `json:"to_keeper_name"`
+	Worflow        []Step   `json:"workflow"`
+	StepIndex      int      `json:"step_index"`
+	Tags           []string `json:"tags"`
+	MatchId        string   `json:"match_id"`
+}
+
+type Transfer struct {
+	DataOrImage   *TransferRequest     `json:"dataOrImage"`
+	Role          []string             `json:"role"`
+	RelationKeys  TransferRelationKeys `json:"relations_keys"`
+	SchemaVersion int                  `json:"schema_version,omitempty"`
+}
+
+type TransferRelationKeys struct {
+	Book       string `json:"book"`
+	Master     string `json:"master,omitempty"`
+	FromKeeper string `json:"from_keeper,omitempty"`
+	ToKeeper   string `json:"to_keeper,omitempty"`
+}
+
+const (
+	WORKFLOW_PURCHASE = "PURCHASE"
+)
+
+const (
+	PURCHASE_STATUS_PROPOSED = "PP"
+	PURCHASE_STATUS_APPROVED = "PA"
+	PURCHASE_STATUS_DECLINED = "PD"
+	PURCHASE_STATUS_ORDERED  = "PO"
+	PURCHASE_STATUS_RECEIVED = "PV"
+)
+
+type PurchaseProposal struct {
+	BookName string `json:"book_name"`
+	Author   string `json:"author"`
+	Isbn     string `json:"isbn"`
+	Reason   string `json:"reason"`
+}
+
+//A book proposed to buy, only one master record in the borrow channel.
+//Everyone who voted, the proposer included, is told when the book is received.
+type PurchaseRequest struct {
+	//Make name first so as to show the JSON's name in changed thread view
+	BookName     string   `json:"book_name"`
+	Author       string   `json:"author"`
+	Isbn13       string   `json:"isbn13,omitempty"`
+	Reason       string   `json:"reason"`
+	ProposerUser string   `json:"proposer_user"`
+	ProposerName string   `json:"proposer_name"`
+	VoterUsers   []string `json:"voter_users"`
+	//the catalog entry created on receipt
+	BookPostId string   `json:"book_post_id,omitempty"`
+	Worflow    []Step   `json:"workflow"`
+	StepIndex  int      `json:"step_index"`
+	Tags       []string `json:"tags"`
+	MatchId    string   `json:"match_id"`
+}
+
+type Purchase struct {
+	DataOrImage   *PurchaseRequest `json:"dataOrImage"`
+	Role          []string         `json:"role"`
+	SchemaVersion int              `json:"schema_version,omitempty"`
+}
+
+type PurchaseEntry struct {
+	MasterKey string `json:"master_key"`
+	*PurchaseRequest
+}
+
+//The book is required to move to PURCHASE_STATUS_RECEIVED,
+//its name, author and isbn default to the proposal's.
+type PurchaseWorkflowRequest struct {
+	WorkflowRequest
+	Book *Book `json:"book,omitempty"`
+}
+
+const (
+	WORKFLOW_DONATION = "DONATION"
+)
+
+const (
+	DONATION_STATUS_OFFERED  = "DO"
+	DONATION_STATUS_ACCEPTED = "DA"
+	DONATION_STATUS_REJECTED = "DR"
+)
+
+type DonationOffer struct {
+	BookName string `json:"book_name"`
+	BookId   string `json:"book_id"`
+	Author   string `json:"author"`
+	Isbn     string `json:"isbn"`
+	Copies   int    `json:"copies"`
+	//the donor keeps the copies and lends them out, or hands them over to the library
+	DonorKeeps bool   `json:"donor_keeps"`
+	Note       string `json:"note"`
+}
+
+//A book offered by a donor, only one master record in the borrow channel.
+//On acceptance, the copies are added to the book with the same id or isbn, or to a new book.
+type DonationRequest struct {
+	//Make name first so as to show the JSON's name in changed thread view
+	BookName   string `json:"book_name"`
+	BookId     string `json:"book_id"`
+	Author     string `json:"author"`
+	Isbn13     string `json:"isbn13,omitempty"`
+	Copies     int    `json:"copies"`
+	DonorUser  string `json:"donor_user"`
+	DonorName  string `json:"donor_name"`
+	DonorKeeps bool   `json:"donor_keeps"`
+	Note       string `json:"note"`
+	//set on acceptance
+	ReviewerUser string   `json:"reviewer_user,omitempty"`
+	KeeperUser   string   `json:"keeper_user,omitempty"`
+	BookPostId   string   `json:"book_post_id,omitempty"`
+	CopyIds      []string `json:"copy_ids,omitempty"`
+	Worflow      []Step   `json:"workflow"`
+	StepIndex    int      `json:"step_index"`
+	Tags         []string `json:"tags"`
+	MatchId      string   `json:"match_id"`
+}
+
+type Donation struct {
+	DataOrImage   *DonationRequest `json:"dataOrImage"`
+	Role          []string         `json:"role"`
+	SchemaVersion int              `json:"schema_version,omitempty"`
+}
+
+type DonationEntry struct {
+	MasterKey string `json:"master_key"`
+	*DonationRequest
+}
+
+//On acceptance, the book id is required if no book matches,
+//and the keeper of handed over copies is the reviewer by default.
+type DonationWorkflowRequest struct {
+	WorkflowRequest
+	BookId string `json:"book_id,omitempty"`
+	Keeper string `json:"keeper,omitempty"`
+}
+
+//Plugin roles, managed by command and kept in the KV store.
+//A library admin is granted every permission.
+const (
+	ROLE_LIBRARY_ADMIN  = "library_admin"
+	ROLE_CATALOG_EDITOR = "catalog_editor"
+	ROLE_LIBWORKER      = "libworker"
+	ROLE_KEEPER         = "keeper"
+	ROLE_BORROWER       = "borrower"
+)
+
+const (
+	ROLES_KV_KEY = "library_roles"
+)
+
+//Every stored document(book parts, borrows and transfers) is written with the schema version.
+//Raise it with a new migration when the stored JSON changes, see migrations.
+const (
+	SCHEMA_VERSION = 2
+
+	MIGRATIONS_KV_KEY      = "library_migrations"
+	MIGRATIONS_LOCK_KV_KEY = "library_migrations_lock"
+)
+
+//A backup is a zip archive of these files, the manifest lists the others with their checksums.
+const (
+	BACKUP_FORMAT_VERSION = 1
+
+	BACKUP_FILE_MANIFEST = "manifest.json"
+	BACKUP_FILE_RECORDS  = "records.json"
+	BACKUP_FILE_AUDIT    = "audit.json"
+)
+
+//Where a record is kept, the channels are of the library the backup is restored to.
+const (
+	BACKUP_CHANNEL_BOOKS     = "books"
+	BACKUP_CHANNEL_BOOKS_PRI = "books_private"
+	BACKUP_CHANNEL_BOOKS_INV = "books_inventory"
+	BACKUP_CHANNEL_BORROW    = "borrow"
+	//the direct channel of the bot and the user
+	BACKUP_CHANNEL_DIRECT = "direct"
+)
+
+type BackupManifest struct {
+	FormatVersion int          `json:"format_version"`
+	SchemaVersion int          `json:"schema_version"`
+	LibraryId     string       `json:"library_id"`
+	CreateAt      int64        `json:"create_at"`
+	Files         []BackupFile `json:"files"`
+}
+
+type BackupFile struct {
+	Name    string `json:"name"`
+	Records int    `json:"records"`
+	Sha256  string `json:"sha256"`
+}
+
+//A book part, a borrow or a transfer record, the message is kept as it is.
+type BackupRecord struct {
+	Id       string `json:"id"`
+	Type     string `json:"type"`
+	Channel  string `json:"channel"`
+	User     string `json:"user,omitempty"`
+	CreateAt int64  `json:"create_at"`
+	Message  string `json:"message"`
+}
+
+//A status change told in the thread of a record.
+type BackupAudit struct {
+	RootId   string `json:"root_id"`
+	UserId   string `json:"user_id"`
+	CreateAt int64  `json:"create_at"`
+	Message  string `json:"message"`
+}
+
+//Progress of migrations, kept in the KV store.
+//A migration run stopped halfway resumes from the cursor.
+type MigrationState struct {
+	//all records are migrated up to this version
+	Version int `json:"version"`
+	//the version the current run migrates to, 0 if none is running
+	Target  int    `json:"target,omitempty"`
+	Library string `json:"library,omitempty"`
+	Channel string `json:"channel,omitempty"`
+	Page    int    `json:"page,omitempty"`
+	//records changed by the current or the last run
+	Migrated int   `json:"migrated"`
+	UpdateAt int64 `json:"update_at,omitempty"`
+}
+
+//Statistics of the borrows requested in a date range, see _computeStats.
+//Lending and InTransit are the current counts, not of the range.
+type LibraryStats struct {
+	LibraryId string `json:"library_id"`
+	From      int64  `json:"from"`
+	To        int64  `json:"to"`
+	Borrows   int    `json:"borrows"`
+	//the most borrowed first
+	ByBook          []StatsCount     `json:"by_book"`
+	ByCategory      []StatsCount     `json:"by_category"`
+	ByKeeper        []StatsCount     `json:"by_keeper"`
+	StatusDurations []StatusDuration `json:"status_durations"`
+	//borrows renewed at least once
+	Renewed     int     `json:"renewed"`
+	RenewalRate float64 `json:"renewal_rate"`
+	Lending     int     `json:"lending"`
+	InTransit   int     `json:"in_transit"`
+}
+
+type StatsCount struct {
+	Key   string `json:"key"`
+	Name  string `json:"name,omitempty"`
+	Count int    `json:"count"`
+}
+
+//How long borrows stayed in a status before the next one.
+type StatusDuration struct {
+	Status       string  `json:"status"`
+	Count        int     `json:"count"`
+	AverageHours float64 `json:"average_hours"`
+}
+
+const (
+	//prefix of the KV key of the last month reported of a library
+	STATS_REPORT_KV_KEY_PREFIX = "library_stats_report_"
+	STATS_DATE_FORMAT          = "2006-01-02"
+	STATS_MONTH_FORMAT         = "2006-01"
+)
+
+//A review of a book by a borrower who returned it, one per user and book.
+//Reviews of a book are kept in one KV entry, see _reviewsKey.
+type Review struct {
+	User     string `json:"user"`
+	Name     string `json:"name,omitempty"`
+	Rating   int    `json:"rating"`
+	Text     string `json:"text,omitempty"`
+	BorrowId string `json:"borrow_id,omitempty"`
+	CreateAt int64  `json:"create_at"`
+	UpdateAt int64  `json:"update_at"`
+}
+
+type ReviewRequest struct {
+	BookPostId string `json:"book_post_id"`
+	Rating     int    `json:"rating"`
+	Text       string `json:"text"`
+}
+
+type BookReviews struct {
+	BookPostId  string   `json:"book_post_id"`
+	Rating      float64  `json:"rating"`
+	RatingCount int      `json:"rating_count"`
+	Reviews     []Review `json:"reviews"`
+}
+
+const (
+	REVIEWS_KV_KEY_PREFIX = "library_reviews_"
+	REVIEW_RATING_MIN     = 1
+	REVIEW_RATING_MAX     = 5
+	//in characters
+	REVIEW_TEXT_MAX_LEN = 1000
+)
+
+//Built offline from the borrows of a library and kept in the KV store, see _buildRecommendations.
+type RecommendationIndex struct {
+	LibraryId string `json:"library_id"`
+	BuildAt   int64  `json:"build_at"`
+	//book post id -> book
+	Books map[string]*RecommendedBook `json:"books"`
+	//username -> book post ids of all the borrows of the user
+	Readers map[string][]string `json:"readers"`
+}
+
+type RecommendedBook struct {
+	Name       string   `json:"name"`
+	Categories []string `json:"categories,omitempty"`
+	Borrows    int      `json:"borrows"`
+	//the books borrowed by the readers of the book, the most first
+	AlsoBorrowed []BookScore `json:"also_borrowed,omitempty"`
+}
+
+type BookScore struct {
+	BookPostId string `json:"book_post_id"`
+	Score      int    `json:"score"`
+}
+
+type Recommendation struct {
+	BookPostId string `json:"book_post_id"`
+	Name       string `json:"name"`
+	Score      int    `json:"score"`
+	//one of RECOMMEND_REASON_*
+	Reason string `json:"reason"`
+}
+
+const (
+	RECOMMEND_REASON_CO_BORROW = "co_borrow"
+	RECOMMEND_REASON_CATEGORY  = "category"
+	RECOMMEND_REASON_POPULAR   = "popular"
+)
+
+const (
+	//prefix of the KV key of the index of a library
+	RECOMMEND_KV_KEY_PREFIX = "library_recommend_"
+	//the index is rebuilt by the background job when it's older
+	RECOMMEND_REBUILD_HOURS = 24
+	RECOMMEND_DEFAULT_LIMIT = 5
+	RECOMMEND_MAX_LIMIT     = 50
+)
+
+const (
+	//user id -> the token of the calendar feeds
+	ICAL_TOKEN_KV_KEY_PREFIX = "library_ical_token_"
+	//sha256 of a token -> user id
+	ICAL_USER_KV_KEY_PREFIX = "library_ical_user_"
+	ICAL_PATH_PREFIX        = "/ical/"
+	//due dates of the books a user is borrowing
+	ICAL_FEED_LOANS = "loans"
+	//expected returns of the copies a user keeps
+	ICAL_FEED_RETURNS = "returns"
+	ICAL_TOKEN_PARAM  = "token"
+)
+
+//URLs to subscribe to in a calendar client
+type ICalFeeds struct {
+	Loans   string `json:"loans"`
+	Returns string `json:"returns"`
+}
+
+const (
+	WEBHOOK_EVENT_BOOK_CREATED   = "book_created"
+	WEBHOOK_EVENT_BOOK_UPDATED   = "book_updated"
+	WEBHOOK_EVENT_BOOK_DELETED   = "book_deleted"
+	WEBHOOK_EVENT_BORROW_CREATED = "borrow_created"
+	WEBHOOK_EVENT_STEP_CHANGED   = "workflow_step_changed"
+)
+
+const (
+	//targets of a library
+	WEBHOOKS_KV_KEY_PREFIX = "library_webhooks_"
+	//deliveries to be sent of a library
+	WEBHOOK_QUEUE_KV_KEY_PREFIX = "library_webhook_queue_"
+	//sent or given up deliveries of a library, the newest first
+	WEBHOOK_LOG_KV_KEY_PREFIX = "library_webhook_log_"
+	//one server of a cluster sends the deliveries at a time
+	WEBHOOK_LOCK_KV_KEY = "library_webhook_lock"
+	WEBHOOK_LOG_MAX     = 200
+	//a delivery is given up after
+	WEBHOOK_MAX_ATTEMPTS = 8
+	//the first retry, doubled after every failure
+	WEBHOOK_RETRY_BASE_SECONDS = 60
+
+	//hex of the HMAC-SHA256 of the body by the secret of the target, prefixed by "sha256="
+	WEBHOOK_HEADER_SIGNATURE = "X-Library-Signature"
+	WEBHOOK_HEADER_EVENT     = "X-Library-Event"
+	WEBHOOK_HEADER_DELIVERY  = "X-Library-Delivery"
+)
+
+const (
+	WEBHOOK_DELIVERY_PENDING   = "pending"
+	WEBHOOK_DELIVERY_DELIVERED = "delivered"
+	WEBHOOK_DELIVERY_FAILED    = "failed"
+)
+
+type WebhookTarget struct {
+	Id  string `json:"id"`
+	URL string `json:"url"`
+	//only shown when the target is added
+	Secret string `json:"secret,omitempty"`
+	//all events if empty
+	Events    []string `json:"events,omitempty"`
+	CreatedBy string   `json:"created_by"`
+	CreateAt  int64    `json:"create_at"`
+}
+
+//the body of a delivery
+type WebhookPayload struct {
+	//same for all the targets of an event
+	Id        string      `json:"id"`
+	Event     string      `json:"event"`
+	LibraryId string      `json:"library_id"`
+	CreateAt  int64       `json:"create_at"`
+	Data      interface{} `json:"data"`
+}
+
+//a user, or a kiosk by the name of its token
+type WebhookActor struct {
+	UserId   string `json:"user_id,omitempty"`
+	Username string `json:"username,omitempty"`
+	Kiosk    string `json:"kiosk,omitempty"`
+}
+
+type WebhookBookData struct {
+	BookPostId string      `json:"book_post_id"`
+	Book       *BookPublic `json:"book"`
+}
+
+type WebhookBorrowData struct {
+	MasterKey string         `json:"master_key"`
+	Borrow    *BorrowRequest `json:"borrow"`
+	Book      *BookPublic    `json:"book"`
+	Actor     *WebhookActor  `json:"actor"`
+}
+
+type WebhookTransitionData struct {
+	MasterKey string `json:"master_key"`
+	//the step the borrow is moved to
+	Step         Step           `json:"step"`
+	PreviousStep Step           `json:"previous_step"`
+	Backward     bool           `json:"backward"`
+	Borrow       *BorrowRequest `json:"borrow"`
+	Book         *BookPublic    `json:"book"`
+	Actor        *WebhookActor  `json:"actor"`
+}
+
+const (
+	//tokens of a library
+	API_TOKENS_KV_KEY_PREFIX = "library_api_tokens_"
+	//pick up a copy ready to be delivered
+	API_TOKEN_SCOPE_CHECKOUT = "kiosk:checkout"
+	//return a delivered copy
+	API_TOKEN_SCOPE_CHECKIN = "kiosk:checkin"
+	//the actor of a transition by a kiosk is the name of its token prefixed
+	KIOSK_ACTOR_PREFIX = "kiosk-"
+)
+
+//issued by a library admin, for a client without a Mattermost session
+type ApiToken struct {
+	Id     string   `json:"id"`
+	Name   string   `json:"name"`
+	Scopes []string `json:"scopes"`
+	//only shown when the token is issued
+	Token string `json:"token,omitempty"`
+	//sha256 of the token, never shown
+	Hash       string `json:"hash,omitempty"`
+	CreatedBy  string `json:"created_by"`
+	CreateAt   int64  `json:"create_at"`
+	LastUsedAt int64  `json:"last_used_at,omitempty"`
+}
+
+type KioskScanRequest struct {
+	CopyId string `json:"copy_id"`
+}
+
+type KioskScanResult struct {
+	MasterKey      string `json:"master_key"`
+	BookName       string `json:"book_name"`
+	CopyId         string `json:"copy_id"`
+	BorrowerUser   string `json:"borrower_user"`
+	PreviousStatus string `json:"previous_status"`
+	Status         string `json:"status"`
+}
+
+const (
+	//opened by scanning the QR code of a copy label
+	SCAN_PATH       = "/scan"
+	SCAN_PARAM_BOOK = "book"
+	SCAN_PARAM_COPY = "copy"
+	//the labels of the copies a keeper keeps
+	LABELS_PARAM_KEEPER = "keeper"
+)
+
+const (
+	//users' penalties of a library
+	PENALTIES_KV_KEY_PREFIX = "library_penalties_"
+	//too many points of overdue days
+	SUSPENSION_REASON_OVERDUE = "overdue"
+	//too many lost copies
+	SUSPENSION_REASON_LOST = "lost"
+)
+
+//zero turns a consequence off, e.g. no points are charged if PointsPerOverdueDay is 0
+type PenaltyPolicy struct {
+	PointsPerOverdueDay int `json:"points_per_overdue_day"`
+	SuspendAtPoints     int `json:"suspend_at_points"`
+	SuspendAtLostCopies int `json:"suspend_at_lost_copies"`
+	SuspensionDays      int `json:"suspension_days"`
+}
+
+type Suspension struct {
+	Reason   string `json:"reason"`
+	CreateAt int64  `json:"create_at"`
+	Until    int64  `json:"until"`
+}
+
+const (
+	ELIGIBILITY_RULE_SUSPENSION       = "suspension"
+	ELIGIBILITY_RULE_STOCK            = "stock"
+	ELIGIBILITY_RULE_CONCURRENT_LIMIT = "concurrent_limit"
+	ELIGIBILITY_RULE_CATEGORY         = "category_restriction"
+	ELIGIBILITY_RULE_DUPLICATE        = "duplicate_borrow"
+
+	ELIGIBILITY_ALLOW = "allow"
+	ELIGIBILITY_DENY  = "deny"
+	ELIGIBILITY_WARN  = "warn"
+	//the borrower to explain the eligibility of
+	ELIGIBILITY_PARAM_USER = "user"
+)
+
+//a rule of the borrow eligibility, the rules are checked in order
+type EligibilityRuleConfig struct {
+	Rule string `json:"rule"`
+	//warn instead of deny if the rule is not met
+	WarnOnly bool `json:"warn_only,omitempty"`
+	//concurrent_limit: the borrow limit of the library if 0
+	Limit int `json:"limit,omitempty"`
+	//category_restriction: books of the categories, of any level,
+	//are for borrowers of the library roles only
+	Categories []string `json:"categories,omitempty"`
+	Roles      []string `json:"roles,omitempty"`
+}
+
+type EligibilityVerdict struct {
+	Rule    string       `json:"rule"`
+	Outcome string       `json:"outcome"`
+	Code    string       `json:"code,omitempty"`
+	Message string       `json:"message,omitempty"`
+	Details ErrorDetails `json:"details,omitempty"`
+}
+
+type EligibilityExplanation struct {
+	BookPostId   string               `json:"book_post_id"`
+	BorrowerUser string               `json:"borrower_user"`
+	Eligible     bool                 `json:"eligible"`
+	Verdicts     []EligibilityVerdict `json:"verdicts"`
+}
+
+//the points and lost copies are used up by the suspension they lead to
+type UserPenalty struct {
+	User       string `json:"user"`
+	Points     int    `json:"points"`
+	LostCopies int    `json:"lost_copies"`
+	//master key of an overdue loan -> the overdue days charged
+	Charged    map[string]int `json:"charged,omitempty"`
+	Suspension *Suspension    `json:"suspension,omitempty"`
+}
+
+type WebhookDelivery struct {
+	Id       string `json:"id"`
+	TargetId string `json:"target_id"`
+	URL      string `json:"url"`
+	Event    string `json:"event"`
+	//sent and signed as is
+	Payload string `json:"payload"`
+	//one of WEBHOOK_DELIVERY_*
+	Status         string `json:"status"`
+	Attempts       int    `json:"attempts"`
+	LastStatusCode int    `json:"last_status_code,omitempty"`
+	LastError      string `json:"last_error,omitempty"`
+	NextAttemptAt  int64  `json:"next_attempt_at,omitempty"`
+	CreateAt       int64  `json:"create_at"`
+	UpdateAt       int64  `json:"update_at"`
+}
+
+//user id -> role names
+type UserRolesMap map[string][]string
+
 type Config struct {
-	MaxRenewTimes int `json:"max_renew_times"`
-	ExpiredDays   int `json:"expire_days"`
+	LibraryId     string        `json:"library_id"`
+	BorrowLimit   int           `json:"borrow_limit"`
+	MaxRenewTimes int           `json:"max_renew_times"`
+	ExpiredDays   int           `json:"expire_days"`
+	Libraries     []LibraryInfo `json:"libraries"`
+}
+
+type LibraryInfo struct {
+	Id   string `json:"id"`
+	Name string `json:"name"`
 }
 
 const (
@@ -225,18 +910,30 @@ const (
 )
 
 type BooksMessage struct {
-	PostId  string `json:"post_id"`
-	Status  string `json:"status"`
-	Message string `json:"message"`
+	PostId   string            `json:"post_id"`
+	Status   string            `json:"status"`
+	Message  string            `json:"message"`
+	Enriched map[string]string `json:"enriched,omitempty"`
+	//dry run only
+	Action string      `json:"action,omitempty"`
+	Diffs  []FieldDiff `json:"diffs,omitempty"`
 }
 
 type Messages map[string]string
 
 type Result struct {
-	Error    string   `json:"error"`
-	Messages Messages `json:"messages,omitempty"`
+	Error string `json:"error"`
+	//stable code of the error, see ErrorCodeOf
+	Code     string       `json:"code,omitempty"`
+	Details  ErrorDetails `json:"details,omitempty"`
+	Messages Messages     `json:"messages,omitempty"`
+	//the rules which only warned, a borrow is let through with them
+	Warnings []EligibilityVerdict `json:"warnings,omitempty"`
 }
 
+//e.g. current stock, the limit that was hit or the current etag
+type ErrorDetails map[string]interface{}
+
 var (
 	ErrBorrowingLimited  = errors.New("borrowing-book-limited")
 	ErrLocked            = errors.New("record-locked")
@@ -245,4 +942,39 @@ var (
 	ErrRenewLimited      = errors.New("renew-limited")
 	ErrChooseInStockCopy = errors.New("choose-in-stock")
 	ErrStale             = errors.New("stale-update")
+	ErrInvalidIsbn       = errors.New("invalid-isbn")
+	ErrDuplicateBook     = errors.New("duplicate-book")
+	ErrInvalidCopyKeeper = errors.New("invalid-copy-keeper")
+	ErrNotPermitted      = errors.New("not-permitted")
+	ErrInvalidRole       = errors.New("invalid-role")
+	ErrInvalidRequest    = errors.New("invalid-request")
+	ErrRuleViolation     = errors.New("rule-violation")
+	ErrSuspended         = errors.New("borrowing-suspended")
+	ErrCategoryLimited   = errors.New("category-limited")
+	ErrDuplicateBorrow   = errors.New("duplicate-borrow")
+)
+
+const (
+	ERROR_CODE_INTERNAL = "internal-error"
+)
+
+const (
+	DEFAULT_LIBRARY_ID = "default"
+	//query parameter of the library a request works on
+	LIBRARY_PARAM = "library"
+)
+
+//keys of ErrorDetails
+const (
+	ERROR_DETAIL_ETAG      = "etag"
+	ERROR_DETAIL_STOCK     = "stock"
+	ERROR_DETAIL_LIMIT     = "limit"
+	ERROR_DETAIL_BORROWING = "borrowing"
+	ERROR_DETAIL_RENEWED   = "renewed"
+	ERROR_DETAIL_COPY_ID   = "copy_id"
+	ERROR_DETAIL_STATUS    = "status"
+	ERROR_DETAIL_UNTIL     = "until"
+	ERROR_DETAIL_REASON    = "reason"
+	ERROR_DETAIL_CATEGORY  = "category"
+	ERROR_DETAIL_MASTER    = "master_key"
 )
@@ -0,0 +1,198 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+
+	"github.com/pkg/errors"
+)
+
+func (p *Plugin) _patchBooks(patchesJson string) (Messages, error) {
+
+	var (
+		patches []*BookPatch
+		retErr  error
+	)
+
+	messages := Messages{}
+
+	if err := json.Unmarshal([]byte(patchesJson), &patches); err != nil {
+		return nil, errors.Wrapf(err, "convert to patches error.")
+	}
+
+	for _, patch := range patches {
+		bookmsg, err := p._patchABook(patch)
+		if err != nil {
+			retErr = errors.Wrapf(err, "some error was occurred in patches.")
+		}
+		mj, _ := json.Marshal(bookmsg)
+		messages[patch.Post_id] = string(mj)
+	}
+
+	return messages, retErr
+}
+
+func (p *Plugin) _patchABook(patch *BookPatch) (*BooksMessage, error) {
+	if err := p._applyBookPatch(patch); err != nil {
+		return &BooksMessage{
+			PostId:  patch.Post_id,
+			Status:  BOOK_UPLOAD_ERROR,
+			Message: err.Error(),
+		}, err
+	}
+
+	return &BooksMessage{
+		PostId:  patch.Post_id,
+		Status:  BOOK_UPLOAD_SUCC,
+		Message: "Successfully patched.",
+	}, nil
+}
+
+// Merge the patch into the current parts and update them as an upload would do.
+// The current parts are read under the lock, so nothing between is lost.
+func (p *Plugin) _applyBookPatch(patch *BookPatch) error {
+
+	pubId := patch.Post_id
+	if pubId == "" {
+		return KindError(ErrInvalidRequest, "post id is required.")
+	}
+	if patch.Etag == "" {
+		return KindError(ErrInvalidRequest, "etag is required.")
+	}
+
+	if _, ok := lockmap.LoadOrStore(pubId, struct{}{}); ok {
+		return errors.Wrapf(ErrLocked, "lock error")
+	}
+
+	defer lockmap.Delete(pubId)
+
+	bookPubOld := &BookPublic{}
+	if _, err := p._getUnmarshaledPost(pubId, bookPubOld); err != nil {
+		return errors.Wrapf(err, "get pub error.")
+	}
+
+	if bookPubOld.MatchId != patch.Etag {
+		return WithDetails(errors.Wrapf(ErrStale, "patch stale"),
+			ErrorDetails{ERROR_DETAIL_ETAG: bookPubOld.MatchId})
+	}
+
+	book := &Book{
+		BookPublic: &BookPublic{},
+		Upload: &Upload{
+			Post_id: pubId,
+			Etag:    patch.Etag,
+		},
+	}
+
+	if err := _mergeBookPart(bookPubOld, patch.Public, book.BookPublic); err != nil {
+		return errors.Wrapf(err, "patch pub error.")
+	}
+
+	//same as an upload, the flag is only changed if it is asked for
+	if len(patch.Public) != 0 {
+		var fields map[string]json.RawMessage
+		if err := json.Unmarshal(patch.Public, &fields); err == nil {
+			_, book.Upload.UpdIsAllowedToBorrow = fields["isAllowedToBorrow"]
+		}
+	}
+
+	if len(patch.Private) != 0 {
+		bookPriOld := &BookPrivate{}
+		if _, err := p._getUnmarshaledPost(bookPubOld.Relations[REL_BOOK_PRIVATE], bookPriOld); err != nil {
+			return errors.Wrapf(err, "get pri error.")
+		}
+		book.BookPrivate = &BookPrivate{}
+		if err := _mergeBookPart(bookPriOld, patch.Private, book.BookPrivate); err != nil {
+			return errors.Wrapf(err, "patch pri error.")
+		}
+	}
+
+	if len(patch.Inventory) != 0 {
+		bookInvOld := &BookInventory{}
+		if _, err := p._getUnmarshaledPost(bookPubOld.Relations[REL_BOOK_INVENTORY], bookInvOld); err != nil {
+			return errors.Wrapf(err, "get inv error.")
+		}
+		//an uploaded stock is the total of copies, present the old one the same way,
+		//so that a patch without stock keeps it.
+		bookInvOld.Stock = bookInvOld.Stock + bookInvOld.TransmitOut + bookInvOld.Lending + bookInvOld.TransmitIn + bookInvOld.InTransit
+		book.BookInventory = &BookInventory{}
+		if err := _mergeBookPart(bookInvOld, patch.Inventory, book.BookInventory); err != nil {
+			return errors.Wrapf(err, "patch inv error.")
+		}
+	}
+
+	plan, err := p._planUpdateABook(book)
+	if err != nil {
+		return err
+	}
+
+	if err := p._updateBookParts(plan.opts); err != nil {
+		return errors.Wrapf(err, "update posts error.")
+	}
+	p._grantKeeperRoleOf(plan.opts.pri)
+
+	p._emitBookEvent(WEBHOOK_EVENT_BOOK_UPDATED, pubId, nil)
+	return nil
+}
+
+// Apply a merge patch to the old part and decode the result into the new part.
+// Unknown fields are refused, a misspelled field would be silently lost otherwise.
+func _mergeBookPart(old interface{}, patch json.RawMessage, new interface{}) error {
+
+	oldJson, err := json.Marshal(old)
+	if err != nil {
+		return errors.Wrapf(err, "marshal error.")
+	}
+
+	var doc interface{}
+	if err := json.Unmarshal(oldJson, &doc); err != nil {
+		return errors.Wrapf(err, "unmarshal error.")
+	}
+
+	if len(patch) != 0 {
+		var patchDoc interface{}
+		if err := json.Unmarshal(patch, &patchDoc); err != nil {
+			return errors.Wrapf(err, "unmarshal patch error.")
+		}
+		if _, ok := patchDoc.(map[string]interface{}); !ok {
+			return KindError(ErrInvalidRequest, "patch should be an object.")
+		}
+		doc = _mergePatch(doc, patchDoc)
+	}
+
+	newJson, err := json.Marshal(doc)
+	if err != nil {
+		return errors.Wrapf(err, "marshal error.")
+	}
+
+	decoder := json.NewDecoder(bytes.NewReader(newJson))
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(new); err != nil {
+		return errors.Wrapf(err, "decode patched part error.")
+	}
+
+	return nil
+}
+
+// JSON merge patch, RFC 7386
+func _mergePatch(target interface{}, patch interface{}) interface{} {
+	patchMap, ok := patch.(map[string]interface{})
+	if !ok {
+		return patch
+	}
+
+	targetMap, ok := target.(map[string]interface{})
+	if !ok {
+		targetMap = map[string]interface{}{}
+	}
+
+	for key, value := range patchMap {
+		if value == nil {
+			delete(targetMap, key)
+			continue
+		}
+		targetMap[key] = _mergePatch(targetMap[key], value)
+	}
+
+	return targetMap
+}
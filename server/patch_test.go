@@ -0,0 +1,133 @@
+package main
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/mattermost/mattermost-server/v5/model"
+	"github.com/mattermost/mattermost-server/v5/plugin/plugintest"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPatch(t *testing.T) {
+
+	t.Run("merge_patch", func(t *testing.T) {
+		var target, patch interface{}
+		json.Unmarshal([]byte(`{"a":"b","c":{"d":"e","f":"g"},"h":[1]}`), &target)
+		json.Unmarshal([]byte(`{"a":"z","c":{"f":null},"h":{"i":1}}`), &patch)
+		merged, _ := json.Marshal(_mergePatch(target, patch))
+		assert.JSONEq(t, `{"a":"z","c":{"d":"e"},"h":{"i":1}}`, string(merged))
+	})
+
+	setup := func() (*TestData, *Plugin, *plugintest.API) {
+		td := NewTestData()
+		plugin := td.NewMockPlugin()
+		api := td.ApiMockCommon()
+		plugin.SetAPI(api)
+		api.On("SearchPostsInTeam", plugin.team.Id, mock.AnythingOfType("[]*model.SearchParams")).
+			Return([]*model.Post{}, nil)
+		return td, plugin, api
+	}
+
+	t.Run("patch_public", func(t *testing.T) {
+		td, plugin, api := setup()
+
+		msg, err := plugin._patchABook(&BookPatch{
+			Post_id: td.BookPostIdPub,
+			Etag:    td.ABookPub.MatchId,
+			Public:  json.RawMessage(`{"name_pub":"a patched book"}`),
+		})
+		require.Nil(t, err)
+		assert.Equal(t, BOOK_UPLOAD_SUCC, msg.Status)
+		assert.Equal(t, "a patched book", td.ABookPub.Name)
+		assert.Equal(t, "zzh", td.ABookPub.Author)
+		assert.Equal(t, "pub1", td.ABookPub.Publisher)
+		assert.Equal(t, true, td.ABookPub.IsAllowedToBorrow)
+		assert.Contains(t, td.ABookPub.Tags, TAG_PREFIX_ID+"zzh-book-001")
+		api.AssertNotCalled(t, "UpdatePost", mock.MatchedBy(func(post *model.Post) bool {
+			return post.Id == td.BookPostIdInv
+		}))
+	})
+
+	t.Run("patch_inventory_keeps_lending", func(t *testing.T) {
+		td, plugin, _ := setup()
+		td.ABookInv.Stock = 2
+		td.ABookInv.Lending = 1
+		td.ABookInv.Copies["zzh-book-001 b2"] = BookCopy{Status: COPY_STATUS_LENDING}
+
+		_, err := plugin._patchABook(&BookPatch{
+			Post_id:   td.BookPostIdPub,
+			Etag:      td.ABookPub.MatchId,
+			Inventory: json.RawMessage(`{"stock":4,"copies":{"zzh-book-001 b4":{"status":"in_stock"}}}`),
+		})
+		require.Nil(t, err)
+		assert.Equal(t, 3, td.ABookInv.Stock)
+		assert.Equal(t, 1, td.ABookInv.Lending)
+		assert.Equal(t, COPY_STATUS_LENDING, td.ABookInv.Copies["zzh-book-001 b2"].Status)
+		assert.Equal(t, COPY_STATUS_INSTOCK, td.ABookInv.Copies["zzh-book-001 b4"].Status)
+	})
+
+	t.Run("patch_delete_lent_copy", func(t *testing.T) {
+		td, plugin, _ := setup()
+		td.ABookInv.Stock = 2
+		td.ABookInv.Lending = 1
+		td.ABookInv.Copies["zzh-book-001 b2"] = BookCopy{Status: COPY_STATUS_LENDING}
+
+		msg, err := plugin._patchABook(&BookPatch{
+			Post_id:   td.BookPostIdPub,
+			Etag:      td.ABookPub.MatchId,
+			Inventory: json.RawMessage(`{"stock":2,"copies":{"zzh-book-001 b2":null}}`),
+		})
+		assert.NotNil(t, err)
+		assert.Equal(t, BOOK_UPLOAD_ERROR, msg.Status)
+		assert.Contains(t, msg.Message, "cannot delete copy")
+	})
+
+	t.Run("patch_copy_keeper_not_in_keepers", func(t *testing.T) {
+		td, plugin, _ := setup()
+
+		_, err := plugin._patchABook(&BookPatch{
+			Post_id: td.BookPostIdPub,
+			Etag:    td.ABookPub.MatchId,
+			Private: json.RawMessage(`{"copy_keeper_map":{"zzh-book-001 b1":{"user":"worker1"}}}`),
+		})
+		assert.ErrorIs(t, err, ErrInvalidCopyKeeper)
+		assert.Equal(t, Keeper{User: "kpuser1"}, td.ABookPri.CopyKeeperMap["zzh-book-001 b1"])
+	})
+
+	t.Run("patch_stale", func(t *testing.T) {
+		td, plugin, _ := setup()
+
+		_, err := plugin._patchABook(&BookPatch{
+			Post_id: td.BookPostIdPub,
+			Etag:    model.NewId(),
+			Public:  json.RawMessage(`{"name_pub":"a patched book"}`),
+		})
+		assert.ErrorIs(t, err, ErrStale)
+		assert.Equal(t, "a test book", td.ABookPub.Name)
+	})
+
+	t.Run("patch_without_etag", func(t *testing.T) {
+		td, plugin, _ := setup()
+
+		_, err := plugin._patchABook(&BookPatch{
+			Post_id: td.BookPostIdPub,
+			Public:  json.RawMessage(`{"name_pub":"a patched book"}`),
+		})
+		assert.NotNil(t, err)
+	})
+
+	t.Run("patch_unknown_field", func(t *testing.T) {
+		td, plugin, _ := setup()
+
+		_, err := plugin._patchABook(&BookPatch{
+			Post_id: td.BookPostIdPub,
+			Etag:    td.ABookPub.MatchId,
+			Public:  json.RawMessage(`{"nmae_pub":"a patched book"}`),
+		})
+		assert.NotNil(t, err)
+		assert.Equal(t, "a test book", td.ABookPub.Name)
+	})
+}
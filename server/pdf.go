@@ -0,0 +1,199 @@
+package main
+
+import (
+	"bytes"
+	"compress/zlib"
+	"fmt"
+	"strings"
+	"unicode/utf16"
+)
+
+// A minimal PDF writer for the label sheets, of rectangles and text only.
+// Latin text is in Helvetica, other text in STSong-Light which readers provide,
+// so no font is embedded.
+type pdfDocument struct {
+	width  float64
+	height float64
+	pages  []*pdfPage
+}
+
+type pdfPage struct {
+	content bytes.Buffer
+}
+
+const (
+	pdfFontLatin = "F1"
+	pdfFontCJK   = "F2"
+)
+
+func _newPDFDocument(width float64, height float64) *pdfDocument {
+	return &pdfDocument{width: width, height: height}
+}
+
+func (d *pdfDocument) addPage() *pdfPage {
+	page := &pdfPage{}
+	d.pages = append(d.pages, page)
+	return page
+}
+
+// The origin is at the bottom left.
+func (pg *pdfPage) fillRect(x float64, y float64, w float64, h float64) {
+	fmt.Fprintf(&pg.content, "%s %s %s %s re f\n", _pdfNum(x), _pdfNum(y), _pdfNum(w), _pdfNum(h))
+}
+
+func (pg *pdfPage) strokeRect(x float64, y float64, w float64, h float64, gray float64) {
+	fmt.Fprintf(&pg.content, "q %s G 0.5 w %s %s %s %s re S Q\n",
+		_pdfNum(gray), _pdfNum(x), _pdfNum(y), _pdfNum(w), _pdfNum(h))
+}
+
+// y is the baseline.
+func (pg *pdfPage) text(x float64, y float64, size float64, text string) {
+	font, encoded := pdfFontLatin, _pdfLatinString(text)
+	if !_isASCII(text) {
+		font, encoded = pdfFontCJK, _pdfCJKString(text)
+	}
+	fmt.Fprintf(&pg.content, "BT /%s %s Tf %s %s Td %s Tj ET\n",
+		font, _pdfNum(size), _pdfNum(x), _pdfNum(y), encoded)
+}
+
+// Estimated for the fonts above: half an em for Latin, an em for others.
+func _pdfTextWidth(text string, size float64) float64 {
+	width := 0.0
+	for _, r := range text {
+		if r < 0x80 {
+			width += size * 0.55
+		} else {
+			width += size
+		}
+	}
+	return width
+}
+
+// Cut at the width with an ellipsis.
+func _pdfFitText(text string, size float64, width float64) string {
+	if _pdfTextWidth(text, size) <= width {
+		return text
+	}
+	runes := []rune(text)
+	for len(runes) > 0 && _pdfTextWidth(string(runes)+"...", size) > width {
+		runes = runes[:len(runes)-1]
+	}
+	return string(runes) + "..."
+}
+
+// Broken at any character, the last line is cut.
+func _pdfWrapText(text string, size float64, width float64, maxLines int) []string {
+	var lines []string
+	runes := []rune(text)
+	for len(runes) > 0 && len(lines) < maxLines-1 {
+		n := 1
+		for n < len(runes) && _pdfTextWidth(string(runes[:n+1]), size) <= width {
+			n++
+		}
+		if n == len(runes) {
+			break
+		}
+		lines = append(lines, string(runes[:n]))
+		runes = runes[n:]
+	}
+	if len(runes) > 0 {
+		lines = append(lines, _pdfFitText(string(runes), size, width))
+	}
+	return lines
+}
+
+func (d *pdfDocument) bytes() ([]byte, error) {
+	var objects []string
+	add := func(obj string) int {
+		objects = append(objects, obj)
+		return len(objects)
+	}
+
+	catalog := add("")
+	pages := add("")
+	latin := add("<< /Type /Font /Subtype /Type1 /BaseFont /Helvetica /Encoding /WinAnsiEncoding >>")
+	descriptor := add("<< /Type /FontDescriptor /FontName /STSong-Light /Flags 6 /FontBBox [-25 -254 1000 880]" +
+		" /ItalicAngle 0 /Ascent 880 /Descent -120 /CapHeight 880 /StemV 93 >>")
+	cidFont := add(fmt.Sprintf("<< /Type /Font /Subtype /CIDFontType0 /BaseFont /STSong-Light"+
+		" /CIDSystemInfo << /Registry (Adobe) /Ordering (GB1) /Supplement 2 >>"+
+		" /FontDescriptor %d 0 R /DW 1000 /W [1 95 500 814 939 500] >>", descriptor))
+	cjk := add(fmt.Sprintf("<< /Type /Font /Subtype /Type0 /BaseFont /STSong-Light /Encoding /UniGB-UCS2-H"+
+		" /DescendantFonts [%d 0 R] >>", cidFont))
+
+	var kids []string
+	for _, page := range d.pages {
+		var compressed bytes.Buffer
+		zw := zlib.NewWriter(&compressed)
+		if _, err := zw.Write(page.content.Bytes()); err != nil {
+			return nil, err
+		}
+		if err := zw.Close(); err != nil {
+			return nil, err
+		}
+
+		content := add(fmt.Sprintf("<< /Length %d /Filter /FlateDecode >>\nstream\n%s\nendstream",
+			compressed.Len(), compressed.String()))
+		kid := add(fmt.Sprintf("<< /Type /Page /Parent %d 0 R /Contents %d 0 R"+
+			" /Resources << /Font << /%s %d 0 R /%s %d 0 R >> >> >>",
+			pages, content, pdfFontLatin, latin, pdfFontCJK, cjk))
+		kids = append(kids, fmt.Sprintf("%d 0 R", kid))
+	}
+
+	objects[catalog-1] = fmt.Sprintf("<< /Type /Catalog /Pages %d 0 R >>", pages)
+	objects[pages-1] = fmt.Sprintf("<< /Type /Pages /Kids [%s] /Count %d /MediaBox [0 0 %s %s] >>",
+		strings.Join(kids, " "), len(kids), _pdfNum(d.width), _pdfNum(d.height))
+
+	var buf bytes.Buffer
+	buf.WriteString("%PDF-1.4\n%\xe2\xe3\xcf\xd3\n")
+	offsets := make([]int, len(objects))
+	for i, obj := range objects {
+		offsets[i] = buf.Len()
+		fmt.Fprintf(&buf, "%d 0 obj\n%s\nendobj\n", i+1, obj)
+	}
+
+	xref := buf.Len()
+	fmt.Fprintf(&buf, "xref\n0 %d\n0000000000 65535 f \n", len(objects)+1)
+	for _, offset := range offsets {
+		fmt.Fprintf(&buf, "%010d 00000 n \n", offset)
+	}
+	fmt.Fprintf(&buf, "trailer\n<< /Size %d /Root %d 0 R >>\nstartxref\n%d\n%%%%EOF\n", len(objects)+1, catalog, xref)
+
+	return buf.Bytes(), nil
+}
+
+func _pdfNum(v float64) string {
+	s := strings.TrimRight(strings.TrimRight(fmt.Sprintf("%.2f", v), "0"), ".")
+	if s == "-0" {
+		return "0"
+	}
+	return s
+}
+
+func _pdfLatinString(text string) string {
+	return "(" + strings.NewReplacer(`\`, `\\`, "(", `\(`, ")", `\)`).Replace(text) + ")"
+}
+
+// UCS-2 in hex, the characters out of the BMP are not in the font.
+func _pdfCJKString(text string) string {
+	var sb strings.Builder
+	sb.WriteString("<")
+	for _, r := range text {
+		if r > 0xFFFF {
+			r = '?'
+		}
+		for _, u := range utf16.Encode([]rune{r}) {
+			fmt.Fprintf(&sb, "%04X", u)
+		}
+	}
+	sb.WriteString(">")
+	return sb.String()
+}
+
+func _isASCII(text string) bool {
+	for _, r := range text {
+		if r >= 0x80 {
+			return false
+		}
+	}
+	return true
+}
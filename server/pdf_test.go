@@ -0,0 +1,75 @@
+package main
+
+import (
+	"bytes"
+	"compress/zlib"
+	"fmt"
+	"io/ioutil"
+	"regexp"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// The decompressed content streams, after checking the cross-reference table.
+func _readTestPDF(t *testing.T, data []byte) []string {
+	require.True(t, bytes.HasPrefix(data, []byte("%PDF-1.4\n")))
+	require.True(t, bytes.HasSuffix(data, []byte("%%EOF\n")))
+
+	m := regexp.MustCompile(`startxref\n(\d+)\n`).FindSubmatch(data)
+	require.NotNil(t, m)
+	xref, _ := strconv.Atoi(string(m[1]))
+	require.True(t, bytes.HasPrefix(data[xref:], []byte("xref\n0 ")))
+	entries := regexp.MustCompile(`(\d{10}) 00000 n `).FindAllSubmatch(data[xref:], -1)
+	for i, entry := range entries {
+		offset, _ := strconv.Atoi(string(entry[1]))
+		assert.True(t, bytes.HasPrefix(data[offset:], []byte(fmt.Sprintf("%d 0 obj\n", i+1))), "object %v", i+1)
+	}
+
+	var contents []string
+	for _, s := range regexp.MustCompile(`(?s)/Length (\d+) /Filter /FlateDecode >>\nstream\n`).FindAllSubmatchIndex(data, -1) {
+		length, _ := strconv.Atoi(string(data[s[2]:s[3]]))
+		zr, err := zlib.NewReader(bytes.NewReader(data[s[1] : s[1]+length]))
+		require.Nil(t, err)
+		content, err := ioutil.ReadAll(zr)
+		require.Nil(t, err)
+		contents = append(contents, string(content))
+	}
+	return contents
+}
+
+func TestPDF(t *testing.T) {
+
+	t.Run("document", func(t *testing.T) {
+		doc := _newPDFDocument(595.28, 841.89)
+		page := doc.addPage()
+		page.fillRect(10, 20.5, 1.25, 0)
+		page.text(10, 800, 8, `a (b) \c`)
+		doc.addPage().text(10, 800, 9, "一本书 b1")
+
+		data, err := doc.bytes()
+		require.Nil(t, err)
+		assert.Contains(t, string(data), "/Count 2 /MediaBox [0 0 595.28 841.89]")
+		assert.Contains(t, string(data), "/BaseFont /STSong-Light /Encoding /UniGB-UCS2-H")
+
+		contents := _readTestPDF(t, data)
+		require.Equal(t, 2, len(contents))
+		assert.Equal(t, "10 20.5 1.25 0 re f\nBT /F1 8 Tf 10 800 Td (a \\(b\\) \\\\c) Tj ET\n", contents[0])
+		assert.Equal(t, "BT /F2 9 Tf 10 800 Td <4E00672C4E66002000620031> Tj ET\n", contents[1])
+	})
+
+	t.Run("text", func(t *testing.T) {
+		assert.Equal(t, "short", _pdfFitText("short", 8, 100))
+		fitted := _pdfFitText(strings.Repeat("书", 20), 10, 50)
+		assert.Equal(t, "书书书...", fitted)
+		assert.LessOrEqual(t, _pdfTextWidth(fitted, 10), 50.0)
+
+		assert.Equal(t, []string{"书书书书书", "书书书书书", "书书书..."}, _pdfWrapText(strings.Repeat("书", 20), 10, 50, 3))
+		assert.Equal(t, []string{"书书书书书", "书书"}, _pdfWrapText(strings.Repeat("书", 7), 10, 50, 3))
+		assert.Equal(t, []string{"a book"}, _pdfWrapText("a book", 10, 50, 3))
+		assert.Empty(t, _pdfWrapText("", 10, 50, 3))
+	})
+}
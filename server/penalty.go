@@ -0,0 +1,290 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// the statuses of a loan that may be overdue
+var overdueStatuses = []string{
+	STATUS_DELIVIED,
+	STATUS_RENEW_REQUESTED,
+	STATUS_RENEW_CONFIRMED,
+	STATUS_RETURN_REQUESTED,
+}
+
+func _validatePenaltyPolicy(policy PenaltyPolicy) error {
+	if policy.PointsPerOverdueDay < 0 || policy.SuspendAtPoints < 0 ||
+		policy.SuspendAtLostCopies < 0 || policy.SuspensionDays < 0 {
+		return errors.New("penalty settings can not be negative")
+	}
+	if (policy.SuspendAtPoints > 0 || policy.SuspendAtLostCopies > 0) && policy.SuspensionDays == 0 {
+		return errors.New("suspension days are required to suspend borrowers")
+	}
+	return nil
+}
+
+func (p *Plugin) _penaltiesKey() string {
+	return PENALTIES_KV_KEY_PREFIX + p.library.id
+}
+
+func (p *Plugin) _loadPenalties() (map[string]*UserPenalty, error) {
+	data, appErr := p.API.KVGet(p._penaltiesKey())
+	if appErr != nil {
+		return nil, errors.Wrapf(appErr, "get penalties error.")
+	}
+
+	penalties := map[string]*UserPenalty{}
+	if data == nil {
+		return penalties, nil
+	}
+	if err := json.Unmarshal(data, &penalties); err != nil {
+		return nil, errors.Wrapf(err, "convert penalties error.")
+	}
+	return penalties, nil
+}
+
+func _penaltyOf(penalties map[string]*UserPenalty, user string) *UserPenalty {
+	pen, ok := penalties[user]
+	if !ok {
+		pen = &UserPenalty{User: user}
+		penalties[user] = pen
+	}
+	return pen
+}
+
+func _isSuspended(pen *UserPenalty, now time.Time) bool {
+	return pen != nil && pen.Suspension != nil && pen.Suspension.Until > _millisOf(now)
+}
+
+// Whole days past the due date.
+func (p *Plugin) _overdueDays(br *BorrowRequest, now time.Time) int {
+	due, ok := p._loanDueDate(br)
+	if !ok || !now.After(due) {
+		return 0
+	}
+	return int(now.Sub(due) / (24 * time.Hour))
+}
+
+// A suspension uses up the points or lost copies leading to it,
+// nothing more happens to a suspended borrower until the suspension ends.
+func (p *Plugin) _suspendIfDue(pen *UserPenalty, now time.Time) {
+	if _isSuspended(pen, now) {
+		return
+	}
+
+	policy := p.penalty
+	var reason string
+	switch {
+	case policy.SuspendAtLostCopies > 0 && pen.LostCopies >= policy.SuspendAtLostCopies:
+		reason = SUSPENSION_REASON_LOST
+		pen.LostCopies -= policy.SuspendAtLostCopies
+	case policy.SuspendAtPoints > 0 && pen.Points >= policy.SuspendAtPoints:
+		reason = SUSPENSION_REASON_OVERDUE
+		pen.Points -= policy.SuspendAtPoints
+	default:
+		return
+	}
+
+	pen.Suspension = &Suspension{
+		Reason:   reason,
+		CreateAt: _millisOf(now),
+		Until:    _millisOf(now.AddDate(0, 0, policy.SuspensionDays)),
+	}
+}
+
+func (p *Plugin) _chargeOverduePenalties(now time.Time) error {
+	for _, id := range p.libraryIds {
+		lp, err := p._withLibrary(id)
+		if err != nil {
+			return err
+		}
+		if err := lp._chargeOverdueLoans(now); err != nil {
+			return errors.Wrapf(err, "charge overdue loans of library %v error.", id)
+		}
+	}
+	return nil
+}
+
+// Every overdue day of a loan is charged once, however often it runs.
+// A loan to be returned is not charged any more, the copy is on its way back.
+func (p *Plugin) _chargeOverdueLoans(now time.Time) error {
+	if p.penalty.PointsPerOverdueDay <= 0 {
+		return nil
+	}
+
+	loans := map[string]*BorrowRequest{}
+	for _, status := range overdueStatuses {
+		found, err := p._activeLoans(TAG_PREFIX_STATUS+status, func(*BorrowRequest) bool { return true })
+		if err != nil {
+			return err
+		}
+		for key, br := range found {
+			loans[key] = br
+		}
+	}
+
+	var penalties map[string]*UserPenalty
+	return p._compareAndUpdateKV(p._penaltiesKey(), &penalties, func() error {
+		if penalties == nil {
+			penalties = map[string]*UserPenalty{}
+		}
+
+		for key, br := range loans {
+			if br.Worflow[br.StepIndex].Status == STATUS_RETURN_REQUESTED {
+				continue
+			}
+			days := p._overdueDays(br, now)
+			pen := penalties[br.BorrowerUser]
+			if days <= 0 || (pen != nil && days <= pen.Charged[key]) {
+				continue
+			}
+
+			pen = _penaltyOf(penalties, br.BorrowerUser)
+			if pen.Charged == nil {
+				pen.Charged = map[string]int{}
+			}
+			pen.Points += (days - pen.Charged[key]) * p.penalty.PointsPerOverdueDay
+			pen.Charged[key] = days
+		}
+
+		for user, pen := range penalties {
+			//returned loans are forgotten
+			for key := range pen.Charged {
+				if _, ok := loans[key]; !ok {
+					delete(pen.Charged, key)
+				}
+			}
+			if pen.Suspension != nil && !_isSuspended(pen, now) {
+				pen.Suspension = nil
+			}
+			p._suspendIfDue(pen, now)
+
+			if pen.Points == 0 && pen.LostCopies == 0 && len(pen.Charged) == 0 && pen.Suspension == nil {
+				delete(penalties, user)
+			}
+		}
+		return nil
+	})
+}
+
+// Refuses a suspended borrower, telling until when and why.
+func (p *Plugin) _checkSuspension(user string, now time.Time) error {
+	penalties, err := p._loadPenalties()
+	if err != nil {
+		return err
+	}
+
+	pen := penalties[user]
+	if !_isSuspended(pen, now) {
+		return nil
+	}
+
+	s := pen.Suspension
+	return WithDetails(KindError(ErrSuspended, "%v %v (%v)",
+		p.i18n.GetText(ErrSuspended.Error()),
+		_timeOfMillis(s.Until).Format("2006-01-02 15:04"),
+		p._suspensionReasonText(s.Reason)),
+		ErrorDetails{ERROR_DETAIL_UNTIL: s.Until, ERROR_DETAIL_REASON: s.Reason})
+}
+
+func (p *Plugin) _suspensionReasonText(reason string) string {
+	if text := p.i18n.GetText("suspension-reason-" + reason); text != "" {
+		return text
+	}
+	return reason
+}
+
+// Library admins only, expired suspensions are left out.
+func (p *Plugin) _listPenalties(userId string) ([]UserPenalty, error) {
+	if err := p._checkRole(userId, ROLE_LIBRARY_ADMIN); err != nil {
+		return nil, err
+	}
+
+	penalties, err := p._loadPenalties()
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+	list := []UserPenalty{}
+	for _, pen := range penalties {
+		if !_isSuspended(pen, now) {
+			pen.Suspension = nil
+		}
+		list = append(list, *pen)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].User < list[j].User })
+	return list, nil
+}
+
+// A copy lent to the user is lost, the user may be suspended for it.
+func (p *Plugin) _recordLostCopy(userId string, user string) (*UserPenalty, error) {
+	if err := p._checkRole(userId, ROLE_LIBRARY_ADMIN); err != nil {
+		return nil, err
+	}
+
+	user = strings.TrimPrefix(user, "@")
+	if _, appErr := p.API.GetUserByUsername(user); appErr != nil {
+		return nil, errors.Wrapf(ErrNotFound, "user %v: %v", user, appErr.Error())
+	}
+
+	now := time.Now()
+	var penalties map[string]*UserPenalty
+	var result UserPenalty
+	if err := p._compareAndUpdateKV(p._penaltiesKey(), &penalties, func() error {
+		if penalties == nil {
+			penalties = map[string]*UserPenalty{}
+		}
+		pen := _penaltyOf(penalties, user)
+		pen.LostCopies++
+		p._suspendIfDue(pen, now)
+		result = *pen
+		return nil
+	}); err != nil {
+		return nil, err
+	}
+	return &result, nil
+}
+
+// The points and lost copies are kept, they may lead to the next suspension.
+func (p *Plugin) _liftSuspension(userId string, user string) error {
+	if err := p._checkRole(userId, ROLE_LIBRARY_ADMIN); err != nil {
+		return err
+	}
+
+	user = strings.TrimPrefix(user, "@")
+	now := time.Now()
+	var penalties map[string]*UserPenalty
+	return p._compareAndUpdateKV(p._penaltiesKey(), &penalties, func() error {
+		pen := penalties[user]
+		if !_isSuspended(pen, now) {
+			return errors.Wrapf(ErrNotFound, "user %v is not suspended", user)
+		}
+		pen.Suspension = nil
+		return nil
+	})
+}
+
+func (p *Plugin) _formatPenalties(penalties []UserPenalty) string {
+	if len(penalties) == 0 {
+		return "No penalties."
+	}
+
+	lines := []string{"| User | Points | Lost copies | Suspended until | Reason |", "|:--|--:|--:|:--|:--|"}
+	for _, pen := range penalties {
+		until, reason := "", ""
+		if pen.Suspension != nil {
+			until = _timeOfMillis(pen.Suspension.Until).Format("2006-01-02 15:04")
+			reason = pen.Suspension.Reason
+		}
+		lines = append(lines, fmt.Sprintf("| @%v | %v | %v | %v | %v |",
+			pen.User, pen.Points, pen.LostCopies, until, reason))
+	}
+	return strings.Join(lines, "\n")
+}
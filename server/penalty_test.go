@@ -0,0 +1,227 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/mattermost/mattermost-server/v5/model"
+	"github.com/mattermost/mattermost-server/v5/plugin/plugintest"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPenalty(t *testing.T) {
+
+	delivered := time.Date(2021, 3, 1, 10, 0, 0, 0, time.Local)
+	due := delivered.AddDate(0, 0, 30)
+
+	type penaltyEnv struct {
+		td     *TestData
+		api    *plugintest.API
+		plugin *Plugin
+		repo   *memRepository
+	}
+
+	setup := func(t *testing.T, policy PenaltyPolicy) *penaltyEnv {
+		td := NewTestData()
+		api := td.ApiMockCommon()
+		api.On("CreatePost", mock.Anything).Return(&model.Post{}, nil)
+		api.On("GetUserByUsername", "nobody").Return(nil,
+			model.NewAppError("GetUserByUsername", "app.user.missing_account.const", nil, "", http.StatusNotFound))
+		plugin := td.NewMockPlugin()
+		plugin.SetAPI(api)
+		repo := newMemRepository()
+		plugin.repo = repo
+		plugin.penalty = policy
+		return &penaltyEnv{td, api, plugin, repo}
+	}
+
+	createLoan := func(t *testing.T, env *penaltyEnv, borrower string, status string) string {
+		wf := env.plugin._createWFTemplate(GetNowTime())
+		wf[_getIndexByStatus(STATUS_DELIVIED, wf)].ActionDate = _millisOf(delivered)
+		br := &BorrowRequest{
+			BookName:     "a book",
+			BorrowerUser: borrower,
+			ChosenCopyId: "a book b1",
+			Worflow:      wf,
+			StepIndex:    _getIndexByStatus(status, wf),
+			Tags: []string{
+				TAG_PREFIX_BORROWER + borrower,
+				TAG_PREFIX_STATUS + status,
+			},
+		}
+		data, _ := _marshalRecord(&Borrow{DataOrImage: br, Role: []string{MASTER}})
+		post, err := env.repo.Create(&model.Post{
+			ChannelId: env.plugin.borrowChannel.Id,
+			Type:      "custom_borrow_type",
+			Message:   string(data),
+		})
+		require.Nil(t, err)
+		return post.Id
+	}
+
+	t.Run("policy", func(t *testing.T) {
+		assert.Nil(t, _validatePenaltyPolicy(PenaltyPolicy{}))
+		assert.Nil(t, _validatePenaltyPolicy(PenaltyPolicy{PointsPerOverdueDay: 1}))
+		assert.Nil(t, _validatePenaltyPolicy(PenaltyPolicy{SuspendAtPoints: 10, SuspensionDays: 7}))
+		assert.NotNil(t, _validatePenaltyPolicy(PenaltyPolicy{SuspendAtLostCopies: 1}))
+		assert.NotNil(t, _validatePenaltyPolicy(PenaltyPolicy{PointsPerOverdueDay: -1}))
+	})
+
+	t.Run("overdue", func(t *testing.T) {
+		env := setup(t, PenaltyPolicy{PointsPerOverdueDay: 2, SuspendAtPoints: 20, SuspensionDays: 7})
+		overdue := createLoan(t, env, "bor", STATUS_DELIVIED)
+		createLoan(t, env, "bor", STATUS_RETURN_REQUESTED)
+		createLoan(t, env, "worker2", STATUS_RETURNED)
+
+		require.Nil(t, env.plugin._chargeOverduePenalties(due.Add(-time.Hour)))
+		penalties, err := env.plugin._loadPenalties()
+		require.Nil(t, err)
+		assert.Empty(t, penalties, "nothing is due yet")
+
+		now := due.AddDate(0, 0, 3).Add(time.Hour)
+		require.Nil(t, env.plugin._chargeOverduePenalties(now))
+		require.Nil(t, env.plugin._chargeOverduePenalties(now.Add(time.Hour)))
+		penalties, err = env.plugin._loadPenalties()
+		require.Nil(t, err)
+		require.Equal(t, 1, len(penalties))
+		assert.Equal(t, &UserPenalty{User: "bor", Points: 6, Charged: map[string]int{overdue: 3}}, penalties["bor"],
+			"a day is charged once, the one to be returned is not charged")
+		assert.Nil(t, env.plugin._checkSuspension("bor", now))
+
+		now = due.AddDate(0, 0, 11)
+		require.Nil(t, env.plugin._chargeOverduePenalties(now))
+		penalties, err = env.plugin._loadPenalties()
+		require.Nil(t, err)
+		pen := penalties["bor"]
+		assert.Equal(t, 2, pen.Points, "the points leading to the suspension are used up")
+		require.NotNil(t, pen.Suspension)
+		assert.Equal(t, SUSPENSION_REASON_OVERDUE, pen.Suspension.Reason)
+		assert.Equal(t, _millisOf(now.AddDate(0, 0, 7)), pen.Suspension.Until)
+
+		err = env.plugin._checkSuspension("bor", now)
+		assert.ErrorIs(t, err, ErrSuspended)
+		assert.Equal(t, "借书权限已暂停至 "+now.AddDate(0, 0, 7).Format("2006-01-02 15:04")+" (逾期罚分达到上限)",
+			env.plugin._errorText(err, "borrow-failed"))
+		assert.Equal(t, SUSPENSION_REASON_OVERDUE, DetailsOf(err)[ERROR_DETAIL_REASON])
+		assert.Nil(t, env.plugin._checkSuspension("bor", now.AddDate(0, 0, 8)), "expired")
+		assert.Nil(t, env.plugin._checkSuspension("worker2", now))
+
+		env.plugin.penalty.PointsPerOverdueDay = 0
+		require.Nil(t, env.plugin._chargeOverduePenalties(now.AddDate(0, 0, 1)))
+		penalties, err = env.plugin._loadPenalties()
+		require.Nil(t, err)
+		assert.Equal(t, 2, penalties["bor"].Points, "charging is turned off")
+	})
+
+	t.Run("lost_and_lift", func(t *testing.T) {
+		env := setup(t, PenaltyPolicy{SuspendAtLostCopies: 2, SuspensionDays: 7})
+		var book Book
+		DeepCopy(&book, env.td.ABook)
+		bookId, err := env.plugin._createABook(&book)
+		require.Nil(t, err)
+
+		pen, err := env.plugin._recordLostCopy(env.td.Worker1Id, "@bor")
+		require.Nil(t, err)
+		assert.Equal(t, 1, pen.LostCopies)
+		assert.Nil(t, pen.Suspension)
+		_, err = env.plugin._recordLostCopy(env.td.BorId, "bor")
+		assert.ErrorIs(t, err, ErrNotPermitted)
+		_, err = env.plugin._recordLostCopy(env.td.Worker1Id, "nobody")
+		assert.ErrorIs(t, err, ErrNotFound)
+
+		pen, err = env.plugin._recordLostCopy(env.td.Worker1Id, "bor")
+		require.Nil(t, err)
+		assert.Equal(t, 0, pen.LostCopies)
+		require.NotNil(t, pen.Suspension)
+		assert.Equal(t, SUSPENSION_REASON_LOST, pen.Suspension.Reason)
+
+		_, _, err = env.plugin._borrowABook(env.td.BorId, &BorrowRequestKey{
+			BookPostId:   bookId,
+			BorrowerUser: env.td.BorrowUser,
+		}, otherRequestData{processTime: GetNowTime()})
+		assert.ErrorIs(t, err, ErrSuspended)
+		assert.True(t, strings.HasPrefix(env.plugin._borrowErrorText(err), "借书权限已暂停至 "))
+		assert.Contains(t, env.plugin._borrowErrorText(err), "(丢失图书达到上限)")
+
+		list, err := env.plugin._listPenalties(env.td.Worker1Id)
+		require.Nil(t, err)
+		require.Equal(t, 1, len(list))
+		assert.Equal(t, "bor", list[0].User)
+		_, err = env.plugin._listPenalties(env.td.BorId)
+		assert.ErrorIs(t, err, ErrNotPermitted)
+
+		assert.ErrorIs(t, env.plugin._liftSuspension(env.td.BorId, "bor"), ErrNotPermitted)
+		require.Nil(t, env.plugin._liftSuspension(env.td.Worker1Id, "bor"))
+		assert.ErrorIs(t, env.plugin._liftSuspension(env.td.Worker1Id, "bor"), ErrNotFound)
+
+		_, _, err = env.plugin._borrowABook(env.td.BorId, &BorrowRequestKey{
+			BookPostId:   bookId,
+			BorrowerUser: env.td.BorrowUser,
+		}, otherRequestData{processTime: GetNowTime()})
+		assert.Nil(t, err)
+	})
+
+	t.Run("http", func(t *testing.T) {
+		env := setup(t, PenaltyPolicy{SuspendAtLostCopies: 1, SuspensionDays: 7})
+		serve := func(userId string, method string, target string) *httptest.ResponseRecorder {
+			w := httptest.NewRecorder()
+			r := httptest.NewRequest(method, target, nil)
+			r.Header.Set("Mattermost-User-ID", userId)
+			env.plugin.ServeHTTP(nil, w, r)
+			return w
+		}
+
+		w := serve(env.td.Worker1Id, http.MethodPost, "/api/v1/penalties/bor/lost")
+		require.Equal(t, http.StatusOK, w.Code)
+		assert.Contains(t, w.Body.String(), `"reason":"lost"`)
+
+		w = serve(env.td.Worker1Id, http.MethodGet, "/api/v1/penalties")
+		require.Equal(t, http.StatusOK, w.Code)
+		assert.Contains(t, w.Body.String(), `"user":"bor"`)
+		w = serve(env.td.BorId, http.MethodGet, "/api/v1/penalties")
+		assert.Equal(t, http.StatusForbidden, w.Code)
+
+		w = serve(env.td.Worker1Id, http.MethodPost, "/api/v1/penalties/bor/suspension")
+		assert.Equal(t, http.StatusMethodNotAllowed, w.Code)
+		w = serve(env.td.Worker1Id, http.MethodDelete, "/api/v1/penalties/bor/suspension")
+		assert.Equal(t, http.StatusOK, w.Code)
+		w = serve(env.td.Worker1Id, http.MethodDelete, "/api/v1/penalties/bor/suspension")
+		assert.Equal(t, http.StatusNotFound, w.Code)
+		w = serve(env.td.Worker1Id, http.MethodGet, "/api/v1/penalties/bor")
+		assert.Equal(t, http.StatusNotFound, w.Code)
+	})
+
+	t.Run("command", func(t *testing.T) {
+		env := setup(t, PenaltyPolicy{SuspendAtLostCopies: 2, SuspensionDays: 7})
+
+		text, err := env.plugin._executePenalty(env.td.Worker1Id, nil)
+		require.Nil(t, err)
+		assert.Equal(t, "No penalties.", text)
+		_, err = env.plugin._executePenalty(env.td.BorId, []string{"list"})
+		assert.ErrorIs(t, err, ErrNotPermitted)
+
+		text, err = env.plugin._executePenalty(env.td.Worker1Id, []string{"lost"})
+		require.Nil(t, err)
+		assert.True(t, strings.HasPrefix(text, "Usage:"))
+		text, err = env.plugin._executePenalty(env.td.Worker1Id, []string{"lost", "bor"})
+		require.Nil(t, err)
+		assert.Equal(t, "Succ. A lost copy is recorded, @bor has lost 1.", text)
+		text, err = env.plugin._executePenalty(env.td.Worker1Id, []string{"lost", "bor"})
+		require.Nil(t, err)
+		assert.True(t, strings.HasPrefix(text, "Succ. A lost copy is recorded, @bor is suspended until "))
+
+		text, err = env.plugin._executePenalty(env.td.Worker1Id, []string{"list"})
+		require.Nil(t, err)
+		assert.Contains(t, text, "| @bor | 0 | 0 | ")
+		assert.Contains(t, text, " | lost |")
+
+		text, err = env.plugin._executePenalty(env.td.Worker1Id, []string{"lift", "bor"})
+		require.Nil(t, err)
+		assert.Equal(t, "Succ. The suspension of bor is lifted.", text)
+	})
+}
@@ -1,10 +1,10 @@
 package main
 
 import (
-	"github.com/mattermost/mattermost-server/v5/model"
 	"github.com/mattermost/mattermost-server/v5/plugin"
 	"net/http"
 	"net/url"
+	"strings"
 	"sync"
 )
 
@@ -25,40 +25,77 @@ type Plugin struct {
 
 	botID string
 
-	team *model.Team
+	// the library a request works on, see _withLibrary
+	*library
 
-	borrowChannel *model.Channel
+	// all configured libraries, the first one is the default
+	libraries  map[string]*library
+	libraryIds []string
 
-	booksChannel    *model.Channel
-	booksPriChannel *model.Channel
-	booksInvChannel *model.Channel
-
-	borrowTimes int
-
-	maxRenewTimes int
-	expiredDays   int
+	// where books and borrows are kept, see _repo
+	repo Repository
         
         i18n *i18n
+
+	metadataProvider MetadataProvider
+
+	// runs the periodic tasks, see _startBackgroundJob
+	backgroundJob *backgroundJob
 }
 
 // ServeHTTP demonstrates a plugin that handles HTTP requests by greeting the world.
 func (p *Plugin) ServeHTTP(c *plugin.Context, w http.ResponseWriter, r *http.Request) {
+	if strings.HasPrefix(r.URL.Path, ICAL_PATH_PREFIX) {
+		p.handleICalRequest(w, r)
+		return
+	}
+	if strings.HasPrefix(r.URL.Path, kioskPathPrefix) {
+		p.handleKioskRequest(w, r)
+		return
+	}
+
 	userID := r.Header.Get("Mattermost-User-ID")
+	if userID == "" && strings.HasPrefix(r.URL.Path, apiV1Prefix) {
+		p._writeAPIResult(w, http.StatusUnauthorized, Result{
+			Error: "Not authorized",
+			Code:  ErrNotPermitted.Error(),
+		})
+		return
+	}
 	if userID == "" {
 	  	http.Redirect(w, r, *p.API.GetConfig().ServiceSettings.SiteURL+"/login?redirect_to="+url.QueryEscape(r.RequestURI), http.StatusFound)
 	    // http.Error(w, "Not authorized", http.StatusUnauthorized)
       return
 	}
+
+	lp, err := p._withLibrary(r.URL.Query().Get(LIBRARY_PARAM))
+	if err != nil {
+		p._writeAPIResult(w, http.StatusNotFound, p._errorResult(err, p.i18n.GetText("library-not-found")))
+		return
+	}
+
 	switch r.URL.Path {
 	case "/borrow":
-		p.handleBorrowRequest(c, w, r)
+		lp.handleBorrowRequest(c, w, r)
 	case "/workflow":
-		p.handleWorkflowRequest(c, w, r)
+		lp.handleWorkflowRequest(c, w, r)
 	case "/books":
-		p.handleBooksRequest(c, w, r)
+		lp.handleBooksRequest(c, w, r)
 	case "/config":
-		p.handleConfigRequest(c, w, r)
+		lp.handleConfigRequest(c, w, r)
+	case "/export":
+		lp.handleExportRequest(c, w, r)
+	case "/transfer":
+		lp.handleTransferRequest(c, w, r)
+	case "/transfer_workflow":
+		lp.handleTransferWorkflowRequest(c, w, r)
+	case SCAN_PATH:
+		lp.handleScanRequest(c, w, r)
 	default:
+		if strings.HasPrefix(r.URL.Path, apiV1Prefix) {
+			lp.handleAPIv1(c, w, r)
+			return
+		}
 		http.NotFound(w, r)
 	}
 }
@@ -0,0 +1,451 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/mattermost/mattermost-server/v5/model"
+	"github.com/pkg/errors"
+)
+
+type purchaseWithPost struct {
+	post     *model.Post
+	purchase *Purchase
+}
+
+// Anyone can propose a book to buy, and the proposer votes for it.
+// A book already in the catalog, or proposed and still open, is refused.
+func (p *Plugin) _proposePurchase(userId string, proposal *PurchaseProposal) (string, error) {
+	name := strings.TrimSpace(proposal.BookName)
+	if name == "" {
+		return "", KindError(ErrInvalidRequest, "book name is required.")
+	}
+
+	var isbn13 string
+	if proposal.Isbn != "" {
+		var err error
+		if _, isbn13, err = NormalizeIsbn(proposal.Isbn); err != nil {
+			return "", err
+		}
+		bookPostId, err := p._findBookPostIdByIsbn(isbn13)
+		if err != nil {
+			return "", err
+		}
+		if bookPostId != "" {
+			return "", errors.Wrapf(ErrDuplicateBook, "isbn %v is already in the library, book post %v", isbn13, bookPostId)
+		}
+		open, err := p._findOpenPurchase(TAG_PREFIX_ISBN + isbn13)
+		if err != nil {
+			return "", err
+		}
+		if open != "" {
+			return "", KindError(ErrRuleViolation, "isbn %v is already proposed, vote for %v instead.", isbn13, open)
+		}
+	}
+
+	proposer, appErr := p.API.GetUser(userId)
+	if appErr != nil {
+		return "", errors.Wrapf(appErr, "get proposer error.")
+	}
+	proposerName, err := p._getDisplayNameByUser(proposer.Username)
+	if err != nil {
+		return "", errors.Wrapf(err, "Failed to get proposer display name. user:%s", proposer.Username)
+	}
+
+	master := &PurchaseRequest{
+		BookName:     name,
+		Author:       strings.TrimSpace(proposal.Author),
+		Isbn13:       isbn13,
+		Reason:       strings.TrimSpace(proposal.Reason),
+		ProposerUser: proposer.Username,
+		ProposerName: proposerName,
+		VoterUsers:   []string{proposer.Username},
+		Worflow:      p._createPurchaseWFTemplate(GetNowTime()),
+		StepIndex:    0,
+		MatchId:      model.NewId(),
+	}
+	p._resetPurchaseTags(master)
+
+	data, err := _marshalRecord(&Purchase{
+		DataOrImage: master,
+		Role:        []string{MASTER},
+	})
+	if err != nil {
+		return "", errors.Wrapf(err, "Marshal purchase error.")
+	}
+
+	post, err := p._repo().Create(&model.Post{
+		UserId:    p.botID,
+		ChannelId: p.borrowChannel.Id,
+		Message:   string(data),
+		Type:      "custom_purchase_type",
+	})
+	if err != nil {
+		return "", errors.Wrapf(err, "Failed to post a purchase record.")
+	}
+
+	return post.Id, nil
+}
+
+// The admin approves or declines a proposal, then orders and receives the approved book.
+func (p *Plugin) _createPurchaseWFTemplate(prt int64) []Step {
+	return []Step{
+		{
+			WorkflowType:        WORKFLOW_PURCHASE,
+			Status:              PURCHASE_STATUS_PROPOSED,
+			ActorRole:           ROLE_LIBRARY_ADMIN,
+			Completed:           true,
+			ActionDate:          prt,
+			NextStepIndex:       []int{1, 2},
+			RelatedRoles:        []string{MASTER},
+			LastActualStepIndex: -1,
+		},
+		{
+			WorkflowType:        WORKFLOW_PURCHASE,
+			Status:              PURCHASE_STATUS_APPROVED,
+			ActorRole:           ROLE_LIBRARY_ADMIN,
+			Completed:           false,
+			ActionDate:          0,
+			NextStepIndex:       []int{3},
+			RelatedRoles:        []string{MASTER},
+			LastActualStepIndex: -1,
+		},
+		{
+			WorkflowType:        WORKFLOW_PURCHASE,
+			Status:              PURCHASE_STATUS_DECLINED,
+			ActorRole:           "",
+			Completed:           false,
+			ActionDate:          0,
+			NextStepIndex:       nil,
+			RelatedRoles:        []string{MASTER},
+			LastActualStepIndex: -1,
+		},
+		{
+			WorkflowType:        WORKFLOW_PURCHASE,
+			Status:              PURCHASE_STATUS_ORDERED,
+			ActorRole:           ROLE_LIBRARY_ADMIN,
+			Completed:           false,
+			ActionDate:          0,
+			NextStepIndex:       []int{4},
+			RelatedRoles:        []string{MASTER},
+			LastActualStepIndex: -1,
+		},
+		{
+			WorkflowType:        WORKFLOW_PURCHASE,
+			Status:              PURCHASE_STATUS_RECEIVED,
+			ActorRole:           "",
+			Completed:           false,
+			ActionDate:          0,
+			NextStepIndex:       nil,
+			RelatedRoles:        []string{MASTER},
+			LastActualStepIndex: -1,
+		},
+	}
+}
+
+func (p *Plugin) _resetPurchaseTags(pr *PurchaseRequest) {
+	pr.Tags = []string{
+		TAG_PREFIX_PROPOSER + pr.ProposerUser,
+		TAG_PREFIX_STATUS + pr.Worflow[pr.StepIndex].Status,
+	}
+	if pr.Isbn13 != "" {
+		pr.Tags = append(pr.Tags, TAG_PREFIX_ISBN+pr.Isbn13)
+	}
+}
+
+func _isPurchaseOpen(pr *PurchaseRequest) bool {
+	switch pr.Worflow[pr.StepIndex].Status {
+	case PURCHASE_STATUS_PROPOSED, PURCHASE_STATUS_APPROVED, PURCHASE_STATUS_ORDERED:
+		return true
+	}
+	return false
+}
+
+// The master key of an open purchase with the tag, empty if none.
+func (p *Plugin) _findOpenPurchase(tag string) (string, error) {
+	records, err := p._repo().SearchByTag(p.borrowChannel, tag)
+	if err != nil {
+		return "", errors.Wrapf(err, "search purchases by %v error.", tag)
+	}
+
+	for _, record := range records {
+		if record.Type != "custom_purchase_type" {
+			continue
+		}
+		var pc Purchase
+		if err := json.Unmarshal([]byte(record.Message), &pc); err != nil || pc.DataOrImage == nil {
+			continue
+		}
+		if _isPurchaseOpen(pc.DataOrImage) {
+			return record.Id, nil
+		}
+	}
+	return "", nil
+}
+
+// An open purchase can be voted once by a user.
+func (p *Plugin) _votePurchase(userId string, masterKey string) (*PurchaseRequest, error) {
+	voter, appErr := p.API.GetUser(userId)
+	if appErr != nil {
+		return nil, errors.Wrapf(appErr, "get voter error.")
+	}
+
+	pwp, err := p._lockAndGetPurchase(masterKey)
+	if errors.Is(err, ErrLocked) {
+		return nil, err
+	}
+	defer lockmap.Delete(masterKey)
+	if err != nil {
+		return nil, err
+	}
+
+	master := pwp.purchase.DataOrImage
+	if !_isPurchaseOpen(master) {
+		return nil, KindError(ErrRuleViolation, "the purchase is %v, not open to vote.", master.Worflow[master.StepIndex].Status)
+	}
+	for _, user := range master.VoterUsers {
+		if user == voter.Username {
+			return master, nil
+		}
+	}
+
+	master.VoterUsers = append(master.VoterUsers, voter.Username)
+	if err := p._savePurchase(pwp); err != nil {
+		return nil, err
+	}
+	return master, nil
+}
+
+// Move a purchase forward by a library admin, or delete it.
+// The proposer can withdraw the proposal before it is approved or declined.
+func (p *Plugin) _processPurchaseRequest(userId string, req *PurchaseWorkflowRequest) error {
+
+	if req.Backward {
+		return KindError(ErrInvalidRequest, "a purchase can't go backward, delete it instead.")
+	}
+
+	actor, appErr := p.API.GetUser(userId)
+	if appErr != nil {
+		return errors.Wrapf(appErr, "get actor error.")
+	}
+
+	pwp, err := p._lockAndGetPurchase(req.MasterPostKey)
+	if errors.Is(err, ErrLocked) {
+		return err
+	}
+	defer lockmap.Delete(req.MasterPostKey)
+	if err != nil {
+		return err
+	}
+
+	master := pwp.purchase.DataOrImage
+	if master.MatchId != req.Etag {
+		return WithDetails(errors.Wrapf(ErrStale, "Get %v purchase stale", MASTER),
+			ErrorDetails{ERROR_DETAIL_ETAG: master.MatchId})
+	}
+
+	isAdmin, err := p._isLibraryAdmin(userId)
+	if err != nil {
+		return err
+	}
+
+	currStep := &master.Worflow[master.StepIndex]
+
+	if req.Delete {
+		proposerWithdraws := actor.Username == master.ProposerUser && currStep.Status == PURCHASE_STATUS_PROPOSED
+		if !isAdmin && !proposerWithdraws {
+			return errors.Wrapf(ErrNotPermitted, "only an admin or the proposer before approval can delete a purchase.")
+		}
+		if err := p._repo().Delete(pwp.post.Id); err != nil {
+			return errors.Wrapf(err, "delete error, please retry or contact admin")
+		}
+		return nil
+	}
+
+	var allowed bool
+	for _, i := range currStep.NextStepIndex {
+		if i == req.NextStepIndex {
+			allowed = true
+			break
+		}
+	}
+	if !allowed {
+		return KindError(ErrRuleViolation, "step %v can't be reached from status %v", req.NextStepIndex, currStep.Status)
+	}
+	if !isAdmin {
+		return errors.Wrapf(ErrNotPermitted, "user %v is not the actor of status %v", actor.Username, currStep.Status)
+	}
+
+	nextStep := &master.Worflow[req.NextStepIndex]
+
+	switch nextStep.Status {
+	case PURCHASE_STATUS_APPROVED:
+	case PURCHASE_STATUS_DECLINED:
+	case PURCHASE_STATUS_ORDERED:
+	case PURCHASE_STATUS_RECEIVED:
+		bookPostId, err := p._createPurchasedBook(master, req.Book, actor.Username)
+		if err != nil {
+			return err
+		}
+		master.BookPostId = bookPostId
+	default:
+		return errors.New(fmt.Sprintf("Unknown status: %v in workflow: %v", nextStep.Status, nextStep.WorkflowType))
+	}
+
+	nextStep.ActionDate = GetNowTime()
+	nextStep.Completed = true
+	nextStep.LastActualStepIndex = master.StepIndex
+	master.StepIndex = req.NextStepIndex
+	master.MatchId = model.NewId()
+	p._resetPurchaseTags(master)
+
+	if err := p._savePurchase(pwp); err != nil {
+		if master.BookPostId == "" {
+			return err
+		}
+		//remove the created book, so a retry doesn't create it again
+		if rbErr := p._deleteABook(&Book{Upload: &Upload{Post_id: master.BookPostId}}); rbErr != nil {
+			return errors.Wrapf(err, "Fatal Error: book %v is created, but the purchase is not saved, and rollback error: %v",
+				master.BookPostId, rbErr)
+		}
+		return err
+	}
+
+	//the purchase is saved anyway, a failed notification is only logged
+	if err := p._notifyRecord(pwp.post, fmt.Sprintf("Status was changed to %v, by @%v.", nextStep.Status, actor.Username)); err != nil {
+		p.API.LogError("Failed to notify status change.", "err", fmt.Sprintf("%+v", err))
+	}
+
+	if nextStep.Status == PURCHASE_STATUS_RECEIVED {
+		p._notifyPurchaseVoters(master)
+	}
+	return nil
+}
+
+// The received book goes to the catalog the same way as a created book.
+// The admin receiving it is its libworker if none is given.
+func (p *Plugin) _createPurchasedBook(master *PurchaseRequest, book *Book, receiver string) (string, error) {
+	if book == nil || book.BookPublic == nil {
+		return "", KindError(ErrInvalidRequest, "the book to add to the catalog is required.")
+	}
+
+	pub := book.BookPublic
+	if pub.Name == "" {
+		pub.Name = master.BookName
+	}
+	if pub.Author == "" {
+		pub.Author = master.Author
+	}
+	if pub.Isbn10 == "" && pub.Isbn13 == "" {
+		pub.Isbn13 = master.Isbn13
+	}
+	if len(pub.LibworkerUsers) == 0 {
+		pub.LibworkerUsers = []string{receiver}
+	}
+
+	bookPostId, err := p._createABook(book)
+	if err != nil {
+		return "", errors.Wrapf(err, "create purchased book error.")
+	}
+	return bookPostId, nil
+}
+
+// A book of the purchase with copies kept by the keeper.
+func _newPurchasedBook(master *PurchaseRequest, bookId string, keeper string, copies int) *Book {
+	return _newBookWithCopies(&BookPublic{
+		Id:     bookId,
+		Name:   master.BookName,
+		Author: master.Author,
+		Isbn13: master.Isbn13,
+	}, keeper, copies)
+}
+
+// A voter not notified doesn't keep the others from being notified.
+func (p *Plugin) _notifyPurchaseVoters(master *PurchaseRequest) {
+	for _, user := range master.VoterUsers {
+		channel, err := p._getBotDirectChannel(user)
+		if err != nil {
+			p.API.LogError("Failed to notify a voter.", "user", user, "err", fmt.Sprintf("%+v", err))
+			continue
+		}
+		if _, appErr := p.API.CreatePost(&model.Post{
+			UserId:    p.botID,
+			ChannelId: channel.Id,
+			Message:   fmt.Sprintf("Good news! %v you voted for has arrived at the library, it's ready to borrow.", master.BookName),
+		}); appErr != nil {
+			p.API.LogError("Failed to notify a voter.", "user", user, "err", appErr.Error())
+		}
+	}
+}
+
+func (p *Plugin) _getPurchaseById(id string) (*purchaseWithPost, error) {
+	pc := new(Purchase)
+	post, err := p._getMasterRecord(id, "custom_purchase_type", pc)
+	if err != nil {
+		return nil, err
+	}
+	return &purchaseWithPost{post: post, purchase: pc}, nil
+}
+
+// The caller deletes the lock of the master key unless ErrLocked is returned.
+func (p *Plugin) _lockAndGetPurchase(masterKey string) (*purchaseWithPost, error) {
+	pc := new(Purchase)
+	post, err := p._lockAndGetMasterRecord(masterKey, "custom_purchase_type", pc)
+	if err != nil {
+		return nil, err
+	}
+	return &purchaseWithPost{post: post, purchase: pc}, nil
+}
+
+func (p *Plugin) _savePurchase(pwp *purchaseWithPost) error {
+	post, err := p._saveMasterRecord(pwp.post, pwp.purchase)
+	if err != nil {
+		return err
+	}
+	pwp.post = post
+	return nil
+}
+
+// The purchases at the status, or the open ones if status is empty.
+// The most voted first, then the oldest first.
+func (p *Plugin) _listPurchases(status string) ([]PurchaseEntry, error) {
+	entries := []PurchaseEntry{}
+	if err := p._eachMasterRecord("custom_purchase_type", func(record *model.Post) {
+		var pc Purchase
+		if err := json.Unmarshal([]byte(record.Message), &pc); err != nil || pc.DataOrImage == nil {
+			return
+		}
+		pr := pc.DataOrImage
+		if status == "" && !_isPurchaseOpen(pr) ||
+			status != "" && pr.Worflow[pr.StepIndex].Status != status {
+			return
+		}
+		entries = append(entries, PurchaseEntry{MasterKey: record.Id, PurchaseRequest: pr})
+	}); err != nil {
+		return nil, err
+	}
+
+	sort.SliceStable(entries, func(i, j int) bool {
+		a, b := entries[i].PurchaseRequest, entries[j].PurchaseRequest
+		if len(a.VoterUsers) != len(b.VoterUsers) {
+			return len(a.VoterUsers) > len(b.VoterUsers)
+		}
+		return a.Worflow[0].ActionDate < b.Worflow[0].ActionDate
+	})
+	return entries, nil
+}
+
+func _formatPurchases(entries []PurchaseEntry) string {
+	if len(entries) == 0 {
+		return "No purchase requests."
+	}
+
+	lines := []string{"| Book | Author | Status | Votes | Proposer | Id |", "|:--|:--|:--|--:|:--|:--|"}
+	for _, e := range entries {
+		lines = append(lines, fmt.Sprintf("| %v | %v | %v | %v | @%v | %v |",
+			e.BookName, e.Author, e.Worflow[e.StepIndex].Status, len(e.VoterUsers), e.ProposerUser, e.MasterKey))
+	}
+	return strings.Join(lines, "\n")
+}
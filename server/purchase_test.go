@@ -0,0 +1,250 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/mattermost/mattermost-server/v5/model"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPurchase(t *testing.T) {
+
+	const isbn = "978-0-306-40615-7"
+
+	getMaster := func(t *testing.T, env *requestEnv, masterKey string) *PurchaseRequest {
+		pwp, err := env.plugin._getPurchaseById(masterKey)
+		require.Nil(t, err)
+		return pwp.purchase.DataOrImage
+	}
+
+	transit := func(env *requestEnv, userId string, masterKey string, status string, book *Book) error {
+		master := getMaster(t, env, masterKey)
+		req := &PurchaseWorkflowRequest{
+			WorkflowRequest: WorkflowRequest{
+				MasterPostKey: masterKey,
+				NextStepIndex: _getIndexByStatus(status, master.Worflow),
+				Etag:          master.MatchId,
+			},
+			Book: book,
+		}
+		return env.plugin._processPurchaseRequest(userId, req)
+	}
+
+	t.Run("propose_vote_receive", func(t *testing.T) {
+		env := newRequestEnv(nil)
+
+		masterKey, err := env.plugin._proposePurchase(env.td.BorId, &PurchaseProposal{
+			BookName: " a new book ",
+			Author:   "zzh",
+			Isbn:     isbn,
+			Reason:   "everyone asks for it",
+		})
+		require.Nil(t, err)
+		master := getMaster(t, env, masterKey)
+		assert.Equal(t, "a new book", master.BookName)
+		assert.Equal(t, "9780306406157", master.Isbn13)
+		assert.Equal(t, "bookbor", master.ProposerName)
+		assert.Equal(t, []string{"bor"}, master.VoterUsers)
+		assert.Contains(t, master.Tags, TAG_PREFIX_STATUS+PURCHASE_STATUS_PROPOSED)
+
+		_, err = env.plugin._votePurchase(env.td.Worker2Id, masterKey)
+		require.Nil(t, err)
+		master, err = env.plugin._votePurchase(env.td.BorId, masterKey)
+		require.Nil(t, err)
+		assert.Equal(t, []string{"bor", "worker2"}, master.VoterUsers, "a user votes once")
+
+		err = transit(env, env.td.BorId, masterKey, PURCHASE_STATUS_APPROVED, nil)
+		assert.ErrorIs(t, err, ErrNotPermitted)
+		err = transit(env, env.td.Worker1Id, masterKey, PURCHASE_STATUS_RECEIVED, nil)
+		assert.ErrorIs(t, err, ErrRuleViolation)
+
+		require.Nil(t, transit(env, env.td.Worker1Id, masterKey, PURCHASE_STATUS_APPROVED, nil))
+		require.Nil(t, transit(env, env.td.Worker1Id, masterKey, PURCHASE_STATUS_ORDERED, nil))
+
+		err = transit(env, env.td.Worker1Id, masterKey, PURCHASE_STATUS_RECEIVED, nil)
+		assert.ErrorIs(t, err, ErrInvalidRequest, "the book is required")
+
+		book := _newPurchasedBook(getMaster(t, env, masterKey), "zzh-book-100", "kpuser1", 2)
+		require.Nil(t, transit(env, env.td.Worker1Id, masterKey, PURCHASE_STATUS_RECEIVED, book))
+
+		master = getMaster(t, env, masterKey)
+		assert.Equal(t, PURCHASE_STATUS_RECEIVED, master.Worflow[master.StepIndex].Status)
+		assert.Equal(t, 3, master.Worflow[master.StepIndex].LastActualStepIndex)
+
+		info, err := env.plugin.GetABook(master.BookPostId)
+		require.Nil(t, err)
+		assert.Equal(t, "a new book", info.book.BookPublic.Name)
+		assert.Equal(t, "zzh", info.book.BookPublic.Author)
+		assert.Equal(t, "9780306406157", info.book.BookPublic.Isbn13)
+		assert.True(t, info.book.BookPublic.IsAllowedToBorrow)
+		assert.Equal(t, []string{"worker1"}, info.book.BookPublic.LibworkerUsers)
+		assert.Equal(t, 2, info.book.BookInventory.Stock)
+		assert.Equal(t, Keeper{User: "kpuser1"}, info.book.BookPrivate.CopyKeeperMap["zzh-book-100 b2"])
+
+		for _, channelId := range []string{env.td.BorId_botId, env.td.Worker2Id_botId} {
+			env.api.AssertCalled(t, "CreatePost", mock.MatchedBy(func(post *model.Post) bool {
+				return post.ChannelId == channelId && post.Message ==
+					"Good news! a new book you voted for has arrived at the library, it's ready to borrow."
+			}))
+		}
+
+		_, err = env.plugin._votePurchase(env.td.Worker1Id, masterKey)
+		assert.ErrorIs(t, err, ErrRuleViolation, "closed")
+		_, err = env.plugin._proposePurchase(env.td.BorId, &PurchaseProposal{BookName: "again", Isbn: isbn})
+		assert.ErrorIs(t, err, ErrDuplicateBook, "in the catalog")
+	})
+
+	t.Run("new_keeper", func(t *testing.T) {
+		env := newRequestEnv(nil)
+
+		masterKey, err := env.plugin._proposePurchase(env.td.BorId, &PurchaseProposal{BookName: "a new book", Isbn: isbn})
+		require.Nil(t, err)
+		require.Nil(t, transit(env, env.td.Worker1Id, masterKey, PURCHASE_STATUS_APPROVED, nil))
+		require.Nil(t, transit(env, env.td.Worker1Id, masterKey, PURCHASE_STATUS_ORDERED, nil))
+		book := _newPurchasedBook(getMaster(t, env, masterKey), "zzh-book-100", "worker2", 1)
+		require.Nil(t, transit(env, env.td.Worker1Id, masterKey, PURCHASE_STATUS_RECEIVED, book))
+
+		roles, err := env.plugin._getUserRoles(env.td.Worker2Id)
+		require.Nil(t, err)
+		assert.Equal(t, []string{ROLE_LIBWORKER, ROLE_KEEPER, ROLE_BORROWER}, roles)
+	})
+
+	t.Run("not_saved_book_removed", func(t *testing.T) {
+		env := newRequestEnv(nil)
+
+		masterKey, err := env.plugin._proposePurchase(env.td.BorId, &PurchaseProposal{BookName: "a new book", Isbn: isbn})
+		require.Nil(t, err)
+		require.Nil(t, transit(env, env.td.Worker1Id, masterKey, PURCHASE_STATUS_APPROVED, nil))
+		require.Nil(t, transit(env, env.td.Worker1Id, masterKey, PURCHASE_STATUS_ORDERED, nil))
+
+		repo := env.plugin.repo
+		env.plugin.repo = &failingUpdateRepository{Repository: repo, id: masterKey}
+		book := _newPurchasedBook(getMaster(t, env, masterKey), "zzh-book-100", "kpuser1", 1)
+		assert.NotNil(t, transit(env, env.td.Worker1Id, masterKey, PURCHASE_STATUS_RECEIVED, book))
+		env.plugin.repo = repo
+
+		bookPostId, err := env.plugin._findBookPostIdByIsbn("9780306406157")
+		require.Nil(t, err)
+		assert.Empty(t, bookPostId)
+
+		// a retry creates the book once
+		book = _newPurchasedBook(getMaster(t, env, masterKey), "zzh-book-100", "kpuser1", 1)
+		require.Nil(t, transit(env, env.td.Worker1Id, masterKey, PURCHASE_STATUS_RECEIVED, book))
+		assert.NotEmpty(t, getMaster(t, env, masterKey).BookPostId)
+	})
+
+	t.Run("voter_not_notified", func(t *testing.T) {
+		env := newRequestEnv(failNotifyingBor)
+
+		masterKey, err := env.plugin._proposePurchase(env.td.BorId, &PurchaseProposal{BookName: "a new book", Isbn: isbn})
+		require.Nil(t, err)
+		_, err = env.plugin._votePurchase(env.td.Worker2Id, masterKey)
+		require.Nil(t, err)
+		require.Nil(t, transit(env, env.td.Worker1Id, masterKey, PURCHASE_STATUS_APPROVED, nil))
+		require.Nil(t, transit(env, env.td.Worker1Id, masterKey, PURCHASE_STATUS_ORDERED, nil))
+
+		book := _newPurchasedBook(getMaster(t, env, masterKey), "zzh-book-100", "kpuser1", 1)
+		require.Nil(t, transit(env, env.td.Worker1Id, masterKey, PURCHASE_STATUS_RECEIVED, book), "the book is received anyway")
+		env.api.AssertCalled(t, "LogError", "Failed to notify a voter.", "user", "bor", "err", mock.AnythingOfType("string"))
+		env.api.AssertCalled(t, "CreatePost", mock.MatchedBy(func(post *model.Post) bool {
+			return post.ChannelId == env.td.Worker2Id_botId
+		}))
+	})
+
+	t.Run("invalid_proposal", func(t *testing.T) {
+		env := newRequestEnv(nil)
+
+		_, err := env.plugin._proposePurchase(env.td.BorId, &PurchaseProposal{BookName: " "})
+		assert.ErrorIs(t, err, ErrInvalidRequest)
+		_, err = env.plugin._proposePurchase(env.td.BorId, &PurchaseProposal{BookName: "a book", Isbn: "123"})
+		assert.ErrorIs(t, err, ErrInvalidIsbn)
+
+		_, err = env.plugin._proposePurchase(env.td.BorId, &PurchaseProposal{BookName: "a book", Isbn: isbn})
+		require.Nil(t, err)
+		_, err = env.plugin._proposePurchase(env.td.Worker2Id, &PurchaseProposal{BookName: "the same book", Isbn: "0306406152"})
+		assert.ErrorIs(t, err, ErrRuleViolation, "proposed and open")
+	})
+
+	t.Run("decline_and_delete", func(t *testing.T) {
+		env := newRequestEnv(nil)
+		masterKey, err := env.plugin._proposePurchase(env.td.BorId, &PurchaseProposal{BookName: "a book"})
+		require.Nil(t, err)
+
+		stale := &PurchaseWorkflowRequest{WorkflowRequest: WorkflowRequest{MasterPostKey: masterKey, NextStepIndex: 2, Etag: "old"}}
+		assert.ErrorIs(t, env.plugin._processPurchaseRequest(env.td.Worker1Id, stale), ErrStale)
+
+		require.Nil(t, transit(env, env.td.Worker1Id, masterKey, PURCHASE_STATUS_DECLINED, nil))
+		err = transit(env, env.td.Worker1Id, masterKey, PURCHASE_STATUS_ORDERED, nil)
+		assert.ErrorIs(t, err, ErrRuleViolation)
+
+		withdraw := func(userId string, masterKey string) error {
+			return env.plugin._processPurchaseRequest(userId, &PurchaseWorkflowRequest{WorkflowRequest: WorkflowRequest{
+				MasterPostKey: masterKey,
+				Delete:        true,
+				Etag:          getMaster(t, env, masterKey).MatchId,
+			}})
+		}
+		assert.ErrorIs(t, withdraw(env.td.BorId, masterKey), ErrNotPermitted, "declined already")
+		require.Nil(t, withdraw(env.td.Worker1Id, masterKey))
+		_, err = env.plugin._getPurchaseById(masterKey)
+		assert.ErrorIs(t, err, ErrNotFound)
+
+		masterKey, err = env.plugin._proposePurchase(env.td.BorId, &PurchaseProposal{BookName: "another book"})
+		require.Nil(t, err)
+		assert.ErrorIs(t, withdraw(env.td.Worker2Id, masterKey), ErrNotPermitted)
+		require.Nil(t, withdraw(env.td.BorId, masterKey))
+	})
+
+	t.Run("command", func(t *testing.T) {
+		env := newRequestEnv(nil)
+
+		text, err := env.plugin._executePurchase(env.td.BorId, nil)
+		require.Nil(t, err)
+		assert.Equal(t, "No purchase requests.", text)
+
+		text, err = env.plugin._executePurchase(env.td.BorId, []string{"propose", "a", "book"})
+		require.Nil(t, err)
+		assert.Contains(t, text, "Succ. a book is proposed")
+		_, err = env.plugin._executePurchase(env.td.Worker2Id, []string{"propose", "a", "popular", "book", isbn})
+		require.Nil(t, err)
+
+		entries, err := env.plugin._listPurchases("")
+		require.Nil(t, err)
+		require.Equal(t, 2, len(entries))
+		var popular string
+		for _, e := range entries {
+			if e.BookName == "a popular book" {
+				assert.Equal(t, "9780306406157", e.Isbn13)
+				popular = e.MasterKey
+			}
+		}
+		require.NotEmpty(t, popular)
+
+		text, err = env.plugin._executePurchase(env.td.BorId, []string{"vote", popular})
+		require.Nil(t, err)
+		assert.Equal(t, "Succ. a popular book has 2 votes.", text)
+
+		text, err = env.plugin._executePurchase(env.td.BorId, []string{"list"})
+		require.Nil(t, err)
+		assert.Contains(t, text, "| a popular book |  | PP | 2 | @worker2 | "+popular+" |\n| a book |")
+
+		_, err = env.plugin._executePurchase(env.td.BorId, []string{"approve", popular})
+		assert.ErrorIs(t, err, ErrNotPermitted)
+		for _, action := range []string{"approve", "order"} {
+			_, err = env.plugin._executePurchase(env.td.Worker1Id, []string{action, popular})
+			require.Nil(t, err)
+		}
+		text, err = env.plugin._executePurchase(env.td.Worker1Id, []string{"receive", popular, "zzh-book-101", "kpuser2"})
+		require.Nil(t, err)
+		assert.Equal(t, "Succ. The purchase of a popular book is PV.", text)
+
+		entries, err = env.plugin._listPurchases(PURCHASE_STATUS_RECEIVED)
+		require.Nil(t, err)
+		require.Equal(t, 1, len(entries))
+		info, err := env.plugin.GetABook(entries[0].BookPostId)
+		require.Nil(t, err)
+		assert.Equal(t, 1, info.book.BookInventory.Stock)
+	})
+}
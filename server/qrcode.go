@@ -0,0 +1,495 @@
+package main
+
+import (
+	"bytes"
+	"image"
+	"image/color"
+	"image/png"
+
+	"github.com/pkg/errors"
+)
+
+// A QR code of byte mode and error correction level M, see ISO/IEC 18004.
+// Level M restores about 15% of a worn label.
+type qrCode struct {
+	version int
+	size    int
+	// [y][x], true is dark
+	modules    [][]bool
+	isFunction [][]bool
+}
+
+const (
+	qrMaxVersion = 40
+	// the light border around a code, in modules
+	qrQuietZone = 4
+	// the format bits of level M
+	qrEclFormatBits = 0
+)
+
+// by version, level M
+var qrEccCodewordsPerBlock = []int{-1,
+	10, 16, 26, 18, 24, 16, 18, 22, 22, 26, 30, 22, 22, 24, 24, 28, 28, 26, 26, 26,
+	26, 28, 28, 28, 28, 28, 28, 28, 28, 28, 28, 28, 28, 28, 28, 28, 28, 28, 28, 28}
+
+var qrEccBlocks = []int{-1,
+	1, 1, 1, 2, 2, 4, 4, 4, 5, 5, 5, 8, 9, 9, 10, 10, 11, 13, 14, 16,
+	17, 17, 18, 20, 21, 23, 25, 26, 28, 29, 31, 33, 35, 37, 38, 40, 43, 45, 47, 49}
+
+// The smallest version that holds the data is used.
+func _encodeQR(data []byte) (*qrCode, error) {
+	version := 1
+	for ; version <= qrMaxVersion; version++ {
+		if 4+_qrCountBits(version)+8*len(data) <= 8*_qrDataCodewords(version) {
+			break
+		}
+	}
+	if version > qrMaxVersion {
+		return nil, KindError(ErrInvalidRequest, "%v bytes are too long for a QR code.", len(data))
+	}
+
+	// mode, count, data, terminator and padding
+	var bits qrBitBuffer
+	bits.append(0x4, 4)
+	bits.append(len(data), _qrCountBits(version))
+	for _, b := range data {
+		bits.append(int(b), 8)
+	}
+	capacity := 8 * _qrDataCodewords(version)
+	bits.append(0, _minInt(4, capacity-len(bits)))
+	bits.append(0, (8-len(bits)%8)%8)
+	for pad := 0xEC; len(bits) < capacity; pad ^= 0xEC ^ 0x11 {
+		bits.append(pad, 8)
+	}
+
+	codewords := make([]byte, len(bits)/8)
+	for i, bit := range bits {
+		if bit {
+			codewords[i>>3] |= 1 << (7 - uint(i&7))
+		}
+	}
+
+	q := &qrCode{version: version, size: version*4 + 17}
+	q.modules = _newQRGrid(q.size)
+	q.isFunction = _newQRGrid(q.size)
+	q._drawFunctionPatterns()
+	q._drawCodewords(_qrAddEccAndInterleave(version, codewords))
+
+	best, minPenalty := 0, -1
+	for mask := 0; mask < 8; mask++ {
+		q._applyMask(mask)
+		q._drawFormatBits(mask)
+		if penalty := q._penalty(); minPenalty < 0 || penalty < minPenalty {
+			best, minPenalty = mask, penalty
+		}
+		q._applyMask(mask)
+	}
+	q._applyMask(best)
+	q._drawFormatBits(best)
+
+	return q, nil
+}
+
+// Black modules on white with the quiet zone, scale pixels per module.
+func (q *qrCode) png(scale int) ([]byte, error) {
+	side := (q.size + 2*qrQuietZone) * scale
+	img := image.NewPaletted(image.Rect(0, 0, side, side), color.Palette{color.White, color.Black})
+	for y := 0; y < q.size; y++ {
+		for x := 0; x < q.size; x++ {
+			if !q.modules[y][x] {
+				continue
+			}
+			for dy := 0; dy < scale; dy++ {
+				for dx := 0; dx < scale; dx++ {
+					img.SetColorIndex((x+qrQuietZone)*scale+dx, (y+qrQuietZone)*scale+dy, 1)
+				}
+			}
+		}
+	}
+
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, img); err != nil {
+		return nil, errors.Wrapf(err, "encode qr code image error.")
+	}
+	return buf.Bytes(), nil
+}
+
+type qrBitBuffer []bool
+
+func (b *qrBitBuffer) append(value int, length int) {
+	for i := length - 1; i >= 0; i-- {
+		*b = append(*b, (value>>uint(i))&1 != 0)
+	}
+}
+
+func _newQRGrid(size int) [][]bool {
+	grid := make([][]bool, size)
+	for i := range grid {
+		grid[i] = make([]bool, size)
+	}
+	return grid
+}
+
+func _qrCountBits(version int) int {
+	if version <= 9 {
+		return 8
+	}
+	return 16
+}
+
+// The modules for data and error correction, without the function patterns.
+func _qrRawDataModules(version int) int {
+	result := (16*version+128)*version + 64
+	if version >= 2 {
+		numAlign := version/7 + 2
+		result -= (25*numAlign-10)*numAlign - 55
+		if version >= 7 {
+			result -= 36
+		}
+	}
+	return result
+}
+
+func _qrDataCodewords(version int) int {
+	return _qrRawDataModules(version)/8 - qrEccCodewordsPerBlock[version]*qrEccBlocks[version]
+}
+
+func _qrAlignmentPositions(version int) []int {
+	if version == 1 {
+		return nil
+	}
+	numAlign := version/7 + 2
+	step := (version*4 + numAlign*2 + 1) / (numAlign*2 - 2) * 2
+	if version == 32 {
+		step = 26
+	}
+
+	positions := make([]int, numAlign)
+	positions[0] = 6
+	for i, pos := numAlign-1, version*4+10; i >= 1; i, pos = i-1, pos-step {
+		positions[i] = pos
+	}
+	return positions
+}
+
+func (q *qrCode) _setFunctionModule(x int, y int, dark bool) {
+	q.modules[y][x] = dark
+	q.isFunction[y][x] = true
+}
+
+func (q *qrCode) _drawFunctionPatterns() {
+	for i := 0; i < q.size; i++ {
+		q._setFunctionModule(6, i, i%2 == 0)
+		q._setFunctionModule(i, 6, i%2 == 0)
+	}
+
+	q._drawFinderPattern(3, 3)
+	q._drawFinderPattern(q.size-4, 3)
+	q._drawFinderPattern(3, q.size-4)
+
+	positions := _qrAlignmentPositions(q.version)
+	last := len(positions) - 1
+	for i, x := range positions {
+		for j, y := range positions {
+			if (i == 0 && j == 0) || (i == 0 && j == last) || (i == last && j == 0) {
+				continue
+			}
+			for dy := -2; dy <= 2; dy++ {
+				for dx := -2; dx <= 2; dx++ {
+					q._setFunctionModule(x+dx, y+dy, _maxInt(_absInt(dx), _absInt(dy)) != 1)
+				}
+			}
+		}
+	}
+
+	// reserved here, drawn with the mask
+	q._drawFormatBits(0)
+	q._drawVersionBits()
+}
+
+// with the separator around it
+func (q *qrCode) _drawFinderPattern(x int, y int) {
+	for dy := -4; dy <= 4; dy++ {
+		for dx := -4; dx <= 4; dx++ {
+			xx, yy := x+dx, y+dy
+			if xx < 0 || xx >= q.size || yy < 0 || yy >= q.size {
+				continue
+			}
+			dist := _maxInt(_absInt(dx), _absInt(dy))
+			q._setFunctionModule(xx, yy, dist != 2 && dist != 4)
+		}
+	}
+}
+
+func _qrFormatBits(mask int) int {
+	data := qrEclFormatBits<<3 | mask
+	rem := data
+	for i := 0; i < 10; i++ {
+		rem = (rem << 1) ^ ((rem >> 9) * 0x537)
+	}
+	return (data<<10 | rem) ^ 0x5412
+}
+
+func (q *qrCode) _drawFormatBits(mask int) {
+	bits := _qrFormatBits(mask)
+	bit := func(i int) bool { return (bits>>uint(i))&1 != 0 }
+
+	for i := 0; i <= 5; i++ {
+		q._setFunctionModule(8, i, bit(i))
+	}
+	q._setFunctionModule(8, 7, bit(6))
+	q._setFunctionModule(8, 8, bit(7))
+	q._setFunctionModule(7, 8, bit(8))
+	for i := 9; i < 15; i++ {
+		q._setFunctionModule(14-i, 8, bit(i))
+	}
+
+	for i := 0; i < 8; i++ {
+		q._setFunctionModule(q.size-1-i, 8, bit(i))
+	}
+	for i := 8; i < 15; i++ {
+		q._setFunctionModule(8, q.size-15+i, bit(i))
+	}
+	q._setFunctionModule(8, q.size-8, true)
+}
+
+func _qrVersionBits(version int) int {
+	rem := version
+	for i := 0; i < 12; i++ {
+		rem = (rem << 1) ^ ((rem >> 11) * 0x1F25)
+	}
+	return version<<12 | rem
+}
+
+func (q *qrCode) _drawVersionBits() {
+	if q.version < 7 {
+		return
+	}
+
+	bits := _qrVersionBits(q.version)
+	for i := 0; i < 18; i++ {
+		dark := (bits>>uint(i))&1 != 0
+		a, b := q.size-11+i%3, i/3
+		q._setFunctionModule(a, b, dark)
+		q._setFunctionModule(b, a, dark)
+	}
+}
+
+// The codewords are split into blocks, each with its error correction,
+// then interleaved by position.
+func _qrAddEccAndInterleave(version int, data []byte) []byte {
+	numBlocks := qrEccBlocks[version]
+	eccLen := qrEccCodewordsPerBlock[version]
+	rawCodewords := _qrRawDataModules(version) / 8
+	numShortBlocks := numBlocks - rawCodewords%numBlocks
+	shortBlockLen := rawCodewords / numBlocks
+
+	divisor := _qrReedSolomonDivisor(eccLen)
+	blocks := make([][]byte, numBlocks)
+	for i, k := 0, 0; i < numBlocks; i++ {
+		n := shortBlockLen - eccLen
+		if i >= numShortBlocks {
+			n++
+		}
+		block := append([]byte{}, data[k:k+n]...)
+		k += n
+		ecc := _qrReedSolomonRemainder(block, divisor)
+		if i < numShortBlocks {
+			// a placeholder to line up with the long blocks
+			block = append(block, 0)
+		}
+		blocks[i] = append(block, ecc...)
+	}
+
+	result := make([]byte, 0, rawCodewords)
+	for i := range blocks[0] {
+		for j, block := range blocks {
+			if i != shortBlockLen-eccLen || j >= numShortBlocks {
+				result = append(result, block[i])
+			}
+		}
+	}
+	return result
+}
+
+func _qrReedSolomonDivisor(degree int) []byte {
+	result := make([]byte, degree)
+	result[degree-1] = 1
+	root := byte(1)
+	for i := 0; i < degree; i++ {
+		for j := range result {
+			result[j] = _qrMultiply(result[j], root)
+			if j+1 < len(result) {
+				result[j] ^= result[j+1]
+			}
+		}
+		root = _qrMultiply(root, 0x02)
+	}
+	return result
+}
+
+func _qrReedSolomonRemainder(data []byte, divisor []byte) []byte {
+	result := make([]byte, len(divisor))
+	for _, b := range data {
+		factor := b ^ result[0]
+		copy(result, result[1:])
+		result[len(result)-1] = 0
+		for i, coef := range divisor {
+			result[i] ^= _qrMultiply(coef, factor)
+		}
+	}
+	return result
+}
+
+// in GF(2^8) modulo x^8 + x^4 + x^3 + x^2 + 1
+func _qrMultiply(x byte, y byte) byte {
+	z := 0
+	for i := 7; i >= 0; i-- {
+		z = (z << 1) ^ ((z >> 7) * 0x11D)
+		z ^= int((y>>uint(i))&1) * int(x)
+	}
+	return byte(z)
+}
+
+// In two-module columns from the bottom right, upwards and downwards by turns,
+// the timing column is skipped.
+func (q *qrCode) _drawCodewords(data []byte) {
+	i := 0
+	for right := q.size - 1; right >= 1; right -= 2 {
+		if right == 6 {
+			right = 5
+		}
+		for vert := 0; vert < q.size; vert++ {
+			for j := 0; j < 2; j++ {
+				x := right - j
+				y := vert
+				if (right+1)&2 == 0 {
+					y = q.size - 1 - vert
+				}
+				if !q.isFunction[y][x] && i < len(data)*8 {
+					q.modules[y][x] = (data[i>>3]>>(7-uint(i&7)))&1 != 0
+					i++
+				}
+			}
+		}
+	}
+}
+
+// Applying a mask twice undoes it.
+func (q *qrCode) _applyMask(mask int) {
+	for y := 0; y < q.size; y++ {
+		for x := 0; x < q.size; x++ {
+			if q.isFunction[y][x] {
+				continue
+			}
+			var invert bool
+			switch mask {
+			case 0:
+				invert = (x+y)%2 == 0
+			case 1:
+				invert = y%2 == 0
+			case 2:
+				invert = x%3 == 0
+			case 3:
+				invert = (x+y)%3 == 0
+			case 4:
+				invert = (x/3+y/2)%2 == 0
+			case 5:
+				invert = x*y%2+x*y%3 == 0
+			case 6:
+				invert = (x*y%2+x*y%3)%2 == 0
+			case 7:
+				invert = ((x+y)%2+x*y%3)%2 == 0
+			}
+			if invert {
+				q.modules[y][x] = !q.modules[y][x]
+			}
+		}
+	}
+}
+
+var qrFinderLike = [][]bool{
+	{true, false, true, true, true, false, true, false, false, false, false},
+	{false, false, false, false, true, false, true, true, true, false, true},
+}
+
+// The lower the easier to scan: long runs, 2x2 blocks, finder-like patterns
+// and an unbalanced dark proportion are penalized.
+func (q *qrCode) _penalty() int {
+	at := func(x int, y int, transposed bool) bool {
+		if transposed {
+			return q.modules[x][y]
+		}
+		return q.modules[y][x]
+	}
+
+	penalty := 0
+	for _, transposed := range []bool{false, true} {
+		for y := 0; y < q.size; y++ {
+			run := 1
+			for x := 1; x <= q.size; x++ {
+				if x < q.size && at(x, y, transposed) == at(x-1, y, transposed) {
+					run++
+					continue
+				}
+				if run >= 5 {
+					penalty += run - 2
+				}
+				run = 1
+			}
+
+			for x := 0; x+len(qrFinderLike[0]) <= q.size; x++ {
+				for _, pattern := range qrFinderLike {
+					matched := true
+					for i, dark := range pattern {
+						if at(x+i, y, transposed) != dark {
+							matched = false
+							break
+						}
+					}
+					if matched {
+						penalty += 40
+					}
+				}
+			}
+		}
+	}
+
+	dark := 0
+	for y := 0; y < q.size; y++ {
+		for x := 0; x < q.size; x++ {
+			if q.modules[y][x] {
+				dark++
+			}
+			if x > 0 && y > 0 && q.modules[y][x] == q.modules[y][x-1] &&
+				q.modules[y][x] == q.modules[y-1][x] && q.modules[y][x] == q.modules[y-1][x-1] {
+				penalty += 3
+			}
+		}
+	}
+	total := q.size * q.size
+	penalty += _absInt(dark*100/total-50) / 5 * 10
+
+	return penalty
+}
+
+func _absInt(x int) int {
+	if x < 0 {
+		return -x
+	}
+	return x
+}
+
+func _maxInt(a int, b int) int {
+	if a > b {
+		return a
+	}
+	return b
+}
+
+func _minInt(a int, b int) int {
+	if a < b {
+		return a
+	}
+	return b
+}
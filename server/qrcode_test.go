@@ -0,0 +1,169 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"image/png"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestQRCode(t *testing.T) {
+
+	// reads the mask from the format bits, then the data back as a scanner does,
+	// without correcting errors
+	read := func(t *testing.T, q *qrCode) []byte {
+		format := 0
+		for i := 14; i >= 9; i-- {
+			format = format<<1 | _boolBit(q.modules[8][14-i])
+		}
+		format = format<<1 | _boolBit(q.modules[8][7])
+		format = format<<1 | _boolBit(q.modules[8][8])
+		format = format<<1 | _boolBit(q.modules[7][8])
+		for i := 5; i >= 0; i-- {
+			format = format<<1 | _boolBit(q.modules[i][8])
+		}
+		mask := -1
+		for m := 0; m < 8; m++ {
+			if _qrFormatBits(m) == format {
+				mask = m
+			}
+		}
+		require.NotEqual(t, -1, mask, "level M")
+
+		q._applyMask(mask)
+		defer q._applyMask(mask)
+
+		var bits qrBitBuffer
+		for right := q.size - 1; right >= 1; right -= 2 {
+			if right == 6 {
+				right = 5
+			}
+			for vert := 0; vert < q.size; vert++ {
+				for j := 0; j < 2; j++ {
+					x, y := right-j, vert
+					if (right+1)&2 == 0 {
+						y = q.size - 1 - vert
+					}
+					if !q.isFunction[y][x] {
+						bits = append(bits, q.modules[y][x])
+					}
+				}
+			}
+		}
+		raw := make([]byte, _qrRawDataModules(q.version)/8)
+		for i := range raw {
+			for _, bit := range bits[i*8 : i*8+8] {
+				raw[i] = raw[i]<<1 | byte(_boolBit(bit))
+			}
+		}
+
+		numBlocks := qrEccBlocks[q.version]
+		eccLen := qrEccCodewordsPerBlock[q.version]
+		numShortBlocks := numBlocks - len(raw)%numBlocks
+		shortBlockLen := len(raw) / numBlocks
+		blocks := make([][]byte, numBlocks)
+		k := 0
+		for i := 0; i <= shortBlockLen; i++ {
+			for j := range blocks {
+				if i != shortBlockLen-eccLen || j >= numShortBlocks {
+					blocks[j] = append(blocks[j], raw[k])
+					k++
+				}
+			}
+		}
+
+		var data []byte
+		divisor := _qrReedSolomonDivisor(eccLen)
+		for _, block := range blocks {
+			assert.Equal(t, make([]byte, eccLen), _qrReedSolomonRemainder(block, divisor), "no errors")
+			data = append(data, block[:len(block)-eccLen]...)
+		}
+
+		require.Equal(t, byte(0x4), data[0]>>4, "byte mode")
+		var stream qrBitBuffer
+		for _, b := range data {
+			stream.append(int(b), 8)
+		}
+		count := 0
+		for _, bit := range stream[4 : 4+_qrCountBits(q.version)] {
+			count = count<<1 | _boolBit(bit)
+		}
+		payload := make([]byte, count)
+		for i := range payload {
+			start := 4 + _qrCountBits(q.version) + i*8
+			for _, bit := range stream[start : start+8] {
+				payload[i] = payload[i]<<1 | byte(_boolBit(bit))
+			}
+		}
+		return payload
+	}
+
+	t.Run("reed_solomon", func(t *testing.T) {
+		// HELLO WORLD of 1-M, ISO/IEC 18004 annex I
+		data := []byte{32, 91, 11, 120, 209, 114, 220, 77, 67, 64, 236, 17, 236, 17, 236, 17}
+		assert.Equal(t, []byte{196, 35, 39, 119, 235, 215, 231, 226, 93, 23},
+			_qrReedSolomonRemainder(data, _qrReedSolomonDivisor(10)))
+	})
+
+	t.Run("format_and_version_bits", func(t *testing.T) {
+		assert.Equal(t, "101010000010010", fmt.Sprintf("%015b", _qrFormatBits(0)))
+		assert.Equal(t, "000111110010010100", fmt.Sprintf("%018b", _qrVersionBits(7)))
+		assert.Equal(t, []int{6, 22, 38}, _qrAlignmentPositions(7))
+		assert.Equal(t, []int{6, 30, 58, 86, 114, 142, 170}, _qrAlignmentPositions(40))
+		assert.Equal(t, 16, _qrDataCodewords(1))
+		assert.Equal(t, 2334, _qrDataCodewords(40))
+	})
+
+	t.Run("round_trip", func(t *testing.T) {
+		for _, text := range []string{
+			"zzh-book-001 b3",
+			"http://localhost:8065/plugins/" + PLUGIN_ID + "/scan?book=" + strings.Repeat("x", 26) + "&copy=%E4%B9%A6+b1&library=default",
+			strings.Repeat("书", 300),
+		} {
+			q, err := _encodeQR([]byte(text))
+			require.Nil(t, err)
+			assert.Equal(t, q.version*4+17, q.size)
+			assert.Equal(t, text, string(read(t, q)))
+			assert.True(t, q.modules[q.size-8][8], "the dark module")
+		}
+
+		q, err := _encodeQR([]byte("zzh-book-001 b3"))
+		require.Nil(t, err)
+		assert.Equal(t, 2, q.version, "1-M holds 14 bytes")
+		for _, corner := range [][2]int{{0, 0}, {q.size - 7, 0}, {0, q.size - 7}} {
+			x, y := corner[0], corner[1]
+			assert.True(t, q.modules[y][x] && q.modules[y+6][x+6] && q.modules[y+3][x+3], "finder")
+			assert.False(t, q.modules[y+1][x+1], "finder")
+		}
+
+		_, err = _encodeQR(make([]byte, 2400))
+		assert.ErrorIs(t, err, ErrInvalidRequest)
+	})
+
+	t.Run("png", func(t *testing.T) {
+		q, err := _encodeQR([]byte("zzh-book-001 b3"))
+		require.Nil(t, err)
+		data, err := q.png(4)
+		require.Nil(t, err)
+
+		img, err := png.Decode(bytes.NewReader(data))
+		require.Nil(t, err)
+		side := (q.size + 2*qrQuietZone) * 4
+		assert.Equal(t, side, img.Bounds().Dx())
+		r, _, _, _ := img.At(0, 0).RGBA()
+		assert.Equal(t, uint32(0xffff), r, "quiet zone")
+		r, _, _, _ = img.At(qrQuietZone*4, qrQuietZone*4).RGBA()
+		assert.Equal(t, uint32(0), r, "finder")
+	})
+}
+
+func _boolBit(b bool) int {
+	if b {
+		return 1
+	}
+	return 0
+}
@@ -0,0 +1,397 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+const recommendPostsPerPage = 200
+
+func (p *Plugin) _recommendKey() string {
+	return RECOMMEND_KV_KEY_PREFIX + p.library.id
+}
+
+// Two books are borrowed together if a user has returned both of them.
+// The readers of a user are all the books borrowed, so that a suggestion is never a book being read.
+func (p *Plugin) _buildRecommendations() (*RecommendationIndex, error) {
+	index := &RecommendationIndex{
+		LibraryId: p.library.id,
+		BuildAt:   GetNowTime(),
+		Books:     map[string]*RecommendedBook{},
+		Readers:   map[string][]string{},
+	}
+
+	for page := 0; ; page++ {
+		records, err := p._repo().List(p.booksChannel, page, recommendPostsPerPage)
+		if err != nil {
+			return nil, errors.Wrapf(err, "list books error. page: %v", page)
+		}
+		for _, record := range records {
+			if record.Type != "custom_book_type" || record.RootId != "" {
+				continue
+			}
+			var pub BookPublic
+			if err := json.Unmarshal([]byte(record.Message), &pub); err != nil {
+				continue
+			}
+			index.Books[record.Id] = _newRecommendedBook(&pub)
+		}
+		if len(records) < recommendPostsPerPage {
+			break
+		}
+	}
+
+	returned := map[string][]string{}
+	for page := 0; ; page++ {
+		records, err := p._repo().List(p.borrowChannel, page, recommendPostsPerPage)
+		if err != nil {
+			return nil, errors.Wrapf(err, "list borrows error. page: %v", page)
+		}
+		for _, record := range records {
+			if record.Type != "custom_borrow_type" || record.RootId != "" {
+				continue
+			}
+			var borrow Borrow
+			if err := json.Unmarshal([]byte(record.Message), &borrow); err != nil {
+				continue
+			}
+			br := borrow.DataOrImage
+			if br == nil || br.BorrowerUser == "" || br.StepIndex >= len(br.Worflow) {
+				continue
+			}
+			book, ok := index.Books[br.BookPostId]
+			if !ok {
+				// deleted
+				continue
+			}
+
+			book.Borrows++
+			index.Readers[br.BorrowerUser] = _appendUnique(index.Readers[br.BorrowerUser], br.BookPostId)
+			if br.Worflow[br.StepIndex].Status == STATUS_RETURNED {
+				returned[br.BorrowerUser] = _appendUnique(returned[br.BorrowerUser], br.BookPostId)
+			}
+		}
+		if len(records) < recommendPostsPerPage {
+			break
+		}
+	}
+
+	together := map[string]map[string]int{}
+	for _, books := range returned {
+		for _, a := range books {
+			for _, b := range books {
+				if a == b {
+					continue
+				}
+				if together[a] == nil {
+					together[a] = map[string]int{}
+				}
+				together[a][b]++
+			}
+		}
+	}
+	for id, scores := range together {
+		also := []BookScore{}
+		for other, score := range scores {
+			also = append(also, BookScore{other, score})
+		}
+		sort.Slice(also, func(i, j int) bool {
+			if also[i].Score != also[j].Score {
+				return also[i].Score > also[j].Score
+			}
+			return also[i].BookPostId < also[j].BookPostId
+		})
+		if len(also) > RECOMMEND_MAX_LIMIT {
+			also = also[:RECOMMEND_MAX_LIMIT]
+		}
+		index.Books[id].AlsoBorrowed = also
+	}
+
+	return index, nil
+}
+
+func _newRecommendedBook(pub *BookPublic) *RecommendedBook {
+	categories := []string{pub.Category1, pub.Category2, pub.Category3}
+	for len(categories) > 0 && categories[len(categories)-1] == "" {
+		categories = categories[:len(categories)-1]
+	}
+	return &RecommendedBook{
+		Name:       pub.Name,
+		Categories: categories,
+	}
+}
+
+func _appendUnique(arr []string, value string) []string {
+	for _, v := range arr {
+		if v == value {
+			return arr
+		}
+	}
+	return append(arr, value)
+}
+
+func (p *Plugin) _saveRecommendations(index *RecommendationIndex) error {
+	data, err := json.Marshal(index)
+	if err != nil {
+		return errors.Wrapf(err, "convert recommendations error.")
+	}
+	if appErr := p.API.KVSet(p._recommendKey(), data); appErr != nil {
+		return errors.Wrapf(appErr, "save recommendations error.")
+	}
+	return nil
+}
+
+// Built on the first use if the background job hasn't built it yet.
+func (p *Plugin) _loadRecommendations() (*RecommendationIndex, error) {
+	data, appErr := p.API.KVGet(p._recommendKey())
+	if appErr != nil {
+		return nil, errors.Wrapf(appErr, "get recommendations error.")
+	}
+
+	if data == nil {
+		return p._rebuildRecommendations()
+	}
+
+	index := &RecommendationIndex{}
+	if err := json.Unmarshal(data, index); err != nil {
+		return nil, errors.Wrapf(err, "convert recommendations error.")
+	}
+	return index, nil
+}
+
+func (p *Plugin) _rebuildRecommendations() (*RecommendationIndex, error) {
+	index, err := p._buildRecommendations()
+	if err != nil {
+		return nil, err
+	}
+	if err := p._saveRecommendations(index); err != nil {
+		return nil, err
+	}
+	return index, nil
+}
+
+// Rebuilds the indexes older than RECOMMEND_REBUILD_HOURS.
+// Servers of a cluster may build an index at the same time, the results are the same.
+func (p *Plugin) _refreshRecommendations(now time.Time) error {
+	for _, id := range p.libraryIds {
+		lp, err := p._withLibrary(id)
+		if err != nil {
+			return err
+		}
+
+		data, appErr := p.API.KVGet(lp._recommendKey())
+		if appErr != nil {
+			return errors.Wrapf(appErr, "get recommendations of library %v error.", id)
+		}
+		if data != nil {
+			var index RecommendationIndex
+			if err := json.Unmarshal(data, &index); err == nil &&
+				_millisOf(now)-index.BuildAt < int64(RECOMMEND_REBUILD_HOURS*time.Hour/time.Millisecond) {
+				continue
+			}
+		}
+
+		if _, err := lp._rebuildRecommendations(); err != nil {
+			return err
+		}
+		p.API.LogInfo("Recommendations rebuilt.", "library", id)
+	}
+	return nil
+}
+
+// The books borrowed by the readers of a book.
+// A new book without borrows falls back to the books of the same categories, the closer first.
+func (p *Plugin) _alsoBorrowed(bookPostId string, limit int) ([]Recommendation, error) {
+	info, err := p.GetABook(bookPostId)
+	if err != nil {
+		return nil, err
+	}
+
+	index, err := p._loadRecommendations()
+	if err != nil {
+		return nil, err
+	}
+
+	book, ok := index.Books[bookPostId]
+	if !ok {
+		// created after the index was built
+		book = _newRecommendedBook(info.book.BookPublic)
+	}
+
+	picker := _newRecommendationPicker(index, limit, map[string]bool{bookPostId: true})
+	for _, also := range book.AlsoBorrowed {
+		picker.add(also.BookPostId, also.Score, RECOMMEND_REASON_CO_BORROW)
+	}
+	picker.addByCategories([]*RecommendedBook{book})
+
+	return picker.picked, nil
+}
+
+// Books borrowed together with the ones the user has read, then the books of the same categories,
+// then the most borrowed ones. Books the user has borrowed are never suggested.
+func (p *Plugin) _suggestForUser(userId string, limit int) ([]Recommendation, error) {
+	user, appErr := p.API.GetUser(userId)
+	if appErr != nil {
+		return nil, errors.Wrapf(appErr, "get user %v error.", userId)
+	}
+
+	index, err := p._loadRecommendations()
+	if err != nil {
+		return nil, err
+	}
+
+	read := map[string]bool{}
+	readBooks := []*RecommendedBook{}
+	for _, id := range index.Readers[user.Username] {
+		read[id] = true
+		if book, ok := index.Books[id]; ok {
+			readBooks = append(readBooks, book)
+		}
+	}
+
+	scores := map[string]int{}
+	for _, book := range readBooks {
+		for _, also := range book.AlsoBorrowed {
+			scores[also.BookPostId] += also.Score
+		}
+	}
+	coBorrowed := []BookScore{}
+	for id, score := range scores {
+		coBorrowed = append(coBorrowed, BookScore{id, score})
+	}
+	sort.Slice(coBorrowed, func(i, j int) bool {
+		if coBorrowed[i].Score != coBorrowed[j].Score {
+			return coBorrowed[i].Score > coBorrowed[j].Score
+		}
+		return coBorrowed[i].BookPostId < coBorrowed[j].BookPostId
+	})
+
+	picker := _newRecommendationPicker(index, limit, read)
+	for _, also := range coBorrowed {
+		picker.add(also.BookPostId, also.Score, RECOMMEND_REASON_CO_BORROW)
+	}
+	picker.addByCategories(readBooks)
+	for _, id := range _sortedByBorrows(index, func(string) bool { return true }) {
+		picker.add(id, index.Books[id].Borrows, RECOMMEND_REASON_POPULAR)
+	}
+
+	return picker.picked, nil
+}
+
+type recommendationPicker struct {
+	index   *RecommendationIndex
+	limit   int
+	exclude map[string]bool
+	picked  []Recommendation
+}
+
+func _newRecommendationPicker(index *RecommendationIndex, limit int, exclude map[string]bool) *recommendationPicker {
+	excluded := map[string]bool{}
+	for id := range exclude {
+		excluded[id] = true
+	}
+	return &recommendationPicker{index, limit, excluded, []Recommendation{}}
+}
+
+func (r *recommendationPicker) add(id string, score int, reason string) {
+	book, ok := r.index.Books[id]
+	if !ok || r.exclude[id] || len(r.picked) >= r.limit {
+		return
+	}
+	r.exclude[id] = true
+	r.picked = append(r.picked, Recommendation{
+		BookPostId: id,
+		Name:       book.Name,
+		Score:      score,
+		Reason:     reason,
+	})
+}
+
+// The score is the depth of the categories shared with one of the books,
+// e.g. 2 if Category1 and Category2 are the same.
+func (r *recommendationPicker) addByCategories(books []*RecommendedBook) {
+	depthOf := func(id string) int {
+		depth := 0
+		for _, book := range books {
+			if d := _sharedCategories(book.Categories, r.index.Books[id].Categories); d > depth {
+				depth = d
+			}
+		}
+		return depth
+	}
+
+	depths := map[string]int{}
+	candidates := _sortedByBorrows(r.index, func(id string) bool {
+		depths[id] = depthOf(id)
+		return depths[id] > 0
+	})
+	sort.SliceStable(candidates, func(i, j int) bool {
+		return depths[candidates[i]] > depths[candidates[j]]
+	})
+	for _, id := range candidates {
+		r.add(id, depths[id], RECOMMEND_REASON_CATEGORY)
+	}
+}
+
+func _sharedCategories(a []string, b []string) int {
+	depth := 0
+	for i := 0; i < len(a) && i < len(b); i++ {
+		if a[i] == "" || a[i] != b[i] {
+			break
+		}
+		depth++
+	}
+	return depth
+}
+
+// The most borrowed first.
+func _sortedByBorrows(index *RecommendationIndex, filter func(id string) bool) []string {
+	ids := []string{}
+	for id := range index.Books {
+		if filter(id) {
+			ids = append(ids, id)
+		}
+	}
+	sort.Slice(ids, func(i, j int) bool {
+		a, b := index.Books[ids[i]], index.Books[ids[j]]
+		if a.Borrows != b.Borrows {
+			return a.Borrows > b.Borrows
+		}
+		return ids[i] < ids[j]
+	})
+	return ids
+}
+
+func _parseRecommendLimit(value string) (int, error) {
+	if value == "" {
+		return RECOMMEND_DEFAULT_LIMIT, nil
+	}
+	limit, err := strconv.Atoi(value)
+	if err != nil || limit <= 0 || limit > RECOMMEND_MAX_LIMIT {
+		return 0, KindError(ErrInvalidRequest, "limit should be from 1 to %v.", RECOMMEND_MAX_LIMIT)
+	}
+	return limit, nil
+}
+
+func _formatRecommendations(title string, recommendations []Recommendation) string {
+	if len(recommendations) == 0 {
+		return "No recommendations yet."
+	}
+
+	reasons := map[string]string{
+		RECOMMEND_REASON_CO_BORROW: "readers also borrowed",
+		RECOMMEND_REASON_CATEGORY:  "same category",
+		RECOMMEND_REASON_POPULAR:   "popular",
+	}
+	lines := []string{title}
+	for i, r := range recommendations {
+		lines = append(lines, fmt.Sprintf("%v. %v (%v)", i+1, r.Name, reasons[r.Reason]))
+	}
+	return strings.Join(lines, "\n")
+}
@@ -0,0 +1,203 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/mattermost/mattermost-server/v5/model"
+	"github.com/mattermost/mattermost-server/v5/plugin/plugintest"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRecommendations(t *testing.T) {
+
+	type recommendEnv struct {
+		td     *TestData
+		api    *plugintest.API
+		plugin *Plugin
+		repo   *memRepository
+	}
+
+	setup := func(t *testing.T) *recommendEnv {
+		td := NewTestData()
+		api := td.ApiMockCommon()
+		plugin := td.NewMockPlugin()
+		plugin.SetAPI(api)
+		repo := newMemRepository()
+		plugin.repo = repo
+		return &recommendEnv{td, api, plugin, repo}
+	}
+
+	createBook := func(t *testing.T, env *recommendEnv, name string, categories ...string) string {
+		var book Book
+		DeepCopy(&book, env.td.ABook)
+		book.BookPublic.Id = ""
+		book.BookPublic.Name = name
+		book.BookPublic.Category1, book.BookPublic.Category2, book.BookPublic.Category3 = "", "", ""
+		if len(categories) > 0 {
+			book.BookPublic.Category1 = categories[0]
+		}
+		if len(categories) > 1 {
+			book.BookPublic.Category2 = categories[1]
+		}
+		if len(categories) > 2 {
+			book.BookPublic.Category3 = categories[2]
+		}
+		id, err := env.plugin._createABook(&book)
+		require.Nil(t, err)
+		return id
+	}
+
+	createBorrow := func(t *testing.T, env *recommendEnv, borrower string, bookId string, status string) {
+		wf := env.plugin._createWFTemplate(GetNowTime())
+		br := &BorrowRequest{
+			BookPostId:   bookId,
+			BorrowerUser: borrower,
+			Worflow:      wf,
+			StepIndex:    _getIndexByStatus(status, wf),
+			Tags:         []string{TAG_PREFIX_BORROWER + borrower, TAG_PREFIX_STATUS + status},
+		}
+		data, _ := _marshalRecord(&Borrow{DataOrImage: br, Role: []string{MASTER}})
+		_, err := env.repo.Create(&model.Post{
+			ChannelId: env.plugin.borrowChannel.Id,
+			Type:      "custom_borrow_type",
+			Message:   string(data),
+		})
+		require.Nil(t, err)
+	}
+
+	ids := func(recommendations []Recommendation) []string {
+		arr := []string{}
+		for _, r := range recommendations {
+			arr = append(arr, r.BookPostId)
+		}
+		return arr
+	}
+
+	t.Run("also_borrowed", func(t *testing.T) {
+		env := setup(t)
+		a := createBook(t, env, "book a", "c1")
+		b := createBook(t, env, "book b", "c2")
+		c := createBook(t, env, "book c", "c3")
+		d := createBook(t, env, "book d", "c4")
+
+		createBorrow(t, env, "bor", a, STATUS_RETURNED)
+		createBorrow(t, env, "bor", b, STATUS_RETURNED)
+		createBorrow(t, env, "worker1", a, STATUS_RETURNED)
+		createBorrow(t, env, "worker1", b, STATUS_RETURNED)
+		createBorrow(t, env, "worker1", c, STATUS_RETURNED)
+		// not returned yet
+		createBorrow(t, env, "worker2", a, STATUS_RETURNED)
+		createBorrow(t, env, "worker2", d, STATUS_DELIVIED)
+
+		recommendations, err := env.plugin._alsoBorrowed(a, RECOMMEND_DEFAULT_LIMIT)
+		require.Nil(t, err)
+		assert.Equal(t, []string{b, c}, ids(recommendations))
+		assert.Equal(t, 2, recommendations[0].Score)
+		assert.Equal(t, "book b", recommendations[0].Name)
+		assert.Equal(t, RECOMMEND_REASON_CO_BORROW, recommendations[0].Reason)
+
+		recommendations, err = env.plugin._alsoBorrowed(a, 1)
+		require.Nil(t, err)
+		assert.Equal(t, []string{b}, ids(recommendations))
+
+		_, err = env.plugin._alsoBorrowed(model.NewId(), RECOMMEND_DEFAULT_LIMIT)
+		assert.ErrorIs(t, err, ErrNotFound)
+	})
+
+	t.Run("category_fallback", func(t *testing.T) {
+		env := setup(t)
+		novel := createBook(t, env, "a novel", "literature", "novel", "fantasy")
+		poem := createBook(t, env, "a poem", "literature", "poetry")
+		createBook(t, env, "a math book", "science", "math")
+		createBorrow(t, env, "bor", poem, STATUS_RETURNED)
+
+		// the index is built before the new book
+		_, err := env.plugin._rebuildRecommendations()
+		require.Nil(t, err)
+		fantasy := createBook(t, env, "a new fantasy novel", "literature", "novel", "fantasy")
+
+		recommendations, err := env.plugin._alsoBorrowed(fantasy, RECOMMEND_DEFAULT_LIMIT)
+		require.Nil(t, err)
+		assert.Equal(t, []string{novel, poem}, ids(recommendations), "the closer category first")
+		assert.Equal(t, 3, recommendations[0].Score)
+		assert.Equal(t, RECOMMEND_REASON_CATEGORY, recommendations[0].Reason)
+	})
+
+	t.Run("suggest_for_user", func(t *testing.T) {
+		env := setup(t)
+		a := createBook(t, env, "book a", "c1")
+		b := createBook(t, env, "book b", "c2")
+		c := createBook(t, env, "book c", "c1")
+		d := createBook(t, env, "book d", "c3")
+		e := createBook(t, env, "book e", "c4")
+
+		createBorrow(t, env, "worker1", a, STATUS_RETURNED)
+		createBorrow(t, env, "worker1", b, STATUS_RETURNED)
+		createBorrow(t, env, "worker2", a, STATUS_RETURNED)
+		createBorrow(t, env, "worker2", d, STATUS_RETURNED)
+		createBorrow(t, env, "worker2", e, STATUS_RETURNED)
+		createBorrow(t, env, "kpuser1", e, STATUS_RETURNED)
+		createBorrow(t, env, "bor", a, STATUS_RETURNED)
+		// being read
+		createBorrow(t, env, "bor", d, STATUS_DELIVIED)
+
+		recommendations, err := env.plugin._suggestForUser(env.td.BorId, RECOMMEND_DEFAULT_LIMIT)
+		require.Nil(t, err)
+		assert.Equal(t, []string{e, b, c}, ids(recommendations), "books borrowed are excluded")
+		assert.Equal(t, []string{RECOMMEND_REASON_CO_BORROW, RECOMMEND_REASON_CO_BORROW, RECOMMEND_REASON_CATEGORY},
+			[]string{recommendations[0].Reason, recommendations[1].Reason, recommendations[2].Reason})
+
+		// a new user gets the popular books
+		recommendations, err = env.plugin._suggestForUser(env.td.Keeper2Id, 1)
+		require.Nil(t, err)
+		assert.Equal(t, []string{a}, ids(recommendations))
+		assert.Equal(t, RECOMMEND_REASON_POPULAR, recommendations[0].Reason)
+		assert.Equal(t, 3, recommendations[0].Score)
+	})
+
+	t.Run("refresh", func(t *testing.T) {
+		env := setup(t)
+		env.api.On("LogInfo", "Recommendations rebuilt.", "library", env.plugin.library.id).Return()
+		a := createBook(t, env, "book a", "c1")
+
+		now := time.Now()
+		require.Nil(t, env.plugin._refreshRecommendations(now))
+		index, err := env.plugin._loadRecommendations()
+		require.Nil(t, err)
+		assert.Equal(t, 0, index.Books[a].Borrows)
+
+		createBorrow(t, env, "bor", a, STATUS_RETURNED)
+		require.Nil(t, env.plugin._refreshRecommendations(now.Add(time.Hour)))
+		index, err = env.plugin._loadRecommendations()
+		require.Nil(t, err)
+		assert.Equal(t, 0, index.Books[a].Borrows, "not rebuilt within the interval")
+
+		require.Nil(t, env.plugin._refreshRecommendations(now.Add(RECOMMEND_REBUILD_HOURS*time.Hour+time.Minute)))
+		index, err = env.plugin._loadRecommendations()
+		require.Nil(t, err)
+		assert.Equal(t, 1, index.Books[a].Borrows)
+	})
+
+	t.Run("command", func(t *testing.T) {
+		env := setup(t)
+		a := createBook(t, env, "book a", "c1")
+		b := createBook(t, env, "book b", "c1")
+		createBorrow(t, env, "worker1", a, STATUS_RETURNED)
+
+		text, err := env.plugin._executeRecommend(env.td.BorId, nil)
+		require.Nil(t, err)
+		assert.Equal(t, "Books you may like:\n1. book a (popular)\n2. book b (popular)", text)
+
+		text, err = env.plugin._executeRecommend(env.td.BorId, []string{b})
+		require.Nil(t, err)
+		assert.Equal(t, "Readers of this book also borrowed:\n1. book a (same category)", text)
+
+		_, err = env.plugin._executeRecommend(env.td.BorId, []string{"rebuild"})
+		assert.ErrorIs(t, err, ErrNotPermitted)
+
+		_, err = _parseRecommendLimit("0")
+		assert.ErrorIs(t, err, ErrInvalidRequest)
+	})
+}
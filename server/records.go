@@ -0,0 +1,83 @@
+package main
+
+import (
+	"encoding/json"
+
+	"github.com/mattermost/mattermost-server/v5/model"
+	"github.com/pkg/errors"
+)
+
+const masterRecordsPerPage = 200
+
+// A purchase or a donation is kept in one master record in the borrow channel.
+// The record is unmarshaled into v, ErrNotFound is returned if it is not of the record type.
+func (p *Plugin) _getMasterRecord(id string, recordType string, v schemaVersioned) (*model.Post, error) {
+	post, err := p._repo().Get(id)
+	if errors.Is(err, ErrNotFound) {
+		return nil, ErrNotFound
+	}
+	if err != nil {
+		return nil, errors.Wrapf(err, "Get post error.")
+	}
+	if post.Type != recordType {
+		return nil, errors.Wrapf(ErrNotFound, "post %v is not a %v", id, recordType)
+	}
+
+	if err := json.Unmarshal([]byte(post.Message), v); err != nil {
+		return nil, errors.Wrapf(err, "Unmarshal post error.")
+	}
+
+	return post, nil
+}
+
+// The caller deletes the lock of the master key unless ErrLocked is returned.
+func (p *Plugin) _lockAndGetMasterRecord(masterKey string, recordType string, v schemaVersioned) (*model.Post, error) {
+	if _, ok := lockmap.LoadOrStore(masterKey, struct{}{}); ok {
+		return nil, errors.Wrapf(ErrLocked, "Lock %v error", MASTER)
+	}
+
+	post, err := p._getMasterRecord(masterKey, recordType, v)
+	if err != nil {
+		return nil, errors.Wrapf(err, "Get %v record error", MASTER)
+	}
+	if err := p._checkLibraryPost(post, p.borrowChannel); err != nil {
+		return nil, err
+	}
+
+	return post, nil
+}
+
+// The updated post is returned.
+func (p *Plugin) _saveMasterRecord(post *model.Post, v schemaVersioned) (*model.Post, error) {
+	data, err := _marshalRecord(v)
+	if err != nil {
+		return nil, errors.Wrapf(err, "Marshal record error.")
+	}
+
+	updated := &model.Post{}
+	DeepCopy(updated, post)
+	updated.Message = string(data)
+	if _, err := p._repo().Update(updated); err != nil {
+		return nil, errors.Wrapf(err, "Update post error. postid: %v", post.Id)
+	}
+	return updated, nil
+}
+
+// Every master record of the type in the borrow channel, the newest first.
+func (p *Plugin) _eachMasterRecord(recordType string, fn func(record *model.Post)) error {
+	for page := 0; ; page++ {
+		records, err := p._repo().List(p.borrowChannel, page, masterRecordsPerPage)
+		if err != nil {
+			return errors.Wrapf(err, "list %v records error. page: %v", recordType, page)
+		}
+		for _, record := range records {
+			if record.Type != recordType || record.RootId != "" {
+				continue
+			}
+			fn(record)
+		}
+		if len(records) < masterRecordsPerPage {
+			return nil
+		}
+	}
+}
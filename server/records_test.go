@@ -0,0 +1,52 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/mattermost/mattermost-server/v5/model"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestMasterRecords(t *testing.T) {
+
+	t.Run("get_lock_save", func(t *testing.T) {
+		env := newRequestEnv(nil)
+		masterKey, err := env.plugin._offerDonation(env.td.BorId, &DonationOffer{BookName: "a book"})
+		require.Nil(t, err)
+
+		_, err = env.plugin._getMasterRecord(masterKey, "custom_purchase_type", &Purchase{})
+		assert.ErrorIs(t, err, ErrNotFound, "not a purchase")
+
+		dn := &Donation{}
+		post, err := env.plugin._lockAndGetMasterRecord(masterKey, "custom_donation_type", dn)
+		require.Nil(t, err)
+		defer lockmap.Delete(masterKey)
+		_, err = env.plugin._lockAndGetMasterRecord(masterKey, "custom_donation_type", &Donation{})
+		assert.ErrorIs(t, err, ErrLocked)
+
+		dn.DataOrImage.BookName = "another book"
+		_, err = env.plugin._saveMasterRecord(post, dn)
+		require.Nil(t, err)
+		saved := &Donation{}
+		_, err = env.plugin._getMasterRecord(masterKey, "custom_donation_type", saved)
+		require.Nil(t, err)
+		assert.Equal(t, "another book", saved.DataOrImage.BookName)
+	})
+
+	t.Run("each_of_type", func(t *testing.T) {
+		env := newRequestEnv(nil)
+		first, err := env.plugin._offerDonation(env.td.BorId, &DonationOffer{BookName: "a book"})
+		require.Nil(t, err)
+		_, err = env.plugin._proposePurchase(env.td.BorId, &PurchaseProposal{BookName: "a new book"})
+		require.Nil(t, err)
+		second, err := env.plugin._offerDonation(env.td.BorId, &DonationOffer{BookName: "another book"})
+		require.Nil(t, err)
+
+		ids := []string{}
+		require.Nil(t, env.plugin._eachMasterRecord("custom_donation_type", func(record *model.Post) {
+			ids = append(ids, record.Id)
+		}))
+		assert.Equal(t, []string{second, first}, ids, "the newest first")
+	})
+}
@@ -0,0 +1,175 @@
+package main
+
+import (
+	"net/http"
+	"sort"
+	"strings"
+
+	"github.com/mattermost/mattermost-server/v5/model"
+	"github.com/mattermost/mattermost-server/v5/plugin"
+	"github.com/pkg/errors"
+)
+
+const (
+	STORAGE_POST = "post"
+	STORAGE_KV   = "kv"
+)
+
+// Books and borrows are kept as records:
+// a book in three records(public, private and inventory), a borrow or a transfer in one record for each role.
+// A record has the shape of a post, its Message is the JSON data,
+// and the hashtags in the Message are its secondary index.
+type Repository interface {
+	// returns ErrNotFound if there is no such record
+	Get(id string) (*model.Post, error)
+	// the id of the record is assigned by the repository
+	Create(record *model.Post) (*model.Post, error)
+	Update(record *model.Post) (*model.Post, error)
+	Delete(id string) error
+	// records in the channel with the hashtag
+	SearchByTag(channel *model.Channel, tag string) ([]*model.Post, error)
+	// records in the channel, the newest first
+	List(channel *model.Channel, page int, perPage int) ([]*model.Post, error)
+}
+
+// Posts are the default repository.
+func (p *Plugin) _repo() Repository {
+	if p.repo != nil {
+		return p.repo
+	}
+	return &postRepository{api: p.API}
+}
+
+// The memory repository is not a storage, it loses every record on restart,
+// tests assign it to the plugin directly.
+func (p *Plugin) _newRepository(storage string) (Repository, error) {
+	switch storage {
+	case "", STORAGE_POST:
+		return &postRepository{api: p.API}, nil
+	case STORAGE_KV:
+		return newKVRepository(p.API), nil
+	default:
+		return nil, errors.Errorf("unknown storage %v", storage)
+	}
+}
+
+type postRepository struct {
+	api plugin.API
+}
+
+func (r *postRepository) Get(id string) (*model.Post, error) {
+	post, appErr := r.api.GetPost(id)
+	if appErr != nil {
+		if appErr.StatusCode == http.StatusNotFound {
+			return nil, errors.Wrapf(ErrNotFound, "post %v", id)
+		}
+		return nil, appErr
+	}
+	return post, nil
+}
+
+func (r *postRepository) Create(record *model.Post) (*model.Post, error) {
+	post, appErr := r.api.CreatePost(record)
+	if appErr != nil {
+		return nil, appErr
+	}
+	return post, nil
+}
+
+func (r *postRepository) Update(record *model.Post) (*model.Post, error) {
+	post, appErr := r.api.UpdatePost(record)
+	if appErr != nil {
+		return nil, appErr
+	}
+	return post, nil
+}
+
+func (r *postRepository) Delete(id string) error {
+	if appErr := r.api.DeletePost(id); appErr != nil {
+		return appErr
+	}
+	return nil
+}
+
+func (r *postRepository) SearchByTag(channel *model.Channel, tag string) ([]*model.Post, error) {
+	posts, appErr := r.api.SearchPostsInTeam(channel.TeamId, []*model.SearchParams{
+		{
+			Terms:     tag,
+			IsHashtag: true,
+			InChannels: []string{
+				channel.Name,
+			},
+		},
+	})
+	if appErr != nil {
+		return nil, appErr
+	}
+	return posts, nil
+}
+
+func (r *postRepository) List(channel *model.Channel, page int, perPage int) ([]*model.Post, error) {
+	postList, appErr := r.api.GetPostsForChannel(channel.Id, page, perPage)
+	if appErr != nil {
+		return nil, appErr
+	}
+
+	posts := []*model.Post{}
+	for _, id := range postList.Order {
+		if post := postList.Posts[id]; post != nil {
+			posts = append(posts, post)
+		}
+	}
+	return posts, nil
+}
+
+func (p *Plugin) _recordsArePosts() bool {
+	_, ok := p._repo().(*postRepository)
+	return ok
+}
+
+// Status changes are told in the thread of a record,
+// or in its channel when records are not posts.
+func (p *Plugin) _notifyRecord(record *model.Post, message string) error {
+	post := &model.Post{
+		UserId:    p.botID,
+		ChannelId: record.ChannelId,
+		Message:   message,
+	}
+	if p._recordsArePosts() {
+		post.RootId = record.Id
+	}
+
+	if _, appErr := p.API.CreatePost(post); appErr != nil {
+		return appErr
+	}
+	return nil
+}
+
+// The hashtags the server would index a post by.
+func _recordTags(message string) []string {
+	hashtags, _ := model.ParseHashtags(message)
+
+	set := map[string]bool{}
+	for _, tag := range strings.Fields(hashtags) {
+		set[strings.ToLower(tag)] = true
+	}
+
+	tags := []string{}
+	for tag := range set {
+		tags = append(tags, tag)
+	}
+	sort.Strings(tags)
+	return tags
+}
+
+func _pageOf(ids []string, page int, perPage int) []string {
+	start := page * perPage
+	if start >= len(ids) {
+		return nil
+	}
+	end := start + perPage
+	if end > len(ids) {
+		end = len(ids)
+	}
+	return ids[start:end]
+}
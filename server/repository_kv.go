@@ -0,0 +1,254 @@
+package main
+
+import (
+	"crypto/sha1"
+	"encoding/hex"
+	"encoding/json"
+	"strings"
+
+	"github.com/mattermost/mattermost-server/v5/model"
+	"github.com/mattermost/mattermost-server/v5/plugin"
+	"github.com/pkg/errors"
+)
+
+const (
+	kvRecordPrefix  = "rec_"
+	kvChannelPrefix = "chl_"
+	kvTagPrefix     = "tag_"
+	kvIndexRetries  = 5
+)
+
+// Records in the KV store, free of the post size limit.
+// Each record is kept under its id, and indexed by its channel and by its hashtags.
+// The indexes are updated by compare-and-set, so concurrent writers don't lose ids.
+type kvRepository struct {
+	api plugin.API
+}
+
+func newKVRepository(api plugin.API) *kvRepository {
+	return &kvRepository{api: api}
+}
+
+func _kvRecordKey(id string) string {
+	return kvRecordPrefix + id
+}
+
+func _kvChannelKey(channelId string) string {
+	return kvChannelPrefix + channelId
+}
+
+// KV keys are limited to 50 characters, so the channel and the tag are hashed.
+func _kvTagKey(channelId string, tag string) string {
+	sum := sha1.Sum([]byte(channelId + " " + strings.ToLower(tag)))
+	return kvTagPrefix + hex.EncodeToString(sum[:])
+}
+
+func (r *kvRepository) Get(id string) (*model.Post, error) {
+	data, appErr := r.api.KVGet(_kvRecordKey(id))
+	if appErr != nil {
+		return nil, errors.Wrapf(appErr, "get record %v error.", id)
+	}
+	if data == nil {
+		return nil, errors.Wrapf(ErrNotFound, "record %v", id)
+	}
+
+	record := new(model.Post)
+	if err := json.Unmarshal(data, record); err != nil {
+		return nil, errors.Wrapf(err, "convert record %v error.", id)
+	}
+	return record, nil
+}
+
+func (r *kvRepository) _set(record *model.Post) error {
+	data, err := json.Marshal(record)
+	if err != nil {
+		return errors.Wrapf(err, "convert record %v error.", record.Id)
+	}
+	if appErr := r.api.KVSet(_kvRecordKey(record.Id), data); appErr != nil {
+		return errors.Wrapf(appErr, "set record %v error.", record.Id)
+	}
+	return nil
+}
+
+func (r *kvRepository) Create(record *model.Post) (*model.Post, error) {
+	created := record.Clone()
+	created.Id = model.NewId()
+	created.CreateAt = GetNowTime()
+	created.UpdateAt = created.CreateAt
+
+	if err := r._set(created); err != nil {
+		return nil, err
+	}
+
+	if err := r._addToIndex(_kvChannelKey(created.ChannelId), created.Id); err != nil {
+		return nil, err
+	}
+	for _, tag := range _recordTags(created.Message) {
+		if err := r._addToIndex(_kvTagKey(created.ChannelId, tag), created.Id); err != nil {
+			return nil, err
+		}
+	}
+
+	return created, nil
+}
+
+func (r *kvRepository) Update(record *model.Post) (*model.Post, error) {
+	old, err := r.Get(record.Id)
+	if err != nil {
+		return nil, err
+	}
+
+	updated := record.Clone()
+	updated.ChannelId = old.ChannelId
+	updated.CreateAt = old.CreateAt
+	updated.UpdateAt = GetNowTime()
+
+	if err := r._set(updated); err != nil {
+		return nil, err
+	}
+
+	oldTags := ConvertStringArrayToSet(_recordTags(old.Message))
+	newTags := ConvertStringArrayToSet(_recordTags(updated.Message))
+	for tag := range oldTags {
+		if !newTags[tag] {
+			if err := r._removeFromIndex(_kvTagKey(updated.ChannelId, tag), updated.Id); err != nil {
+				return nil, err
+			}
+		}
+	}
+	for tag := range newTags {
+		if !oldTags[tag] {
+			if err := r._addToIndex(_kvTagKey(updated.ChannelId, tag), updated.Id); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	return updated, nil
+}
+
+func (r *kvRepository) Delete(id string) error {
+	record, err := r.Get(id)
+	if err != nil {
+		return err
+	}
+
+	for _, tag := range _recordTags(record.Message) {
+		if err := r._removeFromIndex(_kvTagKey(record.ChannelId, tag), id); err != nil {
+			return err
+		}
+	}
+	if err := r._removeFromIndex(_kvChannelKey(record.ChannelId), id); err != nil {
+		return err
+	}
+
+	if appErr := r.api.KVDelete(_kvRecordKey(id)); appErr != nil {
+		return errors.Wrapf(appErr, "delete record %v error.", id)
+	}
+	return nil
+}
+
+// An index may be ahead of the records when a writer fails halfway,
+// so the found records are checked again.
+func (r *kvRepository) SearchByTag(channel *model.Channel, tag string) ([]*model.Post, error) {
+	ids, _, err := r._loadIndex(_kvTagKey(channel.Id, tag))
+	if err != nil {
+		return nil, err
+	}
+
+	tag = strings.ToLower(tag)
+	found := []*model.Post{}
+	for _, id := range ids {
+		record, err := r.Get(id)
+		if errors.Is(err, ErrNotFound) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		if !ConvertStringArrayToSet(_recordTags(record.Message))[tag] {
+			continue
+		}
+		found = append(found, record)
+	}
+	return found, nil
+}
+
+func (r *kvRepository) List(channel *model.Channel, page int, perPage int) ([]*model.Post, error) {
+	ids, _, err := r._loadIndex(_kvChannelKey(channel.Id))
+	if err != nil {
+		return nil, err
+	}
+
+	records := []*model.Post{}
+	for _, id := range _pageOf(ReverseStrings(ids), page, perPage) {
+		record, err := r.Get(id)
+		if errors.Is(err, ErrNotFound) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		records = append(records, record)
+	}
+	return records, nil
+}
+
+func (r *kvRepository) _loadIndex(key string) ([]string, []byte, error) {
+	data, appErr := r.api.KVGet(key)
+	if appErr != nil {
+		return nil, nil, errors.Wrapf(appErr, "get index %v error.", key)
+	}
+
+	ids := []string{}
+	if data == nil {
+		return ids, nil, nil
+	}
+	if err := json.Unmarshal(data, &ids); err != nil {
+		return nil, nil, errors.Wrapf(err, "convert index %v error.", key)
+	}
+	return ids, data, nil
+}
+
+func (r *kvRepository) _updateIndex(key string, update func(ids []string) []string) error {
+	for i := 0; i < kvIndexRetries; i++ {
+		ids, oldData, err := r._loadIndex(key)
+		if err != nil {
+			return err
+		}
+
+		var newData []byte
+		if newIds := update(ids); len(newIds) > 0 {
+			if newData, err = json.Marshal(newIds); err != nil {
+				return errors.Wrapf(err, "convert index %v error.", key)
+			}
+		}
+
+		ok, appErr := r.api.KVCompareAndSet(key, oldData, newData)
+		if appErr != nil {
+			return errors.Wrapf(appErr, "set index %v error.", key)
+		}
+		if ok {
+			return nil
+		}
+	}
+
+	return errors.Wrapf(ErrLocked, "update index %v", key)
+}
+
+func (r *kvRepository) _addToIndex(key string, id string) error {
+	return r._updateIndex(key, func(ids []string) []string {
+		for _, v := range ids {
+			if v == id {
+				return ids
+			}
+		}
+		return append(ids, id)
+	})
+}
+
+func (r *kvRepository) _removeFromIndex(key string, id string) error {
+	return r._updateIndex(key, func(ids []string) []string {
+		return RemoveString(ids, id)
+	})
+}
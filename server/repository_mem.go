@@ -0,0 +1,112 @@
+package main
+
+import (
+	"strings"
+	"sync"
+
+	"github.com/mattermost/mattermost-server/v5/model"
+	"github.com/pkg/errors"
+)
+
+// Records in memory only, e.g. to test the workflow without posts.
+type memRepository struct {
+	mu      sync.Mutex
+	records map[string]*model.Post
+	// channel id -> record ids, the oldest first
+	channels map[string][]string
+}
+
+func newMemRepository() *memRepository {
+	return &memRepository{
+		records:  map[string]*model.Post{},
+		channels: map[string][]string{},
+	}
+}
+
+func (r *memRepository) Get(id string) (*model.Post, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	record, ok := r.records[id]
+	if !ok {
+		return nil, errors.Wrapf(ErrNotFound, "record %v", id)
+	}
+	return record.Clone(), nil
+}
+
+func (r *memRepository) Create(record *model.Post) (*model.Post, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	created := record.Clone()
+	created.Id = model.NewId()
+	created.CreateAt = GetNowTime()
+	created.UpdateAt = created.CreateAt
+
+	r.records[created.Id] = created
+	r.channels[created.ChannelId] = append(r.channels[created.ChannelId], created.Id)
+
+	return created.Clone(), nil
+}
+
+func (r *memRepository) Update(record *model.Post) (*model.Post, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	old, ok := r.records[record.Id]
+	if !ok {
+		return nil, errors.Wrapf(ErrNotFound, "record %v", record.Id)
+	}
+
+	updated := record.Clone()
+	updated.ChannelId = old.ChannelId
+	updated.CreateAt = old.CreateAt
+	updated.UpdateAt = GetNowTime()
+	r.records[updated.Id] = updated
+
+	return updated.Clone(), nil
+}
+
+func (r *memRepository) Delete(id string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	record, ok := r.records[id]
+	if !ok {
+		return errors.Wrapf(ErrNotFound, "record %v", id)
+	}
+
+	delete(r.records, id)
+	r.channels[record.ChannelId] = RemoveString(r.channels[record.ChannelId], id)
+
+	return nil
+}
+
+func (r *memRepository) SearchByTag(channel *model.Channel, tag string) ([]*model.Post, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	tag = strings.ToLower(tag)
+	found := []*model.Post{}
+	for _, id := range r.channels[channel.Id] {
+		record := r.records[id]
+		for _, t := range _recordTags(record.Message) {
+			if t == tag {
+				found = append(found, record.Clone())
+				break
+			}
+		}
+	}
+	return found, nil
+}
+
+func (r *memRepository) List(channel *model.Channel, page int, perPage int) ([]*model.Post, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	records := []*model.Post{}
+	for _, id := range _pageOf(ReverseStrings(r.channels[channel.Id]), page, perPage) {
+		records = append(records, r.records[id].Clone())
+	}
+	return records, nil
+}
@@ -0,0 +1,203 @@
+package main
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/mattermost/mattermost-server/v5/model"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRepository(t *testing.T) {
+
+	channel := &model.Channel{Id: model.NewId()}
+	other := &model.Channel{Id: model.NewId()}
+
+	testRepository := func(t *testing.T, repo Repository) {
+		a, err := repo.Create(&model.Post{ChannelId: channel.Id, Message: `#Author_A #isbn_1`})
+		require.Nil(t, err)
+		require.NotEmpty(t, a.Id)
+		b, err := repo.Create(&model.Post{ChannelId: channel.Id, Message: `#author_a #isbn_2`})
+		require.Nil(t, err)
+		_, err = repo.Create(&model.Post{ChannelId: other.Id, Message: `#author_a`})
+		require.Nil(t, err)
+
+		got, err := repo.Get(a.Id)
+		require.Nil(t, err)
+		assert.Equal(t, a.Message, got.Message)
+
+		_, err = repo.Get(model.NewId())
+		assert.ErrorIs(t, err, ErrNotFound)
+
+		found, err := repo.SearchByTag(channel, "#author_a")
+		require.Nil(t, err)
+		assert.ElementsMatch(t, []string{a.Id, b.Id}, _recordIds(found))
+
+		a.Message = `#author_b #isbn_1`
+		_, err = repo.Update(a)
+		require.Nil(t, err)
+
+		found, err = repo.SearchByTag(channel, "#author_a")
+		require.Nil(t, err)
+		assert.Equal(t, []string{b.Id}, _recordIds(found))
+		found, err = repo.SearchByTag(channel, "#Author_B")
+		require.Nil(t, err)
+		assert.Equal(t, []string{a.Id}, _recordIds(found))
+
+		list, err := repo.List(channel, 0, 1)
+		require.Nil(t, err)
+		assert.Equal(t, []string{b.Id}, _recordIds(list), "the newest first")
+		list, err = repo.List(channel, 1, 1)
+		require.Nil(t, err)
+		assert.Equal(t, []string{a.Id}, _recordIds(list))
+		list, err = repo.List(channel, 2, 1)
+		require.Nil(t, err)
+		assert.Empty(t, list)
+
+		require.Nil(t, repo.Delete(b.Id))
+		_, err = repo.Get(b.Id)
+		assert.ErrorIs(t, err, ErrNotFound)
+		assert.ErrorIs(t, repo.Delete(b.Id), ErrNotFound)
+
+		found, err = repo.SearchByTag(channel, "#author_a")
+		require.Nil(t, err)
+		assert.Empty(t, found)
+		list, err = repo.List(channel, 0, 10)
+		require.Nil(t, err)
+		assert.Equal(t, []string{a.Id}, _recordIds(list))
+	}
+
+	t.Run("memory", func(t *testing.T) {
+		testRepository(t, newMemRepository())
+	})
+
+	t.Run("kv", func(t *testing.T) {
+		td := NewTestData()
+		api := td.ApiMockCommon()
+		testRepository(t, newKVRepository(api))
+
+		assert.Contains(t, td.kvStore, _kvTagKey(channel.Id, "#author_b"))
+		assert.Nil(t, td.kvStore[_kvTagKey(channel.Id, "#isbn_2")], "empty indexes should be removed")
+	})
+
+	t.Run("kv_index_ahead_of_records", func(t *testing.T) {
+		td := NewTestData()
+		api := td.ApiMockCommon()
+		repo := newKVRepository(api)
+
+		a, err := repo.Create(&model.Post{ChannelId: channel.Id, Message: `#author_a`})
+		require.Nil(t, err)
+		delete(td.kvStore, _kvRecordKey(a.Id))
+
+		found, err := repo.SearchByTag(channel, "#author_a")
+		require.Nil(t, err)
+		assert.Empty(t, found)
+	})
+
+	t.Run("storage", func(t *testing.T) {
+		td := NewTestData()
+		plugin := td.NewMockPlugin()
+		plugin.SetAPI(td.ApiMockCommon())
+
+		repo, err := plugin._newRepository("")
+		require.Nil(t, err)
+		assert.IsType(t, &postRepository{}, repo)
+		repo, err = plugin._newRepository(STORAGE_KV)
+		require.Nil(t, err)
+		assert.IsType(t, &kvRepository{}, repo)
+		_, err = plugin._newRepository("memory")
+		assert.NotNil(t, err, "records would be lost on restart")
+	})
+
+	t.Run("record_tags", func(t *testing.T) {
+		assert.Equal(t, []string{"#author_a", "#isbn_1"}, _recordTags("{\n \"tags\": \"#ISBN_1 #Author_A #author_a\"\n}"))
+	})
+}
+
+func TestWorkflowInMemory(t *testing.T) {
+	td := NewTestData()
+	api := td.ApiMockCommon()
+	api.On("CreatePost", mock.Anything).Return(&model.Post{}, nil)
+	plugin := td.NewMockPlugin()
+	plugin.SetAPI(api)
+	repo := newMemRepository()
+	plugin.repo = repo
+
+	var book Book
+	DeepCopy(&book, td.ABook)
+	book.BookPublic.Id = ""
+	bookId, err := plugin._createABook(&book)
+	require.Nil(t, err)
+
+	masterId, _, err := plugin._borrowABook(td.BorId, &BorrowRequestKey{
+		BookPostId:   bookId,
+		BorrowerUser: td.BorrowUser,
+	}, otherRequestData{processTime: GetNowTime()})
+	require.Nil(t, err)
+
+	getMaster := func() *BorrowRequest {
+		post, err := repo.Get(masterId)
+		require.Nil(t, err)
+		var master Borrow
+		require.Nil(t, json.Unmarshal([]byte(post.Message), &master))
+		return master.DataOrImage
+	}
+
+	wf := plugin._createWFTemplate(0)
+	for _, status := range []string{
+		STATUS_CONFIRMED,
+		STATUS_KEEPER_CONFIRMED,
+		STATUS_DELIVIED,
+	} {
+		master := getMaster()
+		var actor, chosen string
+		switch status {
+		case STATUS_CONFIRMED:
+			actor = master.LibworkerUser
+		case STATUS_KEEPER_CONFIRMED:
+			actor = master.KeeperUsers[0]
+			chosen = "zzh-book-001 b1"
+		case STATUS_DELIVIED:
+			actor = td.BorrowUser
+		}
+
+		err := plugin._processWorkflowRequest(td.BorId, &WorkflowRequest{
+			MasterPostKey: masterId,
+			ActorUser:     actor,
+			NextStepIndex: _getIndexByStatus(status, wf),
+			ChosenCopyId:  chosen,
+			Etag:          master.MatchId,
+		})
+		require.Nilf(t, err, "status: %v", status)
+	}
+
+	master := getMaster()
+	assert.Equal(t, STATUS_DELIVIED, master.Worflow[master.StepIndex].Status)
+
+	gotBook, err := plugin.GetABook(bookId)
+	require.Nil(t, err)
+	assert.Equal(t, book.BookInventory.Stock-1, gotBook.book.BookInventory.Stock)
+	assert.Equal(t, book.BookInventory.Lending+1, gotBook.book.BookInventory.Lending)
+
+	borrows, err := repo.SearchByTag(plugin.borrowChannel, TAG_PREFIX_BORROWER+td.BorrowUser)
+	require.Nil(t, err)
+	assert.Equal(t, []string{masterId}, _recordIds(borrows))
+
+	api.AssertNotCalled(t, "UpdatePost", mock.Anything)
+	api.AssertNotCalled(t, "SearchPostsInTeam", mock.Anything, mock.Anything)
+	for _, call := range api.Calls {
+		if call.Method == "CreatePost" {
+			assert.Empty(t, call.Arguments.Get(0).(*model.Post).RootId, "notifications are not threaded without posts")
+		}
+	}
+}
+
+func _recordIds(records []*model.Post) []string {
+	ids := []string{}
+	for _, record := range records {
+		ids = append(ids, record.Id)
+	}
+	return ids
+}
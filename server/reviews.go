@@ -0,0 +1,229 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/mattermost/mattermost-server/v5/model"
+	"github.com/pkg/errors"
+)
+
+const reviewsUpdateRetries = 5
+
+func _reviewsKey(bookPostId string) string {
+	return REVIEWS_KV_KEY_PREFIX + bookPostId
+}
+
+// The newest first.
+func (p *Plugin) _loadReviews(bookPostId string) ([]Review, []byte, error) {
+	data, appErr := p.API.KVGet(_reviewsKey(bookPostId))
+	if appErr != nil {
+		return nil, nil, errors.Wrapf(appErr, "get reviews of %v error.", bookPostId)
+	}
+
+	reviews := []Review{}
+	if data == nil {
+		return reviews, nil, nil
+	}
+	if err := json.Unmarshal(data, &reviews); err != nil {
+		return nil, nil, errors.Wrapf(err, "convert reviews of %v error.", bookPostId)
+	}
+	return reviews, data, nil
+}
+
+func (p *Plugin) _getBookReviews(bookPostId string) (*BookReviews, error) {
+	if _, err := p.GetABook(bookPostId); err != nil {
+		return nil, err
+	}
+
+	reviews, _, err := p._loadReviews(bookPostId)
+	if err != nil {
+		return nil, err
+	}
+
+	rating, count := _aggregateRating(reviews)
+	return &BookReviews{
+		BookPostId:  bookPostId,
+		Rating:      rating,
+		RatingCount: count,
+		Reviews:     reviews,
+	}, nil
+}
+
+// Only a borrower who has returned the book can review it, a new review replaces the old one.
+// The rating of the book is the average of all its reviews.
+func (p *Plugin) _reviewABook(userId string, req *ReviewRequest) (*Review, error) {
+	if req.Rating < REVIEW_RATING_MIN || req.Rating > REVIEW_RATING_MAX {
+		return nil, KindError(ErrInvalidRequest, "rating should be from %v to %v.", REVIEW_RATING_MIN, REVIEW_RATING_MAX)
+	}
+	text := strings.TrimSpace(req.Text)
+	if utf8.RuneCountInString(text) > REVIEW_TEXT_MAX_LEN {
+		return nil, KindError(ErrInvalidRequest, "review should be at most %v characters.", REVIEW_TEXT_MAX_LEN)
+	}
+
+	user, appErr := p.API.GetUser(userId)
+	if appErr != nil {
+		return nil, errors.Wrapf(appErr, "get user %v error.", userId)
+	}
+
+	borrowId, err := p._findReturnedBorrow(user.Username, req.BookPostId)
+	if err != nil {
+		return nil, err
+	}
+
+	pubId := req.BookPostId
+	if _, ok := lockmap.LoadOrStore(pubId, struct{}{}); ok {
+		return nil, errors.Wrapf(ErrLocked, "lock error")
+	}
+	defer lockmap.Delete(pubId)
+
+	bookPub := &BookPublic{}
+	pubPost, err := p._getUnmarshaledPost(pubId, bookPub)
+	if err != nil {
+		return nil, errors.Wrapf(err, "get pub error.")
+	}
+	if err := p._checkLibraryPost(pubPost, p.booksChannel); err != nil {
+		return nil, err
+	}
+
+	name, err := p._getDisplayNameByUser(user.Username)
+	if err != nil {
+		name = ""
+	}
+	now := GetNowTime()
+	review := Review{
+		User:     user.Username,
+		Name:     name,
+		Rating:   req.Rating,
+		Text:     text,
+		BorrowId: borrowId,
+		CreateAt: now,
+		UpdateAt: now,
+	}
+
+	var reviews []Review
+	for i := 0; ; i++ {
+		if i >= reviewsUpdateRetries {
+			return nil, errors.Wrapf(ErrLocked, "update reviews of %v", pubId)
+		}
+
+		var oldData []byte
+		reviews, oldData, err = p._loadReviews(pubId)
+		if err != nil {
+			return nil, err
+		}
+
+		for j, old := range reviews {
+			if old.User == review.User {
+				review.CreateAt = old.CreateAt
+				reviews = append(reviews[:j], reviews[j+1:]...)
+				break
+			}
+		}
+		reviews = append([]Review{review}, reviews...)
+
+		newData, err := json.Marshal(reviews)
+		if err != nil {
+			return nil, errors.Wrapf(err, "convert reviews error.")
+		}
+		ok, appErr := p.API.KVCompareAndSet(_reviewsKey(pubId), oldData, newData)
+		if appErr != nil {
+			return nil, errors.Wrapf(appErr, "save reviews error.")
+		}
+		if ok {
+			break
+		}
+	}
+
+	//the etag is kept, a review doesn't conflict with editing the book
+	bookPub.Rating, bookPub.RatingCount = _aggregateRating(reviews)
+	if err := p._updateBookPart(pubPost, bookPub); err != nil {
+		return nil, errors.Wrapf(err, "update rating of book %v error.", pubId)
+	}
+
+	if p.getConfiguration().AnnounceReviews {
+		if err := p._notifyRecord(pubPost, _formatReview(&review)); err != nil {
+			p.API.LogError("Failed to announce a review.", "err", err.Error())
+		}
+	}
+
+	return &review, nil
+}
+
+// The master record of a returned borrow of the book by the user.
+func (p *Plugin) _findReturnedBorrow(username string, bookPostId string) (string, error) {
+	records, err := p._repo().SearchByTag(p.borrowChannel, TAG_PREFIX_BORROWER+username)
+	if err != nil {
+		return "", errors.Wrapf(err, "search borrows of %v error.", username)
+	}
+
+	for _, record := range records {
+		var borrow Borrow
+		if err := json.Unmarshal([]byte(record.Message), &borrow); err != nil {
+			continue
+		}
+		br := borrow.DataOrImage
+		if br == nil || br.BookPostId != bookPostId || br.BorrowerUser != username {
+			continue
+		}
+		if br.StepIndex < len(br.Worflow) && br.Worflow[br.StepIndex].Status == STATUS_RETURNED {
+			return record.Id, nil
+		}
+	}
+
+	return "", errors.Wrapf(ErrNotPermitted, "user %v has not returned book %v", username, bookPostId)
+}
+
+// Rounded to 2 decimals.
+func _aggregateRating(reviews []Review) (float64, int) {
+	if len(reviews) == 0 {
+		return 0, 0
+	}
+	total := 0
+	for _, review := range reviews {
+		total += review.Rating
+	}
+	return math.Round(float64(total)/float64(len(reviews))*100) / 100, len(reviews)
+}
+
+func _formatReview(review *Review) string {
+	stars := strings.Repeat("★", review.Rating) + strings.Repeat("☆", REVIEW_RATING_MAX-review.Rating)
+	message := fmt.Sprintf("@%v rated this book %v (%v/%v)", review.User, stars, review.Rating, REVIEW_RATING_MAX)
+	if review.Text != "" {
+		message += ":\n> " + strings.ReplaceAll(review.Text, "\n", "\n> ")
+	}
+	return message
+}
+
+// The borrower is invited to review the book once the borrow is returned.
+func (p *Plugin) _inviteReview(master *BorrowRequest) error {
+	channel, err := p._getBotDirectChannel(master.BorrowerUser)
+	if err != nil {
+		return err
+	}
+
+	if _, appErr := p.API.CreatePost(&model.Post{
+		UserId:    p.botID,
+		ChannelId: channel.Id,
+		Message: fmt.Sprintf("Thank you for returning %v. How was it? Rate it from %v to %v with a short review:\n`/%v %v <rating> [review]`",
+			master.BookName, REVIEW_RATING_MIN, REVIEW_RATING_MAX, commandReview, master.BookPostId),
+	}); appErr != nil {
+		return errors.Wrapf(appErr, "invite %v to review error.", master.BorrowerUser)
+	}
+	return nil
+}
+
+func (p *Plugin) _formatBookReviews(reviews *BookReviews) string {
+	if reviews.RatingCount == 0 {
+		return "No reviews yet."
+	}
+
+	lines := []string{fmt.Sprintf("Rating: %.2f/%v, by %v reviews.", reviews.Rating, REVIEW_RATING_MAX, reviews.RatingCount)}
+	for i := range reviews.Reviews {
+		lines = append(lines, _formatReview(&reviews.Reviews[i]))
+	}
+	return strings.Join(lines, "\n")
+}
@@ -0,0 +1,205 @@
+package main
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+
+	"github.com/mattermost/mattermost-server/v5/model"
+	"github.com/mattermost/mattermost-server/v5/plugin/plugintest"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/require"
+)
+
+func TestReviews(t *testing.T) {
+
+	type reviewEnv struct {
+		td     *TestData
+		api    *plugintest.API
+		plugin *Plugin
+		repo   *memRepository
+		bookId string
+	}
+
+	// a master record of a borrow of the book, at the status
+	createBorrow := func(t *testing.T, env *reviewEnv, borrower string, bookId string, status string) string {
+		wf := env.plugin._createWFTemplate(GetNowTime())
+		br := &BorrowRequest{
+			BookPostId:   bookId,
+			BorrowerUser: borrower,
+			Worflow:      wf,
+			StepIndex:    _getIndexByStatus(status, wf),
+			Tags:         []string{TAG_PREFIX_BORROWER + borrower, TAG_PREFIX_STATUS + status},
+		}
+		data, _ := _marshalRecord(&Borrow{DataOrImage: br, Role: []string{MASTER}})
+		post, err := env.repo.Create(&model.Post{
+			ChannelId: env.plugin.borrowChannel.Id,
+			Type:      "custom_borrow_type",
+			Message:   string(data),
+		})
+		require.Nil(t, err)
+		return post.Id
+	}
+
+	setup := func(t *testing.T) *reviewEnv {
+		td := NewTestData()
+		api := td.ApiMockCommon()
+		api.On("CreatePost", mock.Anything).Return(&model.Post{}, nil)
+		plugin := td.NewMockPlugin()
+		plugin.SetAPI(api)
+		repo := newMemRepository()
+		plugin.repo = repo
+
+		var book Book
+		DeepCopy(&book, td.ABook)
+		book.BookPublic.Id = ""
+		book.BookPublic.Rating = 4.5
+		book.BookPublic.RatingCount = 10
+		bookId, err := plugin._createABook(&book)
+		require.Nil(t, err)
+
+		return &reviewEnv{td, api, plugin, repo, bookId}
+	}
+
+	getPub := func(t *testing.T, env *reviewEnv) *BookPublic {
+		post, err := env.repo.Get(env.bookId)
+		require.Nil(t, err)
+		pub := &BookPublic{}
+		require.Nil(t, json.Unmarshal([]byte(post.Message), pub))
+		return pub
+	}
+
+	t.Run("review_returned_book", func(t *testing.T) {
+		env := setup(t)
+		pub := getPub(t, env)
+		assert.Equal(t, 0, pub.RatingCount, "ratings come from reviews only")
+		etag := pub.MatchId
+
+		borrowId := createBorrow(t, env, "bor", env.bookId, STATUS_RETURNED)
+		createBorrow(t, env, "worker1", env.bookId, STATUS_RETURNED)
+
+		review, err := env.plugin._reviewABook(env.td.BorId, &ReviewRequest{BookPostId: env.bookId, Rating: 4, Text: " Good read. "})
+		require.Nil(t, err)
+		assert.Equal(t, "bor", review.User)
+		assert.Equal(t, "bookbor", review.Name)
+		assert.Equal(t, "Good read.", review.Text)
+		assert.Equal(t, borrowId, review.BorrowId)
+
+		_, err = env.plugin._reviewABook(env.td.Worker1Id, &ReviewRequest{BookPostId: env.bookId, Rating: 1})
+		require.Nil(t, err)
+		pub = getPub(t, env)
+		assert.Equal(t, 2.5, pub.Rating)
+		assert.Equal(t, 2, pub.RatingCount)
+		assert.Equal(t, etag, pub.MatchId, "a review doesn't change the etag")
+
+		again, err := env.plugin._reviewABook(env.td.BorId, &ReviewRequest{BookPostId: env.bookId, Rating: 2})
+		require.Nil(t, err)
+		assert.Equal(t, review.CreateAt, again.CreateAt)
+
+		reviews, err := env.plugin._getBookReviews(env.bookId)
+		require.Nil(t, err)
+		assert.Equal(t, 1.5, reviews.Rating)
+		assert.Equal(t, 2, reviews.RatingCount)
+		require.Equal(t, 2, len(reviews.Reviews))
+		assert.Equal(t, "bor", reviews.Reviews[0].User, "the newest first")
+		assert.Equal(t, "", reviews.Reviews[0].Text)
+		assert.Equal(t, 1.5, getPub(t, env).Rating)
+
+		env.api.AssertNotCalled(t, "CreatePost", mock.Anything)
+	})
+
+	t.Run("not_returned", func(t *testing.T) {
+		env := setup(t)
+		createBorrow(t, env, "bor", env.bookId, STATUS_DELIVIED)
+		createBorrow(t, env, "bor", model.NewId(), STATUS_RETURNED)
+
+		_, err := env.plugin._reviewABook(env.td.BorId, &ReviewRequest{BookPostId: env.bookId, Rating: 4})
+		assert.ErrorIs(t, err, ErrNotPermitted)
+		assert.Equal(t, 0, getPub(t, env).RatingCount)
+	})
+
+	t.Run("invalid", func(t *testing.T) {
+		env := setup(t)
+		createBorrow(t, env, "bor", env.bookId, STATUS_RETURNED)
+
+		for _, req := range []ReviewRequest{
+			{BookPostId: env.bookId, Rating: REVIEW_RATING_MIN - 1},
+			{BookPostId: env.bookId, Rating: REVIEW_RATING_MAX + 1},
+			{BookPostId: env.bookId, Rating: 3, Text: strings.Repeat("好", REVIEW_TEXT_MAX_LEN+1)},
+		} {
+			_, err := env.plugin._reviewABook(env.td.BorId, &req)
+			assert.ErrorIs(t, err, ErrInvalidRequest)
+		}
+	})
+
+	t.Run("kept_by_update", func(t *testing.T) {
+		env := setup(t)
+		createBorrow(t, env, "bor", env.bookId, STATUS_RETURNED)
+		_, err := env.plugin._reviewABook(env.td.BorId, &ReviewRequest{BookPostId: env.bookId, Rating: 5})
+		require.Nil(t, err)
+
+		info, err := env.plugin.GetABook(env.bookId)
+		require.Nil(t, err)
+		book := info.book
+		book.BookPublic.Rating = 0
+		book.BookPublic.RatingCount = 0
+		book.Upload = &Upload{Post_id: env.bookId, Etag: book.BookPublic.MatchId}
+		require.Nil(t, env.plugin._updateABook(book))
+
+		pub := getPub(t, env)
+		assert.Equal(t, 5.0, pub.Rating)
+		assert.Equal(t, 1, pub.RatingCount)
+	})
+
+	t.Run("announce", func(t *testing.T) {
+		env := setup(t)
+		env.plugin.configuration = &configuration{AnnounceReviews: true}
+		createBorrow(t, env, "bor", env.bookId, STATUS_RETURNED)
+
+		_, err := env.plugin._reviewABook(env.td.BorId, &ReviewRequest{BookPostId: env.bookId, Rating: 4, Text: "Good read."})
+		require.Nil(t, err)
+
+		env.api.AssertCalled(t, "CreatePost", mock.MatchedBy(func(post *model.Post) bool {
+			return post.ChannelId == env.td.BookChIdPub &&
+				post.Message == "@bor rated this book ★★★★☆ (4/5):\n> Good read."
+		}))
+	})
+
+	t.Run("invite", func(t *testing.T) {
+		env := setup(t)
+
+		require.Nil(t, env.plugin._inviteReview(&BorrowRequest{
+			BookName:     "a test book",
+			BookPostId:   env.bookId,
+			BorrowerUser: "bor",
+		}))
+		env.api.AssertCalled(t, "CreatePost", mock.MatchedBy(func(post *model.Post) bool {
+			return post.ChannelId == env.td.BorId_botId &&
+				strings.Contains(post.Message, "/"+commandReview+" "+env.bookId+" <rating>")
+		}))
+	})
+
+	t.Run("command", func(t *testing.T) {
+		env := setup(t)
+		createBorrow(t, env, "bor", env.bookId, STATUS_RETURNED)
+
+		text, err := env.plugin._executeReview(env.td.BorId, []string{env.bookId})
+		require.Nil(t, err)
+		assert.Equal(t, "No reviews yet.", text)
+
+		_, err = env.plugin._executeReview(env.td.BorId, []string{env.bookId, "five"})
+		assert.ErrorIs(t, err, ErrInvalidRequest)
+
+		text, err = env.plugin._executeReview(env.td.BorId, []string{env.bookId, "3", "Not", "bad."})
+		require.Nil(t, err)
+		assert.Contains(t, text, "(3/5):\n> Not bad.")
+
+		text, err = env.plugin._executeReview(env.td.Worker1Id, []string{env.bookId})
+		require.Nil(t, err)
+		assert.Contains(t, text, "Rating: 3.00/5, by 1 reviews.")
+
+		_, err = env.plugin._executeReview(env.td.BorId, []string{model.NewId()})
+		assert.ErrorIs(t, err, ErrNotFound)
+	})
+}
@@ -0,0 +1,507 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/mattermost/mattermost-server/v5/model"
+	"github.com/pkg/errors"
+)
+
+const (
+	rolesUpdateRetries = 5
+)
+
+// The order is also the order roles are saved and listed in.
+var allRoles = []string{
+	ROLE_LIBRARY_ADMIN,
+	ROLE_CATALOG_EDITOR,
+	ROLE_LIBWORKER,
+	ROLE_KEEPER,
+	ROLE_BORROWER,
+}
+
+func (p *Plugin) _loadRoles() (UserRolesMap, []byte, error) {
+	data, appErr := p.API.KVGet(p._rolesKey())
+	if appErr != nil {
+		return nil, nil, errors.Wrapf(appErr, "get roles error.")
+	}
+
+	roles := UserRolesMap{}
+	if data == nil {
+		return roles, nil, nil
+	}
+
+	if err := json.Unmarshal(data, &roles); err != nil {
+		return nil, nil, errors.Wrapf(err, "convert roles error.")
+	}
+
+	return roles, data, nil
+}
+
+func (p *Plugin) _getUserRoles(userId string) ([]string, error) {
+	roles, _, err := p._loadRoles()
+	if err != nil {
+		return nil, err
+	}
+
+	return roles[userId], nil
+}
+
+// A library admin has every role.
+func (p *Plugin) _hasRole(userId string, roles ...string) (bool, error) {
+	if userId == "" {
+		return false, nil
+	}
+
+	userRoles, err := p._getUserRoles(userId)
+	if err != nil {
+		return false, err
+	}
+
+	has := ConvertStringArrayToSet(userRoles)
+	if has[ROLE_LIBRARY_ADMIN] {
+		return true, nil
+	}
+
+	return ConstainsInStringSet(has, roles), nil
+}
+
+func (p *Plugin) _checkRole(userId string, roles ...string) error {
+	ok, err := p._hasRole(userId, roles...)
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return errors.Wrapf(ErrNotPermitted, "user %v has none of roles %v", userId, roles)
+	}
+
+	return nil
+}
+
+func (p *Plugin) _isLibraryAdmin(userId string) (bool, error) {
+	userRoles, err := p._getUserRoles(userId)
+	if err != nil {
+		return false, err
+	}
+
+	return ConvertStringArrayToSet(userRoles)[ROLE_LIBRARY_ADMIN], nil
+}
+
+func _validateRoles(roles []string) error {
+	valid := ConvertStringArrayToSet(allRoles)
+	for _, role := range roles {
+		if !valid[role] {
+			return errors.Wrapf(ErrInvalidRole, "unknown role %v", role)
+		}
+	}
+	return nil
+}
+
+func _sortRoles(roles []string) []string {
+	has := ConvertStringArrayToSet(roles)
+	sorted := []string{}
+	for _, role := range allRoles {
+		if has[role] {
+			sorted = append(sorted, role)
+		}
+	}
+	return sorted
+}
+
+// Roles of a library are saved in one KV entry, compare-and-set keeps concurrent updates from
+// overwriting each other. Channel memberships follow the new roles.
+func (p *Plugin) _updateUserRoles(userId string, update func(old []string) []string) ([]string, error) {
+
+	var oldRoles, newRoles []string
+
+	for i := 0; ; i++ {
+		if i >= rolesUpdateRetries {
+			return nil, errors.Wrapf(ErrLocked, "update roles of %v", userId)
+		}
+
+		roles, oldData, err := p._loadRoles()
+		if err != nil {
+			return nil, err
+		}
+
+		oldRoles = roles[userId]
+		newRoles = _sortRoles(update(oldRoles))
+		if len(newRoles) == 0 {
+			delete(roles, userId)
+		} else {
+			roles[userId] = newRoles
+		}
+
+		newData, err := json.Marshal(roles)
+		if err != nil {
+			return nil, errors.Wrapf(err, "convert roles error.")
+		}
+
+		ok, appErr := p.API.KVCompareAndSet(p._rolesKey(), oldData, newData)
+		if appErr != nil {
+			return nil, errors.Wrapf(appErr, "save roles error.")
+		}
+		if ok {
+			break
+		}
+	}
+
+	if err := p._syncChannelsByRoles(userId, oldRoles, newRoles); err != nil {
+		return newRoles, err
+	}
+
+	return newRoles, nil
+}
+
+func (p *Plugin) _grantRoles(userId string, roles ...string) ([]string, error) {
+	if err := _validateRoles(roles); err != nil {
+		return nil, err
+	}
+
+	return p._updateUserRoles(userId, func(old []string) []string {
+		return append(old, roles...)
+	})
+}
+
+func (p *Plugin) _revokeRoles(userId string, roles ...string) ([]string, error) {
+	if err := _validateRoles(roles); err != nil {
+		return nil, err
+	}
+
+	revoked := ConvertStringArrayToSet(roles)
+	return p._updateUserRoles(userId, func(old []string) []string {
+		kept := []string{}
+		for _, role := range old {
+			if !revoked[role] {
+				kept = append(kept, role)
+			}
+		}
+		return kept
+	})
+}
+
+func (p *Plugin) _setRoles(userId string, roles ...string) ([]string, error) {
+	if err := _validateRoles(roles); err != nil {
+		return nil, err
+	}
+
+	return p._updateUserRoles(userId, func(old []string) []string {
+		return roles
+	})
+}
+
+// Which private channels the roles are members of.
+func (p *Plugin) _channelsOfRoles(roles []string) map[string]bool {
+	has := ConvertStringArrayToSet(roles)
+	isAdmin := has[ROLE_LIBRARY_ADMIN]
+	isEditor := isAdmin || has[ROLE_CATALOG_EDITOR]
+
+	return map[string]bool{
+		p.booksPriChannel.Id: isEditor,
+		p.booksInvChannel.Id: isEditor,
+		p.borrowChannel.Id:   isAdmin,
+	}
+}
+
+// The keepers are checked before the copies are written, the role is granted after it.
+func (p *Plugin) _checkKeepersExist(keepers ...string) error {
+	for _, keeper := range keepers {
+		if _, appErr := p.API.GetUserByUsername(keeper); appErr != nil {
+			return errors.Wrapf(ErrInvalidCopyKeeper, "keeper %v: %v", keeper, appErr.Error())
+		}
+	}
+	return nil
+}
+
+// A user keeping copies is a keeper, so he/she can move the borrows of the copies.
+// The role is granted after the copies are written, so a failed write leaves no role behind.
+// A user who is a keeper already is left as is.
+// The copies are written already, so a failed grant is logged and the next keeper is granted.
+func (p *Plugin) _grantKeeperRole(keepers ...string) {
+	for _, keeper := range keepers {
+		if err := p._grantKeeperRoleTo(keeper); err != nil {
+			p.API.LogError("Failed to grant the keeper role.", "keeper", keeper, "err", fmt.Sprintf("%+v", err))
+		}
+	}
+}
+
+func (p *Plugin) _grantKeeperRoleTo(keeper string) error {
+	user, appErr := p.API.GetUserByUsername(keeper)
+	if appErr != nil {
+		return errors.Wrapf(ErrInvalidCopyKeeper, "keeper %v: %v", keeper, appErr.Error())
+	}
+	ok, err := p._hasRole(user.Id, ROLE_KEEPER)
+	if err != nil {
+		return err
+	}
+	if ok {
+		return nil
+	}
+	if _, err := p._grantRoles(user.Id, ROLE_KEEPER); err != nil {
+		return errors.Wrapf(err, "grant keeper role to %v error.", keeper)
+	}
+	return nil
+}
+
+// The private channels are only readable to the roles which maintain their data.
+// A user is only removed from the channels his/her old roles were members of,
+// so the members from before there were roles are kept.
+func (p *Plugin) _syncChannelsByRoles(userId string, oldRoles []string, roles []string) error {
+	wasMember := p._channelsOfRoles(oldRoles)
+	member := p._channelsOfRoles(roles)
+
+	user := &model.User{Id: userId}
+
+	if len(roles) > 0 {
+		if err := p.ensureMemberInTeam(p.team, user); err != nil {
+			return errors.Wrapf(err, "add user %v to team error.", userId)
+		}
+	}
+
+	for _, channel := range []*model.Channel{p.booksPriChannel, p.booksInvChannel, p.borrowChannel} {
+		if member[channel.Id] {
+			if err := p.ensureMemberInChannel(channel, user); err != nil {
+				return errors.Wrapf(err, "add user %v to channel %v error.", userId, channel.Name)
+			}
+			continue
+		}
+		if !wasMember[channel.Id] {
+			continue
+		}
+
+		isMember, err := p._isChannelMember(channel.Id, userId)
+		if err != nil {
+			return err
+		}
+		if !isMember {
+			continue
+		}
+		if appErr := p.API.DeleteChannelMember(channel.Id, userId); appErr != nil {
+			return errors.Wrapf(appErr, "remove user %v from channel %v error.", userId, channel.Name)
+		}
+	}
+
+	return nil
+}
+
+// Roles for the users of a library from before there were roles:
+// the members of the books channel borrow, the members of the books channels(private)
+// maintain the catalog, the members of the borrow channel supervise the library,
+// and the libworkers, keepers and participants of borrows keep their positions.
+// Roles are only granted, a user keeps the roles he/she already has.
+func (p *Plugin) _seedRoles() error {
+	seeds := map[string][]string{}
+
+	for _, membership := range []struct {
+		channel *model.Channel
+		role    string
+	}{
+		{p.booksChannel, ROLE_BORROWER},
+		{p.booksPriChannel, ROLE_CATALOG_EDITOR},
+		{p.booksInvChannel, ROLE_CATALOG_EDITOR},
+		{p.borrowChannel, ROLE_LIBRARY_ADMIN},
+	} {
+		userIds, err := p._channelMemberIds(membership.channel)
+		if err != nil {
+			return err
+		}
+		for _, userId := range userIds {
+			if userId != p.botID {
+				seeds[userId] = append(seeds[userId], membership.role)
+			}
+		}
+	}
+
+	byName := map[string][]string{}
+	seedByName := func(role string, users ...string) {
+		for _, user := range users {
+			if user != "" {
+				byName[user] = append(byName[user], role)
+			}
+		}
+	}
+
+	for _, channel := range []*model.Channel{p.booksChannel, p.booksPriChannel, p.borrowChannel} {
+		for page := 0; ; page++ {
+			records, err := p._repo().List(channel, page, migrationsPerPage)
+			if err != nil {
+				return errors.Wrapf(err, "list records error. channel: %v, page: %v", channel.Id, page)
+			}
+
+			for _, record := range records {
+				switch record.Type {
+				case "custom_book_type":
+					var pub BookPublic
+					if err := json.Unmarshal([]byte(record.Message), &pub); err == nil {
+						seedByName(ROLE_LIBWORKER, pub.LibworkerUsers...)
+					}
+				case "custom_book_private_type":
+					var pri BookPrivate
+					if err := json.Unmarshal([]byte(record.Message), &pri); err == nil {
+						seedByName(ROLE_KEEPER, pri.KeeperUsers...)
+					}
+				case "custom_borrow_type":
+					var br Borrow
+					if err := json.Unmarshal([]byte(record.Message), &br); err != nil || br.DataOrImage == nil {
+						continue
+					}
+					seedByName(ROLE_BORROWER, br.DataOrImage.BorrowerUser)
+					seedByName(ROLE_LIBWORKER, br.DataOrImage.LibworkerUser)
+					seedByName(ROLE_KEEPER, br.DataOrImage.KeeperUsers...)
+				}
+			}
+
+			if len(records) < migrationsPerPage {
+				break
+			}
+		}
+	}
+
+	for username, roles := range byName {
+		user, appErr := p.API.GetUserByUsername(username)
+		if appErr != nil {
+			p.API.LogWarn("Skip seeding roles of an unknown user.", "user", username, "err", appErr.Error())
+			continue
+		}
+		seeds[user.Id] = append(seeds[user.Id], roles...)
+	}
+
+	userIds := []string{}
+	for userId := range seeds {
+		userIds = append(userIds, userId)
+	}
+	sort.Strings(userIds)
+
+	for _, userId := range userIds {
+		if _, err := p._grantRoles(userId, seeds[userId]...); err != nil {
+			return errors.Wrapf(err, "seed roles of %v error.", userId)
+		}
+	}
+
+	return nil
+}
+
+func (p *Plugin) _channelMemberIds(channel *model.Channel) ([]string, error) {
+	userIds := []string{}
+	for page := 0; ; page++ {
+		members, appErr := p.API.GetChannelMembers(channel.Id, page, migrationsPerPage)
+		if appErr != nil {
+			return nil, errors.Wrapf(appErr, "get members of channel %v error. page: %v", channel.Id, page)
+		}
+		if members == nil {
+			break
+		}
+		for _, member := range *members {
+			userIds = append(userIds, member.UserId)
+		}
+		if len(*members) < migrationsPerPage {
+			break
+		}
+	}
+	return userIds, nil
+}
+
+// A borrower borrows for himself/herself,
+// a library admin or a libworker can borrow on behalf of a borrower.
+func (p *Plugin) _checkBorrowPermission(userId string, borrowerUser string) error {
+	borrower, appErr := p.API.GetUserByUsername(borrowerUser)
+	if appErr != nil {
+		return errors.Wrapf(appErr, "get borrower %v error.", borrowerUser)
+	}
+
+	if err := p._checkRole(borrower.Id, ROLE_BORROWER); err != nil {
+		return err
+	}
+
+	if borrower.Id == userId {
+		return nil
+	}
+
+	return p._checkRole(userId, ROLE_LIBWORKER)
+}
+
+// A workflow can only be moved by its participants, each with the role of his/her position in it.
+// A library admin can move any workflow.
+func (p *Plugin) _checkWorkflowPermission(userId string, br *BorrowRequest) error {
+	userRoles, err := p._getUserRoles(userId)
+	if err != nil {
+		return err
+	}
+
+	has := ConvertStringArrayToSet(userRoles)
+	if has[ROLE_LIBRARY_ADMIN] {
+		return nil
+	}
+
+	user, appErr := p.API.GetUser(userId)
+	if appErr != nil {
+		return errors.Wrapf(appErr, "get user %v error.", userId)
+	}
+
+	if has[ROLE_BORROWER] && br.BorrowerUser == user.Username {
+		return nil
+	}
+	if has[ROLE_LIBWORKER] && br.LibworkerUser == user.Username {
+		return nil
+	}
+	if has[ROLE_KEEPER] {
+		for _, keeper := range br.KeeperUsers {
+			if keeper == user.Username {
+				return nil
+			}
+		}
+	}
+
+	return errors.Wrapf(ErrNotPermitted, "user %v is not a participant of the borrowing", user.Username)
+}
+
+// Library admins see all keepers' copies,
+// a keeper or a libworker sees his/her own only.
+// Only a library admin can fetch for another user.
+func (p *Plugin) _getFetchInvKeepers(userId string, username string) (string, error) {
+	user, appErr := p.API.GetUserByUsername(username)
+	if appErr != nil {
+		return "", appErr
+	}
+
+	if user.Id != userId {
+		isAdmin, err := p._isLibraryAdmin(userId)
+		if err != nil {
+			return "", err
+		}
+		if !isAdmin {
+			return "", errors.Wrapf(ErrNotPermitted, "fetch for other user %v", username)
+		}
+	}
+
+	isAdmin, err := p._isLibraryAdmin(user.Id)
+	if err != nil {
+		return "", err
+	}
+	if isAdmin {
+		return "@", nil
+	}
+
+	if err := p._checkRole(user.Id, ROLE_KEEPER, ROLE_LIBWORKER); err != nil {
+		return "", err
+	}
+
+	return username, nil
+}
+
+func (p *Plugin) _permissionErrorText(err error) string {
+	if errors.Is(err, ErrNotPermitted) {
+		return p.i18n.GetText("not-permitted")
+	}
+	return p._errorText(err, "internal-error")
+}
+
+func (p *Plugin) _formatUserRoles(username string, roles []string) string {
+	if len(roles) == 0 {
+		return fmt.Sprintf("%v: -", username)
+	}
+	return fmt.Sprintf("%v: %v", username, strings.Join(roles, ", "))
+}
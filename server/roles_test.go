@@ -0,0 +1,275 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/mattermost/mattermost-server/v5/model"
+	"github.com/mattermost/mattermost-server/v5/plugin/plugintest"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRoles(t *testing.T) {
+
+	type env struct {
+		td      *TestData
+		plugin  *Plugin
+		api     *plugintest.API
+		members map[string]map[string]bool
+	}
+
+	setup := func() *env {
+		td := NewTestData()
+		plugin := td.NewMockPlugin()
+		api := td.ApiMockCommon()
+		plugin.SetAPI(api)
+
+		e := &env{
+			td:     td,
+			plugin: plugin,
+			api:    api,
+			members: map[string]map[string]bool{
+				td.BookChIdPri: {},
+				td.BookChIdInv: {},
+			},
+		}
+
+		api.On("GetTeamMember", td.BorTeamId, mock.AnythingOfType("string")).Return(&model.TeamMember{}, nil)
+		isPrivate := func(channelId string) bool {
+			_, ok := e.members[channelId]
+			return ok
+		}
+		api.On("GetChannelMember", mock.MatchedBy(isPrivate), mock.AnythingOfType("string")).Return(
+			func(channelId string, userId string) *model.ChannelMember {
+				if e.members[channelId][userId] {
+					return &model.ChannelMember{}
+				}
+				return nil
+			}, func(channelId string, userId string) *model.AppError {
+				if e.members[channelId][userId] {
+					return nil
+				}
+				return model.NewAppError("GetChannelMember", "app.channel.get_member.missing.app_error", nil, "", http.StatusNotFound)
+			})
+		api.On("AddChannelMember", mock.AnythingOfType("string"), mock.AnythingOfType("string")).Return(
+			func(channelId string, userId string) *model.ChannelMember {
+				if isPrivate(channelId) {
+					e.members[channelId][userId] = true
+				}
+				return &model.ChannelMember{}
+			}, nil)
+		api.On("DeleteChannelMember", mock.AnythingOfType("string"), mock.AnythingOfType("string")).Return(
+			func(channelId string, userId string) *model.AppError {
+				if isPrivate(channelId) {
+					delete(e.members[channelId], userId)
+				}
+				return nil
+			})
+
+		return e
+	}
+
+	t.Run("grant_and_revoke", func(t *testing.T) {
+		e := setup()
+		userId := model.NewId()
+
+		roles, err := e.plugin._grantRoles(userId, ROLE_BORROWER, ROLE_CATALOG_EDITOR)
+		require.Nil(t, err)
+		assert.Equal(t, []string{ROLE_CATALOG_EDITOR, ROLE_BORROWER}, roles)
+		assert.True(t, e.members[e.td.BookChIdPri][userId])
+		assert.True(t, e.members[e.td.BookChIdInv][userId])
+		e.api.AssertNotCalled(t, "AddChannelMember", e.td.BorChannelId, userId)
+
+		ok, err := e.plugin._hasRole(userId, ROLE_CATALOG_EDITOR)
+		require.Nil(t, err)
+		assert.True(t, ok)
+		ok, err = e.plugin._hasRole(userId, ROLE_LIBWORKER, ROLE_KEEPER)
+		require.Nil(t, err)
+		assert.False(t, ok)
+
+		roles, err = e.plugin._revokeRoles(userId, ROLE_CATALOG_EDITOR)
+		require.Nil(t, err)
+		assert.Equal(t, []string{ROLE_BORROWER}, roles)
+		assert.False(t, e.members[e.td.BookChIdPri][userId])
+		assert.False(t, e.members[e.td.BookChIdInv][userId])
+
+		roles, err = e.plugin._revokeRoles(userId, ROLE_BORROWER)
+		require.Nil(t, err)
+		assert.Empty(t, roles)
+		all, _, err := e.plugin._loadRoles()
+		require.Nil(t, err)
+		assert.NotContains(t, all, userId)
+	})
+
+	t.Run("admin_has_every_role", func(t *testing.T) {
+		e := setup()
+		userId := model.NewId()
+
+		_, err := e.plugin._setRoles(userId, ROLE_LIBRARY_ADMIN)
+		require.Nil(t, err)
+		e.api.AssertCalled(t, "AddChannelMember", e.td.BorChannelId, userId)
+
+		ok, err := e.plugin._hasRole(userId, ROLE_KEEPER)
+		require.Nil(t, err)
+		assert.True(t, ok)
+	})
+
+	t.Run("revoke_admin_leaves_borrow_channel", func(t *testing.T) {
+		e := setup()
+
+		_, err := e.plugin._revokeRoles(e.td.Worker1Id, ROLE_LIBRARY_ADMIN)
+		require.Nil(t, err)
+		e.api.AssertCalled(t, "DeleteChannelMember", e.td.BorChannelId, e.td.Worker1Id)
+	})
+
+	t.Run("members_without_roles_kept", func(t *testing.T) {
+		e := setup()
+		userId := model.NewId()
+		e.members[e.td.BookChIdPri][userId] = true
+		e.members[e.td.BookChIdInv][userId] = true
+
+		_, err := e.plugin._grantRoles(userId, ROLE_BORROWER)
+		require.Nil(t, err)
+		assert.True(t, e.members[e.td.BookChIdPri][userId])
+		assert.True(t, e.members[e.td.BookChIdInv][userId])
+		e.api.AssertNotCalled(t, "DeleteChannelMember", mock.Anything, userId)
+	})
+
+	t.Run("invalid_role", func(t *testing.T) {
+		e := setup()
+
+		_, err := e.plugin._grantRoles(model.NewId(), "librarian")
+		assert.ErrorIs(t, err, ErrInvalidRole)
+	})
+
+	t.Run("concurrent_update_retried", func(t *testing.T) {
+		e := setup()
+		userId := model.NewId()
+
+		first := true
+		api := &plugintest.API{}
+		api.On("KVCompareAndSet", ROLES_KV_KEY, mock.Anything, mock.Anything).Return(
+			func(key string, oldValue []byte, newValue []byte) bool {
+				if first {
+					//someone else updated the roles meanwhile
+					first = false
+					e.td.SetRoles(e.td.Worker2Id, ROLE_LIBWORKER)
+				}
+				ok, _ := e.api.KVCompareAndSet(key, oldValue, newValue)
+				return ok
+			}, nil)
+		api.On("KVGet", ROLES_KV_KEY).Return(
+			func(key string) []byte {
+				data, _ := e.api.KVGet(key)
+				return data
+			}, nil)
+		api.On("GetTeamMember", mock.Anything, mock.Anything).Return(&model.TeamMember{}, nil)
+		api.On("GetChannelMember", mock.Anything, mock.Anything).Return(
+			nil, model.NewAppError("GetChannelMember", "app.channel.get_member.missing.app_error", nil, "", http.StatusNotFound))
+		e.plugin.SetAPI(api)
+
+		_, err := e.plugin._grantRoles(userId, ROLE_BORROWER)
+		require.Nil(t, err)
+
+		e.plugin.SetAPI(e.api)
+		all, _, err := e.plugin._loadRoles()
+		require.Nil(t, err)
+		assert.Equal(t, []string{ROLE_BORROWER}, all[userId])
+		assert.Equal(t, []string{ROLE_LIBWORKER}, all[e.td.Worker2Id])
+	})
+
+	t.Run("borrow_permission", func(t *testing.T) {
+		e := setup()
+
+		assert.Nil(t, e.plugin._checkBorrowPermission(e.td.BorId, "bor"))
+		assert.Nil(t, e.plugin._checkBorrowPermission(e.td.Worker2Id, "bor"))
+		assert.ErrorIs(t, e.plugin._checkBorrowPermission(e.td.Keeper1Id, "bor"), ErrNotPermitted)
+
+		e.td.SetRoles(e.td.BorId)
+		assert.ErrorIs(t, e.plugin._checkBorrowPermission(e.td.BorId, "bor"), ErrNotPermitted)
+	})
+
+	t.Run("workflow_permission", func(t *testing.T) {
+		e := setup()
+		br := &BorrowRequest{
+			BorrowerUser:  "bor",
+			LibworkerUser: "worker2",
+			KeeperUsers:   []string{"kpuser1"},
+		}
+
+		assert.Nil(t, e.plugin._checkWorkflowPermission(e.td.BorId, br))
+		assert.Nil(t, e.plugin._checkWorkflowPermission(e.td.Worker2Id, br))
+		assert.Nil(t, e.plugin._checkWorkflowPermission(e.td.Keeper1Id, br))
+		assert.Nil(t, e.plugin._checkWorkflowPermission(e.td.Worker1Id, br))
+		assert.ErrorIs(t, e.plugin._checkWorkflowPermission(e.td.Keeper2Id, br), ErrNotPermitted)
+
+		e.td.SetRoles(e.td.Keeper1Id, ROLE_BORROWER)
+		assert.ErrorIs(t, e.plugin._checkWorkflowPermission(e.td.Keeper1Id, br), ErrNotPermitted)
+	})
+
+	t.Run("fetch_inv_keepers", func(t *testing.T) {
+		e := setup()
+
+		keeper, err := e.plugin._getFetchInvKeepers(e.td.Keeper1Id, "kpuser1")
+		require.Nil(t, err)
+		assert.Equal(t, "kpuser1", keeper)
+
+		keeper, err = e.plugin._getFetchInvKeepers(e.td.Worker1Id, "worker1")
+		require.Nil(t, err)
+		assert.Equal(t, "@", keeper)
+
+		keeper, err = e.plugin._getFetchInvKeepers(e.td.Worker1Id, "kpuser1")
+		require.Nil(t, err)
+		assert.Equal(t, "kpuser1", keeper)
+
+		_, err = e.plugin._getFetchInvKeepers(e.td.Keeper2Id, "kpuser1")
+		assert.ErrorIs(t, err, ErrNotPermitted)
+
+		_, err = e.plugin._getFetchInvKeepers(e.td.BorId, "bor")
+		assert.ErrorIs(t, err, ErrNotPermitted)
+	})
+
+	t.Run("upload_needs_catalog_editor", func(t *testing.T) {
+		e := setup()
+
+		reqJson, _ := json.Marshal(BooksRequest{
+			Action: BOOKS_ACTION_UPLOAD,
+			Body:   "[]",
+		})
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest("POST", "/books", bytes.NewReader(reqJson))
+		r.Header.Set("Mattermost-User-ID", e.td.Worker2Id)
+		e.plugin.ServeHTTP(nil, w, r)
+
+		var result Result
+		json.NewDecoder(w.Result().Body).Decode(&result)
+		assert.Equal(t, e.plugin.i18n.GetText("not-permitted"), result.Error)
+	})
+
+	t.Run("command", func(t *testing.T) {
+		e := setup()
+
+		_, err := e.plugin._executeLibraryRoles(e.td.BorId, []string{"add", "bor", ROLE_KEEPER})
+		assert.ErrorIs(t, err, ErrNotPermitted)
+
+		text, err := e.plugin._executeLibraryRoles(e.td.Worker1Id, []string{"add", "bor", ROLE_KEEPER})
+		require.Nil(t, err)
+		assert.Equal(t, "bor: keeper, borrower", text)
+
+		text, err = e.plugin._executeLibraryRoles(e.td.Worker1Id, []string{"set", "bor", ROLE_BORROWER})
+		require.Nil(t, err)
+		assert.Equal(t, "bor: borrower", text)
+
+		text, err = e.plugin._executeLibraryRoles(e.td.Worker1Id, []string{"list", "bor", "kpuser1"})
+		require.Nil(t, err)
+		assert.Equal(t, "bor: borrower\nkpuser1: keeper, borrower", text)
+
+		_, err = e.plugin._executeLibraryRoles(e.td.Worker1Id, []string{"add", "bor", "librarian"})
+		assert.ErrorIs(t, err, ErrInvalidRole)
+	})
+}
@@ -0,0 +1,333 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/mattermost/mattermost-server/v5/model"
+	"github.com/pkg/errors"
+)
+
+const (
+	statsPostsPerPage = 200
+	// lines of a ranking in the report
+	statsReportTop = 10
+)
+
+// Computes the statistics of the borrows requested in [from, to], in milliseconds.
+// Everything comes from the ActionDate history of the workflows of the master records.
+// A status revisited, e.g. renewed twice, keeps only its last action date,
+// so only its last stay is counted.
+func (p *Plugin) _computeStats(from int64, to int64) (*LibraryStats, error) {
+	stats := &LibraryStats{
+		LibraryId:       p.library.id,
+		From:            from,
+		To:              to,
+		ByBook:          []StatsCount{},
+		ByCategory:      []StatsCount{},
+		ByKeeper:        []StatsCount{},
+		StatusDurations: []StatusDuration{},
+	}
+
+	byBook := map[string]*StatsCount{}
+	byCategory := map[string]*StatsCount{}
+	byKeeper := map[string]*StatsCount{}
+	durations := map[string]*StatusDuration{}
+	totals := map[string]int64{}
+	categories := map[string]string{}
+
+	for page := 0; ; page++ {
+		records, err := p._repo().List(p.borrowChannel, page, statsPostsPerPage)
+		if err != nil {
+			return nil, errors.Wrapf(err, "list borrows error. page: %v", page)
+		}
+
+		for _, record := range records {
+			if record.Type != "custom_borrow_type" || record.RootId != "" {
+				continue
+			}
+			var borrow Borrow
+			if err := json.Unmarshal([]byte(record.Message), &borrow); err != nil {
+				p.API.LogWarn("Skip a borrow not in JSON.", "id", record.Id, "err", err.Error())
+				continue
+			}
+			br := borrow.DataOrImage
+			if br == nil || len(br.Worflow) == 0 {
+				continue
+			}
+			requestedAt := br.Worflow[0].ActionDate
+			if requestedAt < from || requestedAt > to {
+				continue
+			}
+
+			stats.Borrows++
+			_countStats(byBook, br.BookPostId, br.BookName)
+
+			category, ok := categories[br.BookPostId]
+			if !ok {
+				category = p._statsCategoryOf(br.BookPostId)
+				categories[br.BookPostId] = category
+			}
+			_countStats(byCategory, category, "")
+
+			// the keeper is known since the copy was chosen
+			if br.ChosenCopyId != "" && len(br.KeeperUsers) == 1 {
+				keeper := br.KeeperUsers[0]
+				_countStats(byKeeper, keeper, br.KeeperInfos[keeper].Name)
+			}
+
+			if br.RenewedTimes > 0 {
+				stats.Renewed++
+			}
+
+			path := _actualPath(br.Worflow, br.StepIndex)
+			for i := 0; i+1 < len(path); i++ {
+				step, next := br.Worflow[path[i]], br.Worflow[path[i+1]]
+				if step.ActionDate == 0 || next.ActionDate < step.ActionDate {
+					continue
+				}
+				d, ok := durations[step.Status]
+				if !ok {
+					d = &StatusDuration{Status: step.Status}
+					durations[step.Status] = d
+				}
+				d.Count++
+				totals[step.Status] += next.ActionDate - step.ActionDate
+			}
+		}
+
+		if len(records) < statsPostsPerPage {
+			break
+		}
+	}
+
+	if stats.Borrows > 0 {
+		stats.RenewalRate = float64(stats.Renewed) / float64(stats.Borrows)
+	}
+	stats.ByBook = _sortedStatsCounts(byBook)
+	stats.ByCategory = _sortedStatsCounts(byCategory)
+	stats.ByKeeper = _sortedStatsCounts(byKeeper)
+
+	// in the order of the standard workflow
+	for _, step := range p._createWFTemplate(0) {
+		d, ok := durations[step.Status]
+		if !ok {
+			continue
+		}
+		d.AverageHours = float64(totals[step.Status]) / float64(d.Count) / float64(time.Hour/time.Millisecond)
+		stats.StatusDurations = append(stats.StatusDurations, *d)
+	}
+
+	if err := p._countCurrentCopies(stats); err != nil {
+		return nil, err
+	}
+
+	return stats, nil
+}
+
+// The first category of a book, empty if the book is deleted.
+func (p *Plugin) _statsCategoryOf(bookPostId string) string {
+	post, err := p._repo().Get(bookPostId)
+	if err != nil {
+		return ""
+	}
+	var pub BookPublic
+	if err := json.Unmarshal([]byte(post.Message), &pub); err != nil {
+		return ""
+	}
+	return pub.Category1
+}
+
+func (p *Plugin) _countCurrentCopies(stats *LibraryStats) error {
+	for page := 0; ; page++ {
+		records, err := p._repo().List(p.booksInvChannel, page, statsPostsPerPage)
+		if err != nil {
+			return errors.Wrapf(err, "list inventories error. page: %v", page)
+		}
+
+		for _, record := range records {
+			if record.Type != "custom_book_inventory_type" || record.RootId != "" {
+				continue
+			}
+			var inv BookInventory
+			if err := json.Unmarshal([]byte(record.Message), &inv); err != nil {
+				continue
+			}
+			stats.Lending += inv.Lending
+			stats.InTransit += inv.InTransit
+		}
+
+		if len(records) < statsPostsPerPage {
+			break
+		}
+	}
+	return nil
+}
+
+// The steps a workflow actually went through to the current one, the first step first.
+func _actualPath(workflow []Step, current int) []int {
+	path := []int{}
+	visited := map[int]bool{}
+	for i := current; i >= 0 && i < len(workflow) && !visited[i]; i = workflow[i].LastActualStepIndex {
+		visited[i] = true
+		path = append([]int{i}, path...)
+		if i == 0 {
+			break
+		}
+	}
+	return path
+}
+
+func _countStats(counts map[string]*StatsCount, key string, name string) {
+	c, ok := counts[key]
+	if !ok {
+		c = &StatsCount{Key: key, Name: name}
+		counts[key] = c
+	}
+	c.Count++
+}
+
+func _sortedStatsCounts(counts map[string]*StatsCount) []StatsCount {
+	sorted := []StatsCount{}
+	for _, c := range counts {
+		sorted = append(sorted, *c)
+	}
+	sort.Slice(sorted, func(i, j int) bool {
+		if sorted[i].Count != sorted[j].Count {
+			return sorted[i].Count > sorted[j].Count
+		}
+		return sorted[i].Key < sorted[j].Key
+	})
+	return sorted
+}
+
+// Dates are YYYY-MM-DD in the server's time zone, both ends included.
+// The range is the current month by default.
+func _parseStatsRange(fromDate string, toDate string, now time.Time) (int64, int64, error) {
+	from := time.Date(now.Year(), now.Month(), 1, 0, 0, 0, 0, now.Location())
+	to := now
+	if fromDate != "" {
+		t, err := time.ParseInLocation(STATS_DATE_FORMAT, fromDate, now.Location())
+		if err != nil {
+			return 0, 0, KindError(ErrInvalidRequest, "invalid from date %v", fromDate)
+		}
+		from = t
+	}
+	if toDate != "" {
+		t, err := time.ParseInLocation(STATS_DATE_FORMAT, toDate, now.Location())
+		if err != nil {
+			return 0, 0, KindError(ErrInvalidRequest, "invalid to date %v", toDate)
+		}
+		to = t.AddDate(0, 0, 1).Add(-time.Millisecond)
+	}
+	if to.Before(from) {
+		return 0, 0, KindError(ErrInvalidRequest, "to date %v is before from date %v", toDate, fromDate)
+	}
+	return _millisOf(from), _millisOf(to), nil
+}
+
+func _millisOf(t time.Time) int64 {
+	return t.UnixNano() / int64(time.Millisecond)
+}
+
+func _timeOfMillis(ms int64) time.Time {
+	return time.Unix(0, ms*int64(time.Millisecond))
+}
+
+func (p *Plugin) _formatStats(stats *LibraryStats) string {
+	lines := []string{
+		fmt.Sprintf("#### Library statistics: %v ~ %v",
+			_timeOfMillis(stats.From).Format(STATS_DATE_FORMAT), _timeOfMillis(stats.To).Format(STATS_DATE_FORMAT)),
+		fmt.Sprintf("Borrows: %v, renewed: %v (%.1f%%), lending now: %v, in transit now: %v.",
+			stats.Borrows, stats.Renewed, stats.RenewalRate*100, stats.Lending, stats.InTransit),
+	}
+
+	ranking := func(title string, counts []StatsCount) {
+		if len(counts) == 0 {
+			return
+		}
+		lines = append(lines, "", fmt.Sprintf("| %v | Borrows |", title), "|:--|--:|")
+		for i, c := range counts {
+			if i >= statsReportTop {
+				break
+			}
+			name := c.Key
+			if c.Name != "" {
+				name = c.Name
+			}
+			if name == "" {
+				name = "-"
+			}
+			lines = append(lines, fmt.Sprintf("| %v | %v |", name, c.Count))
+		}
+	}
+	ranking("Book", stats.ByBook)
+	ranking("Category", stats.ByCategory)
+	ranking("Keeper", stats.ByKeeper)
+
+	if len(stats.StatusDurations) > 0 {
+		lines = append(lines, "", "| Status | Borrows | Average hours |", "|:--|--:|--:|")
+		for _, d := range stats.StatusDurations {
+			lines = append(lines, fmt.Sprintf("| %v | %v | %.1f |", d.Status, d.Count, d.AverageHours))
+		}
+	}
+
+	return strings.Join(lines, "\n")
+}
+
+// Posts the report of the last month in the books channel of every library, once a month.
+// The month reported is claimed in the KV store, so only one server of the cluster posts it.
+func (p *Plugin) _postMonthlyReports(now time.Time) error {
+	if !p.getConfiguration().MonthlyReport {
+		return nil
+	}
+
+	thisMonth := time.Date(now.Year(), now.Month(), 1, 0, 0, 0, 0, now.Location())
+	lastMonth := thisMonth.AddDate(0, -1, 0)
+	month := lastMonth.Format(STATS_MONTH_FORMAT)
+
+	for _, id := range p.libraryIds {
+		lp, err := p._withLibrary(id)
+		if err != nil {
+			return err
+		}
+
+		key := STATS_REPORT_KV_KEY_PREFIX + id
+		reported, appErr := p.API.KVGet(key)
+		if appErr != nil {
+			return errors.Wrapf(appErr, "get reported month of library %v error.", id)
+		}
+		if string(reported) >= month {
+			continue
+		}
+		ok, appErr := p.API.KVSetWithOptions(key, []byte(month), model.PluginKVSetOptions{
+			Atomic:   true,
+			OldValue: reported,
+		})
+		if appErr != nil {
+			return errors.Wrapf(appErr, "claim report of library %v error.", id)
+		}
+		if !ok {
+			// reported by another server
+			continue
+		}
+
+		stats, err := lp._computeStats(_millisOf(lastMonth), _millisOf(thisMonth)-1)
+		if err != nil {
+			return err
+		}
+		if _, appErr := p.API.CreatePost(&model.Post{
+			UserId:    p.botID,
+			ChannelId: lp.booksChannel.Id,
+			Message:   lp._formatStats(stats),
+		}); appErr != nil {
+			return errors.Wrapf(appErr, "post report of library %v error.", id)
+		}
+		p.API.LogInfo("Monthly report posted.", "library", id, "month", month)
+	}
+
+	return nil
+}
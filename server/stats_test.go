@@ -0,0 +1,229 @@
+package main
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/mattermost/mattermost-server/v5/model"
+	"github.com/mattermost/mattermost-server/v5/plugin/plugintest"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/require"
+)
+
+func TestStats(t *testing.T) {
+
+	hour := int64(time.Hour / time.Millisecond)
+
+	setup := func() (*TestData, *plugintest.API, *Plugin, *memRepository) {
+		td := NewTestData()
+		api := td.ApiMockCommon()
+		api.On("CreatePost", mock.Anything).Return(&model.Post{}, nil)
+		plugin := td.NewMockPlugin()
+		plugin.SetAPI(api)
+		repo := newMemRepository()
+		plugin.repo = repo
+		return td, api, plugin, repo
+	}
+
+	// a master record of a borrow that went through the statuses, hours after the request
+	createBorrow := func(t *testing.T, plugin *Plugin, requestedAt int64, renewed int, keeper string, statuses map[string]int64) {
+		wf := plugin._createWFTemplate(requestedAt)
+		last := 0
+		for i := range wf {
+			hours, ok := statuses[wf[i].Status]
+			if !ok || i == 0 {
+				continue
+			}
+			wf[i].Completed = true
+			wf[i].ActionDate = requestedAt + hours*hour
+			wf[i].LastActualStepIndex = last
+			last = i
+		}
+
+		br := &BorrowRequest{
+			BookName:     "book of " + keeper,
+			BookPostId:   "book-" + keeper,
+			KeeperUsers:  []string{keeper},
+			KeeperInfos:  KeeperInfoMap{keeper: {Name: keeper + " name"}},
+			ChosenCopyId: keeper + " b1",
+			Worflow:      wf,
+			StepIndex:    last,
+			RenewedTimes: renewed,
+		}
+		data, _ := json.Marshal(&Borrow{DataOrImage: br, Role: []string{MASTER}})
+		_, err := plugin._repo().Create(&model.Post{
+			ChannelId: plugin.borrowChannel.Id,
+			Type:      "custom_borrow_type",
+			Message:   string(data),
+		})
+		require.Nil(t, err)
+	}
+
+	t.Run("workflow_history", func(t *testing.T) {
+		_, _, plugin, _ := setup()
+		start := GetNowTime() - 30*24*hour
+
+		createBorrow(t, plugin, start, 1, "kpuser1", map[string]int64{
+			STATUS_CONFIRMED:        2,
+			STATUS_KEEPER_CONFIRMED: 4,
+			STATUS_DELIVIED:         10,
+			STATUS_RENEW_REQUESTED:  20,
+			STATUS_RENEW_CONFIRMED:  21,
+		})
+		createBorrow(t, plugin, start+hour, 0, "kpuser1", map[string]int64{
+			STATUS_CONFIRMED:        4,
+			STATUS_KEEPER_CONFIRMED: 8,
+		})
+		createBorrow(t, plugin, start+2*hour, 0, "kpuser2", map[string]int64{})
+		// out of range
+		createBorrow(t, plugin, start-hour, 0, "kpuser2", map[string]int64{
+			STATUS_CONFIRMED: 100,
+		})
+
+		stats, err := plugin._computeStats(start, GetNowTime())
+		require.Nil(t, err)
+
+		assert.Equal(t, 3, stats.Borrows)
+		assert.Equal(t, 1, stats.Renewed)
+		assert.InDelta(t, 1.0/3, stats.RenewalRate, 0.0001)
+		assert.Equal(t, []StatsCount{
+			{Key: "book-kpuser1", Name: "book of kpuser1", Count: 2},
+			{Key: "book-kpuser2", Name: "book of kpuser2", Count: 1},
+		}, stats.ByBook)
+		assert.Equal(t, []StatsCount{
+			{Key: "kpuser1", Name: "kpuser1 name", Count: 2},
+			{Key: "kpuser2", Name: "kpuser2 name", Count: 1},
+		}, stats.ByKeeper)
+		assert.Equal(t, []StatsCount{{Key: "", Count: 3}}, stats.ByCategory, "the books are not found")
+
+		assert.Equal(t, []StatusDuration{
+			{Status: STATUS_REQUESTED, Count: 2, AverageHours: 3},
+			{Status: STATUS_CONFIRMED, Count: 2, AverageHours: 3},
+			{Status: STATUS_KEEPER_CONFIRMED, Count: 1, AverageHours: 6},
+			{Status: STATUS_DELIVIED, Count: 1, AverageHours: 10},
+			{Status: STATUS_RENEW_REQUESTED, Count: 1, AverageHours: 1},
+		}, stats.StatusDurations, "the current status is not counted")
+	})
+
+	t.Run("in_memory_workflow", func(t *testing.T) {
+		td, _, plugin, repo := setup()
+
+		var book Book
+		DeepCopy(&book, td.ABook)
+		book.BookPublic.Id = ""
+		bookId, err := plugin._createABook(&book)
+		require.Nil(t, err)
+
+		masterId, _, err := plugin._borrowABook(td.BorId, &BorrowRequestKey{
+			BookPostId:   bookId,
+			BorrowerUser: td.BorrowUser,
+		}, otherRequestData{processTime: GetNowTime()})
+		require.Nil(t, err)
+
+		wf := plugin._createWFTemplate(0)
+		for _, status := range []string{STATUS_CONFIRMED, STATUS_KEEPER_CONFIRMED, STATUS_DELIVIED} {
+			post, err := repo.Get(masterId)
+			require.Nil(t, err)
+			var master Borrow
+			require.Nil(t, json.Unmarshal([]byte(post.Message), &master))
+
+			var actor, chosen string
+			switch status {
+			case STATUS_CONFIRMED:
+				actor = master.DataOrImage.LibworkerUser
+			case STATUS_KEEPER_CONFIRMED:
+				actor = master.DataOrImage.KeeperUsers[0]
+				chosen = "zzh-book-001 b3"
+			case STATUS_DELIVIED:
+				actor = td.BorrowUser
+			}
+			require.Nil(t, plugin._processWorkflowRequest(td.BorId, &WorkflowRequest{
+				MasterPostKey: masterId,
+				ActorUser:     actor,
+				NextStepIndex: _getIndexByStatus(status, wf),
+				ChosenCopyId:  chosen,
+				Etag:          master.DataOrImage.MatchId,
+			}))
+		}
+
+		from, to, err := _parseStatsRange("", "", time.Now().Add(time.Minute))
+		require.Nil(t, err)
+		stats, err := plugin._computeStats(from, to)
+		require.Nil(t, err)
+
+		assert.Equal(t, 1, stats.Borrows)
+		assert.Equal(t, []StatsCount{{Key: td.ABookPub.Category1, Count: 1}}, stats.ByCategory)
+		require.Equal(t, 1, len(stats.ByKeeper))
+		assert.Equal(t, "kpuser2", stats.ByKeeper[0].Key)
+		assert.Equal(t, 1, stats.Lending)
+		assert.Equal(t, 0, stats.InTransit)
+		assert.Equal(t, 3, len(stats.StatusDurations))
+
+		text := plugin._formatStats(stats)
+		assert.Contains(t, text, "Borrows: 1, renewed: 0 (0.0%), lending now: 1")
+		assert.Contains(t, text, "| a test book | 1 |")
+	})
+
+	t.Run("range", func(t *testing.T) {
+		now := time.Date(2021, 3, 15, 10, 0, 0, 0, time.Local)
+
+		from, to, err := _parseStatsRange("", "", now)
+		require.Nil(t, err)
+		assert.Equal(t, time.Date(2021, 3, 1, 0, 0, 0, 0, time.Local), _timeOfMillis(from))
+		assert.Equal(t, now, _timeOfMillis(to))
+
+		from, to, err = _parseStatsRange("2021-01-01", "2021-01-31", now)
+		require.Nil(t, err)
+		assert.Equal(t, time.Date(2021, 1, 1, 0, 0, 0, 0, time.Local), _timeOfMillis(from))
+		assert.Equal(t, time.Date(2021, 2, 1, 0, 0, 0, 0, time.Local).Add(-time.Millisecond), _timeOfMillis(to))
+
+		_, _, err = _parseStatsRange("2021-13-01", "", now)
+		assert.ErrorIs(t, err, ErrInvalidRequest)
+		_, _, err = _parseStatsRange("2021-02-01", "2021-01-01", now)
+		assert.ErrorIs(t, err, ErrInvalidRequest)
+	})
+
+	t.Run("monthly_report", func(t *testing.T) {
+		td, api, plugin, _ := setup()
+		now := time.Date(2021, 3, 1, 8, 0, 0, 0, time.Local)
+
+		require.Nil(t, plugin._postMonthlyReports(now))
+		api.AssertNotCalled(t, "CreatePost", mock.Anything)
+
+		plugin.configuration = &configuration{MonthlyReport: true}
+		createBorrow(t, plugin, _millisOf(time.Date(2021, 2, 10, 0, 0, 0, 0, time.Local)), 0, "kpuser1", map[string]int64{})
+		createBorrow(t, plugin, _millisOf(now), 0, "kpuser1", map[string]int64{})
+
+		require.Nil(t, plugin._postMonthlyReports(now))
+		require.Nil(t, plugin._postMonthlyReports(now.Add(time.Hour)))
+
+		reports := []*model.Post{}
+		for _, call := range api.Calls {
+			if call.Method == "CreatePost" {
+				reports = append(reports, call.Arguments.Get(0).(*model.Post))
+			}
+		}
+		require.Equal(t, 1, len(reports), "once a month")
+		assert.Equal(t, td.BookChIdPub, reports[0].ChannelId)
+		assert.Contains(t, reports[0].Message, "2021-02-01 ~ 2021-02-28")
+		assert.Contains(t, reports[0].Message, "Borrows: 1,")
+		assert.Equal(t, "2021-02", string(td.kvStore[STATS_REPORT_KV_KEY_PREFIX+DEFAULT_LIBRARY_ID]))
+	})
+
+	t.Run("command", func(t *testing.T) {
+		td, _, plugin, _ := setup()
+
+		_, err := plugin._executeStats(td.BorId, []string{})
+		assert.ErrorIs(t, err, ErrNotPermitted)
+
+		text, err := plugin._executeStats(td.Worker2Id, []string{"2021-01-01", "2021-01-31"})
+		require.Nil(t, err)
+		assert.Contains(t, text, "2021-01-01 ~ 2021-01-31")
+		assert.Contains(t, text, "Borrows: 0,")
+
+		_, err = plugin._executeStats(td.Worker2Id, []string{"yesterday"})
+		assert.ErrorIs(t, err, ErrInvalidRequest)
+	})
+}
@@ -11,6 +11,7 @@ import (
 
 	"github.com/mattermost/mattermost-server/v5/model"
 	"github.com/mattermost/mattermost-server/v5/plugin/plugintest"
+	"github.com/pkg/errors"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/mock"
 	"github.com/stretchr/testify/require"
@@ -63,6 +64,8 @@ type TestData struct {
 	block1             chan struct{}
 	updateBookErr      bool
 	updateBorrowErr    map[string]bool
+	kvStore            map[string][]byte
+	kvLock             sync.Mutex
 }
 type bookInjectOptions struct {
 	keepersAsLibworkers bool
@@ -195,6 +198,19 @@ func NewTestData(bookInject ...bookInjectOptions) *TestData {
 		td.Keeper1Id = td.Worker1Id
 		td.Keeper2Id = td.Worker2Id
 	}
+
+	td.kvStore = map[string][]byte{}
+	td.SetRoles(td.BorId, ROLE_BORROWER)
+	td.SetRoles(td.Worker1Id, ROLE_LIBRARY_ADMIN, ROLE_LIBWORKER, ROLE_BORROWER)
+	td.SetRoles(td.Worker2Id, ROLE_LIBWORKER, ROLE_BORROWER)
+	if !inject.keepersAsLibworkers {
+		td.SetRoles(td.Keeper1Id, ROLE_KEEPER, ROLE_BORROWER)
+		td.SetRoles(td.Keeper2Id, ROLE_KEEPER, ROLE_BORROWER)
+	} else {
+		td.SetRoles(td.Keeper1Id, ROLE_LIBRARY_ADMIN, ROLE_LIBWORKER, ROLE_KEEPER, ROLE_BORROWER)
+		td.SetRoles(td.Keeper2Id, ROLE_LIBWORKER, ROLE_KEEPER, ROLE_BORROWER)
+	}
+
 	td.BorId_botId = model.NewId()
 	td.Worker1Id_botId = model.NewId()
 	td.Worker2Id_botId = model.NewId()
@@ -242,6 +258,68 @@ func NewTestData(bookInject ...bookInjectOptions) *TestData {
 			FirstName: "name2",
 		}, nil)
 
+		usernames := map[string]string{
+			td.BorId:     "bor",
+			td.Worker1Id: "worker1",
+			td.Worker2Id: "worker2",
+		}
+		if !inject.keepersAsLibworkers {
+			usernames[td.Keeper1Id] = "kpuser1"
+			usernames[td.Keeper2Id] = "kpuser2"
+		}
+		api.On("GetUser", mock.MatchedBy(func(id string) bool {
+			_, ok := usernames[id]
+			return ok
+		})).Return(
+			func(id string) *model.User {
+				return &model.User{Id: id, Username: usernames[id]}
+			}, nil)
+
+		api.On("KVGet", mock.AnythingOfType("string")).Return(
+			func(key string) []byte {
+				td.kvLock.Lock()
+				defer td.kvLock.Unlock()
+				return td.kvStore[key]
+			}, nil)
+		api.On("KVSet", mock.AnythingOfType("string"), mock.Anything).Return(
+			func(key string, value []byte) *model.AppError {
+				td.kvLock.Lock()
+				defer td.kvLock.Unlock()
+				td.kvStore[key] = value
+				return nil
+			})
+		api.On("KVDelete", mock.AnythingOfType("string")).Return(
+			func(key string) *model.AppError {
+				td.kvLock.Lock()
+				defer td.kvLock.Unlock()
+				delete(td.kvStore, key)
+				return nil
+			})
+		api.On("KVSetWithOptions", mock.AnythingOfType("string"), mock.Anything, mock.Anything).Return(
+			func(key string, value []byte, options model.PluginKVSetOptions) bool {
+				td.kvLock.Lock()
+				defer td.kvLock.Unlock()
+				if options.Atomic && !bytes.Equal(td.kvStore[key], options.OldValue) {
+					return false
+				}
+				if value == nil {
+					delete(td.kvStore, key)
+				} else {
+					td.kvStore[key] = value
+				}
+				return true
+			}, nil)
+		api.On("KVCompareAndSet", mock.AnythingOfType("string"), mock.Anything, mock.Anything).Return(
+			func(key string, oldValue []byte, newValue []byte) bool {
+				td.kvLock.Lock()
+				defer td.kvLock.Unlock()
+				if !bytes.Equal(td.kvStore[key], oldValue) {
+					return false
+				}
+				td.kvStore[key] = newValue
+				return true
+			}, nil)
+
 		api.On("GetDirectChannel", td.BorId, td.BotId).Return(&model.Channel{
 			Id: td.BorId_botId,
 		}, nil)
@@ -497,19 +575,23 @@ func NewTestData(bookInject ...bookInjectOptions) *TestData {
 
 	td.NewMockPlugin = func() *Plugin {
 		i18n, _ := NewI18n("zh")
-		return &Plugin{
-			botID: td.BotId,
+		lib := &library{
+			id: DEFAULT_LIBRARY_ID,
 			booksChannel: &model.Channel{
-				Id: td.BookChIdPub,
+				Id:     td.BookChIdPub,
+				TeamId: td.BorTeamId,
 			},
 			booksPriChannel: &model.Channel{
-				Id: td.BookChIdPri,
+				Id:     td.BookChIdPri,
+				TeamId: td.BorTeamId,
 			},
 			booksInvChannel: &model.Channel{
-				Id: td.BookChIdInv,
+				Id:     td.BookChIdInv,
+				TeamId: td.BorTeamId,
 			},
 			borrowChannel: &model.Channel{
-				Id: td.BorChannelId,
+				Id:     td.BorChannelId,
+				TeamId: td.BorTeamId,
 			},
 			team: &model.Team{
 				Id: td.BorTeamId,
@@ -517,7 +599,13 @@ func NewTestData(bookInject ...bookInjectOptions) *TestData {
 			borrowTimes:   2,
 			maxRenewTimes: 2,
 			expiredDays:   30,
-			i18n:          i18n,
+		}
+		return &Plugin{
+			botID:      td.BotId,
+			library:    lib,
+			libraries:  map[string]*library{lib.id: lib},
+			libraryIds: []string{lib.id},
+			i18n:       i18n,
 		}
 	}
 
@@ -740,6 +828,7 @@ func GenerateBorrowRequest(td *TestData, plugin *Plugin, api *plugintest.API, in
 	reqkey := td.ReqKey
 	reqkeyJson, _ := json.Marshal(reqkey)
 	r := httptest.NewRequest("POST", "/borrow", bytes.NewReader(reqkeyJson))
+	r.Header.Set("Mattermost-User-ID", td.BorId)
 	plugin.ServeHTTP(nil, w, r)
 
 	return func() ReturnedInfo {
@@ -756,6 +845,34 @@ func GenerateBorrowRequest(td *TestData, plugin *Plugin, api *plugintest.API, in
 
 }
 
+func (td *TestData) SetRoles(userId string, roles ...string) {
+	td.kvLock.Lock()
+	defer td.kvLock.Unlock()
+
+	allRoles := UserRolesMap{}
+	if data, ok := td.kvStore[ROLES_KV_KEY]; ok {
+		json.Unmarshal(data, &allRoles)
+	}
+	allRoles[userId] = roles
+	td.kvStore[ROLES_KV_KEY], _ = json.Marshal(allRoles)
+}
+
+func (td *TestData) UserIdOf(username string) string {
+	switch username {
+	case "bor":
+		return td.BorId
+	case "worker1":
+		return td.Worker1Id
+	case "worker2":
+		return td.Worker2Id
+	case "kpuser1":
+		return td.Keeper1Id
+	case "kpuser2":
+		return td.Keeper2Id
+	}
+	return ""
+}
+
 func _getIndexByStatus(status string, workflow []Step) int {
 
 	for i, step := range workflow {
@@ -901,3 +1018,54 @@ func _assertAfterwordStepsCleared(t *testing.T, status string, wf []Step, params
 	}
 
 }
+
+// The same copies, all kept by the user.
+func keptBy(copyKeeperMap map[string]Keeper, user string) map[string]Keeper {
+	kept := map[string]Keeper{}
+	for id := range copyKeeperMap {
+		kept[id] = Keeper{User: user}
+	}
+	return kept
+}
+
+// Fails the updates of the record with the id, or of every record if the id is empty.
+type failingUpdateRepository struct {
+	Repository
+	id string
+}
+
+func (r *failingUpdateRepository) Update(record *model.Post) (*model.Post, error) {
+	if r.id == "" || r.id == record.Id {
+		return nil, errors.New("update failed")
+	}
+	return r.Repository.Update(record)
+}
+
+// A plugin with a memory repository, for the requests kept in a master record, e.g. purchases and donations.
+// The mocks of mockFirst are matched before the common ones, it may be nil.
+type requestEnv struct {
+	td     *TestData
+	api    *plugintest.API
+	plugin *Plugin
+}
+
+func newRequestEnv(mockFirst func(td *TestData, api *plugintest.API)) *requestEnv {
+	td := NewTestData()
+	api := td.ApiMockCommon()
+	if mockFirst != nil {
+		mockFirst(td, api)
+	}
+	api.On("CreatePost", mock.Anything).Return(&model.Post{}, nil)
+	api.On("GetTeamMember", td.BorTeamId, mock.AnythingOfType("string")).Return(&model.TeamMember{}, nil)
+	plugin := td.NewMockPlugin()
+	plugin.SetAPI(api)
+	plugin.repo = newMemRepository()
+	return &requestEnv{td, api, plugin}
+}
+
+// The borrower is not notified, a post to his/her direct channel with the bot fails.
+func failNotifyingBor(td *TestData, api *plugintest.API) {
+	api.On("CreatePost", mock.MatchedBy(func(post *model.Post) bool {
+		return post.ChannelId == td.BorId_botId
+	})).Return(nil, model.NewAppError("CreatePost", "", nil, "", 500))
+}
@@ -0,0 +1,562 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+
+	"github.com/mattermost/mattermost-server/v5/model"
+	"github.com/mattermost/mattermost-server/v5/plugin"
+	"github.com/pkg/errors"
+)
+
+type transferWithPost struct {
+	post     *model.Post
+	transfer *Transfer
+}
+
+func (p *Plugin) handleTransferRequest(c *plugin.Context, w http.ResponseWriter, r *http.Request) {
+
+	var key *TransferRequestKey
+	if err := json.NewDecoder(r.Body).Decode(&key); err != nil {
+		p.API.LogError("Failed to convert from transfer request.", "err", fmt.Sprintf("%+v", err))
+		resp, _ := json.Marshal(p._errorResult(ErrInvalidRequest, "Failed to convert from transfer request."))
+
+		w.Write(resp)
+		return
+	}
+
+	if _, err := p._createTransfer(r.Header.Get("Mattermost-User-ID"), key); err != nil {
+		p.API.LogError("Failed to create transfer request.", "err", fmt.Sprintf("%+v", err))
+		resp, _ := json.Marshal(p._errorResult(err, p._transferErrorText(err)))
+
+		w.Write(resp)
+		return
+	}
+
+	resp, _ := json.Marshal(Result{
+		Error: "",
+	})
+
+	w.Write(resp)
+}
+
+func (p *Plugin) handleTransferWorkflowRequest(c *plugin.Context, w http.ResponseWriter, r *http.Request) {
+
+	req := new(WorkflowRequest)
+	if err := json.NewDecoder(r.Body).Decode(req); err != nil {
+		p.API.LogError("Failed to convert from transfer workflow request.", "err", fmt.Sprintf("%+v", err))
+		resp, _ := json.Marshal(p._errorResult(ErrInvalidRequest, "Failed to convert from transfer workflow request."))
+
+		w.Write(resp)
+		return
+	}
+
+	if err := p._processTransferRequest(r.Header.Get("Mattermost-User-ID"), req); err != nil {
+		p.API.LogError("Failed to process transfer request.", "err", fmt.Sprintf("%+v", err))
+		resp, _ := json.Marshal(p._errorResult(err, p._transferErrorText(err)))
+
+		w.Write(resp)
+		return
+	}
+
+	resp, _ := json.Marshal(Result{
+		Error: "",
+	})
+
+	w.Write(resp)
+}
+
+func (p *Plugin) _transferErrorText(err error) string {
+	return p._errorText(err, "transfer-failed")
+}
+
+// Only a library admin can request a transfer.
+func (p *Plugin) _createTransfer(userId string, key *TransferRequestKey) (string, error) {
+
+	isAdmin, err := p._isLibraryAdmin(userId)
+	if err != nil {
+		return "", err
+	}
+	if !isAdmin {
+		return "", errors.Wrapf(ErrNotPermitted, "only an admin can request a transfer.")
+	}
+
+	requester, appErr := p.API.GetUser(userId)
+	if appErr != nil {
+		return "", errors.Wrapf(appErr, "get requester error.")
+	}
+
+	bookInfo, err := p._lockAndGetABook(key.BookPostId)
+	if errors.Is(err, ErrLocked) {
+		return "", err
+	}
+	defer lockmap.Delete(key.BookPostId)
+	if err != nil {
+		return "", err
+	}
+
+	book := bookInfo.book
+	inv := book.BookInventory
+
+	if err := _checkCopyInStock(inv, key.CopyId); err != nil {
+		return "", err
+	}
+
+	fromKeeper, err := p._getKeeperUserByCopyId(key.CopyId, bookInfo)
+	if err != nil {
+		return "", err
+	}
+	if fromKeeper == key.ToKeeper {
+		return "", errors.Wrapf(ErrInvalidCopyKeeper, "copy %v is already kept by %v", key.CopyId, key.ToKeeper)
+	}
+
+	master := &TransferRequest{
+		BookName:       book.BookPublic.Name,
+		BookPostId:     key.BookPostId,
+		BookId:         book.BookPublic.Id,
+		CopyId:         key.CopyId,
+		RequesterUser:  requester.Username,
+		FromKeeperUser: fromKeeper,
+		ToKeeperUser:   key.ToKeeper,
+		Worflow:        p._createTransferWFTemplate(GetNowTime()),
+		StepIndex:      0,
+		MatchId:        model.NewId(),
+	}
+	if master.FromKeeperName, err = p._getDisplayNameByUser(fromKeeper); err != nil {
+		return "", errors.Wrapf(err, "Failed to get keeper display name. user:%s", fromKeeper)
+	}
+	if master.ToKeeperName, err = p._getDisplayNameByUser(key.ToKeeper); err != nil {
+		return "", errors.Wrapf(ErrInvalidCopyKeeper, "keeper %v: %v", key.ToKeeper, err)
+	}
+	p._resetTransferTags(master)
+
+	// start a simple transaction
+	// created save all the posted post, to be able to rollback
+	created := []*model.Post{}
+
+	posts := map[string]*transferWithPost{}
+	for _, role := range []struct {
+		name string
+		user string
+	}{
+		{MASTER, ""},
+		{FROM_KEEPER, fromKeeper},
+		{TO_KEEPER, key.ToKeeper},
+	} {
+		channelId := p.borrowChannel.Id
+		if role.user != "" {
+			directChannel, err := p._getBotDirectChannel(role.user)
+			if err != nil {
+				p._rollBackCreated(created)
+				return "", errors.Wrapf(err, "Failed to get bot direct channel. role: %v, user %v", role.name, role.user)
+			}
+			channelId = directChannel.Id
+		}
+
+		post, err := p._repo().Create(&model.Post{
+			UserId:    p.botID,
+			ChannelId: channelId,
+			Message:   "",
+			Type:      "custom_transfer_type",
+		})
+		if err != nil {
+			if rbErr := p._rollBackCreated(created); rbErr != nil {
+				return "", errors.Wrapf(rbErr, "Fatal Error: Failed to post a transfer record and rollback error. role: %v", role.name)
+			}
+			return "", errors.Wrapf(err, "Failed to post a transfer record. role: %v", role.name)
+		}
+		created = append(created, post)
+
+		posts[role.name] = &transferWithPost{
+			post: post,
+			transfer: &Transfer{
+				DataOrImage: master,
+				Role:        []string{role.name},
+			},
+		}
+	}
+
+	relations := TransferRelationKeys{
+		Book:       key.BookPostId,
+		Master:     posts[MASTER].post.Id,
+		FromKeeper: posts[FROM_KEEPER].post.Id,
+		ToKeeper:   posts[TO_KEEPER].post.Id,
+	}
+	for _, twp := range posts {
+		twp.transfer.RelationKeys = relations
+	}
+
+	//the copy is reserved from now on
+	inv.Copies[key.CopyId] = BookCopy{COPY_STATUS_INTRANSIT}
+	inv.Stock--
+	inv.InTransit++
+	p._syncAllowedToBorrow(book.BookPublic, inv)
+
+	if err := p._saveTransfer(posts, bookInfo); err != nil {
+		if err := p._rollBackCreated(created); err != nil {
+			return "", errors.Wrapf(err, "Fatal Error: Failed to save a transfer and rollback error.")
+		}
+		return "", err
+	}
+
+	return posts[MASTER].post.Id, nil
+}
+
+func (p *Plugin) _createTransferWFTemplate(prt int64) []Step {
+	return []Step{
+		{
+			WorkflowType:  WORKFLOW_TRANSFER,
+			Status:        TRANSFER_STATUS_REQUESTED,
+			ActorRole:     FROM_KEEPER,
+			Completed:     true,
+			ActionDate:    prt,
+			NextStepIndex: []int{1},
+			RelatedRoles: []string{
+				MASTER, FROM_KEEPER, TO_KEEPER,
+			},
+			LastActualStepIndex: -1,
+		},
+		{
+			WorkflowType:  WORKFLOW_TRANSFER,
+			Status:        TRANSFER_STATUS_SHIPPED,
+			ActorRole:     TO_KEEPER,
+			Completed:     false,
+			ActionDate:    0,
+			NextStepIndex: []int{2},
+			RelatedRoles: []string{
+				MASTER, FROM_KEEPER, TO_KEEPER,
+			},
+			LastActualStepIndex: -1,
+		},
+		{
+			WorkflowType:  WORKFLOW_TRANSFER,
+			Status:        TRANSFER_STATUS_RECEIVED,
+			ActorRole:     MASTER,
+			Completed:     false,
+			ActionDate:    0,
+			NextStepIndex: nil,
+			RelatedRoles: []string{
+				MASTER, FROM_KEEPER, TO_KEEPER,
+			},
+			LastActualStepIndex: -1,
+		},
+	}
+}
+
+func (p *Plugin) _resetTransferTags(tr *TransferRequest) {
+	tr.Tags = []string{
+		TAG_PREFIX_KEEPER + tr.FromKeeperUser,
+		TAG_PREFIX_KEEPER + tr.ToKeeperUser,
+		TAG_PREFIX_STATUS + tr.Worflow[tr.StepIndex].Status,
+		TAG_PREFIX_COPYID + p._convertChosenCopyIdToTag(tr.CopyId),
+	}
+}
+
+func (p *Plugin) _syncAllowedToBorrow(pub *BookPublic, inv *BookInventory) {
+	if inv.Stock <= 0 && pub.IsAllowedToBorrow {
+		pub.IsAllowedToBorrow = false
+		pub.ReasonOfDisallowed = p.i18n.GetText("no-stock")
+	}
+	if inv.Stock > 0 && !pub.IsAllowedToBorrow && !pub.ManuallyDisallowed {
+		pub.IsAllowedToBorrow = true
+		pub.ReasonOfDisallowed = ""
+	}
+}
+
+// Move a transfer forward by its actor, or delete it.
+// A transfer can only be deleted by an admin before shipping or after receiving.
+func (p *Plugin) _processTransferRequest(userId string, req *WorkflowRequest) error {
+
+	if req.Backward {
+		return KindError(ErrInvalidRequest, "a transfer can't go backward, delete it instead.")
+	}
+
+	all, err := p._loadAndLockTransfer(req)
+	defer p._unlockTransfer(all)
+	if err != nil {
+		return err
+	}
+
+	master := all[MASTER].transfer.DataOrImage
+
+	bookInfo, err := p._lockAndGetABook(master.BookPostId)
+	if errors.Is(err, ErrLocked) {
+		return err
+	}
+	defer lockmap.Delete(master.BookPostId)
+	if err != nil {
+		return err
+	}
+
+	actor, appErr := p.API.GetUser(userId)
+	if appErr != nil {
+		return errors.Wrapf(appErr, "get actor error.")
+	}
+
+	currStep := &master.Worflow[master.StepIndex]
+
+	if req.Delete {
+		isAdmin, err := p._isLibraryAdmin(userId)
+		if err != nil {
+			return err
+		}
+		if !isAdmin {
+			return errors.Wrapf(ErrNotPermitted, "only an admin can delete a transfer.")
+		}
+		return p._deleteTransfer(all, bookInfo, currStep.Status)
+	}
+
+	var allowed bool
+	for _, i := range currStep.NextStepIndex {
+		if i == req.NextStepIndex {
+			allowed = true
+			break
+		}
+	}
+	if !allowed {
+		return KindError(ErrRuleViolation, "step %v can't be reached from status %v", req.NextStepIndex, currStep.Status)
+	}
+
+	var actorUser string
+	switch currStep.ActorRole {
+	case FROM_KEEPER:
+		actorUser = master.FromKeeperUser
+	case TO_KEEPER:
+		actorUser = master.ToKeeperUser
+	}
+	if actor.Username != actorUser {
+		return errors.Wrapf(ErrNotPermitted, "user %v is not the actor of status %v", actor.Username, currStep.Status)
+	}
+
+	nextStep := &master.Worflow[req.NextStepIndex]
+
+	//the new keepers of the received copy
+	var added []string
+	switch nextStep.Status {
+	case TRANSFER_STATUS_SHIPPED:
+	case TRANSFER_STATUS_RECEIVED:
+		if added, err = p._receiveTransferredCopy(master, bookInfo); err != nil {
+			return err
+		}
+	default:
+		return errors.New(fmt.Sprintf("Unknown status: %v in workflow: %v", nextStep.Status, nextStep.WorkflowType))
+	}
+
+	nextStep.ActionDate = GetNowTime()
+	nextStep.Completed = true
+	nextStep.LastActualStepIndex = master.StepIndex
+	master.StepIndex = req.NextStepIndex
+	master.MatchId = model.NewId()
+	p._resetTransferTags(master)
+
+	if err := p._saveTransfer(all, bookInfo); err != nil {
+		return err
+	}
+	p._grantKeeperRole(added...)
+
+	return p._notifyTransferStatusChange(all, actor.Username)
+}
+
+// The copy arrives, it is in stock again and kept by the new keeper.
+// The new keepers are returned, the role is granted once the transfer is saved.
+func (p *Plugin) _receiveTransferredCopy(master *TransferRequest, bookInfo *bookInfo) ([]string, error) {
+	inv := bookInfo.book.BookInventory
+	pri := bookInfo.book.BookPrivate
+
+	if inv.Copies[master.CopyId].Status != COPY_STATUS_INTRANSIT {
+		return nil, KindError(ErrRuleViolation, "copy %v is not in transit", master.CopyId)
+	}
+
+	inv.Copies[master.CopyId] = BookCopy{COPY_STATUS_INSTOCK}
+	inv.InTransit--
+	inv.Stock++
+	p._syncAllowedToBorrow(bookInfo.book.BookPublic, inv)
+
+	if pri.CopyKeeperMap == nil {
+		pri.CopyKeeperMap = map[string]Keeper{}
+	}
+	pri.CopyKeeperMap[master.CopyId] = Keeper{User: master.ToKeeperUser}
+
+	return p._syncCopyKeepers(pri, map[string]bool{master.FromKeeperUser: true})
+}
+
+func (p *Plugin) _deleteTransfer(all map[string]*transferWithPost, bookInfo *bookInfo, status string) error {
+
+	master := all[MASTER].transfer.DataOrImage
+
+	switch status {
+	case TRANSFER_STATUS_REQUESTED:
+		// adjust the inventory firstly, this leave a chance to retry when deleting posts error
+		inv := bookInfo.book.BookInventory
+		if inv.Copies[master.CopyId].Status == COPY_STATUS_INTRANSIT {
+			inv.Copies[master.CopyId] = BookCopy{COPY_STATUS_INSTOCK}
+			inv.InTransit--
+			inv.Stock++
+			p._syncAllowedToBorrow(bookInfo.book.BookPublic, inv)
+
+			if err := p._updateBookParts(updateOptions{
+				pub:     bookInfo.book.BookPublic,
+				pubPost: bookInfo.pubPost,
+				inv:     inv,
+				invPost: bookInfo.invPost,
+			}); err != nil {
+				return errors.Wrapf(err, "adjust inventory error")
+			}
+		}
+	case TRANSFER_STATUS_RECEIVED:
+	default:
+		return KindError(ErrRuleViolation, "the transfer is not allowed to be deleted.")
+	}
+
+	// put master deletion at last
+	for _, role := range []string{FROM_KEEPER, TO_KEEPER, MASTER} {
+		twp := all[role]
+		if twp == nil {
+			continue
+		}
+		if err := p._repo().Delete(twp.post.Id); err != nil {
+			return errors.Wrapf(err, "delete error, please retry or contact admin")
+		}
+	}
+
+	return nil
+}
+
+func (p *Plugin) _getTransferById(id string) (*transferWithPost, error) {
+	post, err := p._repo().Get(id)
+	if errors.Is(err, ErrNotFound) {
+		return nil, ErrNotFound
+	}
+	if err != nil {
+		return nil, errors.Wrapf(err, "Get post error.")
+	}
+
+	tr := new(Transfer)
+	if err := json.Unmarshal([]byte(post.Message), tr); err != nil {
+		return nil, errors.Wrapf(err, "Unmarshal post error.")
+	}
+
+	return &transferWithPost{post: post, transfer: tr}, nil
+}
+
+func (p *Plugin) _loadAndLockTransfer(req *WorkflowRequest) (map[string]*transferWithPost, error) {
+
+	all := map[string]*transferWithPost{}
+
+	if _, ok := lockmap.LoadOrStore(req.MasterPostKey, struct{}{}); ok {
+		return nil, errors.Wrapf(ErrLocked, "Lock %v error", MASTER)
+	}
+
+	master, err := p._getTransferById(req.MasterPostKey)
+	if err != nil {
+		lockmap.Delete(req.MasterPostKey)
+		return nil, errors.Wrapf(err, "Get %v transfer error", MASTER)
+	}
+	if err := p._checkLibraryPost(master.post, p.borrowChannel); err != nil {
+		lockmap.Delete(req.MasterPostKey)
+		return nil, err
+	}
+	all[MASTER] = master
+
+	if master.transfer.DataOrImage.MatchId != req.Etag {
+		return all, WithDetails(errors.Wrapf(ErrStale, "Get %v transfer stale", MASTER),
+			ErrorDetails{ERROR_DETAIL_ETAG: master.transfer.DataOrImage.MatchId})
+	}
+
+	for _, role := range []struct {
+		name string
+		id   string
+	}{
+		{FROM_KEEPER, master.transfer.RelationKeys.FromKeeper},
+		{TO_KEEPER, master.transfer.RelationKeys.ToKeeper},
+	} {
+		if _, ok := lockmap.LoadOrStore(role.id, struct{}{}); ok {
+			return all, errors.Wrapf(ErrLocked, "Lock %v error", role.name)
+		}
+
+		twp, err := p._getTransferById(role.id)
+		if err != nil {
+			lockmap.Delete(role.id)
+			if errors.Is(err, ErrNotFound) && req.Delete {
+				continue
+			}
+			return all, errors.Wrapf(err, "Get %v transfer error", role.name)
+		}
+		all[role.name] = twp
+	}
+
+	return all, nil
+}
+
+func (p *Plugin) _unlockTransfer(all map[string]*transferWithPost) {
+	for _, twp := range all {
+		if twp != nil {
+			lockmap.Delete(twp.post.Id)
+		}
+	}
+}
+
+// All the posts share the master's data, only role differs.
+func (p *Plugin) _saveTransfer(all map[string]*transferWithPost, bookInfo *bookInfo) error {
+
+	updated := []*model.Post{}
+
+	//MUST MAKE MASTER TO BE UPDATED LAST
+	for _, role := range []string{FROM_KEEPER, TO_KEEPER, MASTER} {
+		twp := all[role]
+		twp.transfer.DataOrImage = all[MASTER].transfer.DataOrImage
+
+		trJson, err := _marshalRecord(twp.transfer)
+		if err != nil {
+			if err := p._rollbackToOld(updated); err != nil {
+				return errors.Wrapf(err, "Fatal Error, mashal error, role: %v, and rollback error", role)
+			}
+			return errors.Wrapf(err, "Marshal %v error.", role)
+		}
+
+		updTr := &model.Post{}
+		DeepCopy(updTr, twp.post)
+		updTr.Message = string(trJson)
+		if updTr.Message == twp.post.Message {
+			continue
+		}
+		if _, err := p._repo().Update(updTr); err != nil {
+			if rbErr := p._rollbackToOld(updated); rbErr != nil {
+				return errors.Wrapf(rbErr, "Fatal Error, update post error, role: %v, and rollback error", role)
+			}
+			return errors.Wrapf(err, "Update post error. role: %v, postid: %v", role, twp.post.Id)
+		}
+		updated = append(updated, twp.post)
+	}
+
+	if err := p._updateBookParts(updateOptions{
+		pub:     bookInfo.book.BookPublic,
+		pubPost: bookInfo.pubPost,
+		pri:     bookInfo.book.BookPrivate,
+		priPost: bookInfo.priPost,
+		inv:     bookInfo.book.BookInventory,
+		invPost: bookInfo.invPost,
+	}); err != nil {
+		if err := p._rollbackToOld(updated); err != nil {
+			return errors.Wrapf(err, "Fatal Error, update book error, and rollback error")
+		}
+		return errors.Wrapf(err, "update book error.")
+	}
+
+	return nil
+}
+
+func (p *Plugin) _notifyTransferStatusChange(all map[string]*transferWithPost, actorUser string) error {
+	master := all[MASTER].transfer.DataOrImage
+	status := master.Worflow[master.StepIndex].Status
+
+	for _, role := range []string{MASTER, FROM_KEEPER, TO_KEEPER} {
+		twp := all[role]
+		if err := p._notifyRecord(twp.post, fmt.Sprintf("Status was changed to %v, by @%v.", status, actorUser)); err != nil {
+			return errors.Wrapf(err, "Failed to notify status change. role: %v", role)
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,249 @@
+package main
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/mattermost/mattermost-server/v5/model"
+	"github.com/mattermost/mattermost-server/v5/plugin/plugintest"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/require"
+)
+
+func TestTransfer(t *testing.T) {
+
+	type env struct {
+		td      *TestData
+		plugin  *Plugin
+		api     *plugintest.API
+		adminId string
+		posts   map[string]*model.Post
+		deleted map[string]bool
+	}
+
+	setup := func() *env {
+		td := NewTestData()
+		plugin := td.NewMockPlugin()
+		api := td.ApiMockCommon()
+		plugin.SetAPI(api)
+
+		e := &env{
+			td:      td,
+			plugin:  plugin,
+			api:     api,
+			adminId: model.NewId(),
+			posts:   map[string]*model.Post{},
+			deleted: map[string]bool{},
+		}
+
+		td.SetRoles(e.adminId, ROLE_LIBRARY_ADMIN)
+
+		users := map[string]string{
+			e.adminId:    "admin",
+			td.Keeper1Id: "kpuser1",
+			td.Keeper2Id: "kpuser2",
+		}
+		api.On("GetUser", mock.AnythingOfType("string")).Return(
+			func(id string) *model.User {
+				return &model.User{Id: id, Username: users[id]}
+			}, nil)
+
+		isTransfer := func(post *model.Post) bool {
+			return post.Type == "custom_transfer_type" && post.RootId == ""
+		}
+		api.On("CreatePost", mock.MatchedBy(isTransfer)).Return(
+			func(post *model.Post) *model.Post {
+				created := &model.Post{}
+				DeepCopy(created, post)
+				created.Id = model.NewId()
+				e.posts[created.Id] = created
+				return created
+			}, nil)
+		api.On("UpdatePost", mock.MatchedBy(isTransfer)).Return(
+			func(post *model.Post) *model.Post {
+				updated := &model.Post{}
+				DeepCopy(updated, post)
+				e.posts[post.Id] = updated
+				return updated
+			}, nil)
+		api.On("GetPost", mock.MatchedBy(func(id string) bool {
+			_, ok := e.posts[id]
+			return ok
+		})).Return(
+			func(id string) *model.Post {
+				post := &model.Post{}
+				DeepCopy(post, e.posts[id])
+				return post
+			}, nil)
+		api.On("DeletePost", mock.MatchedBy(func(id string) bool {
+			_, ok := e.posts[id]
+			return ok
+		})).Return(
+			func(id string) *model.AppError {
+				e.deleted[id] = true
+				return nil
+			})
+		api.On("CreatePost", mock.MatchedBy(func(post *model.Post) bool {
+			return post.RootId != ""
+		})).Return(&model.Post{}, nil)
+
+		return e
+	}
+
+	getMaster := func(e *env, id string) *TransferRequest {
+		var tr Transfer
+		require.Nil(t, json.Unmarshal([]byte(e.posts[id].Message), &tr))
+		return tr.DataOrImage
+	}
+
+	request := func(e *env) string {
+		id, err := e.plugin._createTransfer(e.adminId, &TransferRequestKey{
+			BookPostId: e.td.BookPostIdPub,
+			CopyId:     "zzh-book-001 b3",
+			ToKeeper:   "kpuser1",
+		})
+		require.Nil(t, err)
+		return id
+	}
+
+	step := func(e *env, masterId string, userId string, next int) error {
+		return e.plugin._processTransferRequest(userId, &WorkflowRequest{
+			MasterPostKey: masterId,
+			NextStepIndex: next,
+			Etag:          getMaster(e, masterId).MatchId,
+		})
+	}
+
+	t.Run("request_not_admin", func(t *testing.T) {
+		e := setup()
+		_, err := e.plugin._createTransfer(e.td.Keeper1Id, &TransferRequestKey{
+			BookPostId: e.td.BookPostIdPub,
+			CopyId:     "zzh-book-001 b3",
+			ToKeeper:   "kpuser1",
+		})
+		assert.ErrorIs(t, err, ErrNotPermitted)
+		assert.Empty(t, e.posts)
+	})
+
+	t.Run("request", func(t *testing.T) {
+		e := setup()
+		id := request(e)
+
+		assert.Len(t, e.posts, 3)
+		assert.Equal(t, e.td.BorChannelId, e.posts[id].ChannelId)
+
+		master := getMaster(e, id)
+		assert.Equal(t, "admin", master.RequesterUser)
+		assert.Equal(t, "kpuser2", master.FromKeeperUser)
+		assert.Equal(t, "kpuser1", master.ToKeeperUser)
+		assert.Equal(t, TRANSFER_STATUS_REQUESTED, master.Worflow[master.StepIndex].Status)
+		assert.Contains(t, master.Tags, TAG_PREFIX_STATUS+TRANSFER_STATUS_REQUESTED)
+
+		var tr Transfer
+		json.Unmarshal([]byte(e.posts[id].Message), &tr)
+		assert.Equal(t, id, tr.RelationKeys.Master)
+		assert.Equal(t, e.td.Keeper2Id_botId, e.posts[tr.RelationKeys.FromKeeper].ChannelId)
+		assert.Equal(t, e.td.Keeper1Id_botId, e.posts[tr.RelationKeys.ToKeeper].ChannelId)
+
+		assert.Equal(t, COPY_STATUS_INTRANSIT, e.td.ABookInv.Copies["zzh-book-001 b3"].Status)
+		assert.Equal(t, 2, e.td.ABookInv.Stock)
+		assert.Equal(t, 1, e.td.ABookInv.InTransit)
+	})
+
+	t.Run("request_copy_in_transit", func(t *testing.T) {
+		e := setup()
+		request(e)
+
+		_, err := e.plugin._createTransfer(e.adminId, &TransferRequestKey{
+			BookPostId: e.td.BookPostIdPub,
+			CopyId:     "zzh-book-001 b3",
+			ToKeeper:   "kpuser1",
+		})
+		assert.ErrorIs(t, err, ErrChooseInStockCopy)
+	})
+
+	t.Run("request_same_keeper", func(t *testing.T) {
+		e := setup()
+		_, err := e.plugin._createTransfer(e.adminId, &TransferRequestKey{
+			BookPostId: e.td.BookPostIdPub,
+			CopyId:     "zzh-book-001 b3",
+			ToKeeper:   "kpuser2",
+		})
+		assert.ErrorIs(t, err, ErrInvalidCopyKeeper)
+	})
+
+	t.Run("ship_and_receive", func(t *testing.T) {
+		e := setup()
+		id := request(e)
+
+		assert.ErrorIs(t, step(e, id, e.td.Keeper1Id, 1), ErrNotPermitted)
+		assert.NotNil(t, step(e, id, e.td.Keeper2Id, 2))
+
+		require.Nil(t, step(e, id, e.td.Keeper2Id, 1))
+		master := getMaster(e, id)
+		assert.Equal(t, TRANSFER_STATUS_SHIPPED, master.Worflow[master.StepIndex].Status)
+		assert.Equal(t, COPY_STATUS_INTRANSIT, e.td.ABookInv.Copies["zzh-book-001 b3"].Status)
+
+		assert.ErrorIs(t, step(e, id, e.td.Keeper2Id, 2), ErrNotPermitted)
+		require.Nil(t, step(e, id, e.td.Keeper1Id, 2))
+		master = getMaster(e, id)
+		assert.Equal(t, TRANSFER_STATUS_RECEIVED, master.Worflow[master.StepIndex].Status)
+		assert.True(t, master.Worflow[2].Completed)
+
+		for _, tp := range e.posts {
+			var tr Transfer
+			json.Unmarshal([]byte(tp.Message), &tr)
+			assert.Equal(t, master.MatchId, tr.DataOrImage.MatchId)
+		}
+
+		assert.Equal(t, COPY_STATUS_INSTOCK, e.td.ABookInv.Copies["zzh-book-001 b3"].Status)
+		assert.Equal(t, 3, e.td.ABookInv.Stock)
+		assert.Equal(t, 0, e.td.ABookInv.InTransit)
+		assert.Equal(t, Keeper{User: "kpuser1"}, e.td.ABookPri.CopyKeeperMap["zzh-book-001 b3"])
+		assert.Equal(t, []string{"kpuser1"}, e.td.ABookPri.KeeperUsers)
+		assert.Equal(t, KeeperInfoMap{"kpuser1": {"kpname1"}}, e.td.ABookPri.KeeperInfos)
+	})
+
+	t.Run("stale", func(t *testing.T) {
+		e := setup()
+		id := request(e)
+
+		err := e.plugin._processTransferRequest(e.td.Keeper2Id, &WorkflowRequest{
+			MasterPostKey: id,
+			NextStepIndex: 1,
+			Etag:          model.NewId(),
+		})
+		assert.ErrorIs(t, err, ErrStale)
+	})
+
+	t.Run("delete_requested", func(t *testing.T) {
+		e := setup()
+		id := request(e)
+
+		err := e.plugin._processTransferRequest(e.adminId, &WorkflowRequest{
+			MasterPostKey: id,
+			Delete:        true,
+			Etag:          getMaster(e, id).MatchId,
+		})
+		require.Nil(t, err)
+		assert.Len(t, e.deleted, 3)
+		assert.Equal(t, COPY_STATUS_INSTOCK, e.td.ABookInv.Copies["zzh-book-001 b3"].Status)
+		assert.Equal(t, 3, e.td.ABookInv.Stock)
+		assert.Equal(t, 0, e.td.ABookInv.InTransit)
+	})
+
+	t.Run("delete_shipped", func(t *testing.T) {
+		e := setup()
+		id := request(e)
+		require.Nil(t, step(e, id, e.td.Keeper2Id, 1))
+
+		err := e.plugin._processTransferRequest(e.adminId, &WorkflowRequest{
+			MasterPostKey: id,
+			Delete:        true,
+			Etag:          getMaster(e, id).MatchId,
+		})
+		assert.NotNil(t, err)
+		assert.Empty(t, e.deleted)
+	})
+}
@@ -4,9 +4,14 @@ import (
 	"encoding/json"
 	"fmt"
 	"time"
+
 	// "github.com/mattermost/mattermost-server/v5/model"
+	"github.com/pkg/errors"
 )
 
+// tries of a compare and set before giving up
+const kvUpdateRetries = 5
+
 // Make a deep copy from src into dst.
 func DeepCopyBorrow(dst *Borrow, src *Borrow) error {
 	if dst == nil {
@@ -61,6 +66,24 @@ func ConstainsInStringSet(set map[string]bool, values []string) bool {
 	return false
 }
 
+func RemoveString(arr []string, value string) []string {
+	removed := []string{}
+	for _, v := range arr {
+		if v != value {
+			removed = append(removed, v)
+		}
+	}
+	return removed
+}
+
+func ReverseStrings(arr []string) []string {
+	reversed := make([]string, 0, len(arr))
+	for i := len(arr) - 1; i >= 0; i-- {
+		reversed = append(reversed, arr[i])
+	}
+	return reversed
+}
+
 func DeepCopy(dst interface{}, src interface{}) error {
 	if dst == nil {
 		return fmt.Errorf("dst cannot be nil")
@@ -82,3 +105,37 @@ func DeepCopy(dst interface{}, src interface{}) error {
 func GetNowTime() int64 {
 	return time.Now().UnixNano() / int64(time.Millisecond)
 }
+
+// v is loaded again before every try, the update is retried if the value is changed meanwhile.
+func (p *Plugin) _compareAndUpdateKV(key string, v interface{}, update func() error) error {
+	for i := 0; i < kvUpdateRetries; i++ {
+		data, appErr := p.API.KVGet(key)
+		if appErr != nil {
+			return errors.Wrapf(appErr, "get %v error.", key)
+		}
+		old := data
+		if old == nil {
+			data = []byte("null")
+		}
+		if err := json.Unmarshal(data, v); err != nil {
+			return errors.Wrapf(err, "convert %v error.", key)
+		}
+
+		if err := update(); err != nil {
+			return err
+		}
+
+		newData, err := json.Marshal(v)
+		if err != nil {
+			return errors.Wrapf(err, "convert %v error.", key)
+		}
+		ok, appErr := p.API.KVCompareAndSet(key, old, newData)
+		if appErr != nil {
+			return errors.Wrapf(appErr, "save %v error.", key)
+		}
+		if ok {
+			return nil
+		}
+	}
+	return errors.Wrapf(ErrLocked, "update %v", key)
+}
@@ -0,0 +1,539 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/mattermost/mattermost-server/v5/model"
+	"github.com/pkg/errors"
+)
+
+const (
+	webhookTimeout = 10 * time.Second
+	// refreshed before every send, so it only needs to outlive one timeout
+	webhookLockExpiry = 60 // seconds
+	// deliveries sent by a run for a library, the others wait for the next run
+	webhookBatchSize = 20
+	// how much of an error response is kept in the log
+	webhookErrorBodyMax = 200
+)
+
+var webhookClient = &http.Client{Timeout: webhookTimeout}
+
+var webhookEvents = []string{
+	WEBHOOK_EVENT_BOOK_CREATED,
+	WEBHOOK_EVENT_BOOK_UPDATED,
+	WEBHOOK_EVENT_BOOK_DELETED,
+	WEBHOOK_EVENT_BORROW_CREATED,
+	WEBHOOK_EVENT_STEP_CHANGED,
+}
+
+func (p *Plugin) _webhooksKey() string {
+	return WEBHOOKS_KV_KEY_PREFIX + p.library.id
+}
+
+func (p *Plugin) _webhookQueueKey() string {
+	return WEBHOOK_QUEUE_KV_KEY_PREFIX + p.library.id
+}
+
+func (p *Plugin) _webhookLogKey() string {
+	return WEBHOOK_LOG_KV_KEY_PREFIX + p.library.id
+}
+
+func (p *Plugin) _loadWebhookTargets() ([]WebhookTarget, error) {
+	data, appErr := p.API.KVGet(p._webhooksKey())
+	if appErr != nil {
+		return nil, errors.Wrapf(appErr, "get webhooks error.")
+	}
+
+	targets := []WebhookTarget{}
+	if data == nil {
+		return targets, nil
+	}
+	if err := json.Unmarshal(data, &targets); err != nil {
+		return nil, errors.Wrapf(err, "convert webhooks error.")
+	}
+	return targets, nil
+}
+
+// Secrets are only shown when the targets are added.
+func (p *Plugin) _listWebhookTargets(userId string) ([]WebhookTarget, error) {
+	if err := p._checkRole(userId, ROLE_LIBRARY_ADMIN); err != nil {
+		return nil, err
+	}
+
+	targets, err := p._loadWebhookTargets()
+	if err != nil {
+		return nil, err
+	}
+	for i := range targets {
+		targets[i].Secret = ""
+	}
+	return targets, nil
+}
+
+// A secret is generated if it isn't given.
+func (p *Plugin) _addWebhookTarget(userId string, req *WebhookTarget) (*WebhookTarget, error) {
+	if err := p._checkRole(userId, ROLE_LIBRARY_ADMIN); err != nil {
+		return nil, err
+	}
+
+	u, err := url.Parse(strings.TrimSpace(req.URL))
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return nil, KindError(ErrInvalidRequest, "url should be an absolute http(s) url.")
+	}
+
+	valid := ConvertStringArrayToSet(webhookEvents)
+	events := []string{}
+	for _, event := range req.Events {
+		if !valid[event] {
+			return nil, KindError(ErrInvalidRequest, "unknown event %v, should be one of %v.", event, strings.Join(webhookEvents, ", "))
+		}
+		events = _appendUnique(events, event)
+	}
+
+	user, appErr := p.API.GetUser(userId)
+	if appErr != nil {
+		return nil, errors.Wrapf(appErr, "get user %v error.", userId)
+	}
+
+	target := WebhookTarget{
+		Id:        model.NewId(),
+		URL:       u.String(),
+		Secret:    req.Secret,
+		Events:    events,
+		CreatedBy: user.Username,
+		CreateAt:  GetNowTime(),
+	}
+	if target.Secret == "" {
+		target.Secret = model.NewId() + model.NewId()
+	}
+
+	var targets []WebhookTarget
+	if err := p._compareAndUpdateKV(p._webhooksKey(), &targets, func() error {
+		targets = append(targets, target)
+		return nil
+	}); err != nil {
+		return nil, err
+	}
+
+	return &target, nil
+}
+
+// The pending deliveries to the target are given up when they are sent.
+func (p *Plugin) _removeWebhookTarget(userId string, id string) error {
+	if err := p._checkRole(userId, ROLE_LIBRARY_ADMIN); err != nil {
+		return err
+	}
+
+	var targets []WebhookTarget
+	return p._compareAndUpdateKV(p._webhooksKey(), &targets, func() error {
+		for i, target := range targets {
+			if target.Id == id {
+				targets = append(targets[:i], targets[i+1:]...)
+				return nil
+			}
+		}
+		return errors.Wrapf(ErrNotFound, "webhook %v", id)
+	})
+}
+
+// The pending deliveries first, then the log.
+func (p *Plugin) _listWebhookDeliveries(userId string) ([]WebhookDelivery, error) {
+	if err := p._checkRole(userId, ROLE_LIBRARY_ADMIN); err != nil {
+		return nil, err
+	}
+
+	deliveries := []WebhookDelivery{}
+	for _, key := range []string{p._webhookQueueKey(), p._webhookLogKey()} {
+		data, appErr := p.API.KVGet(key)
+		if appErr != nil {
+			return nil, errors.Wrapf(appErr, "get %v error.", key)
+		}
+		if data == nil {
+			continue
+		}
+		var part []WebhookDelivery
+		if err := json.Unmarshal(data, &part); err != nil {
+			return nil, errors.Wrapf(err, "convert %v error.", key)
+		}
+		deliveries = append(deliveries, part...)
+	}
+	return deliveries, nil
+}
+
+func (p *Plugin) _subscribedWebhooks(event string) []WebhookTarget {
+	targets, err := p._loadWebhookTargets()
+	if err != nil {
+		p.API.LogError("Failed to load webhooks.", "err", fmt.Sprintf("%+v", err))
+		return nil
+	}
+
+	subscribed := []WebhookTarget{}
+	for _, target := range targets {
+		if len(target.Events) == 0 || ConstainsInStringSet(ConvertStringArrayToSet(target.Events), []string{event}) {
+			subscribed = append(subscribed, target)
+		}
+	}
+	return subscribed
+}
+
+// An event is queued for every target, and sent by the background job.
+// A failure is logged only, the change is done anyway.
+func (p *Plugin) _enqueueWebhooks(targets []WebhookTarget, event string, data interface{}) {
+	now := GetNowTime()
+	body, err := json.Marshal(WebhookPayload{
+		Id:        model.NewId(),
+		Event:     event,
+		LibraryId: p.library.id,
+		CreateAt:  now,
+		Data:      data,
+	})
+	if err != nil {
+		p.API.LogError("Failed to convert webhook payload.", "err", fmt.Sprintf("%+v", err))
+		return
+	}
+
+	var queue []WebhookDelivery
+	if err := p._compareAndUpdateKV(p._webhookQueueKey(), &queue, func() error {
+		for _, target := range targets {
+			queue = append(queue, WebhookDelivery{
+				Id:            model.NewId(),
+				TargetId:      target.Id,
+				URL:           target.URL,
+				Event:         event,
+				Payload:       string(body),
+				Status:        WEBHOOK_DELIVERY_PENDING,
+				NextAttemptAt: now,
+				CreateAt:      now,
+				UpdateAt:      now,
+			})
+		}
+		return nil
+	}); err != nil {
+		p.API.LogError("Failed to queue webhooks.", "err", fmt.Sprintf("%+v", err))
+		return
+	}
+
+	p.backgroundJob.kickWebhooks()
+}
+
+// book is the deleted one for a deletion, and is got from the posts if nil.
+func (p *Plugin) _emitBookEvent(event string, bookPostId string, book *BookPublic) {
+	targets := p._subscribedWebhooks(event)
+	if len(targets) == 0 {
+		return
+	}
+
+	if book == nil {
+		info, err := p.GetABook(bookPostId)
+		if err != nil {
+			p.API.LogError("Failed to get the book of a webhook.", "err", fmt.Sprintf("%+v", err))
+			return
+		}
+		book = info.book.BookPublic
+	}
+
+	p._enqueueWebhooks(targets, event, WebhookBookData{
+		BookPostId: bookPostId,
+		Book:       book,
+	})
+}
+
+func (p *Plugin) _emitBorrowCreated(userId string, masterKey string, master *BorrowRequest, book *BookPublic) {
+	targets := p._subscribedWebhooks(WEBHOOK_EVENT_BORROW_CREATED)
+	if len(targets) == 0 {
+		return
+	}
+
+	p._enqueueWebhooks(targets, WEBHOOK_EVENT_BORROW_CREATED, WebhookBorrowData{
+		MasterKey: masterKey,
+		Borrow:    master,
+		Book:      book,
+		Actor:     p._webhookActor(userId),
+	})
+}
+
+func (p *Plugin) _emitStepChanged(actor workflowActor, masterKey string, previous Step, master *BorrowRequest,
+	book *BookPublic, backward bool) {
+	targets := p._subscribedWebhooks(WEBHOOK_EVENT_STEP_CHANGED)
+	if len(targets) == 0 {
+		return
+	}
+
+	webhookActor := &WebhookActor{Kiosk: actor.kiosk}
+	if actor.kiosk == "" {
+		webhookActor = p._webhookActor(actor.userId)
+	}
+
+	p._enqueueWebhooks(targets, WEBHOOK_EVENT_STEP_CHANGED, WebhookTransitionData{
+		MasterKey:    masterKey,
+		Step:         master.Worflow[master.StepIndex],
+		PreviousStep: previous,
+		Backward:     backward,
+		Borrow:       master,
+		Book:         book,
+		Actor:        webhookActor,
+	})
+}
+
+func (p *Plugin) _webhookActor(userId string) *WebhookActor {
+	actor := &WebhookActor{UserId: userId}
+	if user, appErr := p.API.GetUser(userId); appErr == nil {
+		actor.Username = user.Username
+	}
+	return actor
+}
+
+// A background task, also run when an event is queued.
+// A failed library doesn't stop the others, its deliveries are sent by the next run.
+func (p *Plugin) _deliverWebhooks(now time.Time) error {
+	token := model.NewId()
+	ok, appErr := p.API.KVSetWithOptions(WEBHOOK_LOCK_KV_KEY, []byte(token), model.PluginKVSetOptions{
+		Atomic:          true,
+		OldValue:        nil,
+		ExpireInSeconds: webhookLockExpiry,
+	})
+	if appErr != nil {
+		return errors.Wrapf(appErr, "lock webhooks error.")
+	}
+	if !ok {
+		// sent by another server
+		return nil
+	}
+	defer func() {
+		if _, appErr := p.API.KVSetWithOptions(WEBHOOK_LOCK_KV_KEY, nil, model.PluginKVSetOptions{
+			Atomic:   true,
+			OldValue: []byte(token),
+		}); appErr != nil {
+			p.API.LogError("Failed to unlock webhooks.", "err", appErr.Error())
+		}
+	}()
+
+	for _, id := range p.libraryIds {
+		lp, err := p._withLibrary(id)
+		if err == nil {
+			err = lp._deliverLibraryWebhooks(now, token)
+		}
+		if errors.Is(err, ErrLocked) {
+			return err
+		}
+		if err != nil {
+			p.API.LogError("Failed to deliver webhooks of a library.", "library", id, "err", fmt.Sprintf("%+v", err))
+		}
+	}
+	return nil
+}
+
+// The lock is refreshed before every send, so a slow batch doesn't let another server
+// take the lock and send the same deliveries again.
+func (p *Plugin) _refreshWebhooksLock(token string) error {
+	ok, appErr := p.API.KVSetWithOptions(WEBHOOK_LOCK_KV_KEY, []byte(token), model.PluginKVSetOptions{
+		Atomic:          true,
+		OldValue:        []byte(token),
+		ExpireInSeconds: webhookLockExpiry,
+	})
+	if appErr != nil {
+		return errors.Wrapf(appErr, "refresh webhooks lock error.")
+	}
+	if !ok {
+		return errors.Wrapf(ErrLocked, "webhooks lock is lost")
+	}
+	return nil
+}
+
+// The deliveries sent before the lock is lost are still saved.
+func (p *Plugin) _deliverLibraryWebhooks(now time.Time, token string) error {
+	data, appErr := p.API.KVGet(p._webhookQueueKey())
+	if appErr != nil {
+		return errors.Wrapf(appErr, "get webhook queue error.")
+	}
+	if data == nil {
+		return nil
+	}
+	var queue []WebhookDelivery
+	if err := json.Unmarshal(data, &queue); err != nil {
+		return errors.Wrapf(err, "convert webhook queue error.")
+	}
+
+	targets, err := p._loadWebhookTargets()
+	if err != nil {
+		return err
+	}
+	targetById := map[string]*WebhookTarget{}
+	for i := range targets {
+		targetById[targets[i].Id] = &targets[i]
+	}
+
+	var lockErr error
+	sent := map[string]WebhookDelivery{}
+	for _, d := range queue {
+		if len(sent) >= webhookBatchSize {
+			break
+		}
+		if d.NextAttemptAt > _millisOf(now) {
+			continue
+		}
+		if lockErr = p._refreshWebhooksLock(token); lockErr != nil {
+			break
+		}
+		p._sendWebhook(&d, targetById[d.TargetId], now)
+		sent[d.Id] = d
+	}
+	if len(sent) == 0 {
+		return lockErr
+	}
+
+	finished := []WebhookDelivery{}
+	if err := p._compareAndUpdateKV(p._webhookQueueKey(), &queue, func() error {
+		finished = finished[:0]
+		pending := []WebhookDelivery{}
+		for _, d := range queue {
+			if s, ok := sent[d.Id]; ok {
+				d = s
+			}
+			if d.Status == WEBHOOK_DELIVERY_PENDING {
+				pending = append(pending, d)
+			} else {
+				finished = append(finished, d)
+			}
+		}
+		queue = pending
+		return nil
+	}); err != nil {
+		return err
+	}
+
+	var log []WebhookDelivery
+	if err := p._compareAndUpdateKV(p._webhookLogKey(), &log, func() error {
+		for _, d := range finished {
+			log = append([]WebhookDelivery{d}, log...)
+		}
+		if len(log) > WEBHOOK_LOG_MAX {
+			log = log[:WEBHOOK_LOG_MAX]
+		}
+		return nil
+	}); err != nil {
+		return err
+	}
+	return lockErr
+}
+
+// Any 2xx response is a success, the others are retried with backoff until WEBHOOK_MAX_ATTEMPTS.
+func (p *Plugin) _sendWebhook(d *WebhookDelivery, target *WebhookTarget, now time.Time) {
+	d.Attempts++
+	d.UpdateAt = _millisOf(now)
+
+	if target == nil {
+		d.Status = WEBHOOK_DELIVERY_FAILED
+		d.LastError = "the webhook is removed."
+		d.NextAttemptAt = 0
+		return
+	}
+
+	d.LastStatusCode = 0
+	d.LastError = ""
+	if err := _postWebhook(d, target.Secret); err != nil {
+		d.LastError = err.Error()
+		var status *webhookStatusError
+		if errors.As(err, &status) {
+			d.LastStatusCode = status.code
+		}
+	} else {
+		d.LastStatusCode = http.StatusOK
+		d.Status = WEBHOOK_DELIVERY_DELIVERED
+		d.NextAttemptAt = 0
+		return
+	}
+
+	if d.Attempts >= WEBHOOK_MAX_ATTEMPTS {
+		d.Status = WEBHOOK_DELIVERY_FAILED
+		d.NextAttemptAt = 0
+		return
+	}
+	d.NextAttemptAt = _millisOf(now.Add(_webhookBackoff(d.Attempts)))
+}
+
+type webhookStatusError struct {
+	code int
+	body string
+}
+
+func (e *webhookStatusError) Error() string {
+	return fmt.Sprintf("status %v: %v", e.code, e.body)
+}
+
+func _postWebhook(d *WebhookDelivery, secret string) error {
+	r, err := http.NewRequest(http.MethodPost, d.URL, bytes.NewReader([]byte(d.Payload)))
+	if err != nil {
+		return errors.Wrapf(err, "new request error.")
+	}
+	r.Header.Set("Content-Type", "application/json")
+	r.Header.Set(WEBHOOK_HEADER_EVENT, d.Event)
+	r.Header.Set(WEBHOOK_HEADER_DELIVERY, d.Id)
+	r.Header.Set(WEBHOOK_HEADER_SIGNATURE, _signWebhook(secret, []byte(d.Payload)))
+
+	resp, err := webhookClient.Do(r)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		body, _ := ioutil.ReadAll(io.LimitReader(resp.Body, webhookErrorBodyMax))
+		return &webhookStatusError{code: resp.StatusCode, body: string(body)}
+	}
+	io.Copy(ioutil.Discard, resp.Body)
+	return nil
+}
+
+func _signWebhook(secret string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// The wait after the given failed attempts.
+func _webhookBackoff(attempts int) time.Duration {
+	return time.Duration(WEBHOOK_RETRY_BASE_SECONDS) * time.Second << uint(attempts-1)
+}
+
+func _formatWebhookTargets(targets []WebhookTarget) string {
+	if len(targets) == 0 {
+		return "No webhooks."
+	}
+
+	lines := []string{"| Url | Events | Added by | Id |", "|:--|:--|:--|:--|"}
+	for _, t := range targets {
+		events := "all"
+		if len(t.Events) != 0 {
+			events = strings.Join(t.Events, ", ")
+		}
+		lines = append(lines, fmt.Sprintf("| %v | %v | @%v | %v |", t.URL, events, t.CreatedBy, t.Id))
+	}
+	return strings.Join(lines, "\n")
+}
+
+func _formatWebhookDeliveries(deliveries []WebhookDelivery) string {
+	if len(deliveries) == 0 {
+		return "No deliveries."
+	}
+
+	lines := []string{"| Event | Url | Status | Attempts | Last error | Updated | Id |", "|:--|:--|:--|--:|:--|:--|:--|"}
+	for _, d := range deliveries {
+		lines = append(lines, fmt.Sprintf("| %v | %v | %v | %v | %v | %v | %v |",
+			d.Event, d.URL, d.Status, d.Attempts, strings.ReplaceAll(d.LastError, "|", "/"),
+			_timeOfMillis(d.UpdateAt).Format("2006-01-02 15:04:05"), d.Id))
+	}
+	return strings.Join(lines, "\n")
+}
@@ -0,0 +1,342 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/mattermost/mattermost-server/v5/model"
+	"github.com/mattermost/mattermost-server/v5/plugin/plugintest"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/require"
+)
+
+func TestWebhooks(t *testing.T) {
+
+	type received struct {
+		header http.Header
+		body   []byte
+	}
+
+	type webhookEnv struct {
+		td     *TestData
+		api    *plugintest.API
+		plugin *Plugin
+		server *httptest.Server
+		// the status the server responds with
+		status int
+		// called when a delivery is received
+		onReceive func()
+		mu        sync.Mutex
+		received  []received
+	}
+
+	setup := func(t *testing.T) *webhookEnv {
+		td := NewTestData()
+		api := td.ApiMockCommon()
+		api.On("CreatePost", mock.Anything).Return(&model.Post{}, nil)
+		plugin := td.NewMockPlugin()
+		plugin.SetAPI(api)
+		plugin.repo = newMemRepository()
+
+		env := &webhookEnv{td: td, api: api, plugin: plugin, status: http.StatusOK}
+		env.server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			body, _ := ioutil.ReadAll(r.Body)
+			env.mu.Lock()
+			defer env.mu.Unlock()
+			env.received = append(env.received, received{r.Header, body})
+			if env.onReceive != nil {
+				env.onReceive()
+			}
+			w.WriteHeader(env.status)
+		}))
+		t.Cleanup(env.server.Close)
+		return env
+	}
+
+	createBook := func(t *testing.T, env *webhookEnv) string {
+		var book Book
+		DeepCopy(&book, env.td.ABook)
+		book.BookPublic.Id = ""
+		id, err := env.plugin._createABook(&book)
+		require.Nil(t, err)
+		return id
+	}
+
+	payloadOf := func(t *testing.T, r received, data interface{}) *WebhookPayload {
+		payload := &WebhookPayload{Data: data}
+		require.Nil(t, json.Unmarshal(r.body, payload))
+		return payload
+	}
+
+	t.Run("targets", func(t *testing.T) {
+		env := setup(t)
+
+		_, err := env.plugin._addWebhookTarget(env.td.Worker2Id, &WebhookTarget{URL: env.server.URL})
+		assert.ErrorIs(t, err, ErrNotPermitted)
+		_, err = env.plugin._addWebhookTarget(env.td.Worker1Id, &WebhookTarget{URL: "ftp://host/path"})
+		assert.ErrorIs(t, err, ErrInvalidRequest)
+		_, err = env.plugin._addWebhookTarget(env.td.Worker1Id, &WebhookTarget{URL: env.server.URL, Events: []string{"book_lost"}})
+		assert.ErrorIs(t, err, ErrInvalidRequest)
+
+		target, err := env.plugin._addWebhookTarget(env.td.Worker1Id, &WebhookTarget{
+			URL:    env.server.URL,
+			Events: []string{WEBHOOK_EVENT_BOOK_CREATED, WEBHOOK_EVENT_BOOK_CREATED},
+		})
+		require.Nil(t, err)
+		assert.NotEmpty(t, target.Secret)
+		assert.Equal(t, []string{WEBHOOK_EVENT_BOOK_CREATED}, target.Events)
+		assert.Equal(t, "worker1", target.CreatedBy)
+
+		targets, err := env.plugin._listWebhookTargets(env.td.Worker1Id)
+		require.Nil(t, err)
+		require.Equal(t, 1, len(targets))
+		assert.Equal(t, target.Id, targets[0].Id)
+		assert.Empty(t, targets[0].Secret, "hidden")
+
+		assert.ErrorIs(t, env.plugin._removeWebhookTarget(env.td.Worker1Id, "unknown"), ErrNotFound)
+		require.Nil(t, env.plugin._removeWebhookTarget(env.td.Worker1Id, target.Id))
+		targets, err = env.plugin._listWebhookTargets(env.td.Worker1Id)
+		require.Nil(t, err)
+		assert.Empty(t, targets)
+	})
+
+	t.Run("signed_book_events", func(t *testing.T) {
+		env := setup(t)
+		target, err := env.plugin._addWebhookTarget(env.td.Worker1Id, &WebhookTarget{
+			URL:    env.server.URL,
+			Secret: "a secret",
+			Events: []string{WEBHOOK_EVENT_BOOK_CREATED, WEBHOOK_EVENT_BOOK_DELETED},
+		})
+		require.Nil(t, err)
+
+		bookId := createBook(t, env)
+		require.Nil(t, env.plugin._deleteABook(&Book{Upload: &Upload{Post_id: bookId}}))
+		assert.Empty(t, env.received, "sent by the background job")
+
+		require.Nil(t, env.plugin._deliverWebhooks(time.Now()))
+		require.Equal(t, 2, len(env.received))
+
+		created := env.received[0]
+		assert.Equal(t, WEBHOOK_EVENT_BOOK_CREATED, created.header.Get(WEBHOOK_HEADER_EVENT))
+		mac := hmac.New(sha256.New, []byte("a secret"))
+		mac.Write(created.body)
+		assert.Equal(t, "sha256="+hex.EncodeToString(mac.Sum(nil)), created.header.Get(WEBHOOK_HEADER_SIGNATURE))
+
+		data := &WebhookBookData{}
+		payload := payloadOf(t, created, data)
+		assert.Equal(t, WEBHOOK_EVENT_BOOK_CREATED, payload.Event)
+		assert.Equal(t, env.plugin.library.id, payload.LibraryId)
+		assert.Equal(t, bookId, data.BookPostId)
+		assert.Equal(t, env.td.ABook.BookPublic.Name, data.Book.Name)
+
+		deleted := env.received[1]
+		data = &WebhookBookData{}
+		assert.Equal(t, WEBHOOK_EVENT_BOOK_DELETED, payloadOf(t, deleted, data).Event)
+		assert.Equal(t, bookId, data.BookPostId)
+
+		deliveries, err := env.plugin._listWebhookDeliveries(env.td.Worker1Id)
+		require.Nil(t, err)
+		require.Equal(t, 2, len(deliveries))
+		for _, d := range deliveries {
+			assert.Equal(t, WEBHOOK_DELIVERY_DELIVERED, d.Status)
+			assert.Equal(t, target.Id, d.TargetId)
+			assert.Equal(t, 1, d.Attempts)
+		}
+		assert.Equal(t, deleted.header.Get(WEBHOOK_HEADER_DELIVERY), deliveries[0].Id, "the newest first")
+	})
+
+	t.Run("retry_with_backoff", func(t *testing.T) {
+		env := setup(t)
+		_, err := env.plugin._addWebhookTarget(env.td.Worker1Id, &WebhookTarget{URL: env.server.URL})
+		require.Nil(t, err)
+		createBook(t, env)
+
+		env.status = http.StatusServiceUnavailable
+		now := time.Now()
+		require.Nil(t, env.plugin._deliverWebhooks(now))
+		deliveries, err := env.plugin._listWebhookDeliveries(env.td.Worker1Id)
+		require.Nil(t, err)
+		require.Equal(t, 1, len(deliveries))
+		d := deliveries[0]
+		assert.Equal(t, WEBHOOK_DELIVERY_PENDING, d.Status)
+		assert.Equal(t, http.StatusServiceUnavailable, d.LastStatusCode)
+		assert.Equal(t, _millisOf(now.Add(time.Minute)), d.NextAttemptAt)
+
+		require.Nil(t, env.plugin._deliverWebhooks(now.Add(30*time.Second)))
+		assert.Equal(t, 1, len(env.received), "not due yet")
+
+		for i := 2; i < WEBHOOK_MAX_ATTEMPTS; i++ {
+			now = now.Add(_webhookBackoff(i - 1))
+			require.Nil(t, env.plugin._deliverWebhooks(now))
+		}
+		deliveries, err = env.plugin._listWebhookDeliveries(env.td.Worker1Id)
+		require.Nil(t, err)
+		assert.Equal(t, WEBHOOK_MAX_ATTEMPTS-1, deliveries[0].Attempts)
+		assert.Equal(t, 4*time.Minute, _webhookBackoff(3))
+
+		env.status = http.StatusOK
+		require.Nil(t, env.plugin._deliverWebhooks(now.Add(_webhookBackoff(WEBHOOK_MAX_ATTEMPTS-1))))
+		deliveries, err = env.plugin._listWebhookDeliveries(env.td.Worker1Id)
+		require.Nil(t, err)
+		assert.Equal(t, WEBHOOK_DELIVERY_DELIVERED, deliveries[0].Status)
+		assert.Equal(t, WEBHOOK_MAX_ATTEMPTS, len(env.received))
+
+		// given up
+		env.status = http.StatusInternalServerError
+		createBook(t, env)
+		for i := 0; i < WEBHOOK_MAX_ATTEMPTS; i++ {
+			now = now.Add(time.Hour * 24)
+			require.Nil(t, env.plugin._deliverWebhooks(now))
+		}
+		deliveries, err = env.plugin._listWebhookDeliveries(env.td.Worker1Id)
+		require.Nil(t, err)
+		require.Equal(t, 2, len(deliveries))
+		assert.Equal(t, WEBHOOK_DELIVERY_FAILED, deliveries[0].Status)
+		assert.Equal(t, WEBHOOK_MAX_ATTEMPTS, deliveries[0].Attempts)
+	})
+
+	t.Run("borrow_and_transition", func(t *testing.T) {
+		env := setup(t)
+		_, err := env.plugin._addWebhookTarget(env.td.Worker1Id, &WebhookTarget{
+			URL:    env.server.URL,
+			Events: []string{WEBHOOK_EVENT_BORROW_CREATED, WEBHOOK_EVENT_STEP_CHANGED},
+		})
+		require.Nil(t, err)
+		bookId := createBook(t, env)
+
+		masterId, _, err := env.plugin._borrowABook(env.td.BorId, &BorrowRequestKey{
+			BookPostId:   bookId,
+			BorrowerUser: env.td.BorrowUser,
+		}, otherRequestData{processTime: GetNowTime()})
+		require.Nil(t, err)
+
+		master, err := env.plugin._getBorrowById(masterId)
+		require.Nil(t, err)
+		wf := master.borrow.DataOrImage.Worflow
+		require.Nil(t, env.plugin._processWorkflowRequest(env.td.Worker1Id, &WorkflowRequest{
+			MasterPostKey: masterId,
+			ActorUser:     master.borrow.DataOrImage.LibworkerUser,
+			NextStepIndex: _getIndexByStatus(STATUS_CONFIRMED, wf),
+			Etag:          master.borrow.DataOrImage.MatchId,
+		}))
+
+		require.Nil(t, env.plugin._deliverWebhooks(time.Now()))
+		require.Equal(t, 2, len(env.received))
+
+		borrow := &WebhookBorrowData{}
+		assert.Equal(t, WEBHOOK_EVENT_BORROW_CREATED, payloadOf(t, env.received[0], borrow).Event)
+		assert.Equal(t, masterId, borrow.MasterKey)
+		assert.Equal(t, "bor", borrow.Borrow.BorrowerUser)
+		assert.Equal(t, env.td.ABook.BookPublic.Name, borrow.Book.Name)
+		assert.Equal(t, &WebhookActor{UserId: env.td.BorId, Username: "bor"}, borrow.Actor)
+
+		transition := &WebhookTransitionData{}
+		assert.Equal(t, WEBHOOK_EVENT_STEP_CHANGED, payloadOf(t, env.received[1], transition).Event)
+		assert.Equal(t, masterId, transition.MasterKey)
+		assert.Equal(t, STATUS_REQUESTED, transition.PreviousStep.Status)
+		assert.Equal(t, STATUS_CONFIRMED, transition.Step.Status)
+		assert.True(t, transition.Step.Completed)
+		assert.False(t, transition.Backward)
+		assert.Equal(t, STATUS_CONFIRMED, transition.Borrow.Worflow[transition.Borrow.StepIndex].Status)
+		assert.Equal(t, bookId, transition.Borrow.BookPostId)
+		assert.Equal(t, env.td.ABook.BookPublic.Name, transition.Book.Name)
+		assert.Equal(t, "worker1", transition.Actor.Username)
+	})
+
+	t.Run("lock_lost", func(t *testing.T) {
+		env := setup(t)
+		_, err := env.plugin._addWebhookTarget(env.td.Worker1Id, &WebhookTarget{URL: env.server.URL})
+		require.Nil(t, err)
+		createBook(t, env)
+		createBook(t, env)
+
+		// taken by another server while the first delivery is sent
+		env.onReceive = func() {
+			env.td.kvLock.Lock()
+			defer env.td.kvLock.Unlock()
+			env.td.kvStore[WEBHOOK_LOCK_KV_KEY] = []byte("another")
+		}
+		assert.ErrorIs(t, env.plugin._deliverWebhooks(time.Now()), ErrLocked)
+		assert.Equal(t, 1, len(env.received))
+
+		deliveries, err := env.plugin._listWebhookDeliveries(env.td.Worker1Id)
+		require.Nil(t, err)
+		require.Equal(t, 2, len(deliveries))
+		statuses := []string{deliveries[0].Status, deliveries[1].Status}
+		assert.ElementsMatch(t, []string{WEBHOOK_DELIVERY_DELIVERED, WEBHOOK_DELIVERY_PENDING}, statuses)
+	})
+
+	t.Run("failed_library_skipped", func(t *testing.T) {
+		env := setup(t)
+		_, err := env.plugin._addWebhookTarget(env.td.Worker1Id, &WebhookTarget{URL: env.server.URL})
+		require.Nil(t, err)
+		createBook(t, env)
+
+		broken := &library{id: "broken"}
+		env.plugin.libraries[broken.id] = broken
+		env.plugin.libraryIds = append([]string{broken.id}, env.plugin.libraryIds...)
+		env.td.kvLock.Lock()
+		env.td.kvStore[WEBHOOK_QUEUE_KV_KEY_PREFIX+broken.id] = []byte("not json")
+		env.td.kvLock.Unlock()
+
+		require.Nil(t, env.plugin._deliverWebhooks(time.Now()))
+		assert.Equal(t, 1, len(env.received))
+	})
+
+	t.Run("removed_target", func(t *testing.T) {
+		env := setup(t)
+		target, err := env.plugin._addWebhookTarget(env.td.Worker1Id, &WebhookTarget{URL: env.server.URL})
+		require.Nil(t, err)
+		createBook(t, env)
+		require.Nil(t, env.plugin._removeWebhookTarget(env.td.Worker1Id, target.Id))
+
+		require.Nil(t, env.plugin._deliverWebhooks(time.Now()))
+		assert.Empty(t, env.received)
+		deliveries, err := env.plugin._listWebhookDeliveries(env.td.Worker1Id)
+		require.Nil(t, err)
+		require.Equal(t, 1, len(deliveries))
+		assert.Equal(t, WEBHOOK_DELIVERY_FAILED, deliveries[0].Status)
+	})
+
+	t.Run("command", func(t *testing.T) {
+		env := setup(t)
+
+		text, err := env.plugin._executeWebhook(env.td.Worker1Id, nil)
+		require.Nil(t, err)
+		assert.Equal(t, "No webhooks.", text)
+		_, err = env.plugin._executeWebhook(env.td.BorId, []string{"list"})
+		assert.ErrorIs(t, err, ErrNotPermitted)
+
+		text, err = env.plugin._executeWebhook(env.td.Worker1Id, []string{"add", env.server.URL, WEBHOOK_EVENT_BOOK_UPDATED})
+		require.Nil(t, err)
+		assert.True(t, strings.HasPrefix(text, "Succ. Webhook "))
+
+		targets, err := env.plugin._listWebhookTargets(env.td.Worker1Id)
+		require.Nil(t, err)
+		require.Equal(t, 1, len(targets))
+		text, err = env.plugin._executeWebhook(env.td.Worker1Id, []string{"list"})
+		require.Nil(t, err)
+		assert.Contains(t, text, "| "+env.server.URL+" | book_updated | @worker1 | "+targets[0].Id+" |")
+
+		text, err = env.plugin._executeWebhook(env.td.Worker1Id, []string{"log"})
+		require.Nil(t, err)
+		assert.Equal(t, "No deliveries.", text)
+
+		text, err = env.plugin._executeWebhook(env.td.Worker1Id, []string{"remove"})
+		require.Nil(t, err)
+		assert.True(t, strings.HasPrefix(text, "Usage:"))
+		text, err = env.plugin._executeWebhook(env.td.Worker1Id, []string{"remove", targets[0].Id})
+		require.Nil(t, err)
+		assert.Equal(t, "Succ. Webhook "+targets[0].Id+" is removed.", text)
+	})
+}
@@ -27,127 +27,105 @@ func (p *Plugin) handleWorkflowRequest(c *plugin.Context, w http.ResponseWriter,
 	err := json.NewDecoder(r.Body).Decode(workflowReq)
 	if err != nil {
 		p.API.LogError("Failed to convert from workflow request.", "err", err.Error())
-		resp, _ := json.Marshal(Result{
-			Error: "Failed to convert from workflow request.",
-		})
+		resp, _ := json.Marshal(p._errorResult(ErrInvalidRequest, "Failed to convert from workflow request."))
 
 		w.Write(resp)
 		return
 
 	}
 
-	all, err := p._loadAndLock(workflowReq)
-
-	if err != nil {
-		defer p._unlock(all)
-
-		p.API.LogError("Failed to lock and get posts from workflow requests.", "err", err.Error())
-		var errorMessage string
-		if errors.Is(err, ErrLocked) || errors.Is(err, ErrStale) {
-			errorMessage = p.i18n.GetText("system-busy")
-		} else {
-			errorMessage = p.i18n.GetText("failed-to-get-borrow")
-		}
-		resp, _ := json.Marshal(Result{
-			Error: errorMessage,
-		})
+	if err := p._processWorkflowRequest(r.Header.Get("Mattermost-User-ID"), workflowReq); err != nil {
+		p.API.LogError("Process workflow request error.", "err", fmt.Sprintf("%+v", err))
+		resp, _ := json.Marshal(p._errorResult(err, p._workflowErrorText(err)))
 
 		w.Write(resp)
 		return
-
 	}
 
-	defer p._unlock(all)
+	resp, _ := json.Marshal(Result{
+		Error: "",
+	})
 
-	bookPostId := all[MASTER][0].borrow.DataOrImage.BookPostId
-	bookInfo, err := p._lockAndGetABook(bookPostId)
-	if err != nil {
-		defer lockmap.Delete(bookPostId)
-		p.API.LogError("Failed to lock or get a book.", "err", err.Error())
-		var errorMessage string
-		if errors.Is(err, ErrLocked) || errors.Is(err, ErrStale) {
-			errorMessage = p.i18n.GetText("system-busy")
-		} else {
-			errorMessage = p.i18n.GetText("failed-to-get-book")
-		}
-		resp, _ := json.Marshal(Result{
-			Error: errorMessage,
-		})
+	w.Write(resp)
 
-		w.Write(resp)
-		return
+}
 
+func (p *Plugin) _workflowErrorText(err error) string {
+	if errors.Is(err, ErrNotFound) {
+		return p.i18n.GetText("failed-to-get-borrow")
 	}
+	return p._errorText(err, "workflow-failed")
+}
 
-	defer lockmap.Delete(bookPostId)
+// The user or the kiosk who moves a borrow.
+// A kiosk is permitted by the scopes of its token instead of the roles, see _scanAtKiosk.
+type workflowActor struct {
+	userId string
+	kiosk  string
+}
 
-	if workflowReq.Delete {
+// Move a borrowing to the next step, or delete it.
+// The borrow records and the book are locked during the process.
+func (p *Plugin) _processWorkflowRequest(userId string, workflowReq *WorkflowRequest) error {
+	return p._processWorkflowRequestBy(workflowActor{userId: userId}, workflowReq)
+}
 
-		if err := p._deleteBorrowRequest(workflowReq, all, bookInfo); err != nil {
-			p.API.LogError("delete borrow request error, please retry.", "error", err.Error())
-			resp, _ := json.Marshal(Result{
-				Error: fmt.Sprintf("delete borrow request error, please retry."),
-			})
+// The same as _processWorkflowRequest, moved by a user or a kiosk.
+func (p *Plugin) _processWorkflowRequestBy(actor workflowActor, workflowReq *WorkflowRequest) error {
 
-			w.Write(resp)
-			return
-		}
+	all, err := p._loadAndLock(workflowReq)
+	defer p._unlock(all)
+	if err != nil {
+		return errors.Wrapf(err, "Failed to lock and get posts from workflow requests.")
+	}
 
-		resp, _ := json.Marshal(Result{
-			Error: "",
-		})
-		w.Write(resp)
-		return
+	if actor.kiosk == "" {
+		if err := p._checkWorkflowPermission(actor.userId, all[MASTER][0].borrow.DataOrImage); err != nil {
+			return err
+		}
+	}
 
+	bookPostId := all[MASTER][0].borrow.DataOrImage.BookPostId
+	bookInfo, err := p._lockAndGetABook(bookPostId)
+	if errors.Is(err, ErrLocked) {
+		return err
+	}
+	defer lockmap.Delete(bookPostId)
+	if err != nil {
+		return errors.Wrapf(err, "Failed to lock or get a book.")
 	}
 
-	if err := p._process(workflowReq, all, bookInfo); err != nil {
-		p.API.LogError("Process  error.", "error", err.Error())
-		var errText string
-		switch {
-		case errors.Is(err, ErrChooseInStockCopy):
-			errText = p.i18n.GetText(err.Error())
-		case errors.Is(err, ErrNoStock):
-			errText = p.i18n.GetText(err.Error())
-		default:
-			errText = err.Error()
+	if workflowReq.Delete {
+		if err := p._deleteBorrowRequest(workflowReq, all, bookInfo); err != nil {
+			return errors.Wrapf(err, "delete borrow request error, please retry.")
 		}
+		return nil
+	}
 
-		resp, _ := json.Marshal(Result{
-			// Error: fmt.Sprintf("process error."),
-			Error: errText,
-		})
-
-		w.Write(resp)
-		return
+	previous := all[MASTER][0].borrow.DataOrImage.Worflow[all[MASTER][0].borrow.DataOrImage.StepIndex]
+	if err := p._process(workflowReq, all, bookInfo); err != nil {
+		return err
 	}
 
 	if err := p._save(all, bookInfo); err != nil {
-		p.API.LogError("Save error.", "err", err.Error())
-		resp, _ := json.Marshal(Result{
-			Error: "Save error.",
-		})
-
-		w.Write(resp)
-		return
+		return errors.Wrapf(err, "Save error.")
 	}
 
 	if err := p._notifyStatusChange(all, workflowReq); err != nil {
-		p.API.LogError("notify status change error.", "err", err.Error())
-		resp, _ := json.Marshal(Result{
-			Error: "notify status change error.",
-		})
-
-		w.Write(resp)
-		return
+		return errors.Wrapf(err, "notify status change error.")
 	}
 
-	resp, _ := json.Marshal(Result{
-		Error: "",
-	})
+	master := all[MASTER][0].borrow.DataOrImage
+	p._emitStepChanged(actor, all[MASTER][0].post.Id, previous, master, bookInfo.book.BookPublic, workflowReq.Backward)
 
-	w.Write(resp)
+	if !workflowReq.Backward && master.Worflow[master.StepIndex].Status == STATUS_RETURNED {
+		//the borrow is done anyway
+		if err := p._inviteReview(master); err != nil {
+			p.API.LogError("Failed to invite to review.", "err", fmt.Sprintf("%+v", err))
+		}
+	}
 
+	return nil
 }
 
 type _initPassedParams struct {
@@ -237,16 +215,19 @@ func (p *Plugin) _processInventoryOfSingleStep(brwq *borrowWithPost, currStep *S
 		case STATUS_REQUESTED:
 		case STATUS_CONFIRMED:
 			if !req.Backward && inv.Stock <= 0 {
-				return ErrNoStock
+				return WithDetails(ErrNoStock, ErrorDetails{ERROR_DETAIL_STOCK: inv.Stock})
 			}
 
 		case STATUS_KEEPER_CONFIRMED:
 			if !req.Backward && inv.Stock <= 0 {
-				return ErrNoStock
+				return WithDetails(ErrNoStock, ErrorDetails{ERROR_DETAIL_STOCK: inv.Stock})
 			}
 
 			if !req.Backward && inv.Copies[req.ChosenCopyId].Status != COPY_STATUS_INSTOCK {
-				return ErrChooseInStockCopy
+				return WithDetails(ErrChooseInStockCopy, ErrorDetails{
+					ERROR_DETAIL_COPY_ID: req.ChosenCopyId,
+					ERROR_DETAIL_STATUS:  inv.Copies[req.ChosenCopyId].Status,
+				})
 			}
 
 			inv.Stock -= increment
@@ -359,7 +340,10 @@ func (p *Plugin) _processRenewOfSingleStep(br *borrowWithPost, workflow []Step,
 		switch refStep.Status {
 		case STATUS_RENEW_REQUESTED:
 			if br.borrow.DataOrImage.RenewedTimes >= p.maxRenewTimes {
-				return ErrRenewLimited
+				return WithDetails(ErrRenewLimited, ErrorDetails{
+					ERROR_DETAIL_LIMIT:   p.maxRenewTimes,
+					ERROR_DETAIL_RENEWED: br.borrow.DataOrImage.RenewedTimes,
+				})
 			}
 		case STATUS_RENEW_CONFIRMED:
 			br.borrow.DataOrImage.RenewedTimes += increment
@@ -687,7 +671,7 @@ func (p *Plugin) _deleteBorrowRequest(req *WorkflowRequest, all map[string][]*bo
 		st != STATUS_KEEPER_CONFIRMED &&
 		st != STATUS_RETURNED {
 
-		return errors.New("the request is not allowed to be deleted.")
+		return KindError(ErrRuleViolation, "the request is not allowed to be deleted.")
 	}
 
 	// put master deletion at last
@@ -736,8 +720,8 @@ func (p *Plugin) _deleteBorrowRequest(req *WorkflowRequest, all map[string][]*bo
 				if _, ok := savedDeleted[brwp.post.Id]; ok {
 					continue
 				}
-				if appErr := p.API.DeletePost(brwp.post.Id); appErr != nil {
-					return errors.Wrapf(appErr, "delete error, please retry or contact admin")
+				if err := p._repo().Delete(brwp.post.Id); err != nil {
+					return errors.Wrapf(err, "delete error, please retry or contact admin")
 				}
 				savedDeleted[brwp.post.Id] = true
 
@@ -773,18 +757,18 @@ func (p *Plugin) _getUserByRole(step Step, brqRole string, brq *BorrowRequest) [
 func (p *Plugin) _getBorrowById(id string) (*borrowWithPost, error) {
 	var bwp borrowWithPost
 
-	post, appErr := p.API.GetPost(id)
-	if appErr != nil {
-		if appErr.StatusCode == http.StatusNotFound {
-			return nil, ErrNotFound
-		}
-		return nil, errors.Wrapf(appErr, "Get post error.")
+	post, err := p._repo().Get(id)
+	if errors.Is(err, ErrNotFound) {
+		return nil, ErrNotFound
+	}
+	if err != nil {
+		return nil, errors.Wrapf(err, "Get post error.")
 	}
 	bwp.post = post
 
 	br := new(Borrow)
 	if err := json.Unmarshal([]byte(post.Message), br); err != nil {
-		return nil, errors.Wrapf(appErr, "Unmarshal post error.")
+		return nil, errors.Wrapf(err, "Unmarshal post error.")
 	}
 	bwp.borrow = br
 
@@ -796,7 +780,7 @@ func (p *Plugin) _loadAndLock(req *WorkflowRequest) (map[string][]*borrowWithPos
 	allBorrows := map[string][]*borrowWithPost{}
 
 	if _, ok := lockmap.LoadOrStore(req.MasterPostKey, struct{}{}); ok {
-		return nil, errors.New(fmt.Sprintf("Lock %v error", MASTER))
+		return nil, errors.Wrapf(ErrLocked, "Lock %v error", MASTER)
 	}
 
 	// p.API.LogInfo("Checking stock.",
@@ -812,6 +796,11 @@ func (p *Plugin) _loadAndLock(req *WorkflowRequest) (map[string][]*borrowWithPos
 		return nil, errors.Wrapf(err, fmt.Sprintf("Get %v borrow error", MASTER))
 	}
 
+	if err := p._checkLibraryPost(master.post, p.borrowChannel); err != nil {
+		defer lockmap.Delete(req.MasterPostKey)
+		return nil, err
+	}
+
 	// p.API.LogInfo("Checking stale.",
 	// 	"actor", req.ActorUser,
 	// 	"lastupdated", master.borrow.DataOrImage.MatchId,
@@ -820,7 +809,8 @@ func (p *Plugin) _loadAndLock(req *WorkflowRequest) (map[string][]*borrowWithPos
 
 	if master.borrow.DataOrImage.MatchId != req.Etag {
 		defer lockmap.Delete(req.MasterPostKey)
-		return nil, errors.Wrapf(ErrStale, fmt.Sprintf("Get %v borrow stale", MASTER))
+		return nil, WithDetails(errors.Wrapf(ErrStale, fmt.Sprintf("Get %v borrow stale", MASTER)),
+			ErrorDetails{ERROR_DETAIL_ETAG: master.borrow.DataOrImage.MatchId})
 	}
 	allBorrows[MASTER] = append(allBorrows[MASTER], master)
 
@@ -855,7 +845,7 @@ func (p *Plugin) _loadAndLock(req *WorkflowRequest) (map[string][]*borrowWithPos
 				continue
 			}
 			if _, ok := lockmap.LoadOrStore(id, struct{}{}); ok {
-				return nil, errors.New(fmt.Sprintf("Lock %v error", role.name))
+				return nil, errors.Wrapf(ErrLocked, "Lock %v error", role.name)
 			}
 
 			lockedIds[id] = true
@@ -928,8 +918,8 @@ func (p *Plugin) _rollBackDeleted(posts []*model.Post) (map[string]*model.Post,
 		var oldPost model.Post
 		DeepCopy(&oldPost, post)
 		oldPost.Id = ""
-		if newPost, appErr := p.API.CreatePost(&oldPost); appErr != nil {
-			return nil, appErr
+		if newPost, err := p._repo().Create(&oldPost); err != nil {
+			return nil, err
 		} else {
 			created[post.Id] = newPost
 		}
@@ -984,7 +974,7 @@ func (p *Plugin) _updateMasterForRollback(master *borrowWithPost, rbCreated map[
 		DeepCopy(&newMasterPost, master.post)
 		newMasterPost.Message = string(masterBytes)
 		if newMasterPost.Message != master.post.Message {
-			if _, err := p.API.UpdatePost(&newMasterPost); err != nil {
+			if _, err := p._repo().Update(&newMasterPost); err != nil {
 				return errors.Wrapf(err, "update master post error")
 			}
 		}
@@ -1049,7 +1039,7 @@ func (p *Plugin) _save(all map[string][]*borrowWithPost, bookInfo *bookInfo) err
 
 			if br.delete {
 
-				if appErr := p.API.DeletePost(br.post.Id); appErr != nil {
+				if err := p._repo().Delete(br.post.Id); err != nil {
 					if err := p._workflowUpdateRollback(all, role, updated, created, deleted); err != nil {
 						return errors.Wrapf(err, "Fatal Error, Failed to delete a borrow record. role: %v, and rollback error", role)
 					}
@@ -1062,16 +1052,16 @@ func (p *Plugin) _save(all map[string][]*borrowWithPost, bookInfo *bookInfo) err
 			}
 
 			if br.create {
-				if post, appErr := p.API.CreatePost(&model.Post{
+				if post, err := p._repo().Create(&model.Post{
 					UserId:    p.botID,
 					ChannelId: br.post.ChannelId,
 					Message:   "",
 					Type:      "custom_borrow_type",
-				}); appErr != nil {
-					if err := p._workflowUpdateRollback(all, role, updated, created, deleted); err != nil {
-						return errors.Wrapf(err, "Fatal Error, Failed to create a new borrow record. role: %v, and rollback error", role)
+				}); err != nil {
+					if rbErr := p._workflowUpdateRollback(all, role, updated, created, deleted); rbErr != nil {
+						return errors.Wrapf(rbErr, "Fatal Error, Failed to create a new borrow record. role: %v, and rollback error", role)
 					}
-					return errors.Wrapf(appErr, "Failed to create a new borrow record. role: %v", role)
+					return errors.Wrapf(err, "Failed to create a new borrow record. role: %v", role)
 				} else {
 					br.post = post
 					//Only create should update relation key
@@ -1081,7 +1071,7 @@ func (p *Plugin) _save(all map[string][]*borrowWithPost, bookInfo *bookInfo) err
 				}
 			}
 
-			brJson, err := json.MarshalIndent(br.borrow, "", "  ")
+			brJson, err := _marshalRecord(br.borrow)
 			if err != nil {
 				if err := p._workflowUpdateRollback(all, role, updated, created, deleted); err != nil {
 					return errors.Wrapf(err, "Fatal Error, mashal error, role: %v, and rollback error", role)
@@ -1098,7 +1088,7 @@ func (p *Plugin) _save(all map[string][]*borrowWithPost, bookInfo *bookInfo) err
 
 			updBr.Message = string(brJson)
 			if updBr.Message != br.post.Message {
-				if _, err := p.API.UpdatePost(updBr); err != nil {
+				if _, err := p._repo().Update(updBr); err != nil {
 					if err := p._workflowUpdateRollback(all, role, updated, created, deleted); err != nil {
 						return errors.Wrapf(err, "Fatal Error, update post error, role: %v, and rollback error", role)
 					}
@@ -1133,8 +1123,8 @@ func (p *Plugin) _save(all map[string][]*borrowWithPost, bookInfo *bookInfo) err
 
 func (p *Plugin) _rollbackToOld(updated []*model.Post) error {
 	for _, post := range updated {
-		if _, appErr := p.API.UpdatePost(post); appErr != nil {
-			return appErr
+		if _, err := p._repo().Update(post); err != nil {
+			return err
 		}
 	}
 	return nil
@@ -1153,14 +1143,9 @@ func (p *Plugin) _notifyStatusChange(all map[string][]*borrowWithPost, req *Work
 			relatedRoleSet := ConvertStringArrayToSet(currStep.RelatedRoles)
 
 			if ConstainsInStringSet(relatedRoleSet, []string{role}) {
-				if _, appErr := p.API.CreatePost(&model.Post{
-					UserId:    p.botID,
-					ChannelId: br.post.ChannelId,
-					Message: fmt.Sprintf("Status was changed to %v, by @%v.",
-						currStep.Status, req.ActorUser),
-					RootId: br.post.Id,
-				}); appErr != nil {
-					return errors.Wrapf(appErr,
+				if err := p._notifyRecord(br.post, fmt.Sprintf("Status was changed to %v, by @%v.",
+					currStep.Status, req.ActorUser)); err != nil {
+					return errors.Wrapf(err,
 						"Failed to notify status change. role: %v, userid: %v", role, br.post.UserId)
 				}
 			}
@@ -886,6 +886,7 @@ func TestWorkflowHandle(t *testing.T) {
 
 			w := httptest.NewRecorder()
 			r := httptest.NewRequest("POST", "/workflow", bytes.NewReader(wfrJson))
+			r.Header.Set("Mattermost-User-ID", td.BorId)
 			baseLineTime := time.Now().Unix()
 			plugin.ServeHTTP(nil, w, r)
 
@@ -1074,6 +1075,7 @@ func performNext(t *testing.T, env *workflowEnv, status string, assertError bool
 
 	w := httptest.NewRecorder()
 	r := httptest.NewRequest("POST", "/workflow", bytes.NewReader(wfrJson))
+	r.Header.Set("Mattermost-User-ID", env.td.BorId)
 	env.plugin.ServeHTTP(nil, w, r)
 
 	res := new(Result)
@@ -1258,6 +1260,7 @@ func TestWorkflowInvFlow(t *testing.T) {
 
 			w := httptest.NewRecorder()
 			r := httptest.NewRequest("POST", "/workflow", bytes.NewReader(wfrJson))
+			r.Header.Set("Mattermost-User-ID", env.td.BorId)
 			plugin.ServeHTTP(nil, w, r)
 
 			invPost := env.td.RealBookPostUpd[env.td.BookChIdInv]
@@ -1266,6 +1269,7 @@ func TestWorkflowInvFlow(t *testing.T) {
 			inv.Id = ""
 			inv.Name = ""
 			inv.Relations = nil
+			inv.SchemaVersion = 0
 			assert.Equalf(t, step.result.inv, inv, "inventory should be same, at %v", wf[step.wfr.NextStepIndex].Status)
 
 			env.td.ABookInv.Stock = step.result.inv.Stock
@@ -1615,6 +1619,7 @@ func TestWorkflowRevert(t *testing.T) {
 			inv.Id = ""
 			inv.Name = ""
 			inv.Relations = nil
+			inv.SchemaVersion = 0
 			assert.Equalf(t, step.result.inv, inv, "inventory should be same, at %v", step.status)
 
 			if step.result.inv.Stock == 0 {
@@ -2092,6 +2097,8 @@ func TestWorkflowBorrowRestrict(t *testing.T) {
 		var res Result
 		json.NewDecoder(resTest.Body).Decode(&res)
 		assert.Equalf(t, env.plugin.i18n.GetText(ErrBorrowingLimited.Error()), res.Error, "should be error")
+		assert.Equal(t, ErrBorrowingLimited.Error(), res.Code)
+		assert.EqualValues(t, env.plugin.borrowTimes, res.Details[ERROR_DETAIL_LIMIT])
 	})
 
 	t.Run("error_unsufficent_stock", func(t *testing.T) {
@@ -2105,6 +2112,8 @@ func TestWorkflowBorrowRestrict(t *testing.T) {
 		var res Result
 		json.NewDecoder(resTest.Body).Decode(&res)
 		assert.Equalf(t, env.plugin.i18n.GetText(ErrNoStock.Error()), res.Error, "should be error")
+		assert.Equal(t, ErrNoStock.Error(), res.Code)
+		assert.EqualValues(t, 0, res.Details[ERROR_DETAIL_STOCK])
 
 		postPub := env.td.RealBookPostUpd[env.td.BookChIdPub]
 		var pub BookPublic
@@ -2371,6 +2380,7 @@ func TestWorkflowBorrowDelete(t *testing.T) {
 
 		w := httptest.NewRecorder()
 		r := httptest.NewRequest("POST", "/workflow", bytes.NewReader(wfrJson))
+		r.Header.Set("Mattermost-User-ID", env.td.BorId)
 		env.plugin.ServeHTTP(nil, w, r)
 
 		res := new(Result)
@@ -49,6 +49,7 @@ const TEXT: Record<string, string> = {
     TOGGLE_ALLOWED_SUCC: "设置成功",
     TOGGLE_ALLOWED_ERROR: "设置失败,错误:",
     BORROW_SUCC: "请求成功",
+    BORROW_WARNING: "请求成功,注意:",
     BORROW_ERROR: "请求失败,错误:",
     CONFIRM_BORROW: "借阅:",
     CONFIRM_TOGGLE_BORROW: "转换可借阅状态:",
@@ -140,6 +141,16 @@ function BookType(props: any) {
             return;
         }
 
+        //a rule configured as warn only lets the borrow through with a warning
+        if (data.warnings && data.warnings.length > 0) {
+            mutil.setMsgBox({
+                open: true,
+                text: TEXT["BORROW_WARNING"] + data.warnings.map((w) => w.message).join(", "),
+                serverity: "warning",
+            });
+            return;
+        }
+
         //This message doesn't need to justify the message,
         //because there not modification for book post
         mutil.setMsgBox({
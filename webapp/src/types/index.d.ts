@@ -52,6 +52,9 @@ interface BookPublic {
     };
     upd_isAllowedToBorrow: boolean;
     match_id: string;
+    rating?: number;
+    rating_count?: number;
+    schema_version?: number;
 }
 
 interface BookInventory {
@@ -107,9 +110,24 @@ interface Messages {
     [key: string]: string;
 }
 
+interface ErrorDetails {
+    [key: string]: any;
+}
+
+interface EligibilityVerdict {
+    rule: string;
+    outcome: string;
+    code?: string;
+    message?: string;
+    details?: ErrorDetails;
+}
+
 interface Result {
     error: string;
+    code?: string;
+    details?: ErrorDetails;
     messages: Messages;
+    warnings?: EligibilityVerdict[];
 }
 
 interface Step {
@@ -160,6 +178,7 @@ interface Borrow {
         libworker: string;
         keepers: string;
     };
+    schema_version?: number;
 }
 
 interface WorkflowRequest {